@@ -0,0 +1,229 @@
+// Package archive stores the logs of agent instances after they are gone, as
+// one gzipped tarball per instance lifetime in a directory per pool.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogFile is the name of the agent wrapper log inside an archive.
+const LogFile = "azp-agent.log"
+
+// timeLayout is used in archive file names, so they sort by time.
+const timeLayout = "20060102T150405Z"
+
+// Config contains settings for the agent log archive.
+type Config struct {
+	// Dir is the directory archives are written to, in a subdirectory per pool.
+	// Default: /var/lib/incus-azure-pipelines/logs
+	Dir string `json:"dir,omitempty" default:"/var/lib/incus-azure-pipelines/logs"`
+	// MaxAge is how long archives are kept. Default: 168h (7 days)
+	MaxAge time.Duration `json:"maxAge,omitempty" default:"168h" validate:"min=0" jsonschema:"type=string"`
+	// MaxFiles is the number of archives kept per pool. Default: 1000
+	MaxFiles int `json:"maxFiles,omitempty" default:"1000" validate:"min=0"`
+}
+
+// Entry is one archived instance lifetime.
+type Entry struct {
+	Path     string
+	Pool     string
+	Instance string
+	// JobID is the Azure job request the instance ran, or 0 if unknown.
+	JobID int64
+	Time  time.Time
+}
+
+// Archive writes and prunes archives.
+type Archive struct {
+	conf Config
+}
+
+func New(conf Config) *Archive {
+	return &Archive{conf: conf}
+}
+
+// Create returns a writer for the archive of an instance lifetime that ended
+// at t. The archive only appears under its final name once the writer is
+// closed without an error; Abort discards it instead.
+func (a *Archive) Create(pool, instance string, jobID int64, t time.Time) (*Writer, error) {
+	dir := filepath.Join(a.conf.Dir, pool)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, ".partial-*")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{f: f, path: filepath.Join(dir, fileName(instance, jobID, t))}, nil
+}
+
+// Writer receives a gzipped tarball.
+type Writer struct {
+	f    *os.File
+	path string
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	return w.f.Write(b)
+}
+
+// Close moves the archive into place and returns its path.
+func (w *Writer) Close() (string, error) {
+	if err := w.f.Close(); err != nil {
+		_ = os.Remove(w.f.Name())
+		return "", err
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		_ = os.Remove(w.f.Name())
+		return "", err
+	}
+	return w.path, nil
+}
+
+// Abort discards the archive.
+func (w *Writer) Abort() {
+	_ = w.f.Close()
+	_ = os.Remove(w.f.Name())
+}
+
+// Prune removes the archives of pool that are older than MaxAge, and the
+// oldest ones beyond MaxFiles.
+func (a *Archive) Prune(pool string, now time.Time) error {
+	entries, err := List(a.conf.Dir, pool)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, e := range entries {
+		expired := a.conf.MaxAge > 0 && now.Sub(e.Time) > a.conf.MaxAge
+		excess := a.conf.MaxFiles > 0 && len(entries)-i > a.conf.MaxFiles
+		if !expired && !excess {
+			continue
+		}
+		if err := os.Remove(e.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List returns the archives of pool in dir, oldest first. An empty pool lists
+// the archives of every pool.
+func List(dir, pool string) ([]Entry, error) {
+	pools := []string{pool}
+	if pool == "" {
+		dirs, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pools = nil
+		for _, d := range dirs {
+			if d.IsDir() {
+				pools = append(pools, d.Name())
+			}
+		}
+	}
+
+	var entries []Entry
+	for _, pool := range pools {
+		files, err := os.ReadDir(filepath.Join(dir, pool))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			e, ok := parseFileName(f.Name())
+			if !ok {
+				continue
+			}
+			e.Path = filepath.Join(dir, pool, f.Name())
+			e.Pool = pool
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// ReadLog writes the agent wrapper log in the archive at path to w.
+func ReadLog(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s does not contain %s", path, LogFile)
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		if filepath.Clean(hdr.Name) == LogFile {
+			_, err := io.Copy(w, tr)
+			return err
+		}
+	}
+}
+
+// fileName is instance_time[_jobID].tar.gz. Instance names are hostnames, so
+// they never contain an underscore.
+func fileName(instance string, jobID int64, t time.Time) string {
+	name := instance + "_" + t.UTC().Format(timeLayout)
+	if jobID != 0 {
+		name += "_job" + strconv.FormatInt(jobID, 10)
+	}
+	return name + ".tar.gz"
+}
+
+func parseFileName(name string) (Entry, bool) {
+	base, ok := strings.CutSuffix(name, ".tar.gz")
+	if !ok {
+		return Entry{}, false
+	}
+	parts := strings.Split(base, "_")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Entry{}, false
+	}
+	t, err := time.Parse(timeLayout, parts[1])
+	if err != nil {
+		return Entry{}, false
+	}
+	e := Entry{Instance: parts[0], Time: t}
+	if len(parts) == 3 {
+		id, ok := strings.CutPrefix(parts[2], "job")
+		if !ok {
+			return Entry{}, false
+		}
+		if e.JobID, err = strconv.ParseInt(id, 10, 64); err != nil {
+			return Entry{}, false
+		}
+	}
+	return e, true
+}
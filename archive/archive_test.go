@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func writeArchive(t *testing.T, a *Archive, pool, instance string, jobID int64, at time.Time, files map[string]string) string {
+	t.Helper()
+	w, err := a.Create(pool, instance, jobID, at)
+	require.NoError(t, err)
+	_, err = w.Write(tarball(t, files))
+	require.NoError(t, err)
+	path, err := w.Close()
+	require.NoError(t, err)
+	return path
+}
+
+func TestArchive_WriteListRead(t *testing.T) {
+	dir := t.TempDir()
+	a := New(Config{Dir: dir})
+	at := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	path := writeArchive(t, a, "build", "build-0", 42, at, map[string]string{
+		"_diag/Agent_1.log": "diag",
+		LogFile:             "job ran\n",
+	})
+	writeArchive(t, a, "test", "test-1", 0, at.Add(time.Minute), map[string]string{LogFile: "other\n"})
+
+	entries, err := List(dir, "build")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, Entry{Path: path, Pool: "build", Instance: "build-0", JobID: 42, Time: at}, entries[0])
+
+	entries, err = List(dir, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "test-1", entries[1].Instance)
+	assert.Zero(t, entries[1].JobID)
+
+	var buf bytes.Buffer
+	require.NoError(t, ReadLog(path, &buf))
+	assert.Equal(t, "job ran\n", buf.String())
+}
+
+func TestArchive_AbortLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	a := New(Config{Dir: dir})
+
+	w, err := a.Create("build", "build-0", 0, time.Now())
+	require.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	require.NoError(t, err)
+	w.Abort()
+
+	files, err := os.ReadDir(filepath.Join(dir, "build"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestArchive_Prune(t *testing.T) {
+	dir := t.TempDir()
+	a := New(Config{Dir: dir, MaxAge: 24 * time.Hour, MaxFiles: 2})
+	now := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	writeArchive(t, a, "build", "build-0", 0, now.Add(-48*time.Hour), map[string]string{LogFile: ""})
+	writeArchive(t, a, "build", "build-1", 0, now.Add(-3*time.Hour), map[string]string{LogFile: ""})
+	writeArchive(t, a, "build", "build-2", 0, now.Add(-2*time.Hour), map[string]string{LogFile: ""})
+	writeArchive(t, a, "build", "build-3", 0, now.Add(-time.Hour), map[string]string{LogFile: ""})
+	writeArchive(t, a, "test", "test-0", 0, now.Add(-48*time.Hour), map[string]string{LogFile: ""})
+
+	require.NoError(t, a.Prune("build", now))
+
+	entries, err := List(dir, "")
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Instance)
+	}
+	assert.Equal(t, []string{"test-0", "build-2", "build-3"}, names, "other pools are pruned separately")
+}
+
+func TestReadLog_Missing(t *testing.T) {
+	a := New(Config{Dir: t.TempDir()})
+	path := writeArchive(t, a, "build", "build-0", 0, time.Now(), map[string]string{"_diag/Agent_1.log": "diag"})
+
+	err := ReadLog(path, &bytes.Buffer{})
+	assert.ErrorContains(t, err, "does not contain "+LogFile)
+}
+
+func TestParseFileName(t *testing.T) {
+	at := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, jobID := range []int64{0, 12345} {
+		e, ok := parseFileName(fileName("azp-agent-3", jobID, at))
+		require.True(t, ok)
+		assert.Equal(t, Entry{Instance: "azp-agent-3", JobID: jobID, Time: at}, e)
+	}
+
+	for _, name := range []string{
+		".partial-123",
+		"azp-agent-3.tar.gz",
+		"azp-agent-3_yesterday.tar.gz",
+		"azp-agent-3_20250102T030405Z_12345.tar.gz",
+		"azp-agent-3_20250102T030405Z.log",
+	} {
+		_, ok := parseFileName(name)
+		assert.False(t, ok, name)
+	}
+}
@@ -1,12 +1,15 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/creasty/defaults"
 	"github.com/go-playground/validator/v10"
 	"github.com/goccy/go-yaml"
+	"github.com/sklarsa/incus-azure-pipelines/archive"
 	"github.com/sklarsa/incus-azure-pipelines/daemon"
+	"github.com/sklarsa/incus-azure-pipelines/mirror"
 	"github.com/sklarsa/incus-azure-pipelines/pool"
 )
 
@@ -18,6 +21,35 @@ type CLIConfig struct {
 	MetricsPort int `json:"metricsPort,omitempty" validate:"min=0" default:"9922"`
 	// Daemon contains settings for the background daemon processes.
 	Daemon daemon.Config `json:"daemon,omitempty"`
+	// ControlSocket is the path of the unix socket that serves the daemon's control API.
+	// CLI commands act through it when a daemon is running. Default: /run/incus-azure-pipelines.sock
+	ControlSocket string `json:"controlSocket,omitempty" default:"/run/incus-azure-pipelines.sock"`
+	// HistoryFile is the JSONL file the daemon records every agent instance and
+	// the Azure job it ran to. Default: /var/lib/incus-azure-pipelines/history.jsonl
+	HistoryFile string `json:"historyFile,omitempty" default:"/var/lib/incus-azure-pipelines/history.jsonl"`
+	// LogArchive, when set, keeps the wrapper log and _diag directory of every
+	// agent after its instance is gone. Agents then wait up to 5 minutes after
+	// their job for the daemon to collect them.
+	LogArchive *archive.Config `json:"logArchive,omitempty"`
+	// RegistryMirror, when set, runs a pull-through cache of a Docker registry
+	// that agents can use as their registry mirror through docker.registryMirrors.
+	RegistryMirror *mirror.Config `json:"registryMirror,omitempty"`
+	// Remotes are Incus servers reached over HTTPS, keyed by the name pools use to
+	// refer to them. The local daemon is always available as "local".
+	Remotes map[string]RemoteConfig `json:"remotes,omitempty" validate:"dive"`
+}
+
+// RemoteConfig describes how to reach an Incus server over HTTPS.
+type RemoteConfig struct {
+	// URL of the Incus API. For example: https://incus-1.example.com:8443
+	URL string `json:"url" validate:"required,url"`
+	// ClientCert is the path of the PEM client certificate the remote trusts.
+	ClientCert string `json:"clientCert" validate:"required"`
+	// ClientKey is the path of the PEM key of ClientCert.
+	ClientKey string `json:"clientKey" validate:"required"`
+	// ServerCert is the path of the remote's PEM certificate. Leave empty when it
+	// is signed by a CA the system trusts.
+	ServerCert string `json:"serverCert,omitempty"`
 }
 
 func parseConfig(data []byte) (CLIConfig, error) {
@@ -38,8 +70,42 @@ func parseConfig(data []byte) (CLIConfig, error) {
 		}
 	}
 
+	if config.RegistryMirror != nil {
+		if err := defaults.Set(config.RegistryMirror); err != nil {
+			return config, fmt.Errorf("error setting defaults for registryMirror: %w", err)
+		}
+	}
+
 	v := validator.New(validator.WithRequiredStructEnabled())
+	if err := v.Struct(config); err != nil {
+		return config, err
+	}
 
-	return config, v.Struct(config)
+	if err := validateRemotes(config); err != nil {
+		return config, err
+	}
+	for _, p := range config.Pools {
+		if err := errors.Join(p.Incus.ValidateInstanceOptions(), p.ValidateCaches()); err != nil {
+			return config, fmt.Errorf("pool %q: %w", p.Name, err)
+		}
+	}
+	return config, nil
+}
 
+// validateRemotes checks that every remote a pool uses is defined.
+func validateRemotes(config CLIConfig) error {
+	if _, ok := config.Remotes[pool.LocalRemote]; ok {
+		return fmt.Errorf("remote name %q is reserved for the local Incus daemon", pool.LocalRemote)
+	}
+	for _, p := range config.Pools {
+		for _, name := range p.Remotes {
+			if _, ok := config.Remotes[name]; !ok && name != pool.LocalRemote {
+				return fmt.Errorf("pool %q uses unknown remote %q", p.Name, name)
+			}
+		}
+		if len(p.Targets) > 0 && len(p.Remotes) > 1 {
+			return fmt.Errorf("pool %q sets targets, which require a single remote", p.Name)
+		}
+	}
+	return nil
 }
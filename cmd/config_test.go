@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sklarsa/incus-azure-pipelines/pool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -400,4 +401,408 @@ pools:
 	assert.Equal(t, 9922, config.MetricsPort)
 	assert.Equal(t, 5*time.Second, config.Daemon.ReconcileInterval)
 	assert.Equal(t, 30*time.Second, config.Daemon.ReaperInterval)
+	assert.Equal(t, 10*time.Minute, config.Daemon.OrphanCleanupInterval)
+	assert.Equal(t, pool.CreateRetryConfig{
+		Delay:            10 * time.Second,
+		MaxDelay:         5 * time.Minute,
+		BreakerThreshold: 5,
+		BreakerCooldown:  5 * time.Minute,
+	}, config.Pools[0].CreateRetry)
+}
+
+func TestParseConfig_Autoscaling(t *testing.T) {
+	yaml := `
+daemon:
+  autoscaleInterval: 1m
+pools:
+  - name: my-pool
+    minAgents: 2
+    maxAgents: 16
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	assert.Equal(t, 2, config.Pools[0].MinAgents)
+	assert.Equal(t, 16, config.Pools[0].MaxAgents)
+	assert.Equal(t, 16, config.Pools[0].Capacity())
+	assert.True(t, config.Pools[0].Autoscaling())
+	assert.Equal(t, time.Minute, config.Daemon.AutoscaleInterval)
+}
+
+func TestParseConfig_DefaultAutoscaleInterval(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 1
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, config.Daemon.AutoscaleInterval)
+	assert.False(t, config.Pools[0].Autoscaling())
+	assert.Equal(t, 1, config.Pools[0].Capacity())
+}
+
+func TestParseConfig_InvalidAutoscaling(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts string
+	}{
+		{name: "agentCount with maxAgents", counts: "agentCount: 2\n    maxAgents: 4"},
+		{name: "minAgents above maxAgents", counts: "minAgents: 5\n    maxAgents: 4"},
+		{name: "minAgents without maxAgents", counts: "agentCount: 2\n    minAgents: 1"},
+		{name: "maxAgents too high", counts: "maxAgents: 100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yaml := `
+pools:
+  - name: my-pool
+    ` + tt.counts + `
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+`
+			_, err := parseConfig([]byte(yaml))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseConfig_WarmStandby(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 4
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+      warmStandby: 2
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	assert.Equal(t, 2, config.Pools[0].Incus.WarmStandby)
+}
+
+func TestParseConfig_ControlSocket(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 1
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	assert.Equal(t, "/run/incus-azure-pipelines.sock", config.ControlSocket)
+
+	config, err = parseConfig([]byte("controlSocket: /tmp/iap.sock\n" + yaml))
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/iap.sock", config.ControlSocket)
+}
+
+func TestParseConfig_CanaryDefaults(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 4
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+      canary:
+        image: "img-next"
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	assert.Equal(t, &pool.CanaryConfig{
+		Image:             "img-next",
+		Percent:           10,
+		MaxFailurePercent: 20,
+		MinSamples:        5,
+	}, config.Pools[0].Incus.Canary)
+}
+
+func TestParseConfig_InvalidCanary(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 4
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+      canary:
+        image: "img-next"
+        percent: 150
+`
+	_, err := parseConfig([]byte(yaml))
+	assert.Error(t, err)
+}
+
+func TestParseConfig_Remotes(t *testing.T) {
+	yaml := `
+remotes:
+  hetzner-1:
+    url: "https://incus-1.example.com:8443"
+    clientCert: /etc/iap/client.crt
+    clientKey: /etc/iap/client.key
+pools:
+  - name: my-pool
+    agentCount: 4
+    remotes: [local, hetzner-1]
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	assert.Equal(t, "https://incus-1.example.com:8443", config.Remotes["hetzner-1"].URL)
+	assert.Equal(t, []string{"local", "hetzner-1"}, config.Pools[0].Remotes)
+}
+
+func TestParseConfig_InvalidRemotes(t *testing.T) {
+	tests := []struct {
+		name    string
+		remotes string
+		pool    string
+		wantErr string
+	}{
+		{
+			name:    "unknown remote",
+			pool:    "remotes: [hetzner-2]",
+			wantErr: `pool "my-pool" uses unknown remote "hetzner-2"`,
+		},
+		{
+			name:    "reserved name",
+			remotes: "  local: {url: \"https://incus.example.com:8443\", clientCert: a, clientKey: b}",
+			wantErr: `remote name "local" is reserved`,
+		},
+		{
+			name:    "missing client key",
+			remotes: "  hetzner-1: {url: \"https://incus.example.com:8443\", clientCert: a}",
+			wantErr: "ClientKey",
+		},
+		{
+			name:    "targets on several remotes",
+			remotes: "  hetzner-1: {url: \"https://incus.example.com:8443\", clientCert: a, clientKey: b}",
+			pool:    "remotes: [local, hetzner-1]\n    targets: [node-1]",
+			wantErr: "require a single remote",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yaml := "remotes:\n" + tt.remotes + `
+pools:
+  - name: my-pool
+    agentCount: 4
+    ` + tt.pool + `
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+`
+			_, err := parseConfig([]byte(yaml))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestParseConfig_InstanceOptions(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 1
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+      profiles: [default, ci-cache]
+      config:
+        security.syscalls.intercept.mknod: "true"
+      devices:
+        cache:
+          type: disk
+          source: /srv/cache
+          path: /cache
+          readonly: "true"
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	incus := config.Pools[0].Incus
+	assert.Equal(t, []string{"default", "ci-cache"}, incus.Profiles)
+	assert.Equal(t, map[string]string{"security.syscalls.intercept.mknod": "true"}, incus.Config)
+	assert.Equal(t, "/srv/cache", incus.Devices["cache"]["source"])
+}
+
+func TestParseConfig_InvalidInstanceOptions(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 1
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+      vm: true
+      config:
+        security.nesting: "true"
+`
+	_, err := parseConfig([]byte(yaml))
+	assert.ErrorContains(t, err, `pool "my-pool": config key "security.nesting" does not apply to a virtual machine`)
+}
+
+func TestParseConfig_ServicePrincipal(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 4
+    azure:
+      auth: servicePrincipal
+      url: "https://dev.azure.com/org"
+      servicePrincipal:
+        tenantId: tenant
+        clientId: client
+        clientSecret: "file:/run/secrets/azp-client-secret"
+    incus:
+      image: "img"
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	sp := config.Pools[0].Azure.ServicePrincipal
+	require.NotNil(t, sp)
+	assert.Equal(t, "https://login.microsoftonline.com", sp.Authority)
+	assert.Empty(t, config.Pools[0].Azure.PAT)
+}
+
+func TestParseConfig_AzureAuthRequirements(t *testing.T) {
+	tests := []struct {
+		name  string
+		azure string
+	}{
+		{name: "pat missing", azure: "url: https://dev.azure.com/org"},
+		{name: "service principal missing", azure: "auth: servicePrincipal\n      url: https://dev.azure.com/org"},
+		{name: "unknown auth", azure: "auth: oauth\n      pat: token\n      url: https://dev.azure.com/org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yaml := `
+pools:
+  - name: my-pool
+    agentCount: 4
+    azure:
+      ` + tt.azure + `
+    incus:
+      image: "img"
+`
+			_, err := parseConfig([]byte(yaml))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseConfig_Caches(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 2
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+      storagePool: default
+    caches:
+      - name: apt
+        path: /var/cache/apt
+        source: /srv/apt
+      - name: npm
+        path: /home/agent/.npm
+        volume: npm-cache
+        mode: clone
+        writer: 0
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	caches := config.Pools[0].Caches
+	require.Len(t, caches, 2)
+	assert.Equal(t, pool.CacheReadOnly, caches[0].Mode)
+	assert.Equal(t, 3, caches[0].KeepSnapshots)
+	assert.Equal(t, pool.CacheClone, caches[1].Mode)
+	require.NotNil(t, caches[1].Writer)
+	assert.Equal(t, 0, *caches[1].Writer)
+}
+
+func TestParseConfig_InvalidCaches(t *testing.T) {
+	yaml := `
+pools:
+  - name: my-pool
+    agentCount: 1
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+    caches:
+      - name: npm
+        path: /home/agent/.npm
+        volume: npm-cache
+`
+	_, err := parseConfig([]byte(yaml))
+	assert.ErrorContains(t, err, `pool "my-pool": cache "npm": volume requires storagePool or incus.storagePool`)
+}
+
+func TestParseConfig_RegistryMirror(t *testing.T) {
+	yaml := `
+registryMirror:
+  listen: 10.0.0.1:5000
+pools:
+  - name: my-pool
+    agentCount: 1
+    azure:
+      pat: "token"
+      url: "https://dev.azure.com/org"
+    incus:
+      image: "img"
+    docker:
+      registryMirrors: [http://10.0.0.1:5000]
+`
+	config, err := parseConfig([]byte(yaml))
+	require.NoError(t, err)
+	require.NotNil(t, config.RegistryMirror)
+	assert.Equal(t, "10.0.0.1:5000", config.RegistryMirror.Listen)
+	assert.Equal(t, "/var/lib/incus-azure-pipelines/registry", config.RegistryMirror.Dir)
+	assert.Equal(t, "https://registry-1.docker.io", config.RegistryMirror.Upstream)
+	assert.Equal(t, 720*time.Hour, config.RegistryMirror.MaxAge)
+	assert.Equal(t, []string{"http://10.0.0.1:5000"}, config.Pools[0].Docker.RegistryMirrors)
+
+	config, err = parseConfig([]byte(`pools: []`))
+	require.NoError(t, err)
+	assert.Nil(t, config.RegistryMirror)
+
+	// The mirror has no authentication, so where it listens must be chosen.
+	_, err = parseConfig([]byte("registryMirror:\n  dir: /tmp/registry\npools: []\n"))
+	assert.ErrorContains(t, err, "Listen")
 }
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/control"
+	"github.com/spf13/cobra"
+)
+
+var (
+	drainCancel bool
+	drainWait   bool
+)
+
+func init() {
+	drainCmd.Flags().BoolVar(&drainCancel, "cancel", false, "stop draining and let the daemon replace agents again")
+	drainCmd.Flags().BoolVar(&drainWait, "wait", false, "block until the drained agents are gone")
+	rootCmd.AddCommand(drainCmd)
+}
+
+var drainCmd = &cobra.Command{
+	Use:   "drain <pool> [agent-index]",
+	Short: "take a pool or one agent out of rotation without killing jobs",
+	Long: "Stop the running daemon from replacing the agents of a pool, or one " +
+		"agent. Idle agents are stopped by the reaper; busy agents finish their " +
+		"job first. Drain state lives in the daemon and is lost when it restarts. " +
+		"Send SIGUSR1 to the daemon to drain every pool and exit once done.",
+	Args:    cobra.RangeArgs(1, 2),
+	PreRunE: loadConfig,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, ok := control.Dial(ctx, conf.ControlSocket)
+		if !ok {
+			return fmt.Errorf("no daemon is answering on %s; drain requires a running daemon", conf.ControlSocket)
+		}
+
+		poolName, idx := args[0], -1
+		if len(args) == 2 {
+			var err error
+			if poolName, idx, err = parseAgentArgs(args); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		switch {
+		case idx < 0 && drainCancel:
+			err = client.CancelDrainPool(ctx, poolName)
+		case idx < 0:
+			err = client.DrainPool(ctx, poolName)
+		case drainCancel:
+			err = client.CancelDrainAgent(ctx, poolName, idx)
+		default:
+			err = client.DrainAgent(ctx, poolName, idx)
+		}
+		if err != nil || drainCancel || !drainWait {
+			return err
+		}
+		return waitDrained(ctx, client, poolName, idx, 5*time.Second)
+	},
+}
+
+// waitDrained polls the daemon until the pool, or the agent at idx when idx is
+// not negative, has no instances left.
+func waitDrained(ctx context.Context, client *control.Client, poolName string, idx int, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		agents, err := client.Agents(ctx, poolName)
+		if err != nil {
+			return err
+		}
+
+		remaining := 0
+		for _, a := range agents {
+			if a.Status != "" && (idx < 0 || a.Index == idx) {
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			return nil
+		}
+		slog.Info("waiting for agents to drain", "pool", poolName, "remaining", remaining)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/control"
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+	"github.com/spf13/cobra"
+)
+
+var explainOutput string
+
+func init() {
+	explainCmd.Flags().StringVarP(&explainOutput, "output", "o", "table", "output format (table, json)")
+	rootCmd.AddCommand(explainCmd)
+}
+
+var explainCmd = &cobra.Command{
+	Use:   "explain [pool] [agent-index]",
+	Short: "explain what the reaper would do with each agent",
+	Long: "Run the reaper's decision logic without stopping anything, and print " +
+		"for each agent instance whether it would be kept, waited on or reaped, " +
+		"and why. Offline observations come from the running daemon; without " +
+		"one, every offline agent shows as seen offline for the first time.",
+	Args:    cobra.MaximumNArgs(2),
+	PreRunE: loadConfig,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runExplain(args, explainOutput)
+	},
+}
+
+// poolDecisions is the JSON output of one pool.
+type poolDecisions struct {
+	Pool      string              `json:"pool"`
+	Decisions []pool.ReapDecision `json:"decisions"`
+}
+
+func runExplain(args []string, output string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %q, expected table or json", output)
+	}
+	idx := -1
+	if len(args) == 2 {
+		var err error
+		if _, idx, err = parseAgentArgs(args); err != nil {
+			return err
+		}
+	}
+
+	var explain func(context.Context, pool.Config) ([]pool.ReapDecision, error)
+	if client, ok := control.Dial(ctx, conf.ControlSocket); ok {
+		explain = func(ctx context.Context, cfg pool.Config) ([]pool.ReapDecision, error) {
+			return client.ExplainReap(ctx, cfg.Name)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "no daemon is running; offline agents show as seen offline for the first time")
+		remotes := newRemoteConnector(c, conf.Remotes)
+		defer remotes.Disconnect()
+		explain = func(ctx context.Context, cfg pool.Config) ([]pool.ReapDecision, error) {
+			p, err := remotes.newPool(cfg)
+			if err != nil {
+				return nil, err
+			}
+			return p.ExplainReap(ctx)
+		}
+	}
+
+	var results []poolDecisions
+	for _, cfg := range conf.Pools {
+		if len(args) > 0 && cfg.Name != args[0] {
+			continue
+		}
+		decisions, err := explain(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("pool %q: %w", cfg.Name, err)
+		}
+		results = append(results, poolDecisions{Pool: cfg.Name, Decisions: filterDecisions(decisions, idx)})
+	}
+	if len(args) > 0 && len(results) == 0 {
+		return fmt.Errorf("pool not found %q in %s", args[0], configPath)
+	}
+	return printDecisions(os.Stdout, results, output)
+}
+
+// filterDecisions keeps the decision about the agent at idx, or every decision
+// when idx is negative.
+func filterDecisions(decisions []pool.ReapDecision, idx int) []pool.ReapDecision {
+	if idx < 0 {
+		return decisions
+	}
+	var matched []pool.ReapDecision
+	for _, d := range decisions {
+		if d.Index == idx {
+			matched = append(matched, d)
+		}
+	}
+	return matched
+}
+
+func printDecisions(w io.Writer, results []poolDecisions, output string) error {
+	if output == "json" {
+		if results == nil {
+			results = []poolDecisions{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "POOL\tINDEX\tINSTANCE\tAGE\tOFFLINE\tVERDICT\tREASON")
+	for _, r := range results {
+		for _, d := range r.Decisions {
+			offline := "-"
+			if d.OfflineFor > 0 {
+				offline = d.OfflineFor.Round(time.Second).String()
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+				r.Pool,
+				d.Index,
+				d.Name,
+				d.Age.Round(time.Second),
+				offline,
+				d.Verdict,
+				d.Reason,
+			)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintDecisions(t *testing.T) {
+	decisions := []pool.ReapDecision{
+		{Index: 0, Name: "build-0", Verdict: pool.ReapVerdictKeep, Reason: "Agent.Worker is running", Age: time.Hour},
+		{Index: 1, Name: "build-1", Verdict: pool.ReapVerdictWait, Reason: "offline for 2m0s < offline grace period 5m0s", Age: time.Hour, OfflineFor: 2 * time.Minute},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, printDecisions(&buf, []poolDecisions{{Pool: "build", Decisions: decisions}}, "table"))
+	assert.Regexp(t, `build\s+0\s+build-0\s+1h0m0s\s+-\s+keep\s+Agent.Worker is running`, buf.String())
+	assert.Regexp(t, `build\s+1\s+build-1\s+1h0m0s\s+2m0s\s+wait\s+offline for 2m0s`, buf.String())
+
+	assert.Equal(t, decisions[1:], filterDecisions(decisions, 1))
+	assert.Equal(t, decisions, filterDecisions(decisions, -1))
+}
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/history"
+	"github.com/spf13/cobra"
+)
+
+var (
+	historyJob      int64
+	historyInstance string
+	historyLimit    int
+	historyOutput   string
+)
+
+func init() {
+	historyCmd.Flags().Int64Var(&historyJob, "job", 0, "only show the agent that ran this Azure job request ID")
+	historyCmd.Flags().StringVar(&historyInstance, "instance", "", "only show lifetimes of this instance name")
+	historyCmd.Flags().IntVar(&historyLimit, "limit", 50, "show at most this many of the most recent records (0 for all)")
+	historyCmd.Flags().StringVarP(&historyOutput, "output", "o", "table", "output format (table, json)")
+	rootCmd.AddCommand(historyCmd)
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history [pool]",
+	Short: "show which Azure jobs ran on which agent instances",
+	Long: "Show the agent instances the daemon ran, oldest first, with the Azure " +
+		"job each one ran and why it went away. Records are read from historyFile " +
+		"and written when an instance goes away.",
+	Args:    cobra.MaximumNArgs(1),
+	PreRunE: loadConfig,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		records, err := history.Read(conf.HistoryFile)
+		if err != nil {
+			return err
+		}
+
+		filter := historyFilter{job: historyJob, instance: historyInstance, limit: historyLimit}
+		if len(args) == 1 {
+			filter.pool = args[0]
+		}
+		return printHistory(os.Stdout, filter.apply(records), historyOutput)
+	},
+}
+
+type historyFilter struct {
+	pool     string
+	instance string
+	job      int64
+	limit    int
+}
+
+// apply returns the matching records, keeping the most recent ones when there
+// are more than the limit.
+func (f historyFilter) apply(records []history.Record) []history.Record {
+	var matched []history.Record
+	for _, r := range records {
+		if (f.pool != "" && r.Pool != f.pool) ||
+			(f.instance != "" && r.Instance != f.instance) ||
+			(f.job != 0 && r.JobID != f.job) {
+			continue
+		}
+		matched = append(matched, r)
+	}
+	if f.limit > 0 && len(matched) > f.limit {
+		matched = matched[len(matched)-f.limit:]
+	}
+	return matched
+}
+
+func printHistory(w io.Writer, records []history.Record, output string) error {
+	switch output {
+	case "json":
+		if records == nil {
+			records = []history.Record{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case "table":
+	default:
+		return fmt.Errorf("unknown output format %q, expected table or json", output)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ENDED\tPOOL\tINSTANCE\tIMAGE\tJOB\tPIPELINE\tDURATION\tEXIT\tDETAIL")
+	for _, r := range records {
+		job := "-"
+		if r.JobID != 0 {
+			job = fmt.Sprint(r.JobID)
+		}
+		instance := r.Instance
+		if r.Remote != "" {
+			instance = r.Remote + ":" + instance
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.EndedAt.Local().Format(time.DateTime),
+			r.Pool,
+			instance,
+			orDash(shortFingerprint(r.Image)),
+			job,
+			orDash(r.Pipeline),
+			r.EndedAt.Sub(r.CreatedAt).Round(time.Second),
+			r.ExitReason,
+			r.Detail,
+		)
+	}
+	return tw.Flush()
+}
+
+// shortFingerprint abbreviates an image fingerprint the way incus does.
+func shortFingerprint(image string) string {
+	if len(image) == 64 {
+		return image[:12]
+	}
+	return image
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func historyTestRecords() []history.Record {
+	created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	return []history.Record{
+		{Pool: "build", Instance: "build-0", JobID: 1, CreatedAt: created, EndedAt: created.Add(time.Minute), ExitReason: history.ExitPoweroff},
+		{Pool: "test", Instance: "test-0", JobID: 2, CreatedAt: created, EndedAt: created.Add(time.Minute), ExitReason: history.ExitPoweroff},
+		{Pool: "build", Instance: "build-1", JobID: 3, CreatedAt: created, EndedAt: created.Add(time.Minute), ExitReason: history.ExitReaped},
+		{Pool: "build", Instance: "build-0", CreatedAt: created, EndedAt: created, ExitReason: history.ExitCreateError},
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	records := historyTestRecords()
+
+	assert.Len(t, historyFilter{pool: "build"}.apply(records), 3)
+	assert.Equal(t, []history.Record{records[1]}, historyFilter{job: 2}.apply(records))
+	assert.Equal(t, []history.Record{records[0], records[3]}, historyFilter{instance: "build-0"}.apply(records))
+	assert.Equal(t, records[2:], historyFilter{limit: 2}.apply(records), "the most recent records are kept")
+}
+
+func TestPrintHistory(t *testing.T) {
+	r := historyTestRecords()[0]
+	r.Image = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	r.Pipeline = "ci"
+
+	var buf bytes.Buffer
+	require.NoError(t, printHistory(&buf, []history.Record{r}, "table"))
+	assert.Contains(t, buf.String(), "JOB")
+	assert.Regexp(t, `build-0\s+0123456789ab\s+1\s+ci\s+1m0s\s+poweroff`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, printHistory(&buf, nil, "json"))
+	assert.Equal(t, "[]\n", buf.String())
+
+	assert.Error(t, printHistory(&buf, nil, "yaml"))
+}
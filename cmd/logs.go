@@ -1,49 +1,178 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"strconv"
+	"time"
 
+	"github.com/sklarsa/incus-azure-pipelines/archive"
+	"github.com/sklarsa/incus-azure-pipelines/control"
+	"github.com/sklarsa/incus-azure-pipelines/history"
 	"github.com/sklarsa/incus-azure-pipelines/pool"
 	"github.com/spf13/cobra"
 )
 
+var (
+	logsInstance string
+	logsJob      int64
+	logsFollow   bool
+	logsSince    string
+	logsTail     int
+)
+
 func init() {
+	logsCmd.Flags().StringVar(&logsInstance, "instance", "", "read the latest archived log of this instance name")
+	logsCmd.Flags().Int64Var(&logsJob, "job", 0, "read the archived log of the agent that ran this Azure job request ID")
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "keep streaming the log as it grows, including the logs of later instances at the index")
+	logsCmd.Flags().StringVar(&logsSince, "since", "", "only output lines logged since a duration ago (10m) or an RFC 3339 timestamp")
+	logsCmd.Flags().IntVar(&logsTail, "tail", 0, "only output the last N lines of the log (0 for all)")
 	rootCmd.AddCommand(logsCmd)
 }
 
 var logsCmd = &cobra.Command{
-	Use:     "logs <pool> <agent-index>",
-	Short:   "output logs for a given agent",
-	Args:    cobra.ExactArgs(2),
+	Use:   "logs <pool> <agent-index> | logs [pool] --instance NAME | logs [pool] --job ID",
+	Short: "output logs for a given agent",
+	Long: "Output the log of a running agent, or with --instance or --job the " +
+		"archived log of an agent that is gone. Archives are only written when " +
+		"logArchive is configured.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if logsInstance != "" || logsJob != 0 {
+			return cobra.MaximumNArgs(1)(cmd, args)
+		}
+		return cobra.ExactArgs(2)(cmd, args)
+	},
 	PreRunE: loadConfig,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		poolName := args[0]
-		idxStr := args[1]
+		if logsInstance != "" || logsJob != 0 {
+			if logsFollow || logsSince != "" || logsTail != 0 {
+				return errors.New("--follow, --since and --tail only apply to running agents")
+			}
+			var poolName string
+			if len(args) == 1 {
+				poolName = args[0]
+			}
+			entry, err := findArchive(conf, poolName, logsInstance, logsJob)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "archived log of %s from %s\n", entry.Instance, entry.Path)
+			return archive.ReadLog(entry.Path, os.Stdout)
+		}
 
-		idx, err := strconv.Atoi(idxStr)
+		poolName, idx, err := parseAgentArgs(args)
 		if err != nil {
-			return fmt.Errorf("invalid agent index %q: %w", idxStr, err)
+			return err
+		}
+		if logsTail < 0 {
+			return fmt.Errorf("invalid --tail %d", logsTail)
+		}
+		opts := pool.LogOptions{Follow: logsFollow, Tail: logsTail}
+		if opts.Since, err = parseSince(logsSince, time.Now()); err != nil {
+			return err
+		}
+
+		if client, ok := control.Dial(ctx, conf.ControlSocket); ok {
+			if agents, err := client.Agents(ctx, poolName); err == nil {
+				for _, a := range agents {
+					if a.Index == idx {
+						printAgentImage(a.Name, a.Image)
+					}
+				}
+			}
+			return client.AgentLogs(ctx, poolName, idx, os.Stdout, opts)
 		}
 
 		for _, cfg := range conf.Pools {
 			if cfg.Name == poolName {
-				if idx >= cfg.AgentCount {
-					return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, poolName, cfg.AgentCount)
+				if idx >= cfg.Capacity() {
+					return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, poolName, cfg.Capacity())
 				}
-
-				p, err := pool.NewPool(c, cfg)
+				remotes := newRemoteConnector(c, conf.Remotes)
+				defer remotes.Disconnect()
+				p, err := remotes.newPool(cfg)
 				if err != nil {
 					return err
 				}
-
-				return p.AgentLogs(ctx, idx, os.Stdout)
+				if image, err := p.AgentImage(idx); err == nil {
+					printAgentImage(p.AgentName(idx), image)
+				}
+				return p.AgentLogs(ctx, idx, os.Stdout, opts)
 			}
+		}
+		return fmt.Errorf("pool not found %q in %s", poolName, configPath)
+	},
+}
+
+// parseSince parses --since, either a duration before now or a timestamp.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q, expected a duration like 10m or an RFC 3339 timestamp", s)
+	}
+	return t, nil
+}
+
+// printAgentImage reports which image an agent runs on stderr, so the log
+// itself on stdout stays unchanged.
+func printAgentImage(name, image string) {
+	if image == "" {
+		image = "unknown"
+	}
+	fmt.Fprintf(os.Stderr, "agent %s runs image %s\n", name, image)
+}
+
+// findArchive returns the most recent archive matching instance and job. An
+// archive is only named after its job when the job was known when it was
+// written, so other archives are matched through the job history.
+func findArchive(conf CLIConfig, poolName, instance string, job int64) (archive.Entry, error) {
+	if conf.LogArchive == nil {
+		return archive.Entry{}, errors.New("logArchive is not configured")
+	}
+	entries, err := archive.List(conf.LogArchive.Dir, poolName)
+	if err != nil {
+		return archive.Entry{}, err
+	}
 
+	var lifetimes []history.Record
+	if job != 0 {
+		records, err := history.Read(conf.HistoryFile)
+		if err != nil {
+			return archive.Entry{}, err
 		}
+		lifetimes = historyFilter{pool: poolName, instance: instance, job: job}.apply(records)
+	}
 
-		return fmt.Errorf("pool not found %q in %s", poolName, configPath)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if instance != "" && e.Instance != instance {
+			continue
+		}
+		if job == 0 || e.JobID == job || archivedDuring(e, lifetimes) {
+			return e, nil
+		}
+	}
 
-	},
+	if job != 0 {
+		return archive.Entry{}, fmt.Errorf("no archived log found for job %d", job)
+	}
+	return archive.Entry{}, fmt.Errorf("no archived log found for instance %q", instance)
+}
+
+// archivedDuring reports whether e was written for one of the lifetimes. Logs
+// are archived shortly before an instance goes away.
+func archivedDuring(e archive.Entry, lifetimes []history.Record) bool {
+	for _, r := range lifetimes {
+		if e.JobID == 0 && e.Pool == r.Pool && e.Instance == r.Instance &&
+			!e.Time.Before(r.CreatedAt) && !e.Time.After(r.EndedAt) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/archive"
+	"github.com/sklarsa/incus-azure-pipelines/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestArchive(t *testing.T, dir, pool, instance string, jobID int64, at time.Time) string {
+	t.Helper()
+	w, err := archive.New(archive.Config{Dir: dir}).Create(pool, instance, jobID, at)
+	require.NoError(t, err)
+	gz := gzip.NewWriter(w)
+	require.NoError(t, tar.NewWriter(gz).Close())
+	require.NoError(t, gz.Close())
+	path, err := w.Close()
+	require.NoError(t, err)
+	return path
+}
+
+func TestFindArchive(t *testing.T) {
+	dir := t.TempDir()
+	historyFile := filepath.Join(t.TempDir(), "history.jsonl")
+	c := CLIConfig{LogArchive: &archive.Config{Dir: dir}, HistoryFile: historyFile}
+	created := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	first := writeTestArchive(t, dir, "build", "build-0", 7, created.Add(time.Minute))
+	second := writeTestArchive(t, dir, "build", "build-0", 0, created.Add(time.Hour))
+	other := writeTestArchive(t, dir, "test", "test-0", 0, created.Add(2*time.Hour))
+
+	// The job of the second archive was only observed after it was written.
+	require.NoError(t, history.NewLog(historyFile).Append(history.Record{
+		Pool: "build", Instance: "build-0", JobID: 8,
+		CreatedAt: created.Add(50 * time.Minute), EndedAt: created.Add(61 * time.Minute),
+	}))
+
+	for _, tt := range []struct {
+		name     string
+		pool     string
+		instance string
+		job      int64
+		want     string
+	}{
+		{name: "latest of instance", instance: "build-0", want: second},
+		{name: "job in file name", job: 7, want: first},
+		{name: "job from history", job: 8, want: second},
+		{name: "pool", pool: "test", instance: "test-0", want: other},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := findArchive(c, tt.pool, tt.instance, tt.job)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, e.Path)
+		})
+	}
+
+	_, err := findArchive(c, "test", "build-0", 0)
+	assert.ErrorContains(t, err, `no archived log found for instance "build-0"`)
+	_, err = findArchive(c, "", "", 9)
+	assert.ErrorContains(t, err, "no archived log found for job 9")
+	_, err = findArchive(CLIConfig{}, "", "build-0", 0)
+	assert.ErrorContains(t, err, "logArchive is not configured")
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	since, err := parseSince("", now)
+	require.NoError(t, err)
+	assert.True(t, since.IsZero())
+
+	since, err = parseSince("10m", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-10*time.Minute), since)
+
+	since, err = parseSince("2025-01-02T01:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 1, 2, 1, 0, 0, 0, time.UTC), since)
+
+	_, err = parseSince("yesterday", now)
+	assert.ErrorContains(t, err, "invalid --since")
+}
@@ -8,25 +8,43 @@ import (
 
 var (
 	provisionConf = &provision.Config{}
+	specPath      string
 )
 
 func init() {
 	rootCmd.AddCommand(provisionCmd)
 
+	provisionCmd.Flags().StringVarP(&specPath, "file", "f", "", "image spec file to build from, instead of the other flags")
 	provisionCmd.Flags().StringVarP(&provisionConf.BaseAlias, "base", "b", "", "base image alias (starting point)")
 	provisionCmd.Flags().StringVarP(&provisionConf.TargetAlias, "target", "t", "", "target image alias (name of the newly-built image)")
 	provisionCmd.Flags().StringArrayVarP(&provisionConf.Scripts, "scripts", "s", []string{}, "paths to provisioning scripts")
 	provisionCmd.Flags().StringVarP(&provisionConf.ProjectName, "project", "p", "", "name of incus project to build the image in")
 	provisionCmd.Flags().BoolVar(&provisionConf.VM, "vm", false, "build a virtual-machine image instead of a container image")
-
-	_ = provisionCmd.MarkFlagRequired("base")
-	_ = provisionCmd.MarkFlagRequired("target")
+	provisionCmd.Flags().StringArrayVar(&provisionConf.RegistryMirrors, "registry-mirror", []string{}, "docker registry mirror URL to bake into the image")
+	provisionCmd.Flags().StringVar(&provisionConf.AgentVersion, "agent-version", "", "azure pipelines agent release to install (default: the latest release)")
+	provisionCmd.Flags().StringVar(&provisionConf.AgentTarball, "agent-tarball", "", "local agent release tarball to install instead of downloading one")
+	provisionCmd.Flags().StringVar(&provisionConf.AgentSHA256, "agent-sha256", "", "expected sha256 checksum of the agent tarball")
+	provisionCmd.Flags().StringVar(&provisionConf.AgentCacheDir, "agent-cache-dir", "", "directory downloaded agent tarballs are cached in (default: the user cache directory)")
+
+	provisionCmd.MarkFlagsOneRequired("file", "base")
+	provisionCmd.MarkFlagsRequiredTogether("base", "target")
+	for _, flag := range []string{"base", "target", "scripts", "project", "vm", "registry-mirror", "agent-version", "agent-tarball", "agent-sha256"} {
+		provisionCmd.MarkFlagsMutuallyExclusive("file", flag)
+	}
 }
 
 var provisionCmd = &cobra.Command{
 	Use:   "provision",
 	Short: "provision an image to use for azure CI runners",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if specPath != "" {
+			conf, err := provision.LoadSpec(specPath)
+			if err != nil {
+				return err
+			}
+			conf.AgentCacheDir = provisionConf.AgentCacheDir
+			return provision.BaseImage(ctx, c, conf)
+		}
 
 		v := validator.New(validator.WithRequiredStructEnabled())
 		if err := v.Struct(provisionConf); err != nil {
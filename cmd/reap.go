@@ -6,49 +6,80 @@ import (
 	"strconv"
 
 	incus "github.com/lxc/incus/v6/client"
-	"github.com/sklarsa/incus-azure-pipelines/pool"
+	"github.com/sklarsa/incus-azure-pipelines/control"
 	"github.com/spf13/cobra"
 )
 
+var reapDryRun bool
+
 func init() {
+	reapCmd.Flags().BoolVar(&reapDryRun, "dry-run", false, "explain what the reaper would do instead of stopping anything, like the explain command")
 	rootCmd.AddCommand(reapCmd)
 }
 
 var reapCmd = &cobra.Command{
-	Use:   "reap <pool> <agent-index>",
+	Use:   "reap <pool> <agent-index> | reap --dry-run [pool] [agent-index]",
 	Short: "force-stop and replace one ephemeral agent instance",
 	Long: "Force-stop one ephemeral agent instance. This is destructive and can " +
-		"terminate a running job. The daemon reconciler creates a replacement.",
-	Args:    cobra.ExactArgs(2),
+		"terminate a running job. The daemon reconciler creates a replacement. " +
+		"When a daemon is running, the reap goes through its control API so it " +
+		"cannot race with the daemon's own reaper.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if reapDryRun {
+			return cobra.MaximumNArgs(2)(cmd, args)
+		}
+		return cobra.ExactArgs(2)(cmd, args)
+	},
 	PreRunE: loadConfig,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if reapDryRun {
+			return runExplain(args, "table")
+		}
+		if client, ok := control.Dial(ctx, conf.ControlSocket); ok {
+			poolName, idx, err := parseAgentArgs(args)
+			if err != nil {
+				return err
+			}
+			return client.ReapAgent(ctx, poolName, idx)
+		}
 		return runReap(ctx, c, conf, configPath, args)
 	},
 }
 
-func runReap(ctx context.Context, server incus.InstanceServer, config CLIConfig, configPath string, args []string) error {
+// parseAgentArgs parses the <pool> <agent-index> arguments shared by the
+// agent subcommands.
+func parseAgentArgs(args []string) (string, int, error) {
 	if len(args) != 2 {
-		return fmt.Errorf("expected pool and agent index")
+		return "", 0, fmt.Errorf("expected pool and agent index")
 	}
 
-	poolName := args[0]
 	idx, err := strconv.Atoi(args[1])
 	if err != nil {
-		return fmt.Errorf("invalid agent index %q: %w", args[1], err)
+		return "", 0, fmt.Errorf("invalid agent index %q: %w", args[1], err)
 	}
 	if idx < 0 {
-		return fmt.Errorf("invalid agent index %d: must be non-negative", idx)
+		return "", 0, fmt.Errorf("invalid agent index %d: must be non-negative", idx)
+	}
+	return args[0], idx, nil
+}
+
+func runReap(ctx context.Context, server incus.InstanceServer, config CLIConfig, configPath string, args []string) error {
+	poolName, idx, err := parseAgentArgs(args)
+	if err != nil {
+		return err
 	}
 
 	for _, cfg := range config.Pools {
 		if cfg.Name != poolName {
 			continue
 		}
-		if idx >= cfg.AgentCount {
-			return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, poolName, cfg.AgentCount)
+		if idx >= cfg.Capacity() {
+			return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, poolName, cfg.Capacity())
 		}
 
-		p, err := pool.NewPool(server, cfg)
+		remotes := newRemoteConnector(server, config.Remotes)
+		defer remotes.Disconnect()
+		p, err := remotes.newPool(cfg)
 		if err != nil {
 			return err
 		}
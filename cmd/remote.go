@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+)
+
+// remoteConnector connects to the Incus remotes pools place agents on. Each
+// remote is connected to once and shared by every pool that uses it.
+type remoteConnector struct {
+	local   incus.InstanceServer
+	remotes map[string]RemoteConfig
+
+	mu      sync.Mutex
+	servers map[string]incus.InstanceServer
+}
+
+func newRemoteConnector(local incus.InstanceServer, remotes map[string]RemoteConfig) *remoteConnector {
+	return &remoteConnector{
+		local:   local,
+		remotes: remotes,
+		servers: map[string]incus.InstanceServer{},
+	}
+}
+
+// newPool creates a pool on the remotes its config lists, or on the local
+// daemon when it lists none.
+func (rc *remoteConnector) newPool(cfg pool.Config) (*pool.Pool, error) {
+	if len(cfg.Remotes) == 0 {
+		return pool.NewPool(rc.local, cfg)
+	}
+
+	remotes := make([]pool.Remote, 0, len(cfg.Remotes))
+	for _, name := range cfg.Remotes {
+		server, err := rc.connect(name)
+		if err != nil {
+			return nil, fmt.Errorf("connect to remote %q: %w", name, err)
+		}
+		remotes = append(remotes, pool.Remote{Name: name, Server: server})
+	}
+	return pool.NewPoolOnRemotes(remotes, cfg)
+}
+
+func (rc *remoteConnector) connect(name string) (incus.InstanceServer, error) {
+	if name == pool.LocalRemote {
+		return rc.local, nil
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if server, ok := rc.servers[name]; ok {
+		return server, nil
+	}
+
+	remote, ok := rc.remotes[name]
+	if !ok {
+		return nil, fmt.Errorf("remote is not defined")
+	}
+	args, err := remote.connectionArgs()
+	if err != nil {
+		return nil, err
+	}
+	server, err := incus.ConnectIncus(remote.URL, args)
+	if err != nil {
+		return nil, err
+	}
+	rc.servers[name] = server
+	return server, nil
+}
+
+// Disconnect closes the connections to every remote except the local daemon.
+func (rc *remoteConnector) Disconnect() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for name, server := range rc.servers {
+		server.Disconnect()
+		delete(rc.servers, name)
+	}
+}
+
+// connectionArgs reads the certificates of a remote.
+func (r RemoteConfig) connectionArgs() (*incus.ConnectionArgs, error) {
+	clientCert, err := os.ReadFile(r.ClientCert)
+	if err != nil {
+		return nil, fmt.Errorf("read client certificate: %w", err)
+	}
+	clientKey, err := os.ReadFile(r.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("read client key: %w", err)
+	}
+	args := &incus.ConnectionArgs{
+		TLSClientCert: string(clientCert),
+		TLSClientKey:  string(clientKey),
+	}
+	if r.ServerCert != "" {
+		serverCert, err := os.ReadFile(r.ServerCert)
+		if err != nil {
+			return nil, fmt.Errorf("read server certificate: %w", err)
+		}
+		args.TLSServerCert = string(serverCert)
+	}
+	return args, nil
+}
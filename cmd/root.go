@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -92,8 +93,20 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// exitCodeError makes the process exit with a command's own exit code, such as
+// that of a remote shell, without printing anything.
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
+		var code exitCodeError
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
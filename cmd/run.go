@@ -4,12 +4,21 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sklarsa/incus-azure-pipelines/archive"
+	"github.com/sklarsa/incus-azure-pipelines/control"
 	"github.com/sklarsa/incus-azure-pipelines/daemon"
+	"github.com/sklarsa/incus-azure-pipelines/history"
+	"github.com/sklarsa/incus-azure-pipelines/mirror"
 	"github.com/sklarsa/incus-azure-pipelines/pool"
 	"github.com/spf13/cobra"
 )
@@ -24,15 +33,90 @@ var runCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		wg := &sync.WaitGroup{}
 
-		for _, cfg := range conf.Pools {
-			wg.Go(func() {
-				p, err := pool.NewPool(c, cfg)
-				if err != nil {
-					slog.Error("error initializing agent pool", "err", err, "pool", cfg.Name)
+		remotes := newRemoteConnector(c, conf.Remotes)
+		defer remotes.Disconnect()
+		hist := history.NewLog(conf.HistoryFile)
+		var logArchive *archive.Archive
+		if conf.LogArchive != nil {
+			logArchive = archive.New(*conf.LogArchive)
+		}
+		sup := daemon.NewSupervisor(ctx, conf.Daemon, func(cfg pool.Config) (*pool.Pool, error) {
+			p, err := remotes.newPool(cfg)
+			if err != nil {
+				return nil, err
+			}
+			p.SetHistory(hist)
+			if logArchive != nil {
+				p.SetLogArchive(logArchive)
+			}
+			return p, nil
+		})
+		if err := sup.Apply(conf.Pools); err != nil {
+			slog.Error("error initializing agent pools", "err", err)
+		}
+		wg.Go(sup.Wait)
+
+		wg.Go(func() {
+			slog.Info("starting goroutine", "type", "config-reloader")
+			defer slog.Info("exiting goroutine", "type", "config-reloader")
+
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			defer signal.Stop(hup)
+
+			for {
+				select {
+				case <-ctx.Done():
 					return
+				case <-hup:
+					reloadConfig(sup)
 				}
+			}
+		})
+
+		wg.Go(func() {
+			slog.Info("starting goroutine", "type", "drainer")
+			defer slog.Info("exiting goroutine", "type", "drainer")
+
+			usr1 := make(chan os.Signal, 1)
+			signal.Notify(usr1, syscall.SIGUSR1)
+			defer signal.Stop(usr1)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-usr1:
+			}
 
-				daemon.Run(ctx, p, conf.Daemon)
+			// Stop replacing agents everywhere, wait for running jobs to
+			// finish, then shut down.
+			slog.Info("draining all pools before exiting")
+			if err := sup.Drain(ctx, conf.Daemon.ReconcileInterval); err != nil {
+				return
+			}
+			slog.Info("all pools drained, exiting")
+			cancel()
+		})
+
+		wg.Go(func() {
+			slog.Info("starting goroutine", "type", "control-server")
+			defer slog.Info("exiting goroutine", "type", "control-server")
+
+			server := control.NewServer(sup.Pools)
+			slog.Info("binding control-server", "socket", conf.ControlSocket)
+			if err := server.ListenAndServe(ctx, conf.ControlSocket); err != nil {
+				slog.Error("control server error", "err", err)
+			}
+		})
+
+		if conf.RegistryMirror != nil {
+			wg.Go(func() {
+				slog.Info("starting goroutine", "type", "registry-mirror")
+				defer slog.Info("exiting goroutine", "type", "registry-mirror")
+
+				if err := mirror.New(*conf.RegistryMirror).ListenAndServe(ctx); err != nil {
+					slog.Error("registry mirror error", "err", err)
+				}
 			})
 		}
 
@@ -67,3 +151,32 @@ var runCmd = &cobra.Command{
 		wg.Wait()
 	},
 }
+
+// reloadConfig re-reads the config file and applies its pools to the running
+// daemon. An invalid file is logged and ignored so a typo cannot take down
+// pools that are already running.
+func reloadConfig(sup *daemon.Supervisor) {
+	slog.Info("reloading config", "path", configPath)
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		slog.Error("error reading config, keeping current config", "path", configPath, "err", err)
+		return
+	}
+	newConf, err := parseConfig(data)
+	if err != nil {
+		slog.Error("error parsing config, keeping current config", "path", configPath, "err", err)
+		return
+	}
+
+	if newConf.Daemon != conf.Daemon || newConf.MetricsPort != conf.MetricsPort || newConf.ControlSocket != conf.ControlSocket ||
+		newConf.HistoryFile != conf.HistoryFile || !maps.Equal(newConf.Remotes, conf.Remotes) ||
+		!reflect.DeepEqual(newConf.LogArchive, conf.LogArchive) || !reflect.DeepEqual(newConf.RegistryMirror, conf.RegistryMirror) {
+		slog.Warn("daemon, metricsPort, controlSocket, historyFile, logArchive, registryMirror and remotes changes require a restart and were not applied")
+	}
+
+	if err := sup.Apply(newConf.Pools); err != nil {
+		slog.Error("error applying reloaded config", "err", err)
+	}
+	conf.Pools = newConf.Pools
+}
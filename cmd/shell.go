@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/control"
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var shellRoot bool
+
+func init() {
+	shellCmd.Flags().BoolVar(&shellRoot, "root", false, "open the shell as root instead of the agent user")
+	rootCmd.AddCommand(shellCmd)
+}
+
+var shellCmd = &cobra.Command{
+	Use:   "shell <pool> <agent-index>",
+	Short: "open an interactive shell in an agent instance",
+	Long: "Open an interactive login shell as the agent user in one agent " +
+		"instance. When a daemon is running, it neither reaps nor replaces the " +
+		"agent until the shell exits. Exits with the exit code of the shell.",
+	Args:    cobra.ExactArgs(2),
+	PreRunE: loadConfig,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		poolName, idx, err := parseAgentArgs(args)
+		if err != nil {
+			return err
+		}
+
+		for _, cfg := range conf.Pools {
+			if cfg.Name != poolName {
+				continue
+			}
+			if idx >= cfg.Capacity() {
+				return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, poolName, cfg.Capacity())
+			}
+
+			// SIGINT and SIGTERM cancel ctx, but they are meant for the
+			// shell, which only ends when its user exits it.
+			shellCtx := context.WithoutCancel(ctx)
+			if client, ok := control.Dial(ctx, conf.ControlSocket); ok {
+				release, err := client.HoldAgent(shellCtx, poolName, idx)
+				if err != nil {
+					return err
+				}
+				defer release()
+			}
+
+			remotes := newRemoteConnector(c, conf.Remotes)
+			defer remotes.Disconnect()
+			p, err := remotes.newPool(cfg)
+			if err != nil {
+				return err
+			}
+			code, err := runShell(shellCtx, p, idx, shellRoot)
+			if err != nil {
+				return err
+			}
+			if code != 0 {
+				return exitCodeError(code)
+			}
+			return nil
+		}
+		return fmt.Errorf("pool not found %q in %s", poolName, configPath)
+	},
+}
+
+// runShell attaches the local terminal to a shell in the agent at idx and
+// returns the exit code of the shell.
+func runShell(ctx context.Context, p *pool.Pool, idx int, root bool) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts := pool.ShellOptions{
+		Root:   root,
+		Term:   os.Getenv("TERM"),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+	}
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = term.Restore(fd, state) }()
+		opts.Width, opts.Height, _ = term.GetSize(int(os.Stdout.Fd()))
+	}
+	opts.Control = forwardSignals(ctx, int(os.Stdout.Fd()))
+
+	return p.Shell(ctx, idx, opts)
+}
+
+// forwardSignals returns an exec control handler that resizes the remote
+// terminal along with the local one, and forwards SIGHUP and SIGTERM, until
+// ctx is canceled.
+func forwardSignals(ctx context.Context, fd int) func(*websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGWINCH, syscall.SIGHUP, syscall.SIGTERM)
+		defer signal.Stop(sigCh)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigCh:
+				if err := conn.WriteJSON(controlMessage(sig, fd)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func controlMessage(sig os.Signal, fd int) api.InstanceExecControl {
+	if sig == syscall.SIGWINCH {
+		width, height, _ := term.GetSize(fd)
+		return api.InstanceExecControl{
+			Command: "window-resize",
+			Args: map[string]string{
+				"width":  strconv.Itoa(width),
+				"height": strconv.Itoa(height),
+			},
+		}
+	}
+	return api.InstanceExecControl{Command: "signal", Signal: int(sig.(syscall.Signal))}
+}
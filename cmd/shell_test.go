@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControlMessage(t *testing.T) {
+	assert.Equal(t, api.InstanceExecControl{Command: "signal", Signal: 15}, controlMessage(syscall.SIGTERM, -1))
+
+	resize := controlMessage(syscall.SIGWINCH, -1)
+	assert.Equal(t, "window-resize", resize.Command)
+	assert.Contains(t, resize.Args, "width")
+	assert.Contains(t, resize.Args, "height")
+}
+
+func TestExitCodeError(t *testing.T) {
+	var code exitCodeError
+	err := fmt.Errorf("shell: %w", exitCodeError(3))
+	assert.True(t, errors.As(err, &code))
+	assert.Equal(t, exitCodeError(3), code)
+	assert.Equal(t, "exit status 3", code.Error())
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/control"
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statusOutput   string
+	statusWatch    bool
+	statusInterval time.Duration
+)
+
+func init() {
+	statusCmd.Flags().StringVarP(&statusOutput, "output", "o", "table", "output format (table, json)")
+	statusCmd.Flags().BoolVarP(&statusWatch, "watch", "w", false, "refresh the status until interrupted")
+	statusCmd.Flags().DurationVar(&statusInterval, "interval", 5*time.Second, "refresh interval of --watch")
+	rootCmd.AddCommand(statusCmd)
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status [pool]",
+	Short: "show the live state of every agent",
+	Long: "Show every agent slot of the configured pools with its instance " +
+		"state, what Azure reports about the agent, and whether a job worker " +
+		"runs in it. When a daemon is running, in-flight operations and offline " +
+		"observations come from it.",
+	Args:    cobra.MaximumNArgs(1),
+	PreRunE: loadConfig,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if statusOutput != "table" && statusOutput != "json" {
+			return fmt.Errorf("unknown output format %q, expected table or json", statusOutput)
+		}
+		if statusWatch && statusInterval <= 0 {
+			return fmt.Errorf("invalid --interval %s", statusInterval)
+		}
+
+		var names []string
+		for _, cfg := range conf.Pools {
+			if len(args) == 0 || cfg.Name == args[0] {
+				names = append(names, cfg.Name)
+			}
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("pool not found %q in %s", args[0], configPath)
+		}
+
+		source, closeSource, err := newStatusSource(names)
+		if err != nil {
+			return err
+		}
+		defer closeSource()
+
+		if !statusWatch {
+			return printPoolStatus(ctx, os.Stdout, source, names, statusOutput, time.Now())
+		}
+
+		ticker := time.NewTicker(statusInterval)
+		defer ticker.Stop()
+		for {
+			if statusOutput == "table" {
+				// Clear the terminal, as watch(1) does.
+				fmt.Print("\033[H\033[2J")
+			}
+			if err := printPoolStatus(ctx, os.Stdout, source, names, statusOutput, time.Now()); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				fmt.Fprintln(os.Stderr, err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+// statusSource returns the status of the agents of one pool.
+type statusSource func(ctx context.Context, poolName string) ([]pool.AgentStatus, error)
+
+// newStatusSource asks the running daemon, or the pools directly when no
+// daemon is running.
+func newStatusSource(names []string) (statusSource, func(), error) {
+	if client, ok := control.Dial(ctx, conf.ControlSocket); ok {
+		return client.PoolStatus, func() {}, nil
+	}
+
+	remotes := newRemoteConnector(c, conf.Remotes)
+	pools := map[string]*pool.Pool{}
+	for _, cfg := range conf.Pools {
+		for _, name := range names {
+			if cfg.Name != name {
+				continue
+			}
+			p, err := remotes.newPool(cfg)
+			if err != nil {
+				remotes.Disconnect()
+				return nil, nil, err
+			}
+			pools[name] = p
+		}
+	}
+	return func(ctx context.Context, poolName string) ([]pool.AgentStatus, error) {
+		return pools[poolName].Status(ctx)
+	}, remotes.Disconnect, nil
+}
+
+// poolStatus is the JSON output of one pool.
+type poolStatus struct {
+	Pool   string             `json:"pool"`
+	Agents []pool.AgentStatus `json:"agents"`
+}
+
+func printPoolStatus(ctx context.Context, w io.Writer, source statusSource, names []string, output string, now time.Time) error {
+	statuses := make([]poolStatus, 0, len(names))
+	for _, name := range names {
+		agents, err := source(ctx, name)
+		if err != nil {
+			return fmt.Errorf("pool %q: %w", name, err)
+		}
+		statuses = append(statuses, poolStatus{Pool: name, Agents: agents})
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "POOL\tINDEX\tINSTANCE\tSTATE\tAGE\tONLINE\tASSIGNED\tWORKER\tOFFLINE\tIN-FLIGHT\tIMAGE")
+	for _, s := range statuses {
+		for _, a := range s.Agents {
+			state, age := "-", "-"
+			if a.Status != "" {
+				state = a.Status
+				age = now.Sub(a.CreatedAt).Round(time.Second).String()
+			}
+			if a.Draining {
+				state += " (draining)"
+			}
+			online, assigned := "-", "-"
+			if a.Registered {
+				online, assigned = yesNo(a.Online), yesNo(a.Assigned)
+			}
+			worker := "-"
+			if a.WorkerRunning != nil {
+				worker = yesNo(*a.WorkerRunning)
+			}
+			offline := "-"
+			if a.OfflineSince != nil {
+				offline = now.Sub(*a.OfflineSince).Round(time.Second).String()
+			}
+			instance := a.Name
+			if a.Remote != "" {
+				instance = a.Remote + ":" + instance
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.Pool,
+				a.Index,
+				instance,
+				state,
+				age,
+				online,
+				assigned,
+				worker,
+				offline,
+				yesNo(a.InFlight),
+				orDash(shortFingerprint(a.Image)),
+			)
+		}
+	}
+	return tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func statusTestSource(now time.Time) statusSource {
+	running := true
+	offline := now.Add(-2 * time.Minute)
+	return func(_ context.Context, poolName string) ([]pool.AgentStatus, error) {
+		if poolName != "build" {
+			return nil, errors.New("unknown pool")
+		}
+		return []pool.AgentStatus{
+			{
+				AgentInfo:     pool.AgentInfo{Index: 0, Name: "build-0", Status: "Running", CreatedAt: now.Add(-time.Hour), Image: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+				Registered:    true,
+				Online:        true,
+				Assigned:      true,
+				WorkerRunning: &running,
+			},
+			{
+				AgentInfo:  pool.AgentInfo{Index: 1, Name: "build-1", Status: "Running", CreatedAt: now.Add(-time.Minute), InFlight: true, OfflineSince: &offline},
+				Registered: true,
+			},
+			{AgentInfo: pool.AgentInfo{Index: 2, Name: "build-2", Draining: true}},
+		}, nil
+	}
+}
+
+func TestPrintPoolStatus_Table(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	require.NoError(t, printPoolStatus(context.Background(), &buf, statusTestSource(now), []string{"build"}, "table", now))
+	out := buf.String()
+	assert.Contains(t, out, "IN-FLIGHT")
+	assert.Regexp(t, `build\s+0\s+build-0\s+Running\s+1h0m0s\s+yes\s+yes\s+yes\s+-\s+no\s+0123456789ab`, out)
+	assert.Regexp(t, `build\s+1\s+build-1\s+Running\s+1m0s\s+no\s+no\s+-\s+2m0s\s+yes\s+-`, out)
+	assert.Regexp(t, `build\s+2\s+build-2\s+- \(draining\)\s+-\s+-\s+-\s+-\s+-\s+no\s+-`, out)
+}
+
+func TestPrintPoolStatus_JSON(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	require.NoError(t, printPoolStatus(context.Background(), &buf, statusTestSource(now), []string{"build"}, "json", now))
+	var out []poolStatus
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Len(t, out, 1)
+	assert.Equal(t, "build", out[0].Pool)
+	assert.Len(t, out[0].Agents, 3)
+
+	err := printPoolStatus(context.Background(), &buf, statusTestSource(now), []string{"test"}, "json", now)
+	assert.ErrorContains(t, err, `pool "test": unknown pool`)
+}
@@ -0,0 +1,202 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+)
+
+// Client calls the control API of a running daemon.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a Client that connects to the daemon's unix socket.
+func NewClient(socketPath string) *Client {
+	return &Client{http: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}}
+}
+
+// Dial returns a Client if a daemon is answering on socketPath. It returns
+// false when no daemon is running, so callers can fall back to acting on Incus
+// directly.
+func Dial(ctx context.Context, socketPath string) (*Client, bool) {
+	if socketPath == "" {
+		return nil, false
+	}
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, false
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	c := NewClient(socketPath)
+	if _, err := c.Pools(pingCtx); err != nil {
+		return nil, false
+	}
+	return c, true
+}
+
+// Pools lists the pools managed by the daemon.
+func (c *Client) Pools(ctx context.Context) ([]pool.PoolInfo, error) {
+	var pools []pool.PoolInfo
+	return pools, c.getJSON(ctx, "/pools", &pools)
+}
+
+// Agents lists the agent slots of a pool with the daemon's live state.
+func (c *Client) Agents(ctx context.Context, poolName string) ([]pool.AgentInfo, error) {
+	var agents []pool.AgentInfo
+	return agents, c.getJSON(ctx, "/pools/"+url.PathEscape(poolName)+"/agents", &agents)
+}
+
+// PoolStatus returns the agent slots of a pool joined with their Azure status
+// and process checks.
+func (c *Client) PoolStatus(ctx context.Context, poolName string) ([]pool.AgentStatus, error) {
+	var status []pool.AgentStatus
+	return status, c.getJSON(ctx, "/pools/"+url.PathEscape(poolName)+"/status", &status)
+}
+
+// ExplainReap returns what the daemon's reaper would decide about every
+// instance of a pool, without acting on it.
+func (c *Client) ExplainReap(ctx context.Context, poolName string) ([]pool.ReapDecision, error) {
+	var decisions []pool.ReapDecision
+	return decisions, c.getJSON(ctx, "/pools/"+url.PathEscape(poolName)+"/reaper/explain", &decisions)
+}
+
+// ReapAgent force-stops one agent through the daemon.
+func (c *Client) ReapAgent(ctx context.Context, poolName string, idx int) error {
+	return c.send(ctx, http.MethodPost, agentPath(poolName, idx)+"/reap")
+}
+
+// HoldAgent keeps the daemon from reaping or replacing one agent until release
+// is called or ctx is canceled.
+func (c *Client) HoldAgent(ctx context.Context, poolName string, idx int) (release func(), err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := c.do(ctx, http.MethodPost, agentPath(poolName, idx)+"/hold")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return func() {
+		cancel()
+		_ = resp.Body.Close()
+	}, nil
+}
+
+// DrainPool stops the daemon from replacing any agent of a pool. Running jobs
+// are not interrupted.
+func (c *Client) DrainPool(ctx context.Context, poolName string) error {
+	return c.send(ctx, http.MethodPost, "/pools/"+url.PathEscape(poolName)+"/drain")
+}
+
+// CancelDrainPool lets the daemon replace the agents of a pool again.
+func (c *Client) CancelDrainPool(ctx context.Context, poolName string) error {
+	return c.send(ctx, http.MethodDelete, "/pools/"+url.PathEscape(poolName)+"/drain")
+}
+
+// DrainAgent stops the daemon from replacing one agent. A running job is not
+// interrupted.
+func (c *Client) DrainAgent(ctx context.Context, poolName string, idx int) error {
+	return c.send(ctx, http.MethodPost, agentPath(poolName, idx)+"/drain")
+}
+
+// CancelDrainAgent lets the daemon replace one agent again.
+func (c *Client) CancelDrainAgent(ctx context.Context, poolName string, idx int) error {
+	return c.send(ctx, http.MethodDelete, agentPath(poolName, idx)+"/drain")
+}
+
+// AgentLogs streams the log of one agent to w. With opts.Follow it returns once
+// ctx is canceled.
+func (c *Client) AgentLogs(ctx context.Context, poolName string, idx int, w io.Writer, opts pool.LogOptions) error {
+	query := url.Values{}
+	if opts.Follow {
+		query.Set("follow", "true")
+	}
+	if opts.Tail > 0 {
+		query.Set("tail", strconv.Itoa(opts.Tail))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339Nano))
+	}
+	path := agentPath(poolName, idx) + "/logs"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	_, err = io.Copy(w, resp.Body)
+	if opts.Follow && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func agentPath(poolName string, idx int) string {
+	return "/pools/" + url.PathEscape(poolName) + "/agents/" + strconv.Itoa(idx)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, target any) error {
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return fmt.Errorf("decode control API response: %w", err)
+	}
+	return nil
+}
+
+// send sends a request whose response has no body.
+func (c *Client) send(ctx context.Context, method, path string) error {
+	resp, err := c.do(ctx, method, path)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a request and converts non-2xx responses into errors.
+func (c *Client) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://daemon"+apiPrefix+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return resp, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var body errorResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil || body.Error == "" {
+		return nil, fmt.Errorf("control API returned HTTP %d", resp.StatusCode)
+	}
+	return nil, errors.New(body.Error)
+}
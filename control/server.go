@@ -0,0 +1,333 @@
+// Package control implements the daemon's local HTTP API. The API is served on
+// a unix socket so CLI commands can act through the running daemon instead of
+// building a second, uncoordinated copy of each pool.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+)
+
+// apiPrefix is the version prefix of every route. Breaking changes to the API
+// must use a new prefix.
+const apiPrefix = "/v1"
+
+// errorResponse is the body of every non-2xx response.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server exposes the pools of a running daemon over HTTP.
+type Server struct {
+	pools func() []*pool.Pool
+	mux   *http.ServeMux
+}
+
+// NewServer returns a Server for the pools returned by pools. The function is
+// called on every request so the set of pools may change while serving.
+func NewServer(pools func() []*pool.Pool) *Server {
+	s := &Server{pools: pools, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET "+apiPrefix+"/pools", s.listPools)
+	s.mux.HandleFunc("POST "+apiPrefix+"/pools/{pool}/drain", s.drainPool)
+	s.mux.HandleFunc("DELETE "+apiPrefix+"/pools/{pool}/drain", s.cancelDrainPool)
+	s.mux.HandleFunc("GET "+apiPrefix+"/pools/{pool}/agents", s.listAgents)
+	s.mux.HandleFunc("GET "+apiPrefix+"/pools/{pool}/status", s.poolStatus)
+	s.mux.HandleFunc("GET "+apiPrefix+"/pools/{pool}/reaper/explain", s.explainReap)
+	s.mux.HandleFunc("POST "+apiPrefix+"/pools/{pool}/agents/{idx}/drain", s.drainAgent)
+	s.mux.HandleFunc("DELETE "+apiPrefix+"/pools/{pool}/agents/{idx}/drain", s.cancelDrainAgent)
+	s.mux.HandleFunc("POST "+apiPrefix+"/pools/{pool}/agents/{idx}/reap", s.reapAgent)
+	s.mux.HandleFunc("GET "+apiPrefix+"/pools/{pool}/agents/{idx}/logs", s.agentLogs)
+	s.mux.HandleFunc("POST "+apiPrefix+"/pools/{pool}/agents/{idx}/hold", s.holdAgent)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the API on the unix socket at socketPath until ctx is
+// canceled. A stale socket left behind by a previous daemon is replaced, but an
+// error is returned if another daemon is still answering on it.
+func (s *Server) ListenAndServe(ctx context.Context, socketPath string) error {
+	if _, err := os.Stat(socketPath); err == nil {
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			_ = conn.Close()
+			return fmt.Errorf("control socket %s is in use by another daemon", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return fmt.Errorf("remove stale control socket: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0o660); err != nil {
+		_ = l.Close()
+		return err
+	}
+
+	// Streaming requests such as followed logs and holds end with the daemon.
+	server := &http.Server{
+		Handler:     s,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("error shutting down control server", "err", err)
+		}
+	}()
+
+	if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) listPools(w http.ResponseWriter, r *http.Request) {
+	pools := s.pools()
+	infos := make([]pool.PoolInfo, 0, len(pools))
+	for _, p := range pools {
+		infos = append(infos, p.Info())
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) listAgents(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.lookupPool(w, r)
+	if !ok {
+		return
+	}
+	agents, err := p.Agents()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, agents)
+}
+
+func (s *Server) poolStatus(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.lookupPool(w, r)
+	if !ok {
+		return
+	}
+	status, err := p.Status(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) explainReap(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.lookupPool(w, r)
+	if !ok {
+		return
+	}
+	decisions, err := p.ExplainReap(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, decisions)
+}
+
+func (s *Server) reapAgent(w http.ResponseWriter, r *http.Request) {
+	p, idx, ok := s.lookupAgent(w, r)
+	if !ok {
+		return
+	}
+	if err := p.ReapAgent(r.Context(), idx); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// holdAgent keeps an agent in flight until the client disconnects, so the
+// daemon neither reaps nor replaces it while an engineer works in it.
+func (s *Server) holdAgent(w http.ResponseWriter, r *http.Request) {
+	p, idx, ok := s.lookupAgent(w, r)
+	if !ok {
+		return
+	}
+	release, err := p.HoldAgent(idx)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	defer release()
+
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		return
+	}
+	<-r.Context().Done()
+}
+
+func (s *Server) drainPool(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.lookupPool(w, r)
+	if !ok {
+		return
+	}
+	p.Drain()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) cancelDrainPool(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.lookupPool(w, r)
+	if !ok {
+		return
+	}
+	p.CancelDrain()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) drainAgent(w http.ResponseWriter, r *http.Request) {
+	p, idx, ok := s.lookupAgent(w, r)
+	if !ok {
+		return
+	}
+	if err := p.DrainAgent(idx); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) cancelDrainAgent(w http.ResponseWriter, r *http.Request) {
+	p, idx, ok := s.lookupAgent(w, r)
+	if !ok {
+		return
+	}
+	if err := p.CancelDrainAgent(idx); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) agentLogs(w http.ResponseWriter, r *http.Request) {
+	p, idx, ok := s.lookupAgent(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := parseLogOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Once output has been written the status can no longer change, so errors
+	// after that point are only logged.
+	out := &flushWriter{w: w, rc: http.NewResponseController(w)}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := p.AgentLogs(r.Context(), idx, out, opts); err != nil {
+		if out.written {
+			slog.Error("error streaming agent logs", "pool", p.Name(), "idx", idx, "err", err)
+			return
+		}
+		writeError(w, http.StatusBadGateway, err)
+	}
+}
+
+// parseLogOptions reads the follow, tail and since query parameters. since is
+// an RFC 3339 timestamp.
+func parseLogOptions(r *http.Request) (pool.LogOptions, error) {
+	var opts pool.LogOptions
+	query := r.URL.Query()
+	if v := query.Get("follow"); v != "" {
+		follow, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid follow %q", v)
+		}
+		opts.Follow = follow
+	}
+	if v := query.Get("tail"); v != "" {
+		tail, err := strconv.Atoi(v)
+		if err != nil || tail < 0 {
+			return opts, fmt.Errorf("invalid tail %q", v)
+		}
+		opts.Tail = tail
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid since %q", v)
+		}
+		opts.Since = since
+	}
+	return opts, nil
+}
+
+func (s *Server) lookupPool(w http.ResponseWriter, r *http.Request) (*pool.Pool, bool) {
+	name := r.PathValue("pool")
+	for _, p := range s.pools() {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("pool not found %q", name))
+	return nil, false
+}
+
+func (s *Server) lookupAgent(w http.ResponseWriter, r *http.Request) (*pool.Pool, int, bool) {
+	p, ok := s.lookupPool(w, r)
+	if !ok {
+		return nil, 0, false
+	}
+	idx, err := strconv.Atoi(r.PathValue("idx"))
+	if err != nil || idx < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid agent index %q", r.PathValue("idx")))
+		return nil, 0, false
+	}
+	return p, idx, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("error encoding control API response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// flushWriter flushes after every write so streamed output reaches the client
+// as it is produced.
+type flushWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	written bool
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	f.written = f.written || n > 0
+	if err != nil {
+		return n, err
+	}
+	if err := f.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
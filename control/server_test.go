@@ -0,0 +1,248 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func testPool(t *testing.T, m *mocks.MockInstanceServer) *pool.Pool {
+	t.Helper()
+	p, err := pool.NewPool(m, pool.Config{
+		Name:       "build-pool",
+		AgentCount: 2,
+		Azure:      pool.AzureConfig{PAT: "pat", Url: "https://dev.azure.com/org"},
+		Incus:      pool.IncusConfig{Image: "image"},
+	})
+	require.NoError(t, err)
+	return p
+}
+
+// serve starts a control server on a temporary socket and returns a client for it.
+func serve(t *testing.T, pools ...*pool.Pool) *Client {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(t.TempDir(), "control.sock")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServer(func() []*pool.Pool { return pools }).ListenAndServe(ctx, socket)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	var (
+		client *Client
+		ok     bool
+	)
+	require.Eventually(t, func() bool {
+		client, ok = Dial(context.Background(), socket)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	return client
+}
+
+func TestDial_NoDaemon(t *testing.T) {
+	_, ok := Dial(context.Background(), filepath.Join(t.TempDir(), "missing.sock"))
+	assert.False(t, ok)
+	_, ok = Dial(context.Background(), "")
+	assert.False(t, ok)
+}
+
+func TestServer_ListPoolsAndAgents(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	createdAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{
+			Name:        "build-pool-1",
+			Status:      "Running",
+			CreatedAt:   createdAt,
+			InstancePut: api.InstancePut{Config: map[string]string{"user.iap.image-fingerprint": "abc123"}},
+		},
+	}, nil)
+	client := serve(t, testPool(t, m))
+
+	pools, err := client.Pools(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []pool.PoolInfo{{Name: "build-pool", Project: "default", Image: "image", Desired: 2, Capacity: 2}}, pools)
+
+	agents, err := client.Agents(context.Background(), "build-pool")
+	require.NoError(t, err)
+	assert.Equal(t, []pool.AgentInfo{
+		{Index: 0, Name: "build-pool-0"},
+		{Index: 1, Name: "build-pool-1", Status: "Running", CreatedAt: createdAt, Image: "abc123"},
+	}, agents)
+}
+
+func TestServer_UnknownPool(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	client := serve(t, testPool(t, m))
+
+	_, err := client.Agents(context.Background(), "missing")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `pool not found "missing"`)
+}
+
+func TestServer_ReapAgent(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	op := mocks.NewMockOperation(t)
+	op.On("WaitContext", mock.Anything).Return(nil)
+	m.On("UpdateInstanceState", "build-pool-1", mock.MatchedBy(func(req api.InstanceStatePut) bool {
+		return req.Action == "stop" && req.Force
+	}), "").Return(op, nil)
+	client := serve(t, testPool(t, m))
+
+	require.NoError(t, client.ReapAgent(context.Background(), "build-pool", 1))
+
+	err := client.ReapAgent(context.Background(), "build-pool", 5)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid agent index 5")
+}
+
+func TestServer_AgentLogs(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	op := mocks.NewMockOperation(t)
+	op.On("WaitContext", mock.Anything).Return(nil)
+	m.On("ExecInstance", "build-pool-0", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			execArgs := args.Get(2).(*incus.InstanceExecArgs)
+			_, _ = io.WriteString(execArgs.Stdout, "Listening for Jobs\n")
+			close(execArgs.DataDone)
+		}).
+		Return(op, nil)
+	client := serve(t, testPool(t, m))
+
+	var buf bytes.Buffer
+	require.NoError(t, client.AgentLogs(context.Background(), "build-pool", 0, &buf, pool.LogOptions{}))
+	assert.Equal(t, "Listening for Jobs\n", buf.String())
+}
+
+func TestServer_AgentLogs_Options(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	op := mocks.NewMockOperation(t)
+	op.On("WaitContext", mock.Anything).Return(nil)
+	since := time.Date(2025, 1, 2, 3, 4, 0, 0, time.UTC)
+	m.On("GetInstance", "build-pool-0").Return(&api.Instance{Name: "build-pool-0", CreatedAt: since.Add(-time.Hour)}, "", nil)
+	m.On("ExecInstance", "build-pool-0", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[0] == "tail" && req.Command[2] == "3"
+	}), mock.Anything).
+		Run(func(args mock.Arguments) {
+			execArgs := args.Get(2).(*incus.InstanceExecArgs)
+			_, _ = io.WriteString(execArgs.Stdout, "2025-01-02 03:03:00Z: old\n2025-01-02 03:05:00Z: new\n")
+			close(execArgs.DataDone)
+		}).
+		Return(op, nil)
+	client := serve(t, testPool(t, m))
+
+	var buf bytes.Buffer
+	require.NoError(t, client.AgentLogs(context.Background(), "build-pool", 0, &buf, pool.LogOptions{Tail: 3, Since: since}))
+	assert.Equal(t, "2025-01-02 03:05:00Z: new\n", buf.String())
+
+	resp, err := client.do(context.Background(), http.MethodGet, "/pools/build-pool/agents/0/logs?tail=-1")
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid tail")
+}
+
+func TestServer_PoolStatus(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	p, err := pool.NewPool(m, pool.Config{
+		Name:       "build-pool",
+		AgentCount: 2,
+		Azure:      pool.AzureConfig{PAT: "pat", Url: srv.URL},
+		Incus:      pool.IncusConfig{Image: "image"},
+	})
+	require.NoError(t, err)
+	client := serve(t, p)
+
+	_, err = client.PoolStatus(context.Background(), "build-pool")
+	require.Error(t, err, "Azure errors are reported")
+
+	_, err = client.PoolStatus(context.Background(), "nope")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `pool not found "nope"`)
+}
+
+func TestServer_HoldAgent(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	client := serve(t, testPool(t, m))
+	ctx := context.Background()
+
+	release, err := client.HoldAgent(ctx, "build-pool", 1)
+	require.NoError(t, err)
+
+	// The reaper cannot stop a held agent.
+	err = client.ReapAgent(ctx, "build-pool", 1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already has an operation in flight")
+
+	release()
+	assert.Eventually(t, func() bool {
+		release, err := client.HoldAgent(ctx, "build-pool", 1)
+		if err != nil {
+			return false
+		}
+		release()
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "the hold ends when the client disconnects")
+}
+
+func TestServer_InvalidIndex(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	client := serve(t, testPool(t, m))
+
+	resp, err := client.do(context.Background(), http.MethodPost, "/pools/build-pool/agents/nope/reap")
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid agent index")
+}
+
+func TestServer_Drain(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	p := testPool(t, m)
+	client := serve(t, p)
+	ctx := context.Background()
+
+	require.NoError(t, client.DrainAgent(ctx, "build-pool", 1))
+	agents, err := client.Agents(ctx, "build-pool")
+	require.NoError(t, err)
+	assert.False(t, agents[0].Draining)
+	assert.True(t, agents[1].Draining)
+
+	require.NoError(t, client.DrainPool(ctx, "build-pool"))
+	pools, err := client.Pools(ctx)
+	require.NoError(t, err)
+	assert.True(t, pools[0].Draining)
+
+	require.NoError(t, client.CancelDrainPool(ctx, "build-pool"))
+	require.NoError(t, client.CancelDrainAgent(ctx, "build-pool", 1))
+	assert.False(t, p.Draining())
+	assert.False(t, p.AgentDraining(1))
+
+	err = client.DrainAgent(ctx, "build-pool", 9)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid agent index 9")
+}
@@ -2,6 +2,7 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"sync"
 	"time"
@@ -16,6 +17,11 @@ type Config struct {
 	ReaperInterval time.Duration `json:"reaperInterval,omitempty" default:"30s"`
 	// ReconcileInterval is how often to reconcile expected vs actual agent count. Default: 5s
 	ReconcileInterval time.Duration `json:"reconcileInterval,omitempty" default:"5s"`
+	// AutoscaleInterval is how often autoscaled pools check the Azure job queue. Default: 30s
+	AutoscaleInterval time.Duration `json:"autoscaleInterval,omitempty" default:"30s" jsonschema:"type=string"`
+	// OrphanCleanupInterval is how often to delete offline Azure agent
+	// registrations of this host that have no local instance. Default: 10m
+	OrphanCleanupInterval time.Duration `json:"orphanCleanupInterval,omitempty" default:"10m" jsonschema:"type=string"`
 	// Listener contains settings for the event listener.
 	Listener ListenerConfig `json:"listener,omitempty"`
 }
@@ -34,6 +40,12 @@ func Run(ctx context.Context, p *pool.Pool, conf Config) {
 
 	logger := slog.With("pool", p.Name(), "project", p.Project())
 
+	// Size autoscaled pools before the first reconcile so it doesn't start from
+	// the MinAgents floor when jobs are already queued.
+	if err := p.Autoscale(ctx); err != nil {
+		logger.Error("autoscale failed", "err", err)
+	}
+
 	wg.Go(func() {
 		logger.Info("starting goroutine", "type", "agent-builder")
 		for {
@@ -45,7 +57,10 @@ func Run(ctx context.Context, p *pool.Pool, conf Config) {
 
 			go func() {
 				logger.Info("creating agent", "idx", idx)
-				if err := p.CreateAgent(ctx, idx); err != nil {
+				// Refused agents are logged by the pool when it becomes degraded,
+				// and backoffs when the circuit breaker opens.
+				err := p.CreateAgent(ctx, idx)
+				if err != nil && !errors.Is(err, pool.ErrNotAdmitted) && !errors.Is(err, pool.ErrCreateBackoff) {
 					logger.Error("failed to create agent", "idx", idx, "err", err)
 					return
 				}
@@ -57,9 +72,7 @@ func Run(ctx context.Context, p *pool.Pool, conf Config) {
 		logger.Info("starting goroutine", "type", "reconciler")
 
 		// Reconcile immediate upon launch
-		if err := p.Reconcile(agentsToCreate); err != nil {
-			logger.Error("reconcile failed", "err", err)
-		}
+		reconcile(p, agentsToCreate, logger)
 
 		// Then wait for next reconcile trigger until
 		// the agentsToCreate chan is closed
@@ -73,9 +86,7 @@ func Run(ctx context.Context, p *pool.Pool, conf Config) {
 				logger.Info("exiting goroutine", "type", "reconciler")
 				return
 			case <-ticker.C:
-				if err := p.Reconcile(agentsToCreate); err != nil {
-					logger.Error("reconcile failed", "err", err)
-				}
+				reconcile(p, agentsToCreate, logger)
 			}
 		}
 	})
@@ -102,6 +113,137 @@ func Run(ctx context.Context, p *pool.Pool, conf Config) {
 		}
 	})
 
+	// The standby, autoscaler, and canary loops always run because a config
+	// reload can enable those features; each is a no-op while disabled.
+	wg.Go(func() {
+		logger.Info("starting goroutine", "type", "standby")
+		ticker := time.NewTicker(conf.ReconcileInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := p.ReconcileStandby(ctx); err != nil {
+				logger.Error("standby reconcile failed", "err", err)
+			}
+			select {
+			case <-ctx.Done():
+				logger.Info("exiting goroutine", "type", "standby")
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+
+	wg.Go(func() {
+		logger.Info("starting goroutine", "type", "autoscaler")
+		ticker := time.NewTicker(conf.AutoscaleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Info("exiting goroutine", "type", "autoscaler")
+				return
+			case <-ticker.C:
+				if err := p.Autoscale(ctx); err != nil {
+					logger.Error("autoscale failed", "err", err)
+				}
+			}
+		}
+	})
+
+	wg.Go(func() {
+		logger.Info("starting goroutine", "type", "canary")
+		ticker := time.NewTicker(conf.ReaperInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Info("exiting goroutine", "type", "canary")
+				return
+			case <-ticker.C:
+				if err := p.ObserveCanary(ctx); err != nil {
+					logger.Error("canary observation failed", "err", err)
+				}
+			}
+		}
+	})
+
+	// The job observer and log collector are no-ops unless the pool records
+	// history or archives logs.
+	wg.Go(func() {
+		logger.Info("starting goroutine", "type", "job-observer")
+		ticker := time.NewTicker(conf.ReaperInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Info("exiting goroutine", "type", "job-observer")
+				return
+			case <-ticker.C:
+				if err := p.ObserveJobs(ctx); err != nil {
+					logger.Error("job observation failed", "err", err)
+				}
+			}
+		}
+	})
+
+	wg.Go(func() {
+		logger.Info("starting goroutine", "type", "log-collector")
+		ticker := time.NewTicker(conf.ReaperInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Info("exiting goroutine", "type", "log-collector")
+				return
+			case <-ticker.C:
+				if err := p.CollectLogs(ctx); err != nil {
+					logger.Error("log collection failed", "err", err)
+				}
+			}
+		}
+	})
+
+	// A no-op unless the pool mounts cache clones.
+	wg.Go(func() {
+		logger.Info("starting goroutine", "type", "cache-cleanup")
+		ticker := time.NewTicker(conf.ReaperInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Info("exiting goroutine", "type", "cache-cleanup")
+				return
+			case <-ticker.C:
+				if err := p.CleanupCaches(ctx); err != nil {
+					logger.Error("cache cleanup failed", "err", err)
+				}
+			}
+		}
+	})
+
+	wg.Go(func() {
+		logger.Info("starting goroutine", "type", "orphan-cleanup")
+		ticker := time.NewTicker(conf.OrphanCleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Info("exiting goroutine", "type", "orphan-cleanup")
+				return
+			case <-ticker.C:
+				if _, err := p.RemoveOrphanedAgents(ctx); err != nil {
+					logger.Error("orphan cleanup failed", "err", err)
+				}
+			}
+		}
+	})
+
 	wg.Go(func() {
 		logger.Info("starting goroutine", "type", "reaper")
 
@@ -123,3 +265,21 @@ func Run(ctx context.Context, p *pool.Pool, conf Config) {
 
 	wg.Wait()
 }
+
+// reconcile pins the image and refreshes free capacity and admission control
+// for the agents created in this cycle, then queues the missing ones. A failed
+// image lookup keeps the previous fingerprint.
+func reconcile(p *pool.Pool, agentsToCreate chan<- int, logger *slog.Logger) {
+	if err := p.RefreshImage(); err != nil {
+		logger.Error("image lookup failed", "err", err)
+	}
+	if err := p.RefreshCapacity(); err != nil {
+		logger.Warn("capacity lookup failed", "err", err)
+	}
+	if err := p.RefreshAdmission(); err != nil {
+		logger.Warn("admission lookup failed", "err", err)
+	}
+	if err := p.Reconcile(agentsToCreate); err != nil {
+		logger.Error("reconcile failed", "err", err)
+	}
+}
@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+)
+
+// Supervisor runs one daemon loop per pool and applies configuration changes
+// to the set of running pools without restarting the unchanged ones.
+type Supervisor struct {
+	ctx     context.Context
+	conf    Config
+	newPool func(pool.Config) (*pool.Pool, error)
+	run     func(context.Context, *pool.Pool, Config)
+
+	mu       sync.Mutex
+	order    []string
+	running  map[string]*supervisedPool
+	draining bool
+	wg       sync.WaitGroup
+}
+
+type supervisedPool struct {
+	pool   *pool.Pool
+	conf   pool.Config
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewSupervisor returns a Supervisor whose pools run until ctx is canceled.
+// newPool builds a pool from its configuration.
+func NewSupervisor(ctx context.Context, conf Config, newPool func(pool.Config) (*pool.Pool, error)) *Supervisor {
+	return &Supervisor{
+		ctx:     ctx,
+		conf:    conf,
+		newPool: newPool,
+		run:     Run,
+		running: map[string]*supervisedPool{},
+	}
+}
+
+// Apply makes the running pools match confs. New pools are started, pools
+// missing from confs are stopped, and changed pools are reconfigured in place,
+// or replaced if the change cannot be applied to a running pool. Pools that
+// fail to start are skipped and reported in the returned error.
+func (s *Supervisor) Apply(confs []pool.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := map[string]bool{}
+	for _, cfg := range confs {
+		wanted[cfg.Name] = true
+	}
+	for name, sp := range s.running {
+		if !wanted[name] {
+			slog.Info("stopping removed pool", "pool", name)
+			s.stop(sp)
+			delete(s.running, name)
+		}
+	}
+
+	var errs []error
+	order := make([]string, 0, len(confs))
+	for _, cfg := range confs {
+		sp, exists := s.running[cfg.Name]
+		switch {
+		case !exists:
+			if err := s.start(cfg); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		case reflect.DeepEqual(sp.conf, cfg):
+		default:
+			err := sp.pool.Reconfigure(cfg)
+			if errors.Is(err, pool.ErrRestartRequired) {
+				slog.Info("restarting pool to apply configuration", "pool", cfg.Name)
+				s.stop(sp)
+				delete(s.running, cfg.Name)
+				if err := s.start(cfg); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("reconfigure pool %q: %w", cfg.Name, err))
+				continue
+			} else {
+				sp.conf = cfg
+			}
+		}
+		order = append(order, cfg.Name)
+	}
+	s.order = order
+	return errors.Join(errs...)
+}
+
+// start must be called with s.mu held.
+func (s *Supervisor) start(cfg pool.Config) error {
+	p, err := s.newPool(cfg)
+	if err != nil {
+		return fmt.Errorf("initialize pool %q: %w", cfg.Name, err)
+	}
+
+	if s.draining {
+		p.Drain()
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	sp := &supervisedPool{pool: p, conf: cfg, cancel: cancel, done: make(chan struct{})}
+	s.running[cfg.Name] = sp
+	s.wg.Go(func() {
+		defer close(sp.done)
+		s.run(ctx, p, s.conf)
+		// Whether the pool was stopped or the daemon is shutting down, its
+		// background force-stops and job lookups finish before it is gone.
+		p.Close()
+	})
+	return nil
+}
+
+// stop cancels a pool's daemon loop and waits for it to exit and close. Agents
+// that are already running are left alone; they finish their job and are not
+// replaced.
+func (s *Supervisor) stop(sp *supervisedPool) {
+	sp.cancel()
+	<-sp.done
+}
+
+// Pools returns the running pools in configuration order.
+func (s *Supervisor) Pools() []*pool.Pool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pools := make([]*pool.Pool, 0, len(s.order))
+	for _, name := range s.order {
+		pools = append(pools, s.running[name].pool)
+	}
+	return pools
+}
+
+// Drain drains every pool, including pools started by later calls to Apply,
+// and blocks until all of them are drained or ctx is canceled. Pools are
+// checked every interval.
+func (s *Supervisor) Drain(ctx context.Context, interval time.Duration) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		drained := true
+		for _, p := range s.Pools() {
+			p.Drain()
+			done, err := p.Drained()
+			if err != nil {
+				slog.Warn("error checking drain progress", "pool", p.Name(), "err", err)
+			}
+			drained = drained && done
+		}
+		if drained {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Wait blocks until every pool has stopped and closed, which happens once the
+// context passed to NewSupervisor is canceled.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
@@ -0,0 +1,191 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/sklarsa/incus-azure-pipelines/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func poolConfig(name string, agents int) pool.Config {
+	return pool.Config{
+		Name:       name,
+		AgentCount: agents,
+		Azure:      pool.AzureConfig{PAT: "pat", Url: "https://dev.azure.com/org"},
+		Incus:      pool.IncusConfig{Image: "image"},
+	}
+}
+
+// fakeRuns replaces the daemon loop with one that records which pools are
+// running and blocks until its context is canceled.
+type fakeRuns struct {
+	mu      sync.Mutex
+	started []string
+	running map[*pool.Pool]bool
+}
+
+func newTestSupervisor(t *testing.T) (*Supervisor, *fakeRuns, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	m := mocks.NewMockInstanceServer(t)
+	s := NewSupervisor(ctx, Config{}, func(cfg pool.Config) (*pool.Pool, error) {
+		return pool.NewPool(m, cfg)
+	})
+
+	runs := &fakeRuns{running: map[*pool.Pool]bool{}}
+	s.run = func(ctx context.Context, p *pool.Pool, _ Config) {
+		runs.mu.Lock()
+		runs.started = append(runs.started, p.Name())
+		runs.running[p] = true
+		runs.mu.Unlock()
+
+		<-ctx.Done()
+
+		runs.mu.Lock()
+		delete(runs.running, p)
+		runs.mu.Unlock()
+	}
+	t.Cleanup(func() {
+		cancel()
+		s.Wait()
+	})
+	return s, runs, cancel
+}
+
+func (r *fakeRuns) isRunning(p *pool.Pool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running[p]
+}
+
+func names(pools []*pool.Pool) []string {
+	out := []string{}
+	for _, p := range pools {
+		out = append(out, p.Name())
+	}
+	return out
+}
+
+func TestSupervisor_StartsAndStopsPools(t *testing.T) {
+	s, runs, _ := newTestSupervisor(t)
+
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("a", 1), poolConfig("b", 1)}))
+	assert.Equal(t, []string{"a", "b"}, names(s.Pools()))
+	a := s.Pools()[0]
+	b := s.Pools()[1]
+	assert.Eventually(t, func() bool { return runs.isRunning(a) && runs.isRunning(b) }, time.Second, time.Millisecond)
+
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("b", 1), poolConfig("c", 1)}))
+	assert.Equal(t, []string{"b", "c"}, names(s.Pools()))
+	assert.False(t, runs.isRunning(a), "removed pool is stopped before Apply returns")
+	assert.Same(t, b, s.Pools()[0], "unchanged pool keeps running")
+}
+
+func TestSupervisor_ReconfiguresInPlace(t *testing.T) {
+	s, runs, _ := newTestSupervisor(t)
+
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("a", 3)}))
+	p := s.Pools()[0]
+	require.Eventually(t, func() bool { return runs.isRunning(p) }, time.Second, time.Millisecond)
+
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("a", 1)}))
+	assert.Same(t, p, s.Pools()[0])
+	assert.Equal(t, 1, p.DesiredAgents())
+
+	runs.mu.Lock()
+	defer runs.mu.Unlock()
+	assert.Equal(t, []string{"a"}, runs.started, "pool loop is not restarted")
+}
+
+func TestSupervisor_RestartsPoolWhenRequired(t *testing.T) {
+	s, runs, _ := newTestSupervisor(t)
+
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("a", 1)}))
+	old := s.Pools()[0]
+
+	changed := poolConfig("a", 1)
+	changed.Incus.VM = true
+	require.NoError(t, s.Apply([]pool.Config{changed}))
+
+	replacement := s.Pools()[0]
+	assert.NotSame(t, old, replacement)
+	assert.Eventually(t, func() bool { return runs.isRunning(replacement) }, time.Second, time.Millisecond)
+	assert.False(t, runs.isRunning(old))
+}
+
+func TestSupervisor_SkipsPoolsThatFailToStart(t *testing.T) {
+	s, _, _ := newTestSupervisor(t)
+
+	bad := poolConfig("bad(", 1)
+	err := s.Apply([]pool.Config{bad, poolConfig("good", 1)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `initialize pool "bad("`)
+	assert.Equal(t, []string{"good"}, names(s.Pools()))
+}
+
+func TestSupervisor_StopsOnCancel(t *testing.T) {
+	s, runs, cancel := newTestSupervisor(t)
+
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("a", 1)}))
+	p := s.Pools()[0]
+
+	cancel()
+	s.Wait()
+	assert.False(t, runs.isRunning(p))
+}
+
+// uptimeDesc collides with the uptime collector a pool registers until the
+// pool is closed.
+type uptimeDesc string
+
+func (d uptimeDesc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prometheus.NewDesc("iap_agent_uptime", "Time (in seconds) an agent is up and running",
+		[]string{"idx", "image"}, prometheus.Labels{"pool": string(d)})
+}
+
+func (uptimeDesc) Collect(chan<- prometheus.Metric) {}
+
+func TestSupervisor_ClosesPoolsOnShutdown(t *testing.T) {
+	s, _, cancel := newTestSupervisor(t)
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("closed-on-shutdown", 1)}))
+
+	probe := uptimeDesc("closed-on-shutdown")
+	var are prometheus.AlreadyRegisteredError
+	require.ErrorAs(t, prometheus.DefaultRegisterer.Register(probe), &are)
+
+	cancel()
+	s.Wait()
+	require.NoError(t, prometheus.DefaultRegisterer.Register(probe))
+	prometheus.DefaultRegisterer.Unregister(probe)
+}
+
+func TestSupervisor_Drain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := mocks.NewMockInstanceServer(t)
+	s := NewSupervisor(ctx, Config{}, func(cfg pool.Config) (*pool.Pool, error) {
+		return pool.NewPool(m, cfg)
+	})
+	s.run = func(ctx context.Context, _ *pool.Pool, _ Config) { <-ctx.Done() }
+	t.Cleanup(func() {
+		cancel()
+		s.Wait()
+	})
+
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "a-0"}}, nil).Once()
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("a", 1)}))
+
+	require.NoError(t, s.Drain(context.Background(), time.Millisecond))
+	assert.True(t, s.Pools()[0].Draining())
+	m.AssertNumberOfCalls(t, "GetInstances", 2)
+
+	require.NoError(t, s.Apply([]pool.Config{poolConfig("a", 1), poolConfig("b", 1)}))
+	assert.True(t, s.Pools()[1].Draining(), "pools added while draining start drained")
+}
@@ -0,0 +1,111 @@
+// Package history keeps a local record of every agent instance the daemon ran
+// and the Azure job it ran, so jobs can be traced back to instances after the
+// ephemeral instances are gone.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Why an agent instance went away.
+const (
+	// ExitPoweroff means the agent powered off on its own, normally after its job.
+	ExitPoweroff = "poweroff"
+	// ExitReaped means the daemon or an operator stopped the instance.
+	ExitReaped = "reaped"
+	// ExitCreateError means the instance could not be created or started.
+	ExitCreateError = "createError"
+)
+
+// Record describes one agent instance lifetime.
+type Record struct {
+	Pool     string `json:"pool"`
+	Instance string `json:"instance"`
+	Index    int    `json:"index"`
+	// Remote is where the instance ran, for pools on more than one remote.
+	Remote string `json:"remote,omitempty"`
+	// Image is the fingerprint, or alias when unresolved, the instance was created from.
+	Image string `json:"image,omitempty"`
+	// JobID is the Azure job request the agent ran, if it ran one.
+	JobID    int64  `json:"jobId,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+	// CreatedAt is when the instance was started, JobSeenAt when the daemon first
+	// saw the job assigned, and EndedAt when the instance went away.
+	CreatedAt  time.Time `json:"createdAt"`
+	JobSeenAt  time.Time `json:"jobSeenAt,omitzero"`
+	EndedAt    time.Time `json:"endedAt"`
+	ExitReason string    `json:"exitReason"`
+	// Detail explains the exit reason, such as why an instance was reaped.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Log appends records to a JSONL file. It is safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewLog returns a log that writes to path. The file and its directory are
+// created on the first append.
+func NewLog(path string) *Log {
+	return &Log{path: path}
+}
+
+// Append writes r as one line.
+func (l *Log) Append(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns every record in the file at path, oldest first. A missing file
+// has no records.
+func Read(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,59 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_AppendAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "history.jsonl")
+	log := NewLog(path)
+	created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	first := Record{
+		Pool:       "build",
+		Instance:   "build-0",
+		Index:      0,
+		Image:      "fp-1",
+		JobID:      12345,
+		Pipeline:   "ci",
+		CreatedAt:  created,
+		JobSeenAt:  created.Add(time.Minute),
+		EndedAt:    created.Add(10 * time.Minute),
+		ExitReason: ExitPoweroff,
+	}
+	second := Record{
+		Pool:       "build",
+		Instance:   "build-1",
+		Index:      1,
+		CreatedAt:  created,
+		EndedAt:    created,
+		ExitReason: ExitCreateError,
+		Detail:     "image not found",
+	}
+	require.NoError(t, log.Append(first))
+	require.NoError(t, log.Append(second))
+
+	records, err := Read(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Record{first, second}, records)
+}
+
+func TestRead_MissingFile(t *testing.T) {
+	records, err := Read(filepath.Join(t.TempDir(), "history.jsonl"))
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestRead_MalformedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte("{\"pool\":\"build\"}\n{\"pool\":\n"), 0o644))
+
+	_, err := Read(path)
+	assert.ErrorContains(t, err, "history.jsonl:2")
+}
@@ -0,0 +1,606 @@
+// Package mirror is a pull-through cache of a Docker registry. Agents use it
+// as their registry mirror, so the images their jobs pull are downloaded from
+// the upstream registry once per host instead of once per job.
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// pruneInterval is how often cached content older than MaxAge is deleted.
+const pruneInterval = time.Hour
+
+// Config contains settings for the registry mirror.
+type Config struct {
+	// Listen is the address the mirror serves on, for example the address of the
+	// Incus bridge and a port. Agents must be able to reach it. The mirror has no
+	// authentication, so it should not be reachable from anywhere else.
+	Listen string `json:"listen" validate:"required,hostname_port"`
+	// Dir is where blobs and manifests are cached.
+	// Default: /var/lib/incus-azure-pipelines/registry
+	Dir string `json:"dir,omitempty" default:"/var/lib/incus-azure-pipelines/registry"`
+	// Upstream is the registry to mirror. Default: https://registry-1.docker.io
+	Upstream string `json:"upstream,omitempty" default:"https://registry-1.docker.io" validate:"omitempty,url"`
+	// MaxAge is how long cached content is kept after it was last served.
+	// Default: 720h (30 days)
+	MaxAge time.Duration `json:"maxAge,omitempty" default:"720h" validate:"min=0" jsonschema:"type=string"`
+}
+
+var (
+	// nameRe matches repository names, which may not contain ".." or empty
+	// components, so they are safe to use as paths.
+	nameRe   = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRe    = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+	digestRe = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+var requestsMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_registry_mirror_requests",
+		Help: "Count of manifest and blob requests to the registry mirror, by whether they were served from the cache (hit), the upstream registry (miss) or failed (error)",
+	},
+	[]string{"type", "result"},
+)
+
+var bytesMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_registry_mirror_bytes",
+		Help: "Bytes of blobs the registry mirror served, by whether they came from the cache (hit) or the upstream registry (miss)",
+	},
+	[]string{"result"},
+)
+
+var cacheSizeMetric = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "iap_registry_mirror_cache_bytes",
+		Help: "Size of the registry mirror cache after the last prune",
+	},
+)
+
+// Mirror serves the pull side of the registry API, caching what it fetches
+// from upstream. Blobs and manifests are cached by digest, so they never go
+// stale. Tags are resolved upstream with a HEAD request, which Docker Hub does
+// not count against its pull rate limit, and fall back to the last digest seen
+// while upstream is unreachable.
+type Mirror struct {
+	conf     Config
+	upstream string
+	client   *http.Client
+	logger   *slog.Logger
+	now      func() time.Time
+
+	tokenMu sync.Mutex
+	tokens  map[string]token
+}
+
+// token is a bearer token for a scope of the upstream registry.
+type token struct {
+	value   string
+	expires time.Time
+}
+
+func New(conf Config) *Mirror {
+	return &Mirror{
+		conf:     conf,
+		upstream: strings.TrimSuffix(conf.Upstream, "/"),
+		client:   &http.Client{Timeout: 30 * time.Minute},
+		logger:   slog.With("component", "registry-mirror"),
+		now:      time.Now,
+		tokens:   map[string]token{},
+	}
+}
+
+// ListenAndServe serves the mirror on conf.Listen and prunes its cache until
+// ctx is done.
+func (m *Mirror) ListenAndServe(ctx context.Context) error {
+	// Partial downloads are left behind when the daemon stops mid-transfer.
+	if err := os.RemoveAll(m.path("tmp")); err != nil {
+		return err
+	}
+	for _, dir := range []string{"blobs", "manifests", "tags", "tmp"} {
+		if err := os.MkdirAll(m.path(dir), 0o755); err != nil {
+			return err
+		}
+	}
+
+	server := &http.Server{Addr: m.conf.Listen, Handler: m}
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			m.prune()
+			select {
+			case <-ctx.Done():
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := server.Shutdown(shutdownCtx); err != nil {
+					m.logger.Error("error shutting down registry mirror", "err", err)
+				}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	m.logger.Info("binding registry mirror", "listen", m.conf.Listen, "upstream", m.upstream)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry mirror is read-only")
+		return
+	}
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, "{}")
+		return
+	}
+
+	name, kind, ref, ok := parsePath(r.URL.Path)
+	if !ok || !nameRe.MatchString(name) {
+		writeError(w, http.StatusNotFound, "NAME_INVALID", "invalid repository name")
+		return
+	}
+	switch {
+	case kind == "blobs" && digestRe.MatchString(ref):
+		m.serveBlob(w, r, name, ref)
+	case kind == "manifests" && (digestRe.MatchString(ref) || tagRe.MatchString(ref)):
+		m.serveManifest(w, r, name, ref)
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unsupported reference")
+	}
+}
+
+// parsePath splits /v2/<name>/<kind>/<ref>, where the name may contain slashes.
+func parsePath(path string) (name, kind, ref string, ok bool) {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return "", "", "", false
+	}
+	for _, k := range []string{"manifests", "blobs"} {
+		if i := strings.LastIndex(rest, "/"+k+"/"); i > 0 {
+			return rest[:i], k, rest[i+len(k)+2:], true
+		}
+	}
+	return "", "", "", false
+}
+
+func (m *Mirror) serveBlob(w http.ResponseWriter, r *http.Request, name, digest string) {
+	path := m.path("blobs", digest)
+	if size, ok := m.serveCached(w, r, path, "application/octet-stream", digest); ok {
+		requestsMetric.WithLabelValues("blob", "hit").Inc()
+		if r.Method == http.MethodGet {
+			bytesMetric.WithLabelValues("hit").Add(float64(size))
+		}
+		return
+	}
+
+	resp, err := m.fetch(r.Context(), r.Method, name, "blobs/"+digest, r.Header)
+	if err != nil {
+		m.fail(w, "blob", name, digest, err)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		requestsMetric.WithLabelValues("blob", "error").Inc()
+		relay(w, resp)
+		return
+	}
+	requestsMetric.WithLabelValues("blob", "miss").Inc()
+
+	copyHeaders(w, resp, "Content-Length", "Content-Type")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	cache, err := m.newCacheFile()
+	if err != nil {
+		m.logger.Warn("unable to cache blob", "digest", digest, "err", err)
+	}
+	n, err := io.Copy(w, io.TeeReader(resp.Body, cache))
+	bytesMetric.WithLabelValues("miss").Add(float64(n))
+	if err == nil && (resp.ContentLength < 0 || n == resp.ContentLength) {
+		cache.commit(path, digest, m.logger)
+	} else {
+		cache.abort()
+	}
+}
+
+func (m *Mirror) serveManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	digest := ref
+	if !digestRe.MatchString(ref) {
+		var ok bool
+		if digest, ok = m.resolveTag(w, r, name, ref); !ok {
+			return
+		}
+	}
+
+	path := m.path("manifests", digest)
+	mediaType, _ := os.ReadFile(path + ".type")
+	if len(mediaType) > 0 {
+		if _, ok := m.serveCached(w, r, path, string(mediaType), digest); ok {
+			requestsMetric.WithLabelValues("manifest", "hit").Inc()
+			return
+		}
+	}
+
+	// Fetch by digest, so a tag that moves in between cannot return a
+	// different manifest.
+	resp, err := m.fetch(r.Context(), http.MethodGet, name, "manifests/"+digest, r.Header)
+	if err != nil {
+		m.fail(w, "manifest", name, ref, err)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		requestsMetric.WithLabelValues("manifest", "error").Inc()
+		relay(w, resp)
+		return
+	}
+	// Manifests are small; the limit keeps a broken upstream from filling memory.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		m.fail(w, "manifest", name, ref, err)
+		return
+	}
+	requestsMetric.WithLabelValues("manifest", "miss").Inc()
+
+	sum := sha256.Sum256(body)
+	actual := "sha256:" + hex.EncodeToString(sum[:])
+	if actual != digest {
+		m.logger.Warn("upstream manifest does not match its digest, not caching it", "name", name, "ref", ref, "digest", actual)
+	} else {
+		m.storeManifest(actual, resp.Header.Get("Content-Type"), body)
+	}
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.Header().Set("Docker-Content-Digest", actual)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+// resolveTag returns the digest of a tag. It asks upstream first and falls back
+// to the last digest it saw for the tag. It writes the response and returns
+// false when the tag cannot be resolved.
+func (m *Mirror) resolveTag(w http.ResponseWriter, r *http.Request, name, tag string) (string, bool) {
+	resp, err := m.fetch(r.Context(), http.MethodHead, name, "manifests/"+tag, r.Header)
+	if err == nil {
+		_ = resp.Body.Close()
+		if digest := resp.Header.Get("Docker-Content-Digest"); resp.StatusCode == http.StatusOK && digestRe.MatchString(digest) {
+			m.storeTag(name, tag, digest)
+			return digest, true
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			requestsMetric.WithLabelValues("manifest", "error").Inc()
+			relay(w, resp)
+			return "", false
+		}
+		err = fmt.Errorf("upstream returned %s", resp.Status)
+	}
+
+	data, _ := os.ReadFile(m.tagPath(name, tag))
+	if digest := string(data); digestRe.MatchString(digest) {
+		m.logger.Warn("unable to resolve tag upstream, using the cached digest", "name", name, "tag", tag, "digest", digest, "err", err)
+		return digest, true
+	}
+	m.fail(w, "manifest", name, tag, err)
+	return "", false
+}
+
+// serveCached serves the cached file at path, if there is one, and marks it as
+// used so it is not pruned. It returns the size of the file.
+func (m *Mirror) serveCached(w http.ResponseWriter, r *http.Request, path, contentType, digest string) (int64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+	now := m.now()
+	_ = os.Chtimes(path, now, now)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Etag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", time.Time{}, f)
+	return info.Size(), true
+}
+
+// fetch sends a request to upstream, authenticating with a bearer token when
+// upstream asks for one.
+func (m *Mirror) fetch(ctx context.Context, method, name, path string, header http.Header) (*http.Response, error) {
+	scope := "repository:" + name + ":pull"
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, m.upstream+"/v2/"+name+"/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header["Accept"] = header.Values("Accept")
+		if t := m.token(scope); t != "" {
+			req.Header.Set("Authorization", "Bearer "+t)
+		}
+		return m.client.Do(req)
+	}
+
+	resp, err := do()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_ = resp.Body.Close()
+	if err := m.authenticate(ctx, challenge, scope); err != nil {
+		return nil, err
+	}
+	return do()
+}
+
+func (m *Mirror) token(scope string) string {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	t := m.tokens[scope]
+	if m.now().After(t.expires) {
+		return ""
+	}
+	return t.value
+}
+
+// authenticate gets an anonymous pull token for scope from the token server
+// named by a Bearer challenge.
+func (m *Mirror) authenticate(ctx context.Context, challenge, scope string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported upstream authentication %q", scheme)
+	}
+	values := parseChallenge(params)
+	realm, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return fmt.Errorf("invalid upstream authentication realm %q", values["realm"])
+	}
+	query := realm.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("get upstream token: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get upstream token: %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decode upstream token: %w", err)
+	}
+	t := token{value: body.Token, expires: m.now().Add(time.Duration(max(body.ExpiresIn, 60)-10) * time.Second)}
+	if t.value == "" {
+		t.value = body.AccessToken
+	}
+
+	m.tokenMu.Lock()
+	m.tokens[scope] = t
+	m.tokenMu.Unlock()
+	return nil
+}
+
+// parseChallenge parses the key="value" pairs of a WWW-Authenticate header.
+func parseChallenge(params string) map[string]string {
+	values := map[string]string{}
+	for _, match := range challengeRe.FindAllStringSubmatch(params, -1) {
+		values[strings.ToLower(match[1])] = match[2]
+	}
+	return values
+}
+
+var challengeRe = regexp.MustCompile(`([a-zA-Z]+)="([^"]*)"`)
+
+func (m *Mirror) fail(w http.ResponseWriter, kind, name, ref string, err error) {
+	requestsMetric.WithLabelValues(kind, "error").Inc()
+	m.logger.Error("unable to fetch from upstream", "type", kind, "name", name, "ref", ref, "err", err)
+	writeError(w, http.StatusBadGateway, "UNAVAILABLE", "upstream registry unavailable")
+}
+
+func (m *Mirror) path(elem ...string) string {
+	return filepath.Join(append([]string{m.conf.Dir}, elem...)...)
+}
+
+// tagPath keeps tags apart from the repositories nested in name, since no
+// repository name component starts with an underscore.
+func (m *Mirror) tagPath(name, tag string) string {
+	return m.path("tags", filepath.FromSlash(name), "_tags", tag)
+}
+
+func (m *Mirror) storeManifest(digest, mediaType string, body []byte) {
+	path := m.path("manifests", digest)
+	err := writeFile(m.path("tmp"), path+".type", []byte(mediaType))
+	if err == nil {
+		err = writeFile(m.path("tmp"), path, body)
+	}
+	if err != nil {
+		m.logger.Warn("unable to cache manifest", "digest", digest, "err", err)
+	}
+}
+
+func (m *Mirror) storeTag(name, tag, digest string) {
+	path := m.tagPath(name, tag)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		err = writeFile(m.path("tmp"), path, []byte(digest))
+	}
+	if err != nil {
+		m.logger.Warn("unable to cache tag", "name", name, "tag", tag, "err", err)
+	}
+}
+
+// writeFile writes data to path through a temporary file in tmp, so a reader
+// never sees a partial file.
+func writeFile(tmp, path string, data []byte) error {
+	f, err := os.CreateTemp(tmp, "file-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// cacheFile receives a blob while it is sent to the client. Write errors do not
+// interrupt the client; they only keep the blob out of the cache.
+type cacheFile struct {
+	f   *os.File
+	h   hash.Hash
+	err error
+}
+
+func (m *Mirror) newCacheFile() (*cacheFile, error) {
+	f, err := os.CreateTemp(m.path("tmp"), "blob-")
+	return &cacheFile{f: f, h: sha256.New(), err: err}, err
+}
+
+func (c *cacheFile) Write(p []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.f.Write(p)
+		c.h.Write(p)
+	}
+	return len(p), nil
+}
+
+// commit moves the blob into the cache if its content matches digest.
+func (c *cacheFile) commit(path, digest string, logger *slog.Logger) {
+	if c.f == nil {
+		return
+	}
+	err := c.err
+	if closeErr := c.f.Close(); err == nil {
+		err = closeErr
+	}
+	if actual := "sha256:" + hex.EncodeToString(c.h.Sum(nil)); err == nil && actual != digest {
+		err = fmt.Errorf("content has digest %s", actual)
+	}
+	if err == nil {
+		err = os.Rename(c.f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(c.f.Name())
+		logger.Warn("unable to cache blob", "digest", digest, "err", err)
+	}
+}
+
+func (c *cacheFile) abort() {
+	if c.f == nil {
+		return
+	}
+	_ = c.f.Close()
+	_ = os.Remove(c.f.Name())
+}
+
+// prune deletes cached blobs, manifests and tags that were not used for MaxAge,
+// and records the size of what is left. The media type of a manifest goes with
+// it.
+func (m *Mirror) prune() {
+	cutoff := m.now().Add(-m.conf.MaxAge)
+	var size int64
+	var removed int
+	for _, dir := range []string{"blobs", "manifests", "tags"} {
+		err := filepath.WalkDir(m.path(dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil || strings.HasSuffix(path, ".type") {
+				return nil
+			}
+			if m.conf.MaxAge > 0 && info.ModTime().Before(cutoff) {
+				if err := os.Remove(path); err == nil {
+					_ = os.Remove(path + ".type")
+					removed++
+					return nil
+				}
+			}
+			size += info.Size()
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			m.logger.Error("unable to prune registry mirror cache", "dir", dir, "err", err)
+		}
+	}
+	cacheSizeMetric.Set(float64(size))
+	if removed > 0 {
+		m.logger.Info("pruned registry mirror cache", "removed", removed, "size", size)
+	}
+}
+
+func copyHeaders(w http.ResponseWriter, resp *http.Response, keys ...string) {
+	for _, key := range keys {
+		if v := resp.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+}
+
+// relay passes an upstream error response on to the client.
+func relay(w http.ResponseWriter, resp *http.Response) {
+	copyHeaders(w, resp, "Content-Type")
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
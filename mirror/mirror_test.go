@@ -0,0 +1,235 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const manifestType = "application/vnd.oci.image.manifest.v1+json"
+
+func digestOf(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fakeRegistry is an upstream registry that requires an anonymous bearer
+// token, like Docker Hub. It counts the requests that carry the token.
+type fakeRegistry struct {
+	*httptest.Server
+	mu       sync.Mutex
+	blobs    map[string]string
+	manifest string
+	down     bool
+	requests map[string]int
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	t.Helper()
+	f := &fakeRegistry{
+		blobs:    map[string]string{},
+		manifest: `{"schemaVersion": 2}`,
+		requests: map[string]int{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.URL.Path == "/token" {
+			f.requests["token"]++
+			assert.Equal(t, "repository:library/alpine:pull", r.URL.Query().Get("scope"))
+			assert.Equal(t, "registry.test", r.URL.Query().Get("service"))
+			_, _ = io.WriteString(w, `{"token": "secret", "expires_in": 300}`)
+			return
+		}
+		if f.down {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, f.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.requests[r.Method+" "+r.URL.Path]++
+
+		switch {
+		case r.URL.Path == "/v2/library/alpine/manifests/latest" || r.URL.Path == "/v2/library/alpine/manifests/"+digestOf(f.manifest):
+			w.Header().Set("Content-Type", manifestType)
+			w.Header().Set("Docker-Content-Digest", digestOf(f.manifest))
+			if r.Method == http.MethodGet {
+				_, _ = io.WriteString(w, f.manifest)
+			}
+		case strings.HasPrefix(r.URL.Path, "/v2/library/alpine/blobs/"):
+			blob, ok := f.blobs[strings.TrimPrefix(r.URL.Path, "/v2/library/alpine/blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = io.WriteString(w, blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRegistry) count(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[key]
+}
+
+func newTestMirror(t *testing.T, upstream string) *Mirror {
+	t.Helper()
+	m := New(Config{Dir: t.TempDir(), Upstream: upstream, MaxAge: time.Hour})
+	for _, dir := range []string{"blobs", "manifests", "tags", "tmp"} {
+		require.NoError(t, os.MkdirAll(m.path(dir), 0o755))
+	}
+	return m
+}
+
+func get(t *testing.T, m *Mirror, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func counterValue(t *testing.T, c interface{ Write(*dto.Metric) error }) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, c.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestMirror_Blob(t *testing.T) {
+	upstream := newFakeRegistry(t)
+	blob := "layer data"
+	upstream.blobs[digestOf(blob)] = blob
+	m := newTestMirror(t, upstream.URL)
+	path := "/v2/library/alpine/blobs/" + digestOf(blob)
+	hits := counterValue(t, requestsMetric.WithLabelValues("blob", "hit"))
+	misses := counterValue(t, requestsMetric.WithLabelValues("blob", "miss"))
+	hitBytes := counterValue(t, bytesMetric.WithLabelValues("hit"))
+
+	w := get(t, m, path)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, blob, w.Body.String())
+	assert.Equal(t, digestOf(blob), w.Header().Get("Docker-Content-Digest"))
+
+	w = get(t, m, path)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, blob, w.Body.String())
+
+	assert.Equal(t, 1, upstream.count("GET "+path))
+	assert.Equal(t, 1, upstream.count("token"))
+	assert.Equal(t, 1.0, counterValue(t, requestsMetric.WithLabelValues("blob", "miss"))-misses)
+	assert.Equal(t, 1.0, counterValue(t, requestsMetric.WithLabelValues("blob", "hit"))-hits)
+	assert.Equal(t, float64(len(blob)), counterValue(t, bytesMetric.WithLabelValues("hit"))-hitBytes)
+}
+
+func TestMirror_Blob_DigestMismatchNotCached(t *testing.T) {
+	upstream := newFakeRegistry(t)
+	digest := digestOf("expected")
+	upstream.blobs[digest] = "tampered"
+	m := newTestMirror(t, upstream.URL)
+
+	get(t, m, "/v2/library/alpine/blobs/"+digest)
+	_, err := os.Stat(m.path("blobs", digest))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	entries, err := os.ReadDir(m.path("tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestMirror_ManifestByTag(t *testing.T) {
+	upstream := newFakeRegistry(t)
+	m := newTestMirror(t, upstream.URL)
+	path := "/v2/library/alpine/manifests/latest"
+
+	for range 2 {
+		w := get(t, m, path)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, upstream.manifest, w.Body.String())
+		assert.Equal(t, manifestType, w.Header().Get("Content-Type"))
+		assert.Equal(t, digestOf(upstream.manifest), w.Header().Get("Docker-Content-Digest"))
+	}
+	// The tag is resolved with a HEAD every time, and the manifest is only
+	// downloaded once.
+	assert.Equal(t, 2, upstream.count("HEAD "+path))
+	assert.Equal(t, 1, upstream.count("GET /v2/library/alpine/manifests/"+digestOf(upstream.manifest)))
+
+	// While upstream refuses, the last digest of the tag is served.
+	upstream.down = true
+	w := get(t, m, path)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, upstream.manifest, w.Body.String())
+
+	w = get(t, m, "/v2/library/alpine/manifests/edge")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestMirror_RejectsInvalidRequests(t *testing.T) {
+	m := newTestMirror(t, "http://127.0.0.1:0")
+
+	w := get(t, m, "/v2/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "registry/2.0", w.Header().Get("Docker-Distribution-API-Version"))
+
+	for _, path := range []string{
+		"/v2/../etc/manifests/latest",
+		"/v2/library/alpine/blobs/latest",
+		"/v2/library/alpine/tags/list",
+	} {
+		assert.Equal(t, http.StatusNotFound, get(t, m, path).Code, path)
+	}
+
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v2/library/alpine/manifests/latest", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestMirror_Prune(t *testing.T) {
+	m := newTestMirror(t, "http://127.0.0.1:0")
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	old, fresh := digestOf("old"), digestOf("fresh")
+	m.storeManifest(old, manifestType, []byte("old"))
+	m.storeManifest(fresh, manifestType, []byte("fresh"))
+	require.NoError(t, os.Chtimes(m.path("manifests", old), now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+
+	m.prune()
+	_, err := os.Stat(m.path("manifests", old))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(m.path("manifests", old) + ".type")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(m.path("manifests", fresh))
+	assert.NoError(t, err)
+}
+
+func TestParsePath(t *testing.T) {
+	name, kind, ref, ok := parsePath("/v2/my/nested/repo/manifests/v1.2")
+	require.True(t, ok)
+	assert.Equal(t, "my/nested/repo", name)
+	assert.Equal(t, "manifests", kind)
+	assert.Equal(t, "v1.2", ref)
+
+	_, _, _, ok = parsePath("/v2/manifests/latest")
+	assert.False(t, ok)
+	assert.Equal(t, filepath.Join(os.TempDir(), "tags", "a", "b", "_tags", "c"),
+		(&Mirror{conf: Config{Dir: os.TempDir()}}).tagPath("a/b", "c"))
+}
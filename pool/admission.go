@@ -0,0 +1,394 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// ErrNotAdmitted is returned by CreateAgent when admission control refuses to
+// create an agent because the image is missing or the host has no room.
+var ErrNotAdmitted = errors.New("agent creation refused")
+
+// admission is what the pool knows about its image and host capacity since the
+// last RefreshAdmission. Missing values mean unknown, and unknown checks pass.
+type admission struct {
+	refreshed bool
+	// missing maps the images new agents use that cannot be found on some
+	// remote, as fingerprints or aliases, to why.
+	missing map[string]string
+	// total is the memory of every placement. free is its available memory
+	// and storage the free space in the storage pool agents are created in,
+	// both less what the agents admitted since the last refresh may use.
+	total   map[placement]int64
+	free    map[placement]int64
+	storage map[placement]int64
+	// agents maps the indices that had an instance at the last refresh to
+	// where it lives, and admitted the agents being created to where admit
+	// placed them.
+	agents   map[int]placement
+	admitted map[int]placement
+	// degraded is why the last agent was refused, or empty.
+	degraded string
+}
+
+// RefreshAdmission checks that the images new agents use exist on every
+// remote, and records the memory and free storage of every placement along
+// with where the agents run. CreateAgent refuses agents that would not fit.
+// Checks whose data cannot be queried are skipped until the next refresh.
+func (p *Pool) RefreshAdmission() error {
+	conf := p.config()
+	a := admission{
+		refreshed: true,
+		total:     map[placement]int64{},
+		free:      map[placement]int64{},
+		storage:   map[placement]int64{},
+		agents:    map[int]placement{},
+		admitted:  map[int]placement{},
+	}
+	var errs []error
+
+	a.missing = p.missingImages()
+
+	instances, err := p.listInstances()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("list instances: %w", err))
+	}
+	for _, i := range instances {
+		if idx, err := p.agentIndex(i.Name); err == nil {
+			a.agents[idx] = p.placementOf(i)
+		}
+	}
+
+	if conf.Incus.MaxRamInGb > 0 {
+		for _, pl := range p.placements {
+			total, err := p.totalMemory(pl)
+			if err == nil {
+				a.total[pl] = total
+				a.free[pl], err = p.freeMemory(pl)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("query memory on %s: %w", p.label(pl), err))
+				delete(a.total, pl)
+			}
+		}
+	}
+
+	// Only VM pools size their root disk; container disks grow as they are used.
+	if conf.Incus.VM && conf.Incus.DiskSizeInGb > 0 {
+		for _, pl := range p.placements {
+			bytes, err := p.freeStorage(pl, conf.Incus)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("query storage on %s: %w", p.label(pl), err))
+				continue
+			}
+			a.storage[pl] = bytes
+		}
+	}
+
+	p.admitMu.Lock()
+	a.degraded = p.admission.degraded
+	// Agents still being created keep the placement they were admitted to.
+	for idx, pl := range p.admission.admitted {
+		if _, creating := p.inFlight.Load(idx); creating {
+			a.admitted[idx] = pl
+		}
+	}
+	p.admission = a
+	p.admitMu.Unlock()
+
+	// The pool stays degraded until an agent is admitted again, or no agent
+	// is missing anymore.
+	switch {
+	case len(a.missing) > 0:
+		images := slices.Sorted(maps.Keys(a.missing))
+		p.setDegraded(a.missing[images[0]])
+	case err == nil && !p.missingAgents(a.agents):
+		p.setDegraded("")
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Pool) missingAgents(agents map[int]placement) bool {
+	for idx := range p.DesiredAgents() {
+		if _, exists := agents[idx]; !exists && !p.AgentDraining(idx) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingImages returns the images new agents are created from that cannot be
+// found on every remote, with why. A canary rollout uses two.
+func (p *Pool) missingImages() map[string]string {
+	missing := map[string]string{}
+	for _, idx := range []int{0, -1} {
+		source, _ := p.imageSource(idx)
+		image := sourceLabel(source)
+		if _, checked := missing[image]; checked {
+			continue
+		}
+		for _, remote := range p.remotes {
+			err := imageExists(remote.Server, source)
+			if api.StatusErrorCheck(err, http.StatusNotFound) {
+				missing[image] = p.imageNotFound(image, remote.Name)
+				break
+			}
+			if err != nil {
+				p.logger.Warn("unable to check image", "image", image, "remote", remote.Name, "err", err)
+			}
+		}
+	}
+	return missing
+}
+
+// imageExists checks that the image of source is on server.
+func imageExists(server incus.InstanceServer, source api.InstanceSource) error {
+	if source.Fingerprint != "" {
+		_, _, err := server.GetImage(source.Fingerprint)
+		return err
+	}
+	_, _, err := server.GetImageAlias(source.Alias)
+	if !api.StatusErrorCheck(err, http.StatusNotFound) {
+		return err
+	}
+	_, _, err = server.GetImage(source.Alias)
+	return err
+}
+
+func (p *Pool) imageNotFound(image, remote string) string {
+	if len(p.remotes) < 2 {
+		return fmt.Sprintf("image %q not found", image)
+	}
+	return fmt.Sprintf("image %q not found on remote %q", image, remote)
+}
+
+// freeStorage returns the free space of the storage pool agents are created
+// in. Unless the pool names it, it is the one of the root disk of the last
+// profile that has one.
+func (p *Pool) freeStorage(pl placement, conf IncusConfig) (int64, error) {
+	server := p.remotes[pl.remote].Server
+	if pl.target != "" {
+		server = server.UseTarget(pl.target)
+	}
+	storagePool := conf.Devices["root"]["pool"]
+	if storagePool == "" {
+		storagePool = conf.StoragePool
+	}
+	if storagePool == "" {
+		profiles := conf.Profiles
+		if len(profiles) == 0 {
+			profiles = []string{"default"}
+		}
+		for _, name := range profiles {
+			profile, _, err := server.GetProfile(name)
+			if err != nil {
+				return 0, err
+			}
+			if pool := profile.Devices["root"]["pool"]; pool != "" {
+				storagePool = pool
+			}
+		}
+		if storagePool == "" {
+			return 0, fmt.Errorf("no profile has a root disk pool")
+		}
+	}
+
+	resources, err := server.GetStoragePoolResources(storagePool)
+	if err != nil {
+		return 0, err
+	}
+	return int64(resources.Space.Total) - int64(resources.Space.Used), nil
+}
+
+// totalMemory returns the memory of a placement.
+func (p *Pool) totalMemory(pl placement) (int64, error) {
+	server := p.remotes[pl.remote].Server
+	if pl.target != "" {
+		state, _, err := server.GetClusterMemberState(pl.target)
+		if err != nil {
+			return 0, err
+		}
+		return int64(state.SysInfo.TotalRAM), nil
+	}
+
+	resources, err := server.GetServerResources()
+	if err != nil {
+		return 0, err
+	}
+	return int64(resources.Memory.Total), nil
+}
+
+// placementOf returns where the instance i lives.
+func (p *Pool) placementOf(i api.Instance) placement {
+	pl := placement{remote: p.remoteOf(i.Name)}
+	if p.placements[0].target != "" {
+		pl.target = i.Location
+	}
+	return pl
+}
+
+// admit decides whether the agent at idx, which must already be in flight,
+// may be created from source. It places the agent on the placement with the
+// most available memory among those it fits on, and reserves its memory and
+// disk there.
+func (p *Pool) admit(idx int, source api.InstanceSource) error {
+	conf := p.config()
+	p.placeMu.Lock()
+	capacity := maps.Clone(p.free)
+	p.placeMu.Unlock()
+
+	p.admitMu.Lock()
+	pl, reason := p.admissionPlacement(idx, source, conf, capacity)
+	if reason == "" && p.admission.refreshed {
+		a := &p.admission
+		a.admitted[idx] = pl
+		if _, ok := a.free[pl]; ok {
+			a.free[pl] -= int64(conf.Incus.MaxRamInGb) << 30
+		}
+		if _, ok := a.storage[pl]; ok {
+			a.storage[pl] -= int64(conf.Incus.DiskSizeInGb) << 30
+		}
+	}
+	p.admitMu.Unlock()
+
+	p.setDegraded(reason)
+	if reason != "" {
+		admissionRefusedMetric.WithLabelValues(conf.Name).Inc()
+		return fmt.Errorf("%w: %s", ErrNotAdmitted, reason)
+	}
+	return nil
+}
+
+// admissionPlacement returns where the agent at idx fits, or why it fits
+// nowhere. Placements are ranked by the available memory admission control
+// knows of, then by the free memory RefreshCapacity recorded in capacity.
+func (p *Pool) admissionPlacement(idx int, source api.InstanceSource, conf Config, capacity map[placement]int64) (placement, string) {
+	a := &p.admission
+	if !a.refreshed {
+		return placement{}, ""
+	}
+	if reason, ok := a.missing[sourceLabel(source)]; ok {
+		return placement{}, reason
+	}
+
+	var (
+		best    placement
+		bestKey int64
+		found   bool
+		reasons []string
+	)
+	for _, pl := range p.placements {
+		if reason := p.admissionReason(idx, pl, conf); reason != "" {
+			if len(p.placements) > 1 {
+				reason = p.label(pl) + ": " + reason
+			}
+			reasons = append(reasons, reason)
+			continue
+		}
+		key, ok := a.free[pl]
+		if !ok {
+			key = capacity[pl]
+		}
+		if !found || key > bestKey {
+			best, bestKey, found = pl, key, true
+		}
+	}
+	if !found {
+		return placement{}, strings.Join(reasons, "; ")
+	}
+	return best, ""
+}
+
+// admissionReason returns why the agent at idx does not fit on pl, or an empty
+// string when it does. maxRamInGb is a cap rather than what an agent uses, so
+// every agent on pl, created or being created, counts at its cap against the
+// memory of pl. The agent must also fit in the memory still available, which
+// accounts for other pools and workloads.
+func (p *Pool) admissionReason(idx int, pl placement, conf Config) string {
+	a := &p.admission
+	if ram := int64(conf.Incus.MaxRamInGb) << 30; ram > 0 {
+		if total, ok := a.total[pl]; ok {
+			agents := map[int]bool{idx: true}
+			for i, at := range a.agents {
+				if at == pl {
+					agents[i] = true
+				}
+			}
+			for i, at := range a.admitted {
+				if _, creating := p.inFlight.Load(i); creating && at == pl {
+					agents[i] = true
+				}
+			}
+			if need := int64(len(agents)) * ram; need > total {
+				return fmt.Sprintf("%d agents with maxRamInGb %d need %s of memory, the host has %s",
+					len(agents), conf.Incus.MaxRamInGb, formatBytes(need), formatBytes(total))
+			}
+		}
+		if free, ok := a.free[pl]; ok && free < ram {
+			return fmt.Sprintf("maxRamInGb %d does not fit in the %s of memory available on the host",
+				conf.Incus.MaxRamInGb, formatBytes(max(free, 0)))
+		}
+	}
+
+	if disk := int64(conf.Incus.DiskSizeInGb) << 30; conf.Incus.VM && disk > 0 {
+		if storage, ok := a.storage[pl]; ok && storage < disk {
+			return fmt.Sprintf("diskSizeInGb %d does not fit in the %s free in the storage pool",
+				conf.Incus.DiskSizeInGb, formatBytes(max(storage, 0)))
+		}
+	}
+	return ""
+}
+
+// admittedPlacement returns where admit placed the instance called name, if it
+// is an agent being created.
+func (p *Pool) admittedPlacement(name string) (placement, bool) {
+	idx, err := p.agentIndex(name)
+	if err != nil {
+		return placement{}, false
+	}
+	p.admitMu.Lock()
+	defer p.admitMu.Unlock()
+	pl, ok := p.admission.admitted[idx]
+	return pl, ok
+}
+
+// setDegraded records why agents are refused, logging when that changes.
+func (p *Pool) setDegraded(reason string) {
+	p.admitMu.Lock()
+	previous := p.admission.degraded
+	p.admission.degraded = reason
+	p.admitMu.Unlock()
+
+	switch {
+	case reason == previous:
+	case reason == "":
+		p.logger.Info("pool recovered, creating agents again")
+	default:
+		p.logger.Warn("pool degraded, refusing to create agents", "reason", reason)
+	}
+	value := 0.0
+	if reason != "" {
+		value = 1
+	}
+	poolDegradedMetric.WithLabelValues(p.Name()).Set(value)
+}
+
+// Degraded returns why the pool refuses to create agents, or an empty string
+// when it does not.
+func (p *Pool) Degraded() string {
+	p.admitMu.Lock()
+	defer p.admitMu.Unlock()
+	return p.admission.degraded
+}
+
+func formatBytes(b int64) string {
+	return fmt.Sprintf("%.1fGiB", float64(b)/(1<<30))
+}
@@ -0,0 +1,188 @@
+package pool
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_CreateAgent_RefusesMissingImage(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+	notFound := api.StatusErrorf(http.StatusNotFound, "not found")
+	m.On("GetImageAlias", "test-image").Return(nil, "", notFound)
+	m.On("GetImage", "test-image").Return(nil, "", notFound)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+
+	require.NoError(t, p.RefreshAdmission())
+	assert.Equal(t, `image "test-image" not found`, p.Degraded())
+	assert.Equal(t, `image "test-image" not found`, p.Info().Degraded)
+
+	err = p.CreateAgent(context.Background(), 0)
+	require.ErrorIs(t, err, ErrNotAdmitted)
+	assert.ErrorContains(t, err, `image "test-image" not found`)
+	m.AssertNotCalled(t, "CreateInstance", mock.Anything)
+	_, inFlight := p.inFlight.Load(0)
+	assert.False(t, inFlight)
+}
+
+func TestPool_Admission_Memory(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Incus.MaxRamInGb = 4
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	expectAlias(m, "test-image", "fp-1")
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0"}}, nil)
+	// Agent 0 is idle and uses little of the host's 10GiB.
+	m.On("GetServerResources").Return(&api.Resources{Memory: api.ResourcesMemory{Total: 10 << 30, Used: 1 << 30}}, nil)
+	require.NoError(t, p.RefreshAdmission())
+	source, _ := p.imageSource(1)
+
+	// Agent 0 runs and agent 1 is being created: 2 x 4GiB fit in 10GiB.
+	p.inFlight.Store(1, true)
+	require.NoError(t, p.admit(1, source))
+	assert.Empty(t, p.Degraded())
+
+	// A third agent would need 12GiB once their jobs run, even though 5GiB
+	// are still available.
+	p.inFlight.Store(2, true)
+	err = p.admit(2, source)
+	require.ErrorIs(t, err, ErrNotAdmitted)
+	assert.ErrorContains(t, err, "3 agents with maxRamInGb 4 need 12.0GiB of memory, the host has 10.0GiB")
+	assert.NotEmpty(t, p.Degraded())
+
+	// Once agent 1 is done creating, the pool is whole and recovers.
+	p.inFlight.Delete(1)
+	p.inFlight.Delete(2)
+	p.setDesiredAgents(1)
+	require.NoError(t, p.RefreshAdmission())
+	assert.Empty(t, p.Degraded())
+}
+
+func TestPool_Admission_AvailableMemory(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Incus.MaxRamInGb = 4
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	expectAlias(m, "test-image", "fp-1")
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	// Other workloads use most of the host.
+	m.On("GetServerResources").Return(&api.Resources{Memory: api.ResourcesMemory{Total: 10 << 30, Used: 7 << 30}}, nil)
+	require.NoError(t, p.RefreshAdmission())
+	source, _ := p.imageSource(0)
+
+	err = p.admit(0, source)
+	require.ErrorIs(t, err, ErrNotAdmitted)
+	assert.ErrorContains(t, err, "maxRamInGb 4 does not fit in the 3.0GiB of memory available on the host")
+}
+
+func TestPool_Admission_EveryRemote(t *testing.T) {
+	a := mocks.NewMockInstanceServer(t)
+	b := mocks.NewMockInstanceServer(t)
+	p := newRemoteTestPool(t, a, b)
+	notFound := api.StatusErrorf(http.StatusNotFound, "not found")
+	expectAlias(a, "test-image", "fp-1")
+	b.On("GetImageAlias", "test-image").Return(nil, "", notFound)
+	b.On("GetImage", "test-image").Return(nil, "", notFound)
+	for _, m := range []*mocks.MockInstanceServer{a, b} {
+		m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	}
+	expectFreeMemory(a, 2)
+	expectFreeMemory(b, 5)
+	require.NoError(t, p.RefreshAdmission())
+	assert.Equal(t, `image "test-image" not found on remote "b"`, p.Degraded())
+
+	// With the image on every remote, an agent fits on b but not on a, and is
+	// placed there.
+	p.admission.missing = nil
+	source, _ := p.imageSource(0)
+	p.inFlight.Store(0, true)
+	require.NoError(t, p.admit(0, source))
+	assert.Equal(t, placement{remote: 1}, p.place("azp-agent-0"))
+	err := p.admit(1, source)
+	require.ErrorIs(t, err, ErrNotAdmitted)
+	assert.ErrorContains(t, err, "a: maxRamInGb 4 does not fit in the 2.0GiB of memory available on the host")
+	assert.ErrorContains(t, err, "b: maxRamInGb 4 does not fit in the 1.0GiB of memory available on the host")
+}
+
+func TestPool_Admission_PlacesWhereStorageFits(t *testing.T) {
+	a := mocks.NewMockInstanceServer(t)
+	b := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Remotes = []string{"a", "b"}
+	conf.Incus.VM = true
+	conf.Incus.StoragePool = "fast"
+	conf.Incus.DiskSizeInGb = 50
+	p, err := NewPoolOnRemotes([]Remote{{Name: "a", Server: a}, {Name: "b", Server: b}}, conf)
+	require.NoError(t, err)
+	expectAlias(a, "test-image", "fp-1")
+	expectAlias(b, "test-image", "fp-1")
+	for m, free := range map[*mocks.MockInstanceServer]uint64{a: 60 << 30, b: 10 << 30} {
+		m.On("GetInstances", api.InstanceTypeVM).Return([]api.Instance{}, nil)
+		m.On("GetStoragePoolResources", "fast").Return(&api.ResourcesStoragePool{
+			Space: api.ResourcesStoragePoolSpace{Total: 100 << 30, Used: 100<<30 - free},
+		}, nil)
+	}
+	require.NoError(t, p.RefreshAdmission())
+	// b has more free memory, but no room for the disk.
+	expectFreeMemory(a, 8)
+	expectFreeMemory(b, 32)
+	require.NoError(t, p.RefreshCapacity())
+
+	source, _ := p.imageSource(0)
+	p.inFlight.Store(0, true)
+	require.NoError(t, p.admit(0, source))
+	assert.Equal(t, placement{remote: 0}, p.place("azp-agent-0"))
+
+	// a has 10GiB left once the first disk is reserved.
+	err = p.admit(1, source)
+	require.ErrorIs(t, err, ErrNotAdmitted)
+	assert.ErrorContains(t, err, "a: diskSizeInGb 50 does not fit in the 10.0GiB free in the storage pool")
+}
+
+func TestPool_Admission_Storage(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Incus.VM = true
+	conf.Incus.DiskSizeInGb = 50
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	expectAlias(m, "test-image", "fp-1")
+	m.On("GetInstances", api.InstanceTypeVM).Return([]api.Instance{}, nil)
+	m.On("GetProfile", "default").Return(&api.Profile{ProfilePut: api.ProfilePut{
+		Devices: map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "fast"}},
+	}}, "", nil)
+	m.On("GetStoragePoolResources", "fast").Return(&api.ResourcesStoragePool{
+		Space: api.ResourcesStoragePoolSpace{Total: 100 << 30, Used: 20 << 30},
+	}, nil)
+	require.NoError(t, p.RefreshAdmission())
+	source, _ := p.imageSource(0)
+
+	// The first disk is reserved, so the second no longer fits until the
+	// next refresh.
+	require.NoError(t, p.admit(0, source))
+	err = p.admit(1, source)
+	require.ErrorIs(t, err, ErrNotAdmitted)
+	assert.ErrorContains(t, err, "diskSizeInGb 50 does not fit in the 30.0GiB free in the storage pool")
+}
+
+func TestPool_Admission_UnknownBeforeRefresh(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Incus.MaxRamInGb = 4
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	source, _ := p.imageSource(0)
+	require.NoError(t, p.admit(0, source))
+	assert.Empty(t, p.Degraded())
+}
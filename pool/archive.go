@@ -0,0 +1,165 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/archive"
+)
+
+// run_agent.sh touches finishedMarker once the agent has shut down, then waits
+// up to archiveWait for the daemon to collect its logs and remove the marker
+// before powering off.
+const (
+	finishedMarker = "/home/agent/.finished"
+	archiveWait    = 5 * time.Minute
+)
+
+// SetLogArchive makes the pool archive the logs of its agents before their
+// instances go away.
+func (p *Pool) SetLogArchive(a *archive.Archive) {
+	p.archiveMu.Lock()
+	defer p.archiveMu.Unlock()
+	p.archive = a
+}
+
+func (p *Pool) logArchive() *archive.Archive {
+	p.archiveMu.Lock()
+	defer p.archiveMu.Unlock()
+	return p.archive
+}
+
+// CollectLogs archives the logs of agents that finished their job and are
+// waiting to power off, then lets them power off. Old archives are pruned.
+func (p *Pool) CollectLogs(ctx context.Context) error {
+	a := p.logArchive()
+	if a == nil {
+		return nil
+	}
+
+	instances, err := p.ListAgents()
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		idx, err := p.agentIndex(i.Name)
+		if err != nil || i.Status != "Running" {
+			continue
+		}
+		finished, err := p.execSucceeds(ctx, i.Name, []string{"test", "-f", finishedMarker})
+		if err != nil {
+			p.logger.Warn("unable to check whether agent finished", "idx", idx, "err", err)
+			continue
+		}
+		if !finished {
+			continue
+		}
+
+		p.archiveLogs(ctx, idx)
+		if _, err := p.execSucceeds(ctx, i.Name, []string{"rm", "-f", finishedMarker}); err != nil {
+			p.logger.Warn("unable to release finished agent", "idx", idx, "err", err)
+		}
+	}
+
+	return a.Prune(p.Name(), p.now())
+}
+
+// archiveLogs copies the wrapper log and the agent's _diag directory of the
+// instance at idx into the archive. Failures are logged, since they must not
+// keep an instance from going away.
+func (p *Pool) archiveLogs(ctx context.Context, idx int) {
+	a := p.logArchive()
+	if a == nil {
+		return
+	}
+	name := p.AgentName(idx)
+
+	var jobID int64
+	p.historyMu.Lock()
+	if l := p.lifetimes[idx]; l != nil {
+		jobID = l.JobID
+	}
+	p.historyMu.Unlock()
+
+	w, err := a.Create(p.Name(), name, jobID, p.now())
+	if err != nil {
+		p.logger.Error("unable to archive agent logs", "idx", idx, "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultOperationTimeout)
+	defer cancel()
+	// The operation can finish before all of its output has been copied.
+	dataDone := make(chan bool)
+	op, err := p.server(name).ExecInstance(name, api.InstanceExecPost{
+		Command: []string{
+			"sh", "-c",
+			`cd /home/agent && tar -czf - $(ls -d ` + archive.LogFile + ` _diag 2>/dev/null)`,
+		},
+		WaitForWS:   true,
+		Interactive: false,
+	}, &incus.InstanceExecArgs{Stdout: w, DataDone: dataDone})
+	if err == nil {
+		err = waitOp(ctx, op, defaultOperationTimeout)
+	}
+	if err == nil {
+		select {
+		case <-dataDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err == nil {
+		if code, _ := op.Get().Metadata["return"].(float64); code != 0 {
+			err = fmt.Errorf("tar exited with status %d", int(code))
+		}
+	}
+	if err != nil {
+		w.Abort()
+		p.logger.Error("unable to archive agent logs", "idx", idx, "err", err)
+		return
+	}
+
+	path, err := w.Close()
+	if err != nil {
+		p.logger.Error("unable to archive agent logs", "idx", idx, "err", err)
+		return
+	}
+	p.logger.Info("archived agent logs", "idx", idx, "path", path)
+}
+
+// execSucceeds runs command in the instance called name and reports whether it
+// exited with status 0.
+func (p *Pool) execSucceeds(ctx context.Context, name string, command []string) (bool, error) {
+	op, err := p.server(name).ExecInstance(
+		name,
+		api.InstanceExecPost{
+			Command:     command,
+			WaitForWS:   true,
+			Interactive: false,
+		},
+		&incus.InstanceExecArgs{},
+	)
+	if err != nil {
+		return false, fmt.Errorf("exec failed: %w", err)
+	}
+
+	if err := waitOp(ctx, op, defaultOperationTimeout); err != nil {
+		return false, fmt.Errorf("wait failed: %w", err)
+	}
+
+	meta := op.Get().Metadata
+	if meta == nil {
+		return false, fmt.Errorf("metadata is nil")
+	}
+
+	returnCode, ok := meta["return"].(float64)
+	if !ok {
+		return false, fmt.Errorf("return code not found")
+	}
+
+	return int(returnCode) == 0, nil
+}
@@ -0,0 +1,129 @@
+package pool
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/archive"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func logTarball(t *testing.T, log string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: archive.LogFile, Mode: 0o644, Size: int64(len(log))}))
+	_, err := tw.Write([]byte(log))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func isCommand(name string) func(api.InstanceExecPost) bool {
+	return func(req api.InstanceExecPost) bool {
+		return len(req.Command) > 0 && req.Command[0] == name
+	}
+}
+
+// expectTar makes the archive exec of name write data.
+func expectTar(t *testing.T, m *mocks.MockInstanceServer, name string, data []byte) {
+	t.Helper()
+	m.On("ExecInstance", name, mock.MatchedBy(isCommand("sh")), mock.Anything).
+		Run(func(args mock.Arguments) {
+			execArgs := args.Get(2).(*incus.InstanceExecArgs)
+			_, err := execArgs.Stdout.Write(data)
+			require.NoError(t, err)
+			close(execArgs.DataDone)
+		}).
+		Return(processResult(t, true), nil).Once()
+}
+
+func newArchiveTestPool(t *testing.T, m *mocks.MockInstanceServer) (*Pool, string) {
+	t.Helper()
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+	dir := t.TempDir()
+	p.SetLogArchive(archive.New(archive.Config{Dir: dir}))
+	return p, dir
+}
+
+func TestPool_CollectLogs_ArchivesFinishedAgents(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, dir := newArchiveTestPool(t, m)
+
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-0", Status: "Running"},
+		{Name: "azp-agent-1", Status: "Running"},
+		{Name: "azp-agent-2", Status: "Stopped"},
+	}, nil)
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(isCommand("test")), mock.Anything).Return(processResult(t, true), nil).Once()
+	m.On("ExecInstance", "azp-agent-1", mock.MatchedBy(isCommand("test")), mock.Anything).Return(processResult(t, false), nil).Once()
+	expectTar(t, m, "azp-agent-0", logTarball(t, "job done\n"))
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return isCommand("rm")(req) && req.Command[len(req.Command)-1] == finishedMarker
+	}), mock.Anything).Return(processResult(t, true), nil).Once()
+
+	require.NoError(t, p.CollectLogs(context.Background()))
+
+	entries, err := archive.List(dir, "azp-agent")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "azp-agent-0", entries[0].Instance)
+	var buf bytes.Buffer
+	require.NoError(t, archive.ReadLog(entries[0].Path, &buf))
+	assert.Equal(t, "job done\n", buf.String())
+}
+
+func TestPool_CollectLogs_FailedTarKeepsNothing(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, dir := newArchiveTestPool(t, m)
+
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0", Status: "Running"}}, nil)
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(isCommand("test")), mock.Anything).Return(processResult(t, true), nil).Once()
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(isCommand("sh")), mock.Anything).
+		Run(func(args mock.Arguments) {
+			close(args.Get(2).(*incus.InstanceExecArgs).DataDone)
+		}).
+		Return(processResult(t, false), nil).Once()
+	// The agent is released even though its logs could not be archived.
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(isCommand("rm")), mock.Anything).Return(processResult(t, true), nil).Once()
+
+	require.NoError(t, p.CollectLogs(context.Background()))
+
+	entries, err := archive.List(dir, "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPool_CollectLogs_Disabled(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.CollectLogs(context.Background()))
+	m.AssertNotCalled(t, "GetInstances", mock.Anything)
+}
+
+func TestPool_ReapAgent_ArchivesLogs(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, dir := newArchiveTestPool(t, m)
+
+	expectTar(t, m, "azp-agent-1", logTarball(t, "stuck\n"))
+	expectStop(m, t, "azp-agent-1")
+	require.NoError(t, p.ReapAgent(context.Background(), 1))
+
+	entries, err := archive.List(dir, "azp-agent")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "azp-agent-1", entries[0].Instance)
+}
@@ -0,0 +1,207 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newAutoscaleTestPool(t *testing.T, m *mocks.MockInstanceServer, azure AzureAgentClient) *Pool {
+	t.Helper()
+	conf := testConfig()
+	conf.AgentCount = 0
+	conf.MinAgents = 1
+	conf.MaxAgents = 4
+	conf.AgentPrefix = "runner"
+	conf.Incus.StartupGracePeriod = time.Minute
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	p.azure = azure
+	return p
+}
+
+func TestNewPool_AutoscaledPoolStartsAtMinAgents(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p := newAutoscaleTestPool(t, m, &fakeAzureAgentClient{})
+
+	assert.True(t, p.Autoscaling())
+	assert.Equal(t, 1, p.DesiredAgents())
+}
+
+func TestNewPool_FixedPoolDesiresAgentCount(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	assert.False(t, p.Autoscaling())
+	assert.Equal(t, 3, p.DesiredAgents())
+	require.NoError(t, p.Autoscale(context.Background()))
+	assert.Equal(t, 3, p.DesiredAgents())
+}
+
+func TestPool_Autoscale(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []AzureJobRequest
+		want     int
+	}{
+		{name: "empty queue keeps the floor", requests: nil, want: 1},
+		{
+			name: "queued and own running jobs count",
+			requests: []AzureJobRequest{
+				{RequestID: 1},
+				{RequestID: 2},
+				{RequestID: 3, AgentName: "runner-0"},
+			},
+			want: 3,
+		},
+		{
+			name: "jobs on other hosts are ignored",
+			requests: []AzureJobRequest{
+				{RequestID: 1, AgentName: "other-host-0"},
+				{RequestID: 2, AgentName: "runner-x"},
+				{RequestID: 3, AgentName: "runner-1"},
+			},
+			want: 1,
+		},
+		{
+			name: "demand is capped at MaxAgents",
+			requests: []AzureJobRequest{
+				{RequestID: 1}, {RequestID: 2}, {RequestID: 3}, {RequestID: 4}, {RequestID: 5},
+			},
+			want: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := mocks.NewMockInstanceServer(t)
+			p := newAutoscaleTestPool(t, m, &fakeAzureAgentClient{requests: tt.requests})
+
+			require.NoError(t, p.Autoscale(context.Background()))
+			assert.Equal(t, tt.want, p.DesiredAgents())
+		})
+	}
+}
+
+func TestPool_Autoscale_AzureErrorKeepsSize(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	azure := &fakeAzureAgentClient{requests: []AzureJobRequest{{RequestID: 1}, {RequestID: 2}}}
+	p := newAutoscaleTestPool(t, m, azure)
+	require.NoError(t, p.Autoscale(context.Background()))
+	require.Equal(t, 2, p.DesiredAgents())
+
+	azure.err = errors.New("Azure unavailable")
+	assert.Error(t, p.Autoscale(context.Background()))
+	assert.Equal(t, 2, p.DesiredAgents())
+}
+
+func TestPool_Reconcile_Autoscaled(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-0"},
+	}, nil)
+	p := newAutoscaleTestPool(t, m, &fakeAzureAgentClient{requests: []AzureJobRequest{
+		{RequestID: 1}, {RequestID: 2}, {RequestID: 3},
+	}})
+	require.NoError(t, p.Autoscale(context.Background()))
+
+	ch := make(chan int, 64)
+	require.NoError(t, p.Reconcile(ch))
+	close(ch)
+
+	var created []int
+	for idx := range ch {
+		created = append(created, idx)
+	}
+	assert.Equal(t, []int{1, 2}, created)
+}
+
+func TestPool_CreateAgent_SkipsIndexAboveDesired(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p := newAutoscaleTestPool(t, m, &fakeAzureAgentClient{})
+
+	require.NoError(t, p.CreateAgent(context.Background(), 2))
+	m.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestPool_Reap_StopsIdleExcessAgent(t *testing.T) {
+	now := time.Now()
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{
+		oldRunningAgent("azp-agent-2", now),
+	}, nil)
+	m.On("ExecInstance", "azp-agent-2", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[len(req.Command)-1] == "Agent.Worker"
+	}), mock.Anything).Return(processResult(t, false), nil).Once()
+	expectStop(m, t, "azp-agent-2")
+	azure := &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+		"runner-2": {ID: 12, Online: true},
+	}}
+	p := newAutoscaleTestPool(t, m, azure)
+
+	require.NoError(t, p.Reap(context.Background()))
+	m.AssertCalled(t, "UpdateInstanceState", "azp-agent-2", mock.Anything, "")
+	assert.Equal(t, []int{12}, azure.disabled, "the online agent is disabled before it is stopped")
+}
+
+func TestPool_Reap_KeepsExcessAgentAssignedWhileDisabling(t *testing.T) {
+	now := time.Now()
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{
+		oldRunningAgent("azp-agent-2", now),
+	}, nil)
+	m.On("ExecInstance", "azp-agent-2", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[len(req.Command)-1] == "Agent.Worker"
+	}), mock.Anything).Return(processResult(t, false), nil).Once()
+	azure := &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+		"runner-2": {ID: 12, Online: true},
+	}}
+	// Azure dispatches a job right before the agent is disabled.
+	azure.onDisable = func() {
+		azure.agents = map[string]AzureAgentStatus{"runner-2": {ID: 12, Online: true, Assigned: true}}
+	}
+	p := newAutoscaleTestPool(t, m, azure)
+
+	require.NoError(t, p.Reap(context.Background()))
+	assert.Equal(t, []int{12}, azure.disabled)
+	m.AssertNotCalled(t, "UpdateInstanceState", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPool_Reap_KeepsBusyExcessAgent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		worker  bool
+		azure   *fakeAzureAgentClient
+		queries bool
+	}{
+		{name: "worker running", worker: true, azure: &fakeAzureAgentClient{}},
+		{name: "assigned", azure: &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+			"runner-2": {Online: true, Assigned: true},
+		}}, queries: true},
+		{name: "azure unavailable", azure: &fakeAzureAgentClient{err: errors.New("Azure unavailable")}, queries: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			m := mocks.NewMockInstanceServer(t)
+			m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{
+				oldRunningAgent("azp-agent-2", now),
+			}, nil)
+			m.On("ExecInstance", "azp-agent-2", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+				return req.Command[len(req.Command)-1] == "Agent.Worker"
+			}), mock.Anything).Return(processResult(t, tc.worker), nil).Once()
+			p := newAutoscaleTestPool(t, m, tc.azure)
+
+			require.NoError(t, p.Reap(context.Background()))
+			assert.Equal(t, tc.queries, tc.azure.calls > 0)
+			m.AssertNotCalled(t, "UpdateInstanceState", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
@@ -1,38 +1,97 @@
 package pool
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const azureAPIVersion = "7.1"
 
+// finishedJobRequestCount is how many of the most recent finished job requests
+// ListFinishedJobRequests returns. Azure keeps the whole history of a pool, so
+// listing it all grows without bound.
+const finishedJobRequestCount = 200
+
 // AzureAgentStatus is the Azure-side state used to decide whether a local
 // instance can be safely reaped.
 type AzureAgentStatus struct {
+	// ID identifies the agent registration in the Azure pool.
+	ID       int
 	Online   bool
 	Assigned bool
+	// RequestID and Pipeline describe the assigned job, when there is one, and
+	// AssignedAt is when it was assigned to the agent.
+	RequestID  int64
+	Pipeline   string
+	AssignedAt time.Time
+}
+
+// AzureJobRequest is a job in an Azure pool.
+type AzureJobRequest struct {
+	RequestID int64
+	// AgentName is the agent the job is assigned to. Empty while the job is queued.
+	AgentName string
+	// Pipeline is the name of the pipeline definition the job belongs to.
+	Pipeline string
+	// FinishTime and Result are only set once the job has finished. Result is
+	// the Azure task result, such as "succeeded", "failed" or "canceled".
+	FinishTime time.Time
+	Result     string
 }
 
-// AzureAgentClient lists the agents currently registered in an Azure pool.
+// AzureAgentClient lists the agents and jobs of an Azure pool.
 type AzureAgentClient interface {
 	ListAgents(ctx context.Context, poolName string) (map[string]AzureAgentStatus, error)
+	// ListJobRequests returns the job requests in the pool that have not finished.
+	ListJobRequests(ctx context.Context, poolName string) ([]AzureJobRequest, error)
+	// ListFinishedJobRequests returns the most recent job requests in the pool
+	// that have finished, up to finishedJobRequestCount of them.
+	ListFinishedJobRequests(ctx context.Context, poolName string) ([]AzureJobRequest, error)
+	// DeleteAgent removes the agent registration with the given ID from the pool.
+	DeleteAgent(ctx context.Context, poolName string, agentID int) error
+	// DisableAgent stops Azure from assigning jobs to the agent registration
+	// with the given ID.
+	DisableAgent(ctx context.Context, poolName string, agentID int) error
+}
+
+// credential authorizes requests to the Azure DevOps REST API.
+type credential interface {
+	authorize(ctx context.Context, req *http.Request) error
+}
+
+// patCredential authorizes requests with a personal access token.
+type patCredential func(ctx context.Context) (string, error)
+
+func (f patCredential) authorize(ctx context.Context, req *http.Request) error {
+	pat, err := f(ctx)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", pat)
+	return nil
 }
 
 type httpAzureAgentClient struct {
-	baseURL *url.URL
-	pat     string
-	client  *http.Client
+	baseURL    *url.URL
+	credential credential
+	client     *http.Client
+
+	// poolIDs caches the IDs of the pools resolved by poolID.
+	poolIDsMu sync.Mutex
+	poolIDs   map[string]int
 }
 
-func newHTTPAzureAgentClient(rawURL, pat string, client *http.Client) (*httpAzureAgentClient, error) {
+func newHTTPAzureAgentClient(rawURL string, credential credential, client *http.Client) (*httpAzureAgentClient, error) {
 	baseURL, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, fmt.Errorf("parse Azure URL: %w", err)
@@ -40,53 +99,26 @@ func newHTTPAzureAgentClient(rawURL, pat string, client *http.Client) (*httpAzur
 	if client == nil {
 		client = &http.Client{Timeout: 30 * time.Second}
 	}
-	return &httpAzureAgentClient{baseURL: baseURL, pat: pat, client: client}, nil
+	return &httpAzureAgentClient{baseURL: baseURL, credential: credential, client: client, poolIDs: map[string]int{}}, nil
 }
 
 func (c *httpAzureAgentClient) ListAgents(ctx context.Context, poolName string) (map[string]AzureAgentStatus, error) {
-	poolsURL, err := c.endpoint("_apis", "distributedtask", "pools")
+	poolID, err := c.poolID(ctx, poolName)
 	if err != nil {
 		return nil, err
 	}
-	query := poolsURL.Query()
-	query.Set("poolName", poolName)
-	query.Set("api-version", azureAPIVersion)
-	poolsURL.RawQuery = query.Encode()
-
-	var pools struct {
-		Value []struct {
-			ID   int    `json:"id"`
-			Name string `json:"name"`
-		} `json:"value"`
-	}
-	if err := c.getJSON(ctx, poolsURL, &pools); err != nil {
-		return nil, fmt.Errorf("list Azure pools: %w", err)
-	}
-
-	poolID := 0
-	for _, candidate := range pools.Value {
-		if candidate.Name != poolName {
-			continue
-		}
-		if candidate.ID <= 0 || poolID != 0 {
-			return nil, fmt.Errorf("azure pool %q response is ambiguous or malformed", poolName)
-		}
-		poolID = candidate.ID
-	}
-	if poolID == 0 {
-		return nil, fmt.Errorf("azure pool %q not found", poolName)
-	}
 
 	agentsURL, err := c.endpoint("_apis", "distributedtask", "pools", strconv.Itoa(poolID), "agents")
 	if err != nil {
 		return nil, err
 	}
-	query = agentsURL.Query()
+	query := agentsURL.Query()
 	query.Set("includeAssignedRequest", "true")
 	query.Set("api-version", azureAPIVersion)
 	agentsURL.RawQuery = query.Encode()
 
 	type agentRecord struct {
+		ID              int             `json:"id"`
 		Name            string          `json:"name"`
 		Status          string          `json:"status"`
 		AssignedRequest json.RawMessage `json:"assignedRequest"`
@@ -95,6 +127,7 @@ func (c *httpAzureAgentClient) ListAgents(ctx context.Context, poolName string)
 		Value json.RawMessage `json:"value"`
 	}
 	if err := c.getJSON(ctx, agentsURL, &response); err != nil {
+		c.forgetPoolID(poolName, err)
 		return nil, fmt.Errorf("list agents in Azure pool %q: %w", poolName, err)
 	}
 	if len(response.Value) == 0 || string(response.Value) == "null" {
@@ -124,12 +157,215 @@ func (c *httpAzureAgentClient) ListAgents(ctx context.Context, poolName string)
 			return nil, fmt.Errorf("azure agent %q has unknown status %q", agent.Name, agent.Status)
 		}
 
-		assigned := len(agent.AssignedRequest) > 0 && string(agent.AssignedRequest) != "null"
-		agents[agent.Name] = AzureAgentStatus{Online: online, Assigned: assigned}
+		status := AzureAgentStatus{ID: agent.ID, Online: online}
+		if len(agent.AssignedRequest) > 0 && string(agent.AssignedRequest) != "null" {
+			status.Assigned = true
+			// The job details only feed the history and job duration limits,
+			// so they are best effort.
+			var request struct {
+				RequestID  int64     `json:"requestId"`
+				AssignTime time.Time `json:"assignTime"`
+				Definition struct {
+					Name string `json:"name"`
+				} `json:"definition"`
+			}
+			if err := json.Unmarshal(agent.AssignedRequest, &request); err == nil {
+				status.RequestID = request.RequestID
+				status.Pipeline = request.Definition.Name
+				status.AssignedAt = request.AssignTime
+			}
+		}
+		agents[agent.Name] = status
 	}
 	return agents, nil
 }
 
+func (c *httpAzureAgentClient) ListJobRequests(ctx context.Context, poolName string) ([]AzureJobRequest, error) {
+	return c.listJobRequests(ctx, poolName, false)
+}
+
+func (c *httpAzureAgentClient) ListFinishedJobRequests(ctx context.Context, poolName string) ([]AzureJobRequest, error) {
+	return c.listJobRequests(ctx, poolName, true)
+}
+
+func (c *httpAzureAgentClient) listJobRequests(ctx context.Context, poolName string, finished bool) ([]AzureJobRequest, error) {
+	poolID, err := c.poolID(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	requestsURL, err := c.endpoint("_apis", "distributedtask", "pools", strconv.Itoa(poolID), "jobrequests")
+	if err != nil {
+		return nil, err
+	}
+	// Unfinished requests are always listed, along with this many of the most
+	// recent finished ones.
+	completed := 0
+	if finished {
+		completed = finishedJobRequestCount
+	}
+	query := requestsURL.Query()
+	query.Set("completedRequestCount", strconv.Itoa(completed))
+	query.Set("api-version", azureAPIVersion)
+	requestsURL.RawQuery = query.Encode()
+
+	var response struct {
+		Value []struct {
+			RequestID     int64  `json:"requestId"`
+			FinishTime    string `json:"finishTime"`
+			Result        string `json:"result"`
+			ReservedAgent *struct {
+				Name string `json:"name"`
+			} `json:"reservedAgent"`
+			Definition struct {
+				Name string `json:"name"`
+			} `json:"definition"`
+		} `json:"value"`
+	}
+	if err := c.getJSON(ctx, requestsURL, &response); err != nil {
+		c.forgetPoolID(poolName, err)
+		return nil, fmt.Errorf("list job requests in Azure pool %q: %w", poolName, err)
+	}
+	if response.Value == nil {
+		return nil, fmt.Errorf("azure pool %q response did not contain a job request list", poolName)
+	}
+
+	requests := []AzureJobRequest{}
+	for _, r := range response.Value {
+		if (r.FinishTime != "") != finished {
+			continue
+		}
+		request := AzureJobRequest{RequestID: r.RequestID, Pipeline: r.Definition.Name, Result: r.Result}
+		if r.ReservedAgent != nil {
+			request.AgentName = r.ReservedAgent.Name
+		}
+		if finished {
+			request.FinishTime, err = time.Parse(time.RFC3339Nano, r.FinishTime)
+			if err != nil {
+				return nil, fmt.Errorf("parse finish time of job request %d: %w", r.RequestID, err)
+			}
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+func (c *httpAzureAgentClient) DeleteAgent(ctx context.Context, poolName string, agentID int) error {
+	poolID, err := c.poolID(ctx, poolName)
+	if err != nil {
+		return err
+	}
+
+	agentURL, err := c.endpoint("_apis", "distributedtask", "pools", strconv.Itoa(poolID), "agents", strconv.Itoa(agentID))
+	if err != nil {
+		return err
+	}
+	query := agentURL.Query()
+	query.Set("api-version", azureAPIVersion)
+	agentURL.RawQuery = query.Encode()
+
+	resp, err := c.do(ctx, http.MethodDelete, agentURL, nil)
+	if err != nil {
+		c.forgetPoolID(poolName, err)
+		return fmt.Errorf("delete agent %d from Azure pool %q: %w", agentID, poolName, err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (c *httpAzureAgentClient) DisableAgent(ctx context.Context, poolName string, agentID int) error {
+	poolID, err := c.poolID(ctx, poolName)
+	if err != nil {
+		return err
+	}
+
+	agentURL, err := c.endpoint("_apis", "distributedtask", "pools", strconv.Itoa(poolID), "agents", strconv.Itoa(agentID))
+	if err != nil {
+		return err
+	}
+	query := agentURL.Query()
+	query.Set("api-version", azureAPIVersion)
+	agentURL.RawQuery = query.Encode()
+
+	body, err := json.Marshal(map[string]any{"id": agentID, "enabled": false})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPatch, agentURL, body)
+	if err != nil {
+		c.forgetPoolID(poolName, err)
+		return fmt.Errorf("disable agent %d in Azure pool %q: %w", agentID, poolName, err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// poolID resolves an Azure pool name to its numeric ID. IDs are cached until
+// a request with one fails with HTTP 404, as it does once the pool is deleted.
+func (c *httpAzureAgentClient) poolID(ctx context.Context, poolName string) (int, error) {
+	c.poolIDsMu.Lock()
+	poolID, ok := c.poolIDs[poolName]
+	c.poolIDsMu.Unlock()
+	if ok {
+		return poolID, nil
+	}
+
+	poolID, err := c.resolvePoolID(ctx, poolName)
+	if err != nil {
+		return 0, err
+	}
+	c.poolIDsMu.Lock()
+	c.poolIDs[poolName] = poolID
+	c.poolIDsMu.Unlock()
+	return poolID, nil
+}
+
+// forgetPoolID drops the cached ID of poolName when err says it was not found.
+func (c *httpAzureAgentClient) forgetPoolID(poolName string, err error) {
+	var status azureStatusError
+	if errors.As(err, &status) && int(status) == http.StatusNotFound {
+		c.poolIDsMu.Lock()
+		delete(c.poolIDs, poolName)
+		c.poolIDsMu.Unlock()
+	}
+}
+
+func (c *httpAzureAgentClient) resolvePoolID(ctx context.Context, poolName string) (int, error) {
+	poolsURL, err := c.endpoint("_apis", "distributedtask", "pools")
+	if err != nil {
+		return 0, err
+	}
+	query := poolsURL.Query()
+	query.Set("poolName", poolName)
+	query.Set("api-version", azureAPIVersion)
+	poolsURL.RawQuery = query.Encode()
+
+	var pools struct {
+		Value []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"value"`
+	}
+	if err := c.getJSON(ctx, poolsURL, &pools); err != nil {
+		return 0, fmt.Errorf("list Azure pools: %w", err)
+	}
+
+	poolID := 0
+	for _, candidate := range pools.Value {
+		if candidate.Name != poolName {
+			continue
+		}
+		if candidate.ID <= 0 || poolID != 0 {
+			return 0, fmt.Errorf("azure pool %q response is ambiguous or malformed", poolName)
+		}
+		poolID = candidate.ID
+	}
+	if poolID == 0 {
+		return 0, fmt.Errorf("azure pool %q not found", poolName)
+	}
+	return poolID, nil
+}
+
 func (c *httpAzureAgentClient) endpoint(parts ...string) (*url.URL, error) {
 	joined, err := url.JoinPath(c.baseURL.String(), parts...)
 	if err != nil {
@@ -143,23 +379,12 @@ func (c *httpAzureAgentClient) endpoint(parts ...string) (*url.URL, error) {
 }
 
 func (c *httpAzureAgentClient) getJSON(ctx context.Context, endpoint *url.URL, target any) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
-	if err != nil {
-		return err
-	}
-	req.SetBasicAuth("", c.pat)
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := c.client.Do(req)
+	resp, err := c.do(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
 
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
-		return fmt.Errorf("azure API returned HTTP %d", resp.StatusCode)
-	}
-
 	decoder := json.NewDecoder(io.LimitReader(resp.Body, 8<<20))
 	if err := decoder.Decode(target); err != nil {
 		return fmt.Errorf("decode Azure response: %w", err)
@@ -173,3 +398,36 @@ func (c *httpAzureAgentClient) getJSON(ctx context.Context, endpoint *url.URL, t
 	}
 	return nil
 }
+
+// do sends an authorized request with an optional JSON body and fails on any
+// non-2xx response. The caller closes the body of a successful response.
+func (c *httpAzureAgentClient) do(ctx context.Context, method string, endpoint *url.URL, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := c.credential.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		_ = resp.Body.Close()
+		return nil, azureStatusError(resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// azureStatusError is a non-2xx HTTP status returned by the Azure API.
+type azureStatusError int
+
+func (e azureStatusError) Error() string {
+	return fmt.Sprintf("azure API returned HTTP %d", int(e))
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -28,20 +30,20 @@ func TestHTTPAzureAgentClient_ListAgentsPreservesBasePathAndAuthenticates(t *tes
 			assert.Equal(t, "/tfs/collection/_apis/distributedtask/pools/42/agents", r.URL.Path)
 			assert.Equal(t, "true", r.URL.Query().Get("includeAssignedRequest"))
 			assert.Equal(t, "7.1", r.URL.Query().Get("api-version"))
-			_, _ = fmt.Fprint(w, `{"count":2,"value":[{"name":"runner-0","status":"online","assignedRequest":{"requestId":1}},{"name":"runner-1","status":"offline","assignedRequest":null}]}`)
+			_, _ = fmt.Fprint(w, `{"count":2,"value":[{"name":"runner-0","status":"online","assignedRequest":{"requestId":1,"assignTime":"2025-01-02T03:04:05.5Z"}},{"name":"runner-1","status":"offline","assignedRequest":null}]}`)
 		default:
 			t.Fatalf("unexpected request %d", requests)
 		}
 	}))
 	defer server.Close()
 
-	client, err := newHTTPAzureAgentClient(server.URL+"/tfs/collection", "secret-pat", server.Client())
+	client, err := newHTTPAzureAgentClient(server.URL+"/tfs/collection", staticToken("secret-pat"), server.Client())
 	require.NoError(t, err)
 
 	agents, err := client.ListAgents(context.Background(), "build-pool")
 	require.NoError(t, err)
 	assert.Equal(t, map[string]AzureAgentStatus{
-		"runner-0": {Online: true, Assigned: true},
+		"runner-0": {Online: true, Assigned: true, RequestID: 1, AssignedAt: time.Date(2025, 1, 2, 3, 4, 5, 5e8, time.UTC)},
 		"runner-1": {Online: false, Assigned: false},
 	}, agents)
 	assert.Equal(t, 2, requests)
@@ -74,7 +76,7 @@ func TestHTTPAzureAgentClient_ListAgentsFailsClosed(t *testing.T) {
 			}))
 			defer server.Close()
 
-			client, err := newHTTPAzureAgentClient(server.URL, "pat", server.Client())
+			client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
 			require.NoError(t, err)
 			_, err = client.ListAgents(context.Background(), "build-pool")
 			assert.Error(t, err)
@@ -88,8 +90,195 @@ func TestHTTPAzureAgentClient_RejectsMalformedPoolResponse(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client, err := newHTTPAzureAgentClient(server.URL, "pat", server.Client())
+	client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
 	require.NoError(t, err)
 	_, err = client.ListAgents(context.Background(), "build-pool")
 	assert.Error(t, err)
 }
+
+func TestHTTPAzureAgentClient_ListJobRequestsSkipsFinished(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			assert.Equal(t, "/_apis/distributedtask/pools", r.URL.Path)
+			_, _ = fmt.Fprint(w, `{"value":[{"id":42,"name":"build-pool"}]}`)
+		case 2:
+			assert.Equal(t, "/_apis/distributedtask/pools/42/jobrequests", r.URL.Path)
+			assert.Equal(t, "0", r.URL.Query().Get("completedRequestCount"))
+			assert.Equal(t, "7.1", r.URL.Query().Get("api-version"))
+			_, _ = fmt.Fprint(w, `{"count":3,"value":[
+				{"requestId":1,"queueTime":"2025-01-02T03:04:05Z"},
+				{"requestId":2,"reservedAgent":{"id":7,"name":"runner-0"}},
+				{"requestId":3,"reservedAgent":{"id":8,"name":"runner-1"},"finishTime":"2025-01-02T03:09:05Z","result":"succeeded"}
+			]}`)
+		default:
+			t.Fatalf("unexpected request %d", requests)
+		}
+	}))
+	defer server.Close()
+
+	client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
+	require.NoError(t, err)
+
+	jobs, err := client.ListJobRequests(context.Background(), "build-pool")
+	require.NoError(t, err)
+	assert.Equal(t, []AzureJobRequest{
+		{RequestID: 1},
+		{RequestID: 2, AgentName: "runner-0"},
+	}, jobs)
+}
+
+func TestHTTPAzureAgentClient_ListFinishedJobRequests(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			_, _ = fmt.Fprint(w, `{"value":[{"id":42,"name":"build-pool"}]}`)
+			return
+		}
+		assert.Equal(t, "200", r.URL.Query().Get("completedRequestCount"))
+		_, _ = fmt.Fprint(w, `{"count":2,"value":[
+			{"requestId":2,"reservedAgent":{"id":7,"name":"runner-0"}},
+			{"requestId":3,"reservedAgent":{"id":8,"name":"runner-1"},"definition":{"id":5,"name":"ci"},"finishTime":"2025-01-02T03:09:05.123Z","result":"failed"}
+		]}`)
+	}))
+	defer server.Close()
+
+	client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
+	require.NoError(t, err)
+
+	jobs, err := client.ListFinishedJobRequests(context.Background(), "build-pool")
+	require.NoError(t, err)
+	assert.Equal(t, []AzureJobRequest{{
+		RequestID:  3,
+		AgentName:  "runner-1",
+		Pipeline:   "ci",
+		FinishTime: time.Date(2025, 1, 2, 3, 9, 5, 123000000, time.UTC),
+		Result:     "failed",
+	}}, jobs)
+}
+
+func TestHTTPAzureAgentClient_ListJobRequestsFailsClosed(t *testing.T) {
+	for _, body := range []string{`{}`, `{"value":null}`, `{"value":`} {
+		t.Run(body, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					_, _ = fmt.Fprint(w, `{"value":[{"id":42,"name":"build-pool"}]}`)
+					return
+				}
+				_, _ = fmt.Fprint(w, body)
+			}))
+			defer server.Close()
+
+			client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
+			require.NoError(t, err)
+			_, err = client.ListJobRequests(context.Background(), "build-pool")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHTTPAzureAgentClient_CachesPoolID(t *testing.T) {
+	var lookups, jobRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_apis/distributedtask/pools" {
+			lookups++
+			_, _ = fmt.Fprintf(w, `{"value":[{"id":%d,"name":"build-pool"}]}`, 41+lookups)
+			return
+		}
+		jobRequests++
+		// The pool is recreated after the second listing.
+		if jobRequests == 3 {
+			assert.Equal(t, "/_apis/distributedtask/pools/42/jobrequests", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"value":[]}`)
+	}))
+	defer server.Close()
+
+	client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
+	require.NoError(t, err)
+	for range 2 {
+		_, err := client.ListJobRequests(context.Background(), "build-pool")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, lookups)
+
+	_, err = client.ListJobRequests(context.Background(), "build-pool")
+	require.ErrorContains(t, err, "HTTP 404")
+	_, err = client.ListJobRequests(context.Background(), "build-pool")
+	require.NoError(t, err)
+	assert.Equal(t, 2, lookups)
+}
+
+func staticToken(pat string) patCredential {
+	return func(context.Context) (string, error) { return pat, nil }
+}
+
+func TestHTTPAzureAgentClient_DeleteAgent(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			_, _ = fmt.Fprint(w, `{"value":[{"id":42,"name":"build-pool"}]}`)
+			return
+		}
+		assert.Equal(t, http.MethodDelete, r.Method)
+		assert.Equal(t, "/_apis/distributedtask/pools/42/agents/17", r.URL.Path)
+		assert.Equal(t, "7.1", r.URL.Query().Get("api-version"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
+	require.NoError(t, err)
+	require.NoError(t, client.DeleteAgent(context.Background(), "build-pool", 17))
+	assert.Equal(t, 2, requests)
+}
+
+func TestHTTPAzureAgentClient_DisableAgent(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			_, _ = fmt.Fprint(w, `{"value":[{"id":42,"name":"build-pool"}]}`)
+			return
+		}
+		assert.Equal(t, http.MethodPatch, r.Method)
+		assert.Equal(t, "/_apis/distributedtask/pools/42/agents/17", r.URL.Path)
+		assert.Equal(t, "7.1", r.URL.Query().Get("api-version"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"id":17,"enabled":false}`, string(body))
+		_, _ = fmt.Fprint(w, `{"id":17,"enabled":false}`)
+	}))
+	defer server.Close()
+
+	client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
+	require.NoError(t, err)
+	require.NoError(t, client.DisableAgent(context.Background(), "build-pool", 17))
+	assert.Equal(t, 2, requests)
+}
+
+func TestHTTPAzureAgentClient_DeleteAgentFails(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			_, _ = fmt.Fprint(w, `{"value":[{"id":42,"name":"build-pool"}]}`)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client, err := newHTTPAzureAgentClient(server.URL, staticToken("pat"), server.Client())
+	require.NoError(t, err)
+	assert.ErrorContains(t, client.DeleteAgent(context.Background(), "build-pool", 17), "HTTP 403")
+}
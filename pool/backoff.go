@@ -0,0 +1,144 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCreateBackoff is returned by CreateAgent while an agent index waits after
+// failed creations, or while the circuit breaker pauses creation for the pool.
+var ErrCreateBackoff = errors.New("agent creation backing off")
+
+// createTracker counts consecutive failed creations per agent index and for
+// the pool. Once the pool fails BreakerThreshold times in a row, the circuit
+// breaker opens and pauses creation for BreakerCooldown. Then a single agent
+// is created as a probe: its success closes the breaker, and its failure
+// opens it again.
+type createTracker struct {
+	failures     map[int]int
+	retryAt      map[int]time.Time
+	poolFailures int
+	// openUntil is set while the breaker is open. probing is set while the
+	// probe agent is being created.
+	openUntil time.Time
+	probing   bool
+}
+
+// CreationPausedUntil returns when the circuit breaker lets the pool create a
+// probe agent, or the zero time when it is closed.
+func (p *Pool) CreationPausedUntil() time.Time {
+	p.createMu.Lock()
+	defer p.createMu.Unlock()
+	return p.creates.openUntil
+}
+
+// backingOff reports whether creating the agent at idx now would fail with
+// ErrCreateBackoff.
+func (p *Pool) backingOff(idx int) bool {
+	now := p.now()
+
+	p.createMu.Lock()
+	defer p.createMu.Unlock()
+	t := &p.creates
+	if !t.openUntil.IsZero() {
+		return now.Before(t.openUntil) || t.probing
+	}
+	return now.Before(t.retryAt[idx])
+}
+
+// allowCreate decides whether the agent at idx may be created now, and whether
+// it is the probe of an open circuit breaker.
+func (p *Pool) allowCreate(idx int) (bool, error) {
+	now := p.now()
+
+	p.createMu.Lock()
+	defer p.createMu.Unlock()
+	t := &p.creates
+	if !t.openUntil.IsZero() {
+		if now.Before(t.openUntil) {
+			return false, fmt.Errorf("%w: circuit breaker open until %s", ErrCreateBackoff, t.openUntil.Format(time.RFC3339))
+		}
+		if t.probing {
+			return false, fmt.Errorf("%w: circuit breaker is probing", ErrCreateBackoff)
+		}
+		t.probing = true
+		p.logger.Info("create circuit breaker probing", "idx", idx)
+		return true, nil
+	}
+
+	if retryAt := t.retryAt[idx]; now.Before(retryAt) {
+		return false, fmt.Errorf("%w: agent %d failed %d times, retrying at %s",
+			ErrCreateBackoff, idx, t.failures[idx], retryAt.Format(time.RFC3339))
+	}
+	return false, nil
+}
+
+// cancelProbe lets another agent probe the open circuit breaker, after the
+// probe agent was not created at all.
+func (p *Pool) cancelProbe() {
+	p.createMu.Lock()
+	defer p.createMu.Unlock()
+	p.creates.probing = false
+}
+
+// createFinished records the outcome of creating the agent at idx.
+func (p *Pool) createFinished(idx int, probe bool, err error) {
+	conf := p.config()
+	now := p.now()
+
+	p.createMu.Lock()
+	defer p.createMu.Unlock()
+	t := &p.creates
+	if probe {
+		t.probing = false
+	}
+
+	if err == nil {
+		delete(t.failures, idx)
+		delete(t.retryAt, idx)
+		t.poolFailures = 0
+		if !t.openUntil.IsZero() {
+			t.openUntil = time.Time{}
+			createBreakerOpenMetric.WithLabelValues(conf.Name).Set(0)
+			p.logger.Info("create circuit breaker closed", "idx", idx)
+		}
+		return
+	}
+
+	t.failures[idx]++
+	t.retryAt[idx] = now.Add(createDelay(conf.CreateRetry, t.failures[idx]))
+	t.poolFailures++
+
+	switch {
+	case probe:
+		t.openUntil = now.Add(conf.CreateRetry.BreakerCooldown)
+		p.logger.Error("create circuit breaker probe failed, pausing agent creation",
+			"idx", idx,
+			"until", t.openUntil,
+			"err", err,
+		)
+	case t.openUntil.IsZero() && conf.CreateRetry.BreakerThreshold > 0 && t.poolFailures >= conf.CreateRetry.BreakerThreshold:
+		t.openUntil = now.Add(conf.CreateRetry.BreakerCooldown)
+		createBreakerOpenMetric.WithLabelValues(conf.Name).Set(1)
+		createBreakerTripsMetric.WithLabelValues(conf.Name).Inc()
+		p.logger.Error("create circuit breaker opened, pausing agent creation",
+			"failures", t.poolFailures,
+			"until", t.openUntil,
+			"err", err,
+		)
+	}
+}
+
+// createDelay returns how long an agent index waits after failing failures
+// times in a row.
+func createDelay(conf CreateRetryConfig, failures int) time.Duration {
+	delay := conf.Delay
+	for i := 1; i < failures && delay < conf.MaxDelay; i++ {
+		delay *= 2
+	}
+	if conf.MaxDelay > 0 {
+		delay = min(delay, conf.MaxDelay)
+	}
+	return delay
+}
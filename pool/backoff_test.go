@@ -0,0 +1,133 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newBackoffTestPool(t *testing.T, m *mocks.MockInstanceServer, now *time.Time) *Pool {
+	t.Helper()
+	conf := testConfig()
+	conf.CreateRetry = CreateRetryConfig{
+		Delay:            10 * time.Second,
+		MaxDelay:         time.Minute,
+		BreakerThreshold: 2,
+		BreakerCooldown:  5 * time.Minute,
+	}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	p.now = func() time.Time { return *now }
+	return p
+}
+
+func breakerMetrics(t *testing.T) (open, trips float64) {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, createBreakerOpenMetric.WithLabelValues("azp-agent").Write(&m))
+	open = m.GetGauge().GetValue()
+	require.NoError(t, createBreakerTripsMetric.WithLabelValues("azp-agent").Write(&m))
+	return open, m.GetCounter().GetValue()
+}
+
+func TestCreateDelay(t *testing.T) {
+	conf := CreateRetryConfig{Delay: 10 * time.Second, MaxDelay: time.Minute}
+	assert.Equal(t, 10*time.Second, createDelay(conf, 1))
+	assert.Equal(t, 20*time.Second, createDelay(conf, 2))
+	assert.Equal(t, 40*time.Second, createDelay(conf, 3))
+	assert.Equal(t, time.Minute, createDelay(conf, 4))
+	assert.Equal(t, time.Minute, createDelay(conf, 100))
+}
+
+func TestPool_CreateAgent_BacksOffPerIndex(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	now := time.Now()
+	p := newBackoffTestPool(t, m, &now)
+	p.conf.CreateRetry.BreakerThreshold = 0
+	m.On("CreateInstance", mock.Anything).Return(nil, errors.New("image broken")).Twice()
+
+	require.Error(t, p.CreateAgent(context.Background(), 0))
+	err := p.CreateAgent(context.Background(), 0)
+	require.ErrorIs(t, err, ErrCreateBackoff)
+	assert.ErrorContains(t, err, "agent 0 failed 1 times")
+
+	// Reconcile skips the index until its delay has passed.
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-1"}, {Name: "azp-agent-2"},
+	}, nil)
+	queued := make(chan int, 3)
+	require.NoError(t, p.Reconcile(queued))
+	assert.Empty(t, queued)
+
+	now = now.Add(10 * time.Second)
+	require.NoError(t, p.Reconcile(queued))
+	assert.Equal(t, 0, <-queued)
+	require.Error(t, p.CreateAgent(context.Background(), 0))
+
+	// The second failure doubles the delay.
+	now = now.Add(10 * time.Second)
+	require.ErrorIs(t, p.CreateAgent(context.Background(), 0), ErrCreateBackoff)
+	m.AssertNumberOfCalls(t, "CreateInstance", 2)
+}
+
+func TestPool_CreateAgent_CircuitBreaker(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	now := time.Now()
+	p := newBackoffTestPool(t, m, &now)
+	_, trips := breakerMetrics(t)
+
+	m.On("CreateInstance", mock.Anything).Return(nil, errors.New("incus unavailable")).Times(3)
+	require.Error(t, p.CreateAgent(context.Background(), 0))
+	require.Error(t, p.CreateAgent(context.Background(), 1))
+	assert.Equal(t, now.Add(5*time.Minute), p.CreationPausedUntil())
+	open, tripped := breakerMetrics(t)
+	assert.Equal(t, 1.0, open)
+	assert.Equal(t, trips+1, tripped)
+
+	// While open, no agent is created, not even at an index without failures.
+	err := p.CreateAgent(context.Background(), 2)
+	require.ErrorIs(t, err, ErrCreateBackoff)
+	assert.ErrorContains(t, err, "circuit breaker open")
+
+	// After the cooldown, a single failed probe opens the breaker again.
+	now = now.Add(5 * time.Minute)
+	require.Error(t, p.CreateAgent(context.Background(), 2))
+	assert.Equal(t, now.Add(5*time.Minute), p.CreationPausedUntil())
+	require.ErrorIs(t, p.CreateAgent(context.Background(), 2), ErrCreateBackoff)
+
+	// A successful probe closes it.
+	now = now.Add(5 * time.Minute)
+	m.On("CreateInstance", mock.Anything).Return(okOp(t), nil).Once()
+	expectAgentStart(t, m, "azp-agent-2")
+	require.NoError(t, p.CreateAgent(context.Background(), 2))
+	assert.True(t, p.CreationPausedUntil().IsZero())
+	open, tripped = breakerMetrics(t)
+	assert.Equal(t, 0.0, open)
+	assert.Equal(t, trips+1, tripped)
+}
+
+func TestPool_CreateAgent_ProbeIsExclusive(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	now := time.Now()
+	p := newBackoffTestPool(t, m, &now)
+	p.creates.openUntil = now
+
+	probe, err := p.allowCreate(0)
+	require.NoError(t, err)
+	assert.True(t, probe)
+	_, err = p.allowCreate(1)
+	assert.ErrorIs(t, err, ErrCreateBackoff)
+
+	p.cancelProbe()
+	probe, err = p.allowCreate(1)
+	require.NoError(t, err)
+	assert.True(t, probe)
+}
@@ -0,0 +1,292 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// cacheSnapshotPrefix names the snapshots taken before a writer agent starts,
+// so other snapshots of a volume are left alone.
+const cacheSnapshotPrefix = "iap-"
+
+// Config keys stamped onto cache clones. The instance a clone was made for is
+// recorded because instances are renamed when a standby is claimed, so the
+// clone name says nothing about who uses it.
+const (
+	cacheConfigKey         = "user.iap.cache"
+	cacheInstanceConfigKey = "user.iap.instance"
+)
+
+// ValidateCaches checks the cache settings that depend on each other or on the
+// rest of the pool config.
+func (c Config) ValidateCaches() error {
+	var errs []error
+	for _, cache := range c.Caches {
+		if cache.Volume == "" {
+			if cache.Mode == CacheClone {
+				errs = append(errs, fmt.Errorf("cache %q: mode clone requires a volume", cache.Name))
+			}
+			if cache.Writer != nil {
+				errs = append(errs, fmt.Errorf("cache %q: a writer requires a volume", cache.Name))
+			}
+			continue
+		}
+		if cacheStoragePool(c.Incus, cache) == "" {
+			errs = append(errs, fmt.Errorf("cache %q: volume requires storagePool or incus.storagePool", cache.Name))
+		}
+		if cache.Writer != nil && *cache.Writer >= c.Capacity() {
+			errs = append(errs, fmt.Errorf("cache %q: writer %d is not an agent index, capacity is %d", cache.Name, *cache.Writer, c.Capacity()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func cacheStoragePool(conf IncusConfig, cache CacheConfig) string {
+	if cache.StoragePool != "" {
+		return cache.StoragePool
+	}
+	return conf.StoragePool
+}
+
+func cacheDeviceName(cache CacheConfig) string {
+	return "cache-" + cache.Name
+}
+
+// cloneName returns a new name for the clone of a cache volume used by an
+// instance. Names are unique per create: a claimed standby keeps its clone
+// attached under its new name while its slot is created again.
+func (p *Pool) cloneName(instance string, cache CacheConfig) string {
+	return instance + "-cache-" + cache.Name + "-" + strconv.FormatInt(p.now().UnixNano(), 36)
+}
+
+// isCacheWriter reports whether the instance called name mounts cache
+// read-write.
+func (p *Pool) isCacheWriter(name string, cache CacheConfig) bool {
+	if cache.Writer == nil {
+		return false
+	}
+	idx, err := p.agentIndex(name)
+	return err == nil && idx == *cache.Writer
+}
+
+// isAnyCacheWriter reports whether the agent at idx writes to a cache. Writer
+// agents are always created from the image, since a standby mounts its caches
+// like any other agent.
+func (p *Pool) isAnyCacheWriter(idx int) bool {
+	for _, cache := range p.config().Caches {
+		if cache.Writer != nil && *cache.Writer == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// addCacheDevices adds a disk device per cache to the devices of the instance
+// called name.
+func (p *Pool) addCacheDevices(name string, conf Config, devices map[string]map[string]string) {
+	for _, cache := range conf.Caches {
+		device := map[string]string{
+			"type": "disk",
+			"path": cache.Path,
+		}
+		switch {
+		case cache.Volume == "":
+			device["source"] = cache.Source
+			device["readonly"] = "true"
+		case p.isCacheWriter(name, cache):
+			device["pool"] = cacheStoragePool(conf.Incus, cache)
+			device["source"] = cache.Volume
+		case cache.Mode == CacheClone:
+			device["pool"] = cacheStoragePool(conf.Incus, cache)
+			device["source"] = p.cloneName(name, cache)
+		default:
+			device["pool"] = cacheStoragePool(conf.Incus, cache)
+			device["source"] = cache.Volume
+			device["readonly"] = "true"
+		}
+		devices[cacheDeviceName(cache)] = device
+	}
+}
+
+// prepareCaches runs on the server an instance is about to be created on. It
+// snapshots the volumes the instance writes to, and creates the clones its
+// cache devices name from the latest snapshot of their volumes.
+func (p *Pool) prepareCaches(ctx context.Context, server incus.InstanceServer, req api.InstancesPost) error {
+	conf := p.config()
+	for _, cache := range conf.Caches {
+		if cache.Volume == "" {
+			continue
+		}
+		pool := cacheStoragePool(conf.Incus, cache)
+		switch {
+		case p.isCacheWriter(req.Name, cache):
+			if err := p.snapshotCache(ctx, server, pool, cache); err != nil {
+				return fmt.Errorf("snapshot cache %q: %w", cache.Name, err)
+			}
+		case cache.Mode == CacheClone:
+			device, ok := req.Devices[cacheDeviceName(cache)]
+			if !ok {
+				continue
+			}
+			if err := p.cloneCache(server, pool, req.Name, device["source"], cache); err != nil {
+				return fmt.Errorf("clone cache %q: %w", cache.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// cacheSnapshots returns the snapshots the pool took of a cache volume,
+// oldest first.
+func cacheSnapshots(server incus.InstanceServer, pool string, cache CacheConfig) ([]api.StorageVolumeSnapshot, error) {
+	all, err := server.GetStoragePoolVolumeSnapshots(pool, "custom", cache.Volume)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []api.StorageVolumeSnapshot
+	for _, s := range all {
+		// Snapshot names come back as volume/snapshot.
+		if _, name, ok := strings.Cut(s.Name, "/"); ok {
+			s.Name = name
+		}
+		if strings.HasPrefix(s.Name, cacheSnapshotPrefix) {
+			snapshots = append(snapshots, s)
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+func (p *Pool) snapshotCache(ctx context.Context, server incus.InstanceServer, pool string, cache CacheConfig) error {
+	snapshot := cacheSnapshotPrefix + p.now().UTC().Format("20060102T150405Z")
+	op, err := server.CreateStoragePoolVolumeSnapshot(pool, "custom", cache.Volume, api.StorageVolumeSnapshotsPost{Name: snapshot})
+	if err != nil {
+		return err
+	}
+	if err := waitOp(ctx, op, defaultOperationTimeout); err != nil {
+		return err
+	}
+	p.logger.Info("snapshotted cache", "cache", cache.Name, "volume", cache.Volume, "snapshot", snapshot)
+
+	snapshots, err := cacheSnapshots(server, pool, cache)
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > max(cache.KeepSnapshots, 1) {
+		op, err := server.DeleteStoragePoolVolumeSnapshot(pool, "custom", cache.Volume, snapshots[0].Name)
+		if err == nil {
+			err = waitOp(ctx, op, defaultOperationTimeout)
+		}
+		if err != nil {
+			p.logger.Warn("unable to delete cache snapshot", "cache", cache.Name, "snapshot", snapshots[0].Name, "err", err)
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// cloneCache creates the clone of a cache volume for the instance called name
+// from the latest snapshot, or from the volume itself before the first one.
+func (p *Pool) cloneCache(server incus.InstanceServer, pool, name, clone string, cache CacheConfig) error {
+	source := cache.Volume
+	snapshots, err := cacheSnapshots(server, pool, cache)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		source += "/" + snapshots[len(snapshots)-1].Name
+	}
+
+	return server.CreateStoragePoolVolume(pool, api.StorageVolumesPost{
+		Name: clone,
+		Type: "custom",
+		StorageVolumePut: api.StorageVolumePut{
+			Config: map[string]string{
+				poolConfigKey:          p.config().Name,
+				cacheConfigKey:         cache.Name,
+				cacheInstanceConfigKey: name,
+			},
+		},
+		Source: api.StorageVolumeSource{
+			Type: "copy",
+			Name: source,
+			Pool: pool,
+		},
+	})
+}
+
+// CleanupCaches deletes the cache clones of instances that are gone. Clones
+// are found by the pool and instance stamped on them; those still attached to
+// an instance, or made for an instance being created, are kept.
+func (p *Pool) CleanupCaches(ctx context.Context) error {
+	conf := p.config()
+	var clones []CacheConfig
+	for _, cache := range conf.Caches {
+		if cache.Volume != "" && cache.Mode == CacheClone {
+			clones = append(clones, cache)
+		}
+	}
+	if len(clones) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for _, pl := range p.placements {
+		server := p.remotes[pl.remote].Server
+		if pl.target != "" {
+			server = server.UseTarget(pl.target)
+		}
+		for _, cache := range clones {
+			pool := cacheStoragePool(conf.Incus, cache)
+			volumes, err := server.GetStoragePoolVolumes(pool)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("list volumes of %s on %s: %w", pool, p.label(pl), err))
+				continue
+			}
+			for _, v := range volumes {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if v.Type != "custom" || v.Config[poolConfigKey] != conf.Name || v.Config[cacheConfigKey] != cache.Name ||
+					len(v.UsedBy) > 0 || p.creatingInstance(v.Config[cacheInstanceConfigKey]) {
+					continue
+				}
+				// Cluster members can list the same volume, so it may be gone.
+				err := server.DeleteStoragePoolVolume(pool, "custom", v.Name)
+				if api.StatusErrorCheck(err, http.StatusNotFound) {
+					continue
+				}
+				if err != nil {
+					errs = append(errs, fmt.Errorf("delete cache clone %q: %w", v.Name, err))
+					continue
+				}
+				p.logger.Info("deleted cache clone", "cache", cache.Name, "volume", v.Name)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// creatingInstance reports whether the instance called name is being
+// created, so the clones made for it may not be attached yet.
+func (p *Pool) creatingInstance(name string) bool {
+	if idx, err := p.agentIndex(name); err == nil {
+		_, creating := p.inFlight.Load(idx)
+		return creating
+	}
+	if _, err := p.standbyIndex(name); err == nil {
+		_, creating := p.standbyInFlight.Load(name)
+		return creating
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package pool
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func cacheConfig() Config {
+	conf := testConfig()
+	conf.Incus.StoragePool = "default"
+	writer := 0
+	conf.Caches = []CacheConfig{
+		{Name: "apt", Path: "/var/cache/apt", Source: "/srv/apt", Mode: CacheReadOnly},
+		{Name: "npm", Path: "/home/agent/.npm", Volume: "npm-cache", Mode: CacheReadOnly, Writer: &writer},
+		{Name: "nuget", Path: "/home/agent/.nuget", Volume: "nuget-cache", StoragePool: "fast", Mode: CacheClone, KeepSnapshots: 2},
+	}
+	return conf
+}
+
+func TestPool_InstanceRequest_CacheDevices(t *testing.T) {
+	p, err := NewPool(mocks.NewMockInstanceServer(t), cacheConfig())
+	require.NoError(t, err)
+
+	req := p.instanceRequest(p.AgentName(1))
+	assert.Equal(t, map[string]string{
+		"type": "disk", "path": "/var/cache/apt", "source": "/srv/apt", "readonly": "true",
+	}, req.Devices["cache-apt"])
+	assert.Equal(t, map[string]string{
+		"type": "disk", "path": "/home/agent/.npm", "pool": "default", "source": "npm-cache", "readonly": "true",
+	}, req.Devices["cache-npm"])
+	assert.Regexp(t, `^azp-agent-1-cache-nuget-[0-9a-z]+$`, req.Devices["cache-nuget"]["source"])
+	assert.Equal(t, map[string]string{
+		"type": "disk", "path": "/home/agent/.nuget", "pool": "fast", "source": req.Devices["cache-nuget"]["source"],
+	}, req.Devices["cache-nuget"])
+
+	// The writer mounts its volume read-write.
+	req = p.instanceRequest(p.AgentName(0))
+	assert.Equal(t, map[string]string{
+		"type": "disk", "path": "/home/agent/.npm", "pool": "default", "source": "npm-cache",
+	}, req.Devices["cache-npm"])
+	assert.True(t, p.isAnyCacheWriter(0))
+	assert.False(t, p.isAnyCacheWriter(1))
+}
+
+func TestPool_PrepareCaches_ClonesLatestSnapshot(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, cacheConfig())
+	require.NoError(t, err)
+	now := time.Now()
+	m.On("GetStoragePoolVolumeSnapshots", "fast", "custom", "nuget-cache").Return([]api.StorageVolumeSnapshot{
+		{Name: "nuget-cache/iap-2", CreatedAt: now},
+		{Name: "nuget-cache/manual", CreatedAt: now.Add(time.Hour)},
+		{Name: "nuget-cache/iap-1", CreatedAt: now.Add(-time.Hour)},
+	}, nil)
+	req := p.instanceRequest(p.AgentName(1))
+	m.On("CreateStoragePoolVolume", "fast", api.StorageVolumesPost{
+		Name: req.Devices["cache-nuget"]["source"],
+		Type: "custom",
+		StorageVolumePut: api.StorageVolumePut{Config: map[string]string{
+			"user.iap.pool": "azp-agent", "user.iap.cache": "nuget", "user.iap.instance": "azp-agent-1",
+		}},
+		Source: api.StorageVolumeSource{Type: "copy", Name: "nuget-cache/iap-2", Pool: "fast"},
+	}).Return(nil)
+
+	require.NoError(t, p.prepareCaches(context.Background(), m, req))
+}
+
+func TestPool_CloneName_UniquePerCreate(t *testing.T) {
+	p, err := NewPool(mocks.NewMockInstanceServer(t), cacheConfig())
+	require.NoError(t, err)
+	now := time.Now()
+	p.now = func() time.Time { now = now.Add(time.Millisecond); return now }
+
+	// A claimed standby keeps its clone while its slot is created again.
+	name := p.StandbyName(0)
+	assert.NotEqual(t, p.instanceRequest(name).Devices["cache-nuget"]["source"],
+		p.instanceRequest(name).Devices["cache-nuget"]["source"])
+}
+
+func TestPool_PrepareCaches_WriterSnapshots(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := cacheConfig()
+	conf.Caches[1].KeepSnapshots = 2
+	conf.Caches = conf.Caches[:2]
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	m.On("CreateStoragePoolVolumeSnapshot", "default", "custom", "npm-cache",
+		api.StorageVolumeSnapshotsPost{Name: "iap-20260301T120000Z"}).Return(okOp(t), nil)
+	m.On("GetStoragePoolVolumeSnapshots", "default", "custom", "npm-cache").Return([]api.StorageVolumeSnapshot{
+		{Name: "npm-cache/iap-20260301T120000Z", CreatedAt: now},
+		{Name: "npm-cache/iap-20260228T120000Z", CreatedAt: now.Add(-24 * time.Hour)},
+		{Name: "npm-cache/iap-20260227T120000Z", CreatedAt: now.Add(-48 * time.Hour)},
+	}, nil)
+	m.On("DeleteStoragePoolVolumeSnapshot", "default", "custom", "npm-cache", "iap-20260227T120000Z").Return(okOp(t), nil)
+
+	require.NoError(t, p.prepareCaches(context.Background(), m, p.instanceRequest(p.AgentName(0))))
+	m.AssertNumberOfCalls(t, "DeleteStoragePoolVolumeSnapshot", 1)
+
+	// Other agents mount the volume read-only as is.
+	require.NoError(t, p.prepareCaches(context.Background(), m, p.instanceRequest(p.AgentName(1))))
+	m.AssertNumberOfCalls(t, "CreateStoragePoolVolumeSnapshot", 1)
+}
+
+func TestPool_CleanupCaches(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, cacheConfig())
+	require.NoError(t, err)
+	clone := func(name, pool, cache, instance string, usedBy ...string) api.StorageVolume {
+		v := api.StorageVolume{Name: name, Type: "custom", UsedBy: usedBy}
+		v.Config = map[string]string{"user.iap.pool": pool, "user.iap.cache": cache, "user.iap.instance": instance}
+		return v
+	}
+	m.On("GetStoragePoolVolumes", "fast").Return([]api.StorageVolume{
+		{Name: "nuget-cache", Type: "custom"},
+		// A claimed standby keeps the clone made for it under its new name.
+		clone("azp-agent-standby-0-cache-nuget-a", "azp-agent", "nuget", "azp-agent-standby-0", "/1.0/instances/azp-agent-0"),
+		clone("azp-agent-standby-0-cache-nuget-b", "azp-agent", "nuget", "azp-agent-standby-0"),
+		clone("azp-agent-1-cache-nuget-a", "azp-agent", "nuget", "azp-agent-1"),
+		clone("azp-agent-2-cache-nuget-a", "azp-agent", "nuget", "azp-agent-2"),
+		clone("other-0-cache-nuget-a", "other", "nuget", "other-0"),
+		clone("azp-agent-1-cache-npm-a", "azp-agent", "npm", "azp-agent-1"),
+	}, nil)
+	m.On("DeleteStoragePoolVolume", "fast", "custom", "azp-agent-1-cache-nuget-a").Return(nil)
+	m.On("DeleteStoragePoolVolume", "fast", "custom", "azp-agent-standby-0-cache-nuget-b").
+		Return(api.StatusErrorf(http.StatusNotFound, "not found"))
+
+	// Agent 2 is being created, so its clone is not attached yet.
+	p.inFlight.Store(2, true)
+	require.NoError(t, p.CleanupCaches(context.Background()))
+	m.AssertNumberOfCalls(t, "DeleteStoragePoolVolume", 2)
+}
+
+func TestPool_CleanupCaches_NoClones(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := cacheConfig()
+	conf.Caches = conf.Caches[:2]
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	require.NoError(t, p.CleanupCaches(context.Background()))
+	m.AssertNotCalled(t, "GetStoragePoolVolumes", mock.Anything)
+}
+
+func TestConfig_ValidateCaches(t *testing.T) {
+	require.NoError(t, cacheConfig().ValidateCaches())
+
+	conf := cacheConfig()
+	conf.Incus.StoragePool = ""
+	writer := 3
+	conf.Caches[0].Mode = CacheClone
+	conf.Caches[0].Writer = &writer
+	conf.Caches[2].Writer = &writer
+	err := conf.ValidateCaches()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `cache "apt": mode clone requires a volume`)
+	assert.ErrorContains(t, err, `cache "apt": a writer requires a volume`)
+	assert.ErrorContains(t, err, `cache "npm": volume requires storagePool or incus.storagePool`)
+	assert.ErrorContains(t, err, `cache "nuget": writer 3 is not an agent index, capacity is 3`)
+}
@@ -0,0 +1,274 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// A canary rollout pins both images to fingerprints when it starts, so
+// republishing an alias mid-rollout changes neither side. Each canary agent
+// contributes one outcome: a failed create, a reap because the agent never came
+// up, or the result of its job. Only jobs of instances created from the
+// candidate count. Once enough outcomes are in and too many have failed, the
+// pool rolls back to the previous fingerprint for good.
+
+// canaryRollout tracks one candidate image rollout. It is guarded by the
+// pool's imageMu.
+type canaryRollout struct {
+	// base and image are the configured images the state belongs to, and
+	// candidate and stable are the fingerprints they resolved to.
+	base      string
+	image     string
+	candidate string
+	stable    string
+	since     time.Time
+	successes int
+	failures  int
+	seenJobs  map[int64]bool
+	// agents holds when the candidate instance at each agent index was
+	// created, so jobs of instances on the previous image are not counted.
+	agents map[int]time.Time
+	// rolledBack is set once the failure threshold was crossed.
+	rolledBack bool
+}
+
+// CanaryInfo summarizes a candidate image rollout.
+type CanaryInfo struct {
+	Image       string `json:"image"`
+	Fingerprint string `json:"fingerprint"`
+	Previous    string `json:"previous"`
+	Agents      int    `json:"agents"`
+	Successes   int    `json:"successes"`
+	Failures    int    `json:"failures"`
+	RolledBack  bool   `json:"rolledBack"`
+}
+
+// startCanary resets the rollout state when the configured images change,
+// resolving both to fingerprints. It is a no-op while they stay the same, so a
+// config reload does not restart a rollout.
+func (p *Pool) startCanary(conf Config) error {
+	p.imageMu.Lock()
+	defer p.imageMu.Unlock()
+
+	if conf.Incus.Canary == nil {
+		p.canary = canaryRollout{}
+		return nil
+	}
+	if conf.Incus.Canary.Image == p.canary.image && conf.Incus.Image == p.canary.base {
+		return nil
+	}
+
+	stable, err := p.resolveImage(conf.Incus.Image)
+	if err != nil {
+		return fmt.Errorf("resolve image %q: %w", conf.Incus.Image, err)
+	}
+	candidate, err := p.resolveImage(conf.Incus.Canary.Image)
+	if err != nil {
+		return fmt.Errorf("resolve canary image %q: %w", conf.Incus.Canary.Image, err)
+	}
+
+	p.canary = canaryRollout{
+		base:      conf.Incus.Image,
+		image:     conf.Incus.Canary.Image,
+		candidate: candidate,
+		stable:    stable,
+		since:     p.now(),
+		seenJobs:  map[int64]bool{},
+		agents:    map[int]time.Time{},
+	}
+	p.logger.Info("starting canary rollout",
+		"candidate", candidate,
+		"previous", stable,
+		"agents", canaryAgents(conf),
+	)
+	return nil
+}
+
+// canaryAgents returns how many of the lowest agent indices run the candidate.
+func canaryAgents(conf Config) int {
+	if conf.Incus.Canary == nil {
+		return 0
+	}
+	return (conf.Capacity()*conf.Incus.Canary.Percent + 99) / 100
+}
+
+// isRolledBackCanary reports whether instance was created from a candidate
+// image that has since been rolled back.
+func (p *Pool) isRolledBackCanary(instance api.InstanceFull) bool {
+	p.imageMu.Lock()
+	defer p.imageMu.Unlock()
+	return p.canary.rolledBack && instanceFingerprint(instance.Config) == p.canary.candidate
+}
+
+// isCanaryInstance reports whether instance was created from the candidate
+// image of the rollout in progress.
+func (p *Pool) isCanaryInstance(instance api.InstanceFull) bool {
+	p.imageMu.Lock()
+	defer p.imageMu.Unlock()
+	return p.canary.candidate != "" && !p.canary.rolledBack &&
+		instanceFingerprint(instance.Config) == p.canary.candidate
+}
+
+// noteCanaryAgent records whether the instance just created at idx runs the
+// candidate image.
+func (p *Pool) noteCanaryAgent(idx int, canary bool, createdAt time.Time) {
+	p.imageMu.Lock()
+	defer p.imageMu.Unlock()
+	if p.canary.agents == nil {
+		return
+	}
+	if canary {
+		p.canary.agents[idx] = createdAt
+	} else {
+		delete(p.canary.agents, idx)
+	}
+}
+
+// recordCanaryOutcome counts one canary outcome and rolls back once the failure
+// rate crosses the configured threshold.
+func (p *Pool) recordCanaryOutcome(success bool, detail string) {
+	conf := p.config()
+	if conf.Incus.Canary == nil {
+		return
+	}
+
+	p.imageMu.Lock()
+	defer p.imageMu.Unlock()
+	if p.canary.candidate == "" || p.canary.rolledBack {
+		return
+	}
+
+	if success {
+		p.canary.successes++
+		canaryOutcomesMetric.WithLabelValues(conf.Name, "success").Inc()
+	} else {
+		p.canary.failures++
+		canaryOutcomesMetric.WithLabelValues(conf.Name, "failure").Inc()
+		p.logger.Warn("canary agent failed", "candidate", p.canary.candidate, "detail", detail)
+	}
+
+	total := p.canary.successes + p.canary.failures
+	if total < conf.Incus.Canary.MinSamples || p.canary.failures*100 <= total*conf.Incus.Canary.MaxFailurePercent {
+		return
+	}
+
+	p.canary.rolledBack = true
+	canaryRollbacksMetric.WithLabelValues(conf.Name).Inc()
+	p.logger.Error("canary failure rate exceeded threshold, rolling back",
+		"candidate", p.canary.candidate,
+		"previous", p.canary.stable,
+		"failures", p.canary.failures,
+		"outcomes", total,
+		"max_failure_percent", conf.Incus.Canary.MaxFailurePercent,
+	)
+}
+
+// ObserveCanary counts the results of the jobs canary agents finished since
+// the rollout started. Candidate instances the pool did not create, for
+// example before a daemon restart, are found by their image fingerprint.
+func (p *Pool) ObserveCanary(ctx context.Context) error {
+	conf := p.config()
+	if conf.Incus.Canary == nil {
+		return nil
+	}
+
+	p.imageMu.Lock()
+	active := p.canary.candidate != "" && !p.canary.rolledBack
+	since, candidate := p.canary.since, p.canary.candidate
+	p.imageMu.Unlock()
+	if !active {
+		return nil
+	}
+
+	instances, err := p.ListAgents()
+	if err != nil {
+		return err
+	}
+	p.imageMu.Lock()
+	for _, i := range instances {
+		idx, err := p.agentIndex(i.Name)
+		if err != nil || instanceFingerprint(i.Config) != candidate || p.canary.agents == nil {
+			continue
+		}
+		if created, ok := p.canary.agents[idx]; !ok || i.CreatedAt.After(created) {
+			p.canary.agents[idx] = i.CreatedAt
+		}
+	}
+	p.imageMu.Unlock()
+
+	requests, err := p.azure.ListFinishedJobRequests(ctx, conf.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range requests {
+		if r.FinishTime.Before(since) {
+			continue
+		}
+		matches := p.azureAgentRe.FindStringSubmatch(r.AgentName)
+		if len(matches) < 2 {
+			continue
+		}
+		idx, err := strconv.Atoi(matches[1])
+		if err != nil {
+			continue
+		}
+		p.imageMu.Lock()
+		created, ok := p.canary.agents[idx]
+		p.imageMu.Unlock()
+		if !ok || r.FinishTime.Before(created) {
+			continue
+		}
+
+		var success bool
+		switch r.Result {
+		case "succeeded", "succeededWithIssues":
+			success = true
+		case "abandoned":
+			success = false
+		case "failed":
+			if !conf.Incus.Canary.CountFailedJobs {
+				continue
+			}
+			success = false
+		default:
+			continue
+		}
+
+		p.imageMu.Lock()
+		seen := p.canary.seenJobs[r.RequestID]
+		if p.canary.seenJobs != nil {
+			p.canary.seenJobs[r.RequestID] = true
+		}
+		p.imageMu.Unlock()
+		if !seen {
+			p.recordCanaryOutcome(success, fmt.Sprintf("job %d %s", r.RequestID, r.Result))
+		}
+	}
+	return nil
+}
+
+// CanaryInfo returns the state of the candidate image rollout, or nil when
+// none is configured.
+func (p *Pool) CanaryInfo() *CanaryInfo {
+	conf := p.config()
+	if conf.Incus.Canary == nil {
+		return nil
+	}
+
+	p.imageMu.Lock()
+	defer p.imageMu.Unlock()
+	return &CanaryInfo{
+		Image:       conf.Incus.Canary.Image,
+		Fingerprint: p.canary.candidate,
+		Previous:    p.canary.stable,
+		Agents:      canaryAgents(conf),
+		Successes:   p.canary.successes,
+		Failures:    p.canary.failures,
+		RolledBack:  p.canary.rolledBack,
+	}
+}
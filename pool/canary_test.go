@@ -0,0 +1,230 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func canaryTestConfig() Config {
+	conf := testConfig()
+	conf.AgentCount = 4
+	conf.AgentPrefix = "runner"
+	conf.Incus.Canary = &CanaryConfig{
+		Image:             "candidate-image",
+		Percent:           25,
+		MaxFailurePercent: 50,
+		MinSamples:        2,
+	}
+	return conf
+}
+
+func expectImageAliases(m *mocks.MockInstanceServer) {
+	m.On("GetImageAlias", "test-image").Return(&api.ImageAliasesEntry{
+		ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "stable-fp"},
+	}, "", nil)
+	m.On("GetImageAlias", "candidate-image").Return(&api.ImageAliasesEntry{
+		ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "candidate-fp"},
+	}, "", nil)
+}
+
+// agentOnImage returns an agent instance stamped with the image it runs.
+func agentOnImage(name string, created time.Time, fingerprint string) api.Instance {
+	i := api.Instance{Name: name, CreatedAt: created}
+	i.Config = map[string]string{"user.iap.image-fingerprint": fingerprint}
+	return i
+}
+
+func newCanaryTestPool(t *testing.T, m *mocks.MockInstanceServer, azure AzureAgentClient) *Pool {
+	t.Helper()
+	expectImageAliases(m)
+	p, err := NewPool(m, canaryTestConfig())
+	require.NoError(t, err)
+	p.azure = azure
+	return p
+}
+
+func TestNewPool_CanaryResolvesFingerprints(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetImageAlias", "test-image").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "not found"))
+	m.On("GetImage", "test-image").Return(&api.Image{Fingerprint: "stable-fp"}, "", nil)
+	m.On("GetImageAlias", "candidate-image").Return(&api.ImageAliasesEntry{
+		ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "candidate-fp"},
+	}, "", nil)
+
+	p, err := NewPool(m, canaryTestConfig())
+	require.NoError(t, err)
+	assert.Equal(t, &CanaryInfo{
+		Image:       "candidate-image",
+		Fingerprint: "candidate-fp",
+		Previous:    "stable-fp",
+		Agents:      1,
+	}, p.CanaryInfo())
+}
+
+func TestNewPool_CanaryImageMissing(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetImageAlias", "test-image").Return(nil, "", errors.New("connection refused"))
+
+	_, err := NewPool(m, canaryTestConfig())
+	assert.ErrorContains(t, err, `resolve image "test-image"`)
+}
+
+func TestPool_CreateAgent_CanaryUsesCandidate(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p := newCanaryTestPool(t, m, &fakeAzureAgentClient{})
+
+	m.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Name == "azp-agent-0" && req.Source.Fingerprint == "candidate-fp" && req.Source.Alias == ""
+	})).Return(okOp(t), nil).Once()
+	m.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Name == "azp-agent-1" && req.Source.Fingerprint == "stable-fp" && req.Source.Alias == ""
+	})).Return(okOp(t), nil).Once()
+	expectAgentStart(t, m, "azp-agent-0")
+	expectAgentStart(t, m, "azp-agent-1")
+
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+	require.NoError(t, p.CreateAgent(context.Background(), 1))
+}
+
+func TestPool_CanaryRollsBackAboveThreshold(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p := newCanaryTestPool(t, m, &fakeAzureAgentClient{})
+
+	m.On("CreateInstance", mock.Anything).Return(nil, errors.New("image is broken"))
+	require.Error(t, p.CreateAgent(context.Background(), 0))
+	p.recordCanaryOutcome(true, "job succeeded")
+	assert.False(t, p.CanaryInfo().RolledBack, "a 50% failure rate does not cross the threshold")
+
+	source, canary := p.imageSource(0)
+	assert.True(t, canary)
+	assert.Equal(t, "candidate-fp", source.Fingerprint)
+
+	p.recordCanaryOutcome(false, "job failed")
+	assert.True(t, p.CanaryInfo().RolledBack)
+
+	source, canary = p.imageSource(0)
+	assert.False(t, canary)
+	assert.Equal(t, "stable-fp", source.Fingerprint)
+}
+
+func TestPool_ObserveCanary(t *testing.T) {
+	now := time.Now()
+	m := mocks.NewMockInstanceServer(t)
+	azure := &fakeAzureAgentClient{}
+	p := newCanaryTestPool(t, m, azure)
+	p.canary.since = now
+
+	// The agent on the canary index was created before the rollout.
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		agentOnImage("azp-agent-0", now.Add(-time.Hour), "stable-fp"),
+	}, nil).Once()
+	azure.finished = []AzureJobRequest{
+		{RequestID: 1, AgentName: "runner-0", FinishTime: now.Add(time.Minute), Result: "abandoned"},
+	}
+	require.NoError(t, p.ObserveCanary(context.Background()))
+	assert.Equal(t, 0, p.CanaryInfo().Failures, "jobs of agents on the previous image are ignored")
+
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	p.noteCanaryAgent(0, true, now.Add(2*time.Minute))
+	azure.finished = append(azure.finished,
+		AzureJobRequest{RequestID: 2, AgentName: "runner-0", FinishTime: now.Add(3 * time.Minute), Result: "succeeded"},
+		AzureJobRequest{RequestID: 3, AgentName: "runner-0", FinishTime: now.Add(3 * time.Minute), Result: "canceled"},
+		AzureJobRequest{RequestID: 4, AgentName: "runner-0", FinishTime: now.Add(3 * time.Minute), Result: "failed"},
+		AzureJobRequest{RequestID: 5, AgentName: "runner-1", FinishTime: now.Add(3 * time.Minute), Result: "abandoned"},
+		AzureJobRequest{RequestID: 6, AgentName: "other-0", FinishTime: now.Add(3 * time.Minute), Result: "abandoned"},
+		AzureJobRequest{RequestID: 7, AgentName: "runner-0", FinishTime: now.Add(-time.Minute), Result: "abandoned"},
+	)
+	require.NoError(t, p.ObserveCanary(context.Background()))
+	require.NoError(t, p.ObserveCanary(context.Background()))
+
+	info := p.CanaryInfo()
+	assert.Equal(t, 1, info.Successes, "each job is counted once")
+	assert.Equal(t, 0, info.Failures, "old, canceled, failed, and non-canary jobs are ignored")
+}
+
+func TestPool_ObserveCanary_CountFailedJobs(t *testing.T) {
+	now := time.Now()
+	m := mocks.NewMockInstanceServer(t)
+	azure := &fakeAzureAgentClient{}
+	p := newCanaryTestPool(t, m, azure)
+	conf := canaryTestConfig()
+	conf.Incus.Canary.CountFailedJobs = true
+	require.NoError(t, p.Reconfigure(conf))
+	p.canary.since = now
+
+	// A candidate agent created before a daemon restart is found by its image.
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		agentOnImage("azp-agent-0", now, "candidate-fp"),
+	}, nil)
+	azure.finished = []AzureJobRequest{
+		{RequestID: 1, AgentName: "runner-0", FinishTime: now.Add(time.Minute), Result: "failed"},
+		{RequestID: 2, AgentName: "runner-0", FinishTime: now.Add(time.Minute), Result: "abandoned"},
+	}
+	require.NoError(t, p.ObserveCanary(context.Background()))
+
+	info := p.CanaryInfo()
+	assert.Equal(t, 2, info.Failures)
+	assert.True(t, info.RolledBack)
+}
+
+func TestPool_Reap_StopsIdleRolledBackCanary(t *testing.T) {
+	now := time.Now()
+	m := mocks.NewMockInstanceServer(t)
+	p := newCanaryTestPool(t, m, &fakeAzureAgentClient{})
+	p.canary.rolledBack = true
+
+	instance := oldRunningAgent("azp-agent-0", now)
+	instance.Config = map[string]string{"volatile.base_image": "candidate-fp"}
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{instance}, nil)
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[len(req.Command)-1] == "Agent.Worker"
+	}), mock.Anything).Return(processResult(t, false), nil).Once()
+	expectStop(m, t, "azp-agent-0")
+
+	require.NoError(t, p.Reap(context.Background()))
+	m.AssertCalled(t, "UpdateInstanceState", "azp-agent-0", mock.Anything, "")
+}
+
+func TestPool_IsCanaryInstance_PrefersStampedFingerprint(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p := newCanaryTestPool(t, m, &fakeAzureAgentClient{})
+	p.canary.candidate = "candidate-fp"
+
+	instance := oldRunningAgent("azp-agent-0", time.Now())
+	instance.Config = map[string]string{
+		fingerprintConfigKey:  "candidate-fp",
+		"volatile.base_image": "other-fp",
+	}
+	assert.True(t, p.isCanaryInstance(instance))
+	assert.False(t, p.isRolledBackCanary(instance))
+
+	p.canary.rolledBack = true
+	assert.False(t, p.isCanaryInstance(instance))
+	assert.True(t, p.isRolledBackCanary(instance))
+}
+
+func TestPool_Reconfigure_KeepsCanaryRollout(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p := newCanaryTestPool(t, m, &fakeAzureAgentClient{})
+	p.recordCanaryOutcome(true, "job succeeded")
+
+	conf := canaryTestConfig()
+	conf.AgentCount = 2
+	require.NoError(t, p.Reconfigure(conf))
+	assert.Equal(t, 1, p.CanaryInfo().Successes)
+
+	conf.Incus.Canary = nil
+	require.NoError(t, p.Reconfigure(conf))
+	assert.Nil(t, p.CanaryInfo())
+	source, _ := p.imageSource(0)
+	assert.Equal(t, "test-image", source.Alias)
+}
@@ -3,8 +3,14 @@ package pool
 import "time"
 
 type Config struct {
-	// AgentCount is the number of agents to run on this node
-	AgentCount int `json:"agentCount" validate:"required,min=1,max=64"`
+	// AgentCount is the number of agents to run on this node. Mutually exclusive with MaxAgents.
+	AgentCount int `json:"agentCount,omitempty" validate:"required_without=MaxAgents,excluded_with=MaxAgents,omitempty,min=1,max=64"`
+	// MinAgents is the number of agents kept running when the Azure job queue is empty.
+	// Only used when MaxAgents is set. Default: 0
+	MinAgents int `json:"minAgents,omitempty" validate:"min=0,ltefield=MaxAgents"`
+	// MaxAgents enables demand-driven autoscaling. The pool runs one agent per queued or
+	// running job in the Azure pool, bounded by MinAgents and MaxAgents.
+	MaxAgents int `json:"maxAgents,omitempty" validate:"omitempty,min=1,max=64"`
 	// AgentPrefix overrides the hostname used for Azure agent naming.
 	// If not set, defaults to the machine's hostname.
 	// Must be unique per host to avoid agent name collisions.
@@ -12,10 +18,30 @@ type Config struct {
 	// OfflineGracePeriod is how long an unassigned Azure agent must remain offline
 	// with no local Agent.Worker before its instance is reaped. Default: 5m
 	OfflineGracePeriod time.Duration `json:"offlineGracePeriod,omitempty" validate:"min=0" default:"5m" jsonschema:"type=string"`
+	// MaxLifetime is how long an agent instance may run before the reaper stops
+	// it, even in the middle of a job. 0 disables the limit. Default: 0
+	MaxLifetime time.Duration `json:"maxLifetime,omitempty" validate:"min=0" jsonschema:"type=string"`
+	// MaxJobDuration is how long an agent may run one Azure job before the
+	// reaper stops it. 0 disables the limit. Default: 0
+	MaxJobDuration time.Duration `json:"maxJobDuration,omitempty" validate:"min=0" jsonschema:"type=string"`
+	// Caches are host directories or Incus custom volumes mounted into every
+	// agent, so jobs do not download the same dependencies again.
+	Caches []CacheConfig `json:"caches,omitempty" validate:"unique=Name,dive"`
+	// Docker contains settings for the Docker daemon inside agents.
+	Docker DockerConfig `json:"docker,omitempty"`
+	// CreateRetry contains settings for backing off after failed agent creations.
+	CreateRetry CreateRetryConfig `json:"createRetry,omitempty"`
 	// Azure specific settings
 	Azure AzureConfig `json:"azure" validate:"required"`
 	// Incus specific settings
 	Incus IncusConfig `json:"incus" validate:"required"`
+	// Remotes are the names of the Incus remotes the pool spreads its agents
+	// over, each new agent going to the one with the most free memory.
+	// Default: the local Incus daemon
+	Remotes []string `json:"remotes,omitempty" validate:"unique"`
+	// Targets are the members of a clustered remote to spread agents over. Only
+	// valid with a single remote.
+	Targets []string `json:"targets,omitempty" validate:"unique"`
 	// Env is a map of environment variables to set when running the agent.
 	Env map[string]string `json:"env,omitempty"`
 	// Name is the name of the Azure Devops pool to run agents for.
@@ -23,6 +49,19 @@ type Config struct {
 	Name string `json:"name" validate:"required,hostname"`
 }
 
+// Capacity returns the highest number of agents the pool may run at once.
+func (c Config) Capacity() int {
+	if c.Autoscaling() {
+		return c.MaxAgents
+	}
+	return c.AgentCount
+}
+
+// Autoscaling reports whether the pool is sized from the Azure job queue.
+func (c Config) Autoscaling() bool {
+	return c.MaxAgents > 0
+}
+
 type IncusConfig struct {
 	// MaxCores specifies the max number of cores that each agent can use. For container pools it sets
 	// limits.cpu.allowance as a percentage-based soft limit; for VM pools it sets limits.cpu as a hard
@@ -47,13 +86,134 @@ type IncusConfig struct {
 	// StoragePool is the Incus storage pool used to size the VM root disk when
 	// DiskSizeInGb is set on a VM pool. Leave empty to use Incus's default pool.
 	StoragePool string `json:"storagePool,omitempty"`
+	// Profiles are the Incus profiles applied to agent instances, in order.
+	// Default: the default profile
+	Profiles []string `json:"profiles,omitempty" validate:"unique,dive,required"`
+	// Config is merged over the instance config the pool sets, such as
+	// security.nesting and the limits above. Keys must fit the instance type.
+	Config map[string]string `json:"config,omitempty"`
+	// Devices are merged over the devices the pool adds, replacing any device
+	// of the same name. A device of type none removes one inherited from a
+	// profile.
+	Devices map[string]map[string]string `json:"devices,omitempty"`
+	// WarmStandby is the number of stopped instances kept ready for this pool. When an
+	// agent slot frees up, a standby is renamed and started instead of creating a new
+	// instance from the image. Default: 0 (disabled)
+	WarmStandby int `json:"warmStandby,omitempty" validate:"min=0,max=64"`
 	// StartupGracePeriod is how long to wait before considering an agent stale
 	StartupGracePeriod time.Duration `json:"startupGracePeriod,omitempty"`
+	// Canary rolls a candidate image out to a share of the agents before the
+	// whole pool uses it. While set, the other agents stay on the image Image
+	// pointed to when the rollout started.
+	Canary *CanaryConfig `json:"canary,omitempty"`
+}
+
+// Cache modes.
+const (
+	CacheReadOnly = "readonly"
+	CacheClone    = "clone"
+)
+
+// CacheConfig describes a build cache mounted into agents.
+type CacheConfig struct {
+	// Name identifies the cache. The agent device is called cache-<name>.
+	Name string `json:"name" validate:"required,hostname"`
+	// Path is where the cache is mounted in the agent.
+	Path string `json:"path" validate:"required,startswith=/"`
+	// Source is a host directory to mount. Mutually exclusive with Volume.
+	Source string `json:"source,omitempty" validate:"required_without=Volume,excluded_with=Volume,omitempty,startswith=/"`
+	// Volume is an Incus custom storage volume to mount.
+	Volume string `json:"volume,omitempty"`
+	// StoragePool is the storage pool of Volume. Default: incus.storagePool
+	StoragePool string `json:"storagePool,omitempty"`
+	// Mode is how agents mount the cache: readonly, or clone to give every agent
+	// a writable copy-on-write copy of the latest snapshot of Volume, deleted
+	// with the agent. Default: readonly
+	Mode string `json:"mode,omitempty" default:"readonly" validate:"omitempty,oneof=readonly clone"`
+	// Writer is the index of an agent that mounts Volume read-write to refresh
+	// it. Each time the writer agent is replaced, Volume is snapshotted first,
+	// so clones start from what the last writer job left. Default: none
+	Writer *int `json:"writer,omitempty" validate:"omitempty,min=0"`
+	// KeepSnapshots is the number of snapshots of Volume kept when the writer
+	// takes a new one. Default: 3
+	KeepSnapshots int `json:"keepSnapshots,omitempty" default:"3" validate:"min=0"`
 }
 
+// DockerConfig contains settings for the Docker daemon inside agents.
+type DockerConfig struct {
+	// RegistryMirrors are written to registry-mirrors in /etc/docker/daemon.json
+	// of every agent before it starts, replacing the mirrors of the image. For
+	// example: http://10.0.0.1:5000
+	RegistryMirrors []string `json:"registryMirrors,omitempty" validate:"unique,dive,url"`
+}
+
+// CreateRetryConfig contains settings for backing off after failed agent
+// creations, per agent index and for the whole pool.
+type CreateRetryConfig struct {
+	// Delay is how long an agent index waits after its first failed creation.
+	// It doubles with every further failure. Default: 10s
+	Delay time.Duration `json:"delay,omitempty" default:"10s" validate:"min=0" jsonschema:"type=string"`
+	// MaxDelay caps the wait of an agent index. Default: 5m
+	MaxDelay time.Duration `json:"maxDelay,omitempty" default:"5m" validate:"min=0" jsonschema:"type=string"`
+	// BreakerThreshold is the number of consecutive failed creations in the pool
+	// after which creation is paused. Default: 5
+	BreakerThreshold int `json:"breakerThreshold,omitempty" default:"5" validate:"min=0"`
+	// BreakerCooldown is how long creation stays paused before a single agent is
+	// created to probe whether it works again. Default: 5m
+	BreakerCooldown time.Duration `json:"breakerCooldown,omitempty" default:"5m" validate:"min=0" jsonschema:"type=string"`
+}
+
+// CanaryConfig describes a candidate image rollout.
+type CanaryConfig struct {
+	// Image is the Incus image alias or fingerprint to try on canary agents.
+	Image string `json:"image" validate:"required"`
+	// Percent is the share of agent indices, rounded up, that run Image. Default: 10
+	Percent int `json:"percent,omitempty" default:"10" validate:"min=1,max=100"`
+	// MaxFailurePercent is the share of failed canary outcomes above which the
+	// pool rolls back to the previous image. Default: 20
+	MaxFailurePercent int `json:"maxFailurePercent,omitempty" default:"20" validate:"min=0,max=100"`
+	// MinSamples is the number of canary outcomes needed before the failure rate
+	// is judged. Default: 5
+	MinSamples int `json:"minSamples,omitempty" default:"5" validate:"min=1"`
+	// CountFailedJobs counts canary jobs that failed as canary failures. Off by
+	// default, since ordinary test failures would roll back a good image: only
+	// failed creates, agents that never came up and abandoned jobs count.
+	CountFailedJobs bool `json:"countFailedJobs,omitempty"`
+}
+
+// Azure authentication modes.
+const (
+	AuthPAT              = "pat"
+	AuthServicePrincipal = "servicePrincipal"
+)
+
 type AzureConfig struct {
-	// PAT is an Azure Devops personal access token used for registering the agents
-	PAT string `json:"pat" validate:"required"`
+	// Auth selects how the daemon and its agents authenticate: "pat" for a
+	// personal access token, or "servicePrincipal" for OAuth tokens from
+	// Microsoft Entra ID. Default: pat
+	Auth string `json:"auth,omitempty" default:"pat" validate:"oneof=pat servicePrincipal"`
+	// PAT is an Azure Devops personal access token used for registering the agents.
+	// Instead of the token itself, it can reference one as env:NAME, file:PATH or
+	// exec:COMMAND [ARGS...]. References are resolved again for every new agent.
+	// Required when Auth is pat.
+	PAT string `json:"pat,omitempty" validate:"required_if=Auth pat"`
+	// ServicePrincipal is the Entra ID application used when Auth is servicePrincipal.
+	ServicePrincipal *ServicePrincipalConfig `json:"servicePrincipal,omitempty" validate:"required_if=Auth servicePrincipal"`
 	// Url of the server. For example: https://dev.azure.com/myorganization or http://my-azure-devops-server:8080/tfs
 	Url string `json:"url" validate:"required,url"`
 }
+
+// ServicePrincipalConfig describes a Microsoft Entra ID application that gets
+// tokens with the client credentials flow.
+type ServicePrincipalConfig struct {
+	// TenantID is the directory (tenant) ID of the application.
+	TenantID string `json:"tenantId" validate:"required"`
+	// ClientID is the application (client) ID.
+	ClientID string `json:"clientId" validate:"required"`
+	// ClientSecret is the application's client secret. It accepts the same
+	// references as PAT.
+	ClientSecret string `json:"clientSecret" validate:"required"`
+	// Authority is the Entra ID endpoint tokens are requested from.
+	// Default: https://login.microsoftonline.com
+	Authority string `json:"authority,omitempty" default:"https://login.microsoftonline.com" validate:"url"`
+}
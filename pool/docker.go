@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+const dockerDaemonConfig = "/etc/docker/daemon.json"
+
+// dockerReloadTimeout is how long the Docker reload is retried for while the
+// instance boots, every dockerReloadInterval.
+var (
+	dockerReloadTimeout  = time.Minute
+	dockerReloadInterval = 2 * time.Second
+)
+
+// configureDocker points the Docker daemon of the instance called name at the
+// configured registry mirrors. The rest of its daemon.json is kept. Docker
+// reloads registry-mirrors without a restart, so running containers are left
+// alone.
+func (p *Pool) configureDocker(ctx context.Context, name string) error {
+	mirrors := p.config().Docker.RegistryMirrors
+	if len(mirrors) == 0 {
+		return nil
+	}
+	server := p.server(name)
+
+	daemonConfig := map[string]any{}
+	content, _, err := server.GetInstanceFile(name, dockerDaemonConfig)
+	switch {
+	case api.StatusErrorCheck(err, http.StatusNotFound):
+	case err != nil:
+		return fmt.Errorf("read %s: %w", dockerDaemonConfig, err)
+	default:
+		data, err := io.ReadAll(content)
+		_ = content.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", dockerDaemonConfig, err)
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &daemonConfig); err != nil {
+				return fmt.Errorf("parse %s: %w", dockerDaemonConfig, err)
+			}
+		}
+	}
+	daemonConfig["registry-mirrors"] = mirrors
+
+	data, err := json.MarshalIndent(daemonConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := server.CreateInstanceFile(name, dockerDaemonConfig, incus.InstanceFileArgs{
+		Content:   bytes.NewReader(data),
+		WriteMode: "overwrite",
+		Mode:      0644,
+	}); err != nil {
+		return fmt.Errorf("write %s: %w", dockerDaemonConfig, err)
+	}
+
+	return p.reloadDocker(ctx, name)
+}
+
+// reloadDocker reloads the Docker daemon of the instance called name, starting
+// it if it has not started yet. Containers are configured right after they
+// start, so it first waits for systemd to finish booting, then retries until
+// dockerReloadTimeout. Instances without Docker are left alone.
+func (p *Pool) reloadDocker(ctx context.Context, name string) error {
+	// is-system-running exits with an error on a degraded system, which Docker
+	// does not care about.
+	if _, err := p.execSucceeds(ctx, name, []string{"systemctl", "is-system-running", "--wait"}); err != nil {
+		p.logger.Debug("unable to wait for the instance to boot", "name", name, "err", err)
+	}
+
+	deadline := time.Now().Add(dockerReloadTimeout)
+	for {
+		ok, err := p.execSucceeds(ctx, name, []string{"systemctl", "reload-or-restart", "docker.service"})
+		switch {
+		case err != nil:
+			err = fmt.Errorf("reload docker: %w", err)
+		case !ok:
+			err = fmt.Errorf("reload docker: systemctl exited with an error")
+		default:
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if exists, checkErr := p.execSucceeds(ctx, name, []string{"systemctl", "cat", "docker.service"}); checkErr == nil && !exists {
+				p.logger.Warn("instance has no docker.service, registry mirrors not configured", "name", name)
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dockerReloadInterval):
+		}
+	}
+}
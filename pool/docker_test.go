@@ -0,0 +1,143 @@
+package pool
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func expectSystemctl(t *testing.T, m *mocks.MockInstanceServer, name string, ok bool, args ...string) {
+	t.Helper()
+	m.On("ExecInstance", name, mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return slices.Equal(req.Command, append([]string{"systemctl"}, args...))
+	}), mock.Anything).Return(processResult(t, ok), nil).Once()
+}
+
+func expectDockerReload(t *testing.T, m *mocks.MockInstanceServer, name string, ok bool) {
+	t.Helper()
+	expectSystemctl(t, m, name, true, "is-system-running", "--wait")
+	expectSystemctl(t, m, name, ok, "reload-or-restart", "docker.service")
+}
+
+func shortDockerReload(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	oldTimeout, oldInterval := dockerReloadTimeout, dockerReloadInterval
+	dockerReloadTimeout, dockerReloadInterval = timeout, time.Millisecond
+	t.Cleanup(func() { dockerReloadTimeout, dockerReloadInterval = oldTimeout, oldInterval })
+}
+
+func expectDaemonConfigWrite(m *mocks.MockInstanceServer, name string) {
+	m.On("GetInstanceFile", name, "/etc/docker/daemon.json").
+		Return(nil, nil, api.StatusErrorf(http.StatusNotFound, "not found"))
+	m.On("CreateInstanceFile", name, "/etc/docker/daemon.json", mock.Anything).Return(nil)
+}
+
+func TestPool_ConfigureDocker_MergesDaemonConfig(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Docker.RegistryMirrors = []string{"http://10.0.0.1:5000"}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	m.On("GetInstanceFile", "azp-agent-0", "/etc/docker/daemon.json").
+		Return(io.NopCloser(strings.NewReader(`{"log-driver": "local", "registry-mirrors": ["https://old"]}`)), nil, nil)
+	var written string
+	m.On("CreateInstanceFile", "azp-agent-0", "/etc/docker/daemon.json", mock.Anything).
+		Run(func(args mock.Arguments) {
+			data, _ := io.ReadAll(args.Get(2).(incus.InstanceFileArgs).Content)
+			written = string(data)
+		}).Return(nil)
+	expectDockerReload(t, m, "azp-agent-0", true)
+
+	require.NoError(t, p.configureDocker(context.Background(), "azp-agent-0"))
+	assert.JSONEq(t, `{"log-driver": "local", "registry-mirrors": ["http://10.0.0.1:5000"]}`, written)
+}
+
+func TestPool_ConfigureDocker_NoDaemonConfig(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Docker.RegistryMirrors = []string{"http://10.0.0.1:5000"}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	shortDockerReload(t, 0)
+	expectDaemonConfigWrite(m, "azp-agent-0")
+	expectDockerReload(t, m, "azp-agent-0", false)
+	expectSystemctl(t, m, "azp-agent-0", true, "cat", "docker.service")
+
+	err = p.configureDocker(context.Background(), "azp-agent-0")
+	assert.ErrorContains(t, err, "reload docker: systemctl exited with an error")
+}
+
+func TestPool_ConfigureDocker_RetriesReloadWhileBooting(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Docker.RegistryMirrors = []string{"http://10.0.0.1:5000"}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	shortDockerReload(t, time.Minute)
+	expectDaemonConfigWrite(m, "azp-agent-0")
+	expectDockerReload(t, m, "azp-agent-0", false)
+	expectSystemctl(t, m, "azp-agent-0", true, "reload-or-restart", "docker.service")
+
+	require.NoError(t, p.configureDocker(context.Background(), "azp-agent-0"))
+}
+
+func TestPool_ConfigureDocker_NoDockerService(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Docker.RegistryMirrors = []string{"http://10.0.0.1:5000"}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	shortDockerReload(t, 0)
+	expectDaemonConfigWrite(m, "azp-agent-0")
+	expectDockerReload(t, m, "azp-agent-0", false)
+	expectSystemctl(t, m, "azp-agent-0", false, "cat", "docker.service")
+
+	require.NoError(t, p.configureDocker(context.Background(), "azp-agent-0"))
+}
+
+func TestPool_CreateAgent_FailedDockerReload(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Docker.RegistryMirrors = []string{"http://10.0.0.1:5000"}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	shortDockerReload(t, 0)
+	m.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Name == "azp-agent-0"
+	})).Return(okOp(t), nil).Once()
+	expectDaemonConfigWrite(m, "azp-agent-0")
+	expectDockerReload(t, m, "azp-agent-0", false)
+	expectSystemctl(t, m, "azp-agent-0", true, "cat", "docker.service")
+
+	err = p.CreateAgent(context.Background(), 0)
+	assert.ErrorContains(t, err, "reload docker: systemctl exited with an error")
+	// The agent is not started without its mirrors.
+	m.AssertNotCalled(t, "CreateInstanceFile", "azp-agent-0", "/home/agent/.token", mock.Anything)
+	_, inFlight := p.inFlight.Load(0)
+	assert.False(t, inFlight)
+}
+
+func TestPool_ConfigureDocker_Disabled(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.configureDocker(context.Background(), "azp-agent-0"))
+	m.AssertNotCalled(t, "GetInstanceFile", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,70 @@
+package pool
+
+// Draining takes agents out of rotation without killing jobs. A draining agent
+// is not replaced when it goes away: the reaper stops it once it is idle, and a
+// busy one finishes its job and powers off on its own.
+
+// Drain starts draining every agent of the pool.
+func (p *Pool) Drain() {
+	if !p.draining.Swap(true) {
+		p.logger.Info("draining pool")
+	}
+}
+
+// CancelDrain lets the pool create agents again. Agents drained individually
+// stay drained.
+func (p *Pool) CancelDrain() {
+	if p.draining.Swap(false) {
+		p.logger.Info("canceled pool drain")
+	}
+}
+
+// Draining reports whether the whole pool is draining.
+func (p *Pool) Draining() bool {
+	return p.draining.Load()
+}
+
+// DrainAgent starts draining the agent at idx.
+func (p *Pool) DrainAgent(idx int) error {
+	if err := p.validateIndex(idx); err != nil {
+		return err
+	}
+	if _, drained := p.drainingAgents.LoadOrStore(idx, true); !drained {
+		p.logger.Info("draining agent", "idx", idx)
+	}
+	return nil
+}
+
+// CancelDrainAgent lets the pool replace the agent at idx again.
+func (p *Pool) CancelDrainAgent(idx int) error {
+	if err := p.validateIndex(idx); err != nil {
+		return err
+	}
+	if _, drained := p.drainingAgents.LoadAndDelete(idx); drained {
+		p.logger.Info("canceled agent drain", "idx", idx)
+	}
+	return nil
+}
+
+// AgentDraining reports whether the agent at idx is draining, either on its own
+// or because the whole pool is.
+func (p *Pool) AgentDraining(idx int) bool {
+	if p.Draining() {
+		return true
+	}
+	_, drained := p.drainingAgents.Load(idx)
+	return drained
+}
+
+// Drained reports whether the pool is draining and none of its agent instances
+// are left.
+func (p *Pool) Drained() (bool, error) {
+	if !p.Draining() {
+		return false, nil
+	}
+	instances, err := p.ListAgents()
+	if err != nil {
+		return false, err
+	}
+	return len(instances) == 0, nil
+}
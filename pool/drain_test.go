@@ -0,0 +1,134 @@
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Reconcile_SkipsDrainingAgents(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+	require.NoError(t, p.DrainAgent(1))
+
+	ch := make(chan int, 64)
+	require.NoError(t, p.Reconcile(ch))
+	close(ch)
+
+	var created []int
+	for idx := range ch {
+		created = append(created, idx)
+	}
+	assert.Equal(t, []int{0, 2}, created)
+
+	p.Drain()
+	ch = make(chan int, 64)
+	require.NoError(t, p.Reconcile(ch))
+	assert.Empty(t, ch)
+}
+
+func TestPool_CreateAgent_SkipsDrainingAgent(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+	require.NoError(t, p.DrainAgent(0))
+
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+	m.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestPool_CancelDrain(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	p.Drain()
+	require.NoError(t, p.DrainAgent(1))
+	assert.True(t, p.AgentDraining(0))
+
+	p.CancelDrain()
+	assert.False(t, p.AgentDraining(0))
+	assert.True(t, p.AgentDraining(1), "individually drained agents stay drained")
+
+	require.NoError(t, p.CancelDrainAgent(1))
+	assert.False(t, p.AgentDraining(1))
+}
+
+func TestPool_DrainAgent_ValidatesIndex(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, p.DrainAgent(3), "invalid agent index 3")
+	assert.ErrorContains(t, p.CancelDrainAgent(-1), "invalid agent index -1")
+}
+
+func TestPool_Reap_StopsIdleDrainingAgent(t *testing.T) {
+	now := time.Now()
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{
+		oldRunningAgent("azp-agent-0", now),
+		oldRunningAgent("azp-agent-1", now),
+	}, nil)
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[len(req.Command)-1] == "Agent.Worker"
+	}), mock.Anything).Return(processResult(t, false), nil).Once()
+	m.On("ExecInstance", "azp-agent-1", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[len(req.Command)-1] == "Agent.Worker"
+	}), mock.Anything).Return(processResult(t, true), nil).Once()
+	expectStop(m, t, "azp-agent-0")
+	p := newOfflineTestPool(t, m, &now, &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+		"runner-0": {Online: true},
+	}})
+	p.Drain()
+
+	require.NoError(t, p.Reap(context.Background()))
+	m.AssertCalled(t, "UpdateInstanceState", "azp-agent-0", mock.Anything, "")
+	m.AssertNotCalled(t, "UpdateInstanceState", "azp-agent-1", mock.Anything, mock.Anything)
+}
+
+func TestPool_Drained(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	drained, err := p.Drained()
+	require.NoError(t, err)
+	assert.False(t, drained, "a pool that is not draining is never drained")
+
+	p.Drain()
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-1"}}, nil).Once()
+	drained, err = p.Drained()
+	require.NoError(t, err)
+	assert.False(t, drained)
+
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "other"}}, nil).Once()
+	drained, err = p.Drained()
+	require.NoError(t, err)
+	assert.True(t, drained)
+}
+
+func TestPool_ReconcileStandby_DeletesStandbyWhileDraining(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Incus.WarmStandby = 2
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	p.Drain()
+
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-standby-0", Status: "Stopped"},
+	}, nil)
+	m.On("DeleteInstance", "azp-agent-standby-0").Return(okOp(t), nil).Once()
+
+	require.NoError(t, p.ReconcileStandby(context.Background()))
+	m.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
@@ -0,0 +1,118 @@
+package pool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureDevOpsScope requests a token for the Azure DevOps resource.
+const azureDevOpsScope = "499b84ac-1321-427f-aa17-267ca6975798/.default"
+
+// tokenExpiryMargin is how long before it expires a cached token is replaced,
+// so an agent handed a token still has time to register with it.
+const tokenExpiryMargin = 5 * time.Minute
+
+// entraTokenSource gets OAuth access tokens for a service principal from
+// Microsoft Entra ID with the client credentials flow.
+type entraTokenSource struct {
+	tokenURL string
+	clientID string
+	// secret is the client secret, or a reference to it.
+	secret string
+	client *http.Client
+	now    func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newEntraTokenSource(conf ServicePrincipalConfig, client *http.Client, now func() time.Time) (*entraTokenSource, error) {
+	tokenURL, err := url.JoinPath(conf.Authority, conf.TenantID, "oauth2", "v2.0", "token")
+	if err != nil {
+		return nil, fmt.Errorf("build Entra token URL: %w", err)
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &entraTokenSource{
+		tokenURL: tokenURL,
+		clientID: conf.ClientID,
+		secret:   conf.ClientSecret,
+		client:   client,
+		now:      now,
+	}, nil
+}
+
+// Token returns a cached access token, or requests a new one when the cached
+// one is about to expire.
+func (s *entraTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && s.now().Before(s.expiry.Add(-tokenExpiryMargin)) {
+		return s.token, nil
+	}
+
+	secret, err := resolveSecret(ctx, s.secret)
+	if err != nil {
+		return "", fmt.Errorf("resolve client secret: %w", err)
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.clientID},
+		"client_secret": {secret},
+		"scope":         {azureDevOpsScope},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request Entra token: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var response struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("read Entra token response: %w", err)
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("decode Entra token response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request Entra token: %s: %s: %s", resp.Status, response.Error, response.ErrorDescription)
+	}
+	if response.AccessToken == "" {
+		return "", fmt.Errorf("entra token response did not contain an access token")
+	}
+
+	s.token = response.AccessToken
+	s.expiry = s.now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+func (s *entraTokenSource) authorize(ctx context.Context, req *http.Request) error {
+	token, err := s.Token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
@@ -0,0 +1,132 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTokenEndpoint serves Entra ID client credential grants, numbering the
+// tokens it hands out.
+func fakeTokenEndpoint(t *testing.T, issued *int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/tenant-id/oauth2/v2.0/token", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, azureDevOpsScope, r.PostForm.Get("scope"))
+
+		if r.PostForm.Get("client_id") != "client-id" || r.PostForm.Get("client_secret") != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = fmt.Fprint(w, `{"error":"invalid_client","error_description":"bad secret"}`)
+			return
+		}
+		*issued++
+		_, _ = fmt.Fprintf(w, `{"token_type":"Bearer","expires_in":3600,"access_token":"token-%d"}`, *issued)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func servicePrincipal(authority string) *ServicePrincipalConfig {
+	return &ServicePrincipalConfig{
+		TenantID:     "tenant-id",
+		ClientID:     "client-id",
+		ClientSecret: "client-secret",
+		Authority:    authority,
+	}
+}
+
+func TestEntraTokenSource_CachesUntilExpiry(t *testing.T) {
+	var issued int
+	server := fakeTokenEndpoint(t, &issued)
+	now := time.Now()
+	source, err := newEntraTokenSource(*servicePrincipal(server.URL), server.Client(), func() time.Time { return now })
+	require.NoError(t, err)
+
+	token, err := source.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	now = now.Add(50 * time.Minute)
+	token, err = source.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	now = now.Add(5 * time.Minute)
+	token, err = source.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token, "tokens close to expiry are replaced")
+}
+
+func TestEntraTokenSource_RejectedSecret(t *testing.T) {
+	var issued int
+	server := fakeTokenEndpoint(t, &issued)
+	conf := servicePrincipal(server.URL)
+	conf.ClientSecret = "wrong"
+	source, err := newEntraTokenSource(*conf, server.Client(), time.Now)
+	require.NoError(t, err)
+
+	_, err = source.Token(context.Background())
+	assert.ErrorContains(t, err, "invalid_client: bad secret")
+}
+
+func TestHTTPAzureAgentClient_ServicePrincipalUsesBearerToken(t *testing.T) {
+	var issued int
+	tokens := fakeTokenEndpoint(t, &issued)
+	source, err := newEntraTokenSource(*servicePrincipal(tokens.URL), tokens.Client(), time.Now)
+	require.NoError(t, err)
+
+	azure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token-1", r.Header.Get("Authorization"))
+		_, _ = fmt.Fprint(w, `{"value":[{"id":42,"name":"build-pool"}]}`)
+	}))
+	defer azure.Close()
+
+	client, err := newHTTPAzureAgentClient(azure.URL, source, azure.Client())
+	require.NoError(t, err)
+	_, err = client.poolID(context.Background(), "build-pool")
+	require.NoError(t, err)
+}
+
+func TestPool_CreateAgent_ServicePrincipalToken(t *testing.T) {
+	var issued int
+	server := fakeTokenEndpoint(t, &issued)
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Azure = AzureConfig{
+		Auth:             AuthServicePrincipal,
+		Url:              "https://dev.azure.com/myorg",
+		ServicePrincipal: servicePrincipal(server.URL),
+	}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	assert.Equal(t, 0, issued, "tokens are only requested when needed")
+
+	m.On("CreateInstance", mock.Anything).Return(okOp(t), nil).Once()
+	m.On("CreateInstanceFile", "azp-agent-0", "/home/agent/.token", mock.MatchedBy(func(args incus.InstanceFileArgs) bool {
+		content, err := io.ReadAll(args.Content)
+		return err == nil && string(content) == "token-1"
+	})).Return(nil).Once()
+	m.On("ExecInstance", "azp-agent-0", mock.Anything, mock.Anything).Return(okOp(t), nil)
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+}
+
+func TestNewPool_ServicePrincipalMissing(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Azure.Auth = AuthServicePrincipal
+	_, err := NewPool(m, conf)
+	assert.ErrorContains(t, err, "requires servicePrincipal settings")
+}
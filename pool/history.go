@@ -0,0 +1,231 @@
+package pool
+
+import (
+	"context"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/history"
+)
+
+// jobLookupTimeout bounds the Azure lookup of the job an instance that went
+// away ran, when no observation saw it.
+var jobLookupTimeout = 30 * time.Second
+
+// lifetime is the history record of an agent instance that still exists.
+type lifetime struct {
+	history.Record
+	// reaping holds why the instance is being stopped, so the delete event it
+	// causes is recorded as a reap rather than a poweroff.
+	reaping string
+}
+
+// SetHistory makes the pool record every agent instance lifetime to h.
+func (p *Pool) SetHistory(h *history.Log) {
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	p.history = h
+}
+
+// startLifetime records that a new instance runs at idx.
+func (p *Pool) startLifetime(idx int, image string) {
+	name := p.AgentName(idx)
+	remote := p.historyRemote(name)
+
+	p.historyMu.Lock()
+	if p.history == nil {
+		p.historyMu.Unlock()
+		return
+	}
+	previous := p.lifetimes[idx]
+	p.lifetimes[idx] = &lifetime{Record: history.Record{
+		Pool:      p.Name(),
+		Instance:  name,
+		Index:     idx,
+		Remote:    remote,
+		Image:     image,
+		CreatedAt: p.now(),
+	}}
+	p.historyMu.Unlock()
+
+	// The delete event of the previous instance was missed, for example while
+	// the event listener reconnected.
+	if previous != nil {
+		p.appendHistory(previous, history.ExitPoweroff, "instance went away unobserved")
+	}
+}
+
+// failedLifetime records an instance that could not be created or started.
+func (p *Pool) failedLifetime(idx int, image string, err error) {
+	name := p.AgentName(idx)
+	remote := p.historyRemote(name)
+	now := p.now()
+
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	p.appendHistoryLocked(history.Record{
+		Pool:       p.Name(),
+		Instance:   name,
+		Index:      idx,
+		Remote:     remote,
+		Image:      image,
+		CreatedAt:  now,
+		EndedAt:    now,
+		ExitReason: history.ExitCreateError,
+		Detail:     err.Error(),
+	})
+}
+
+// markReaping notes why the instance at idx is about to be stopped. An empty
+// reason clears the note after a failed stop.
+func (p *Pool) markReaping(idx int, reason string) {
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	if l := p.lifetimes[idx]; l != nil {
+		l.reaping = reason
+	}
+}
+
+// endLifetime records that the instance at idx went away. An instance marked
+// as being reaped is recorded as reaped whatever reason is given.
+//
+// Jobs shorter than the observation interval are never seen running, so the
+// job of an instance without one is looked up among the finished jobs of its
+// agent first. The lookup runs in the background, so Azure does not hold up
+// the caller.
+func (p *Pool) endLifetime(idx int, reason, detail string) {
+	p.historyMu.Lock()
+	l := p.lifetimes[idx]
+	delete(p.lifetimes, idx)
+	p.historyMu.Unlock()
+	if l == nil {
+		return
+	}
+
+	if l.reaping != "" {
+		reason, detail = history.ExitReaped, l.reaping
+	}
+	if l.JobID != 0 {
+		p.appendHistory(l, reason, detail)
+		return
+	}
+	r := l.Record
+	r.EndedAt = p.now()
+	r.ExitReason = reason
+	r.Detail = detail
+	p.jobLookups.Go(func() {
+		p.attributeJob(&r)
+		p.historyMu.Lock()
+		defer p.historyMu.Unlock()
+		p.appendHistoryLocked(r)
+	})
+}
+
+// attributeJob fills in the job of a record from the latest job the agent
+// finished since the instance was created, if Azure has one.
+func (p *Pool) attributeJob(r *history.Record) {
+	ctx, cancel := context.WithTimeout(context.Background(), jobLookupTimeout)
+	defer cancel()
+	requests, err := p.azure.ListFinishedJobRequests(ctx, p.Name())
+	if err != nil {
+		p.logger.Warn("unable to look up the job of a finished instance", "instance", r.Instance, "err", err)
+		return
+	}
+
+	agent := p.AzureAgentName(r.Index)
+	var job AzureJobRequest
+	for _, req := range requests {
+		if req.AgentName != agent || req.FinishTime.Before(r.CreatedAt) {
+			continue
+		}
+		if job.RequestID == 0 || req.FinishTime.After(job.FinishTime) {
+			job = req
+		}
+	}
+	if job.RequestID != 0 {
+		r.JobID = job.RequestID
+		r.Pipeline = job.Pipeline
+	}
+}
+
+func (p *Pool) appendHistory(l *lifetime, reason, detail string) {
+	r := l.Record
+	r.EndedAt = p.now()
+	r.ExitReason = reason
+	r.Detail = detail
+
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	p.appendHistoryLocked(r)
+}
+
+func (p *Pool) appendHistoryLocked(r history.Record) {
+	if p.history == nil {
+		return
+	}
+	if err := p.history.Append(r); err != nil {
+		p.logger.Error("unable to write history record", "instance", r.Instance, "err", err)
+	}
+}
+
+// historyRemote returns the remote to record for an instance, or an empty
+// string for pools on a single remote.
+func (p *Pool) historyRemote(name string) string {
+	if len(p.remotes) < 2 {
+		return ""
+	}
+	return p.RemoteName(name)
+}
+
+// ObserveJobs records which Azure job each agent runs. Agents the pool did not
+// create, for example before a daemon restart, are adopted into the history.
+func (p *Pool) ObserveJobs(ctx context.Context) error {
+	p.historyMu.Lock()
+	enabled := p.history != nil
+	p.historyMu.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	instances, err := p.ListAgents()
+	if err != nil {
+		return err
+	}
+	agents, err := p.azure.ListAgents(ctx, p.Name())
+	if err != nil {
+		return err
+	}
+
+	now := p.now()
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	for _, i := range instances {
+		idx, err := p.agentIndex(i.Name)
+		if err != nil {
+			continue
+		}
+		l := p.lifetimes[idx]
+		if l == nil {
+			// Instances being created are recorded once they have started.
+			if _, creating := p.inFlight.Load(idx); creating {
+				continue
+			}
+			l = &lifetime{Record: history.Record{
+				Pool:      p.Name(),
+				Instance:  i.Name,
+				Index:     idx,
+				Remote:    p.historyRemote(i.Name),
+				Image:     instanceFingerprint(i.Config),
+				CreatedAt: i.CreatedAt,
+			}}
+			p.lifetimes[idx] = l
+		}
+
+		status := agents[p.AzureAgentName(idx)]
+		if status.RequestID != 0 && l.JobID == 0 {
+			l.JobID = status.RequestID
+			l.Pipeline = status.Pipeline
+			l.JobSeenAt = now
+		}
+	}
+	return nil
+}
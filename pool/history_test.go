@@ -0,0 +1,146 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/history"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newHistoryTestPool(t *testing.T, m *mocks.MockInstanceServer, azure AzureAgentClient) (*Pool, string) {
+	t.Helper()
+	conf := testConfig()
+	conf.AgentPrefix = "runner"
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	p.azure = azure
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	p.SetHistory(history.NewLog(path))
+	return p, path
+}
+
+func readHistory(t *testing.T, path string) []history.Record {
+	t.Helper()
+	records, err := history.Read(path)
+	require.NoError(t, err)
+	return records
+}
+
+func TestPool_History_RecordsJobAndPoweroff(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	azure := &fakeAzureAgentClient{}
+	p, path := newHistoryTestPool(t, m, azure)
+
+	m.On("CreateInstance", mock.Anything).Return(okOp(t), nil).Once()
+	expectAgentStart(t, m, "azp-agent-0")
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+	assert.Empty(t, readHistory(t, path), "records are written when the instance goes away")
+
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0"}}, nil)
+	azure.agents = map[string]AzureAgentStatus{
+		"runner-0": {Online: true, Assigned: true, RequestID: 12345, Pipeline: "ci"},
+	}
+	require.NoError(t, p.ObserveJobs(context.Background()))
+
+	p.endLifetime(0, history.ExitPoweroff, "")
+	records := readHistory(t, path)
+	require.Len(t, records, 1)
+	assert.Equal(t, "azp-agent-0", records[0].Instance)
+	assert.Equal(t, "test-image", records[0].Image)
+	assert.Equal(t, int64(12345), records[0].JobID)
+	assert.Equal(t, "ci", records[0].Pipeline)
+	assert.Equal(t, history.ExitPoweroff, records[0].ExitReason)
+	assert.False(t, records[0].JobSeenAt.IsZero())
+}
+
+func TestPool_History_RecordsReap(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, path := newHistoryTestPool(t, m, &fakeAzureAgentClient{})
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-1", CreatedAt: time.Now().Add(-time.Hour)},
+	}, nil)
+	require.NoError(t, p.ObserveJobs(context.Background()))
+
+	expectStop(m, t, "azp-agent-1")
+	require.NoError(t, p.ReapAgent(context.Background(), 1))
+	// The delete event caused by the stop does not record the instance again.
+	p.endLifetime(1, history.ExitPoweroff, "")
+	p.jobLookups.Wait()
+
+	records := readHistory(t, path)
+	require.Len(t, records, 1)
+	assert.Equal(t, history.ExitReaped, records[0].ExitReason)
+	assert.Equal(t, "reaped manually", records[0].Detail)
+}
+
+func TestPool_History_AttributesJobNeverSeenRunning(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	azure := &fakeAzureAgentClient{}
+	p, path := newHistoryTestPool(t, m, azure)
+	created := time.Now().Add(-time.Hour)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-1", CreatedAt: created},
+	}, nil)
+	require.NoError(t, p.ObserveJobs(context.Background()))
+
+	// The job ran between two observations.
+	azure.finished = []AzureJobRequest{
+		{RequestID: 10, AgentName: "runner-1", Pipeline: "old", FinishTime: created.Add(-time.Minute)},
+		{RequestID: 11, AgentName: "runner-1", Pipeline: "ci", FinishTime: created.Add(time.Minute)},
+		{RequestID: 12, AgentName: "runner-2", Pipeline: "ci", FinishTime: created.Add(time.Minute)},
+	}
+	p.endLifetime(1, history.ExitPoweroff, "")
+	p.jobLookups.Wait()
+
+	records := readHistory(t, path)
+	require.Len(t, records, 1)
+	assert.Equal(t, int64(11), records[0].JobID)
+	assert.Equal(t, "ci", records[0].Pipeline)
+	assert.True(t, records[0].JobSeenAt.IsZero())
+}
+
+func TestPool_History_RecordsWithoutJobWhenLookupFails(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	azure := &fakeAzureAgentClient{}
+	p, path := newHistoryTestPool(t, m, azure)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-1"}}, nil)
+	require.NoError(t, p.ObserveJobs(context.Background()))
+
+	azure.err = errors.New("unavailable")
+	p.endLifetime(1, history.ExitPoweroff, "")
+	p.jobLookups.Wait()
+
+	records := readHistory(t, path)
+	require.Len(t, records, 1)
+	assert.Zero(t, records[0].JobID)
+}
+
+func TestPool_History_RecordsCreateError(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, path := newHistoryTestPool(t, m, &fakeAzureAgentClient{})
+	m.On("CreateInstance", mock.Anything).Return(nil, errors.New("image not found")).Once()
+
+	require.Error(t, p.CreateAgent(context.Background(), 2))
+	records := readHistory(t, path)
+	require.Len(t, records, 1)
+	assert.Equal(t, "azp-agent-2", records[0].Instance)
+	assert.Equal(t, history.ExitCreateError, records[0].ExitReason)
+	assert.Equal(t, "image not found", records[0].Detail)
+}
+
+func TestPool_History_Disabled(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.ObserveJobs(context.Background()))
+	m.AssertNotCalled(t, "GetInstances", mock.Anything)
+}
@@ -0,0 +1,133 @@
+package pool
+
+import (
+	"net/http"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// Config keys stamped onto every instance the pool creates, so the image an
+// agent runs can be told from the instance alone.
+const (
+	poolConfigKey        = "user.iap.pool"
+	imageConfigKey       = "user.iap.image"
+	fingerprintConfigKey = "user.iap.image-fingerprint"
+)
+
+// RefreshImage resolves the configured image alias to the fingerprint that new
+// agents are created from until the next refresh. Agents created between two
+// refreshes therefore always run the same build, even if the alias moves. A
+// canary rollout pins its own fingerprints, so this is a no-op during one.
+func (p *Pool) RefreshImage() error {
+	conf := p.config()
+	if conf.Incus.Canary != nil {
+		return nil
+	}
+
+	fingerprint, err := p.resolveImage(conf.Incus.Image)
+	if err != nil {
+		return err
+	}
+
+	p.imageMu.Lock()
+	previous := p.fingerprint
+	p.fingerprint = fingerprint
+	p.imageMu.Unlock()
+
+	if previous != fingerprint {
+		p.logger.Info("resolved image", "image", conf.Incus.Image, "fingerprint", fingerprint, "previous", previous)
+		if previous != "" {
+			imageInfoMetric.DeletePartialMatch(map[string]string{"pool": conf.Name})
+		}
+		imageInfoMetric.WithLabelValues(conf.Name, conf.Incus.Image, fingerprint).Set(1)
+	}
+	return nil
+}
+
+// Fingerprint returns the image fingerprint new agents are created from, or an
+// empty string if the image has not been resolved yet.
+func (p *Pool) Fingerprint() string {
+	p.imageMu.Lock()
+	defer p.imageMu.Unlock()
+	return p.fingerprint
+}
+
+// resolveImage returns the fingerprint of an image alias or fingerprint.
+func (p *Pool) resolveImage(name string) (string, error) {
+	alias, _, err := p.c.GetImageAlias(name)
+	if err == nil {
+		return alias.Target, nil
+	}
+	if !api.StatusErrorCheck(err, http.StatusNotFound) {
+		return "", err
+	}
+
+	image, _, err := p.c.GetImage(name)
+	if err != nil {
+		return "", err
+	}
+	return image.Fingerprint, nil
+}
+
+// imageSource returns the image to create the agent at idx from, and whether
+// that agent is a canary. Pass a negative idx for instances that are not tied
+// to an index yet, such as standbys. Until the image is first resolved, the
+// configured alias is used as is.
+func (p *Pool) imageSource(idx int) (api.InstanceSource, bool) {
+	conf := p.config()
+
+	p.imageMu.Lock()
+	defer p.imageMu.Unlock()
+	switch {
+	case conf.Incus.Canary == nil && p.fingerprint == "":
+		return api.InstanceSource{Type: "image", Alias: conf.Incus.Image}, false
+	case conf.Incus.Canary == nil:
+		return api.InstanceSource{Type: "image", Fingerprint: p.fingerprint}, false
+	case !p.canary.rolledBack && idx >= 0 && idx < canaryAgents(conf):
+		return api.InstanceSource{Type: "image", Fingerprint: p.canary.candidate}, true
+	default:
+		return api.InstanceSource{Type: "image", Fingerprint: p.canary.stable}, false
+	}
+}
+
+// stampImage records the pool and the image an instance request uses.
+func (p *Pool) stampImage(req *api.InstancesPost, canary bool) {
+	conf := p.config()
+	image := conf.Incus.Image
+	if canary && conf.Incus.Canary != nil {
+		image = conf.Incus.Canary.Image
+	}
+
+	req.Config[poolConfigKey] = conf.Name
+	req.Config[imageConfigKey] = image
+	delete(req.Config, fingerprintConfigKey)
+	if req.Source.Fingerprint != "" {
+		req.Config[fingerprintConfigKey] = req.Source.Fingerprint
+	}
+}
+
+// instanceFingerprint returns the fingerprint of the image an instance was
+// created from, or an empty string if it is unknown.
+func instanceFingerprint(config map[string]string) string {
+	if fingerprint := config[fingerprintConfigKey]; fingerprint != "" {
+		return fingerprint
+	}
+	return config["volatile.base_image"]
+}
+
+// sourceLabel returns the fingerprint of an image source, or its alias when it
+// has not been resolved.
+func sourceLabel(source api.InstanceSource) string {
+	if source.Fingerprint != "" {
+		return source.Fingerprint
+	}
+	return source.Alias
+}
+
+// isCurrentStandby reports whether a standby instance was created from the
+// image new agents use. Standbys left over from an earlier image are replaced
+// instead of claimed.
+func (p *Pool) isCurrentStandby(instance api.Instance) bool {
+	source, _ := p.imageSource(-1)
+	return source.Fingerprint == "" || instanceFingerprint(instance.Config) == source.Fingerprint
+}
@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func expectAlias(m *mocks.MockInstanceServer, alias, fingerprint string) *mock.Call {
+	return m.On("GetImageAlias", alias).Return(&api.ImageAliasesEntry{
+		ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: fingerprint},
+	}, "", nil)
+}
+
+func TestPool_RefreshImage_PinsFingerprint(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+	assert.Empty(t, p.Fingerprint())
+
+	expectAlias(m, "test-image", "fp-1").Once()
+	require.NoError(t, p.RefreshImage())
+	assert.Equal(t, "fp-1", p.Fingerprint())
+
+	m.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Source.Fingerprint == "fp-1" &&
+			req.Source.Alias == "" &&
+			req.Config["user.iap.pool"] == "azp-agent" &&
+			req.Config["user.iap.image"] == "test-image" &&
+			req.Config["user.iap.image-fingerprint"] == "fp-1"
+	})).Return(okOp(t), nil).Once()
+	expectAgentStart(t, m, "azp-agent-0")
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+
+	m.On("GetImageAlias", "test-image").Return(nil, "", errors.New("incus unavailable")).Once()
+	require.Error(t, p.RefreshImage())
+	assert.Equal(t, "fp-1", p.Fingerprint(), "a failed lookup keeps the pinned fingerprint")
+}
+
+func TestPool_Create_UnresolvedImageUsesAlias(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	req := p.instanceRequest(p.AgentName(0))
+	assert.Equal(t, "test-image", req.Source.Alias)
+	assert.Equal(t, "test-image", req.Config["user.iap.image"])
+	assert.NotContains(t, req.Config, "user.iap.image-fingerprint")
+}
+
+func TestPool_RefreshImage_CanaryPinsItsOwnImages(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p := newCanaryTestPool(t, m, &fakeAzureAgentClient{})
+
+	require.NoError(t, p.RefreshImage())
+	m.AssertNumberOfCalls(t, "GetImageAlias", 2)
+
+	req := p.instanceRequest(p.AgentName(1))
+	assert.Equal(t, "stable-fp", req.Config["user.iap.image-fingerprint"])
+}
+
+func TestPool_ReconcileStandby_ReplacesStandbyFromOldImage(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, standbyTestConfig())
+	require.NoError(t, err)
+	expectAlias(m, "test-image", "fp-2")
+	require.NoError(t, p.RefreshImage())
+
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{
+			Name:        "azp-agent-standby-0",
+			Status:      "Stopped",
+			InstancePut: api.InstancePut{Config: map[string]string{"user.iap.image-fingerprint": "fp-1"}},
+		},
+		{
+			Name:        "azp-agent-standby-1",
+			Status:      "Stopped",
+			InstancePut: api.InstancePut{Config: map[string]string{"volatile.base_image": "fp-2"}},
+		},
+	}, nil)
+	m.On("DeleteInstance", "azp-agent-standby-0").Return(okOp(t), nil).Once()
+
+	require.NoError(t, p.ReconcileStandby(context.Background()))
+	m.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestPool_AgentImage(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	m.On("GetInstance", "azp-agent-1").Return(&api.Instance{
+		InstancePut: api.InstancePut{Config: map[string]string{"volatile.base_image": "fp-1"}},
+	}, "", nil)
+	image, err := p.AgentImage(1)
+	require.NoError(t, err)
+	assert.Equal(t, "fp-1", image)
+
+	_, err = p.AgentImage(3)
+	assert.ErrorContains(t, err, "invalid agent index 3")
+}
@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Instance config keys, as exact keys or prefixes ending in a dot, that only
+// apply to one instance type. Incus rejects them on the other.
+var (
+	containerOnlyKeys = []string{
+		"limits.cpu.allowance",
+		"limits.cpu.priority",
+		"limits.memory.enforce",
+		"limits.memory.swap",
+		"limits.memory.swap.priority",
+		"limits.processes",
+		"linux.kernel_modules",
+		"linux.sysctl.",
+		"migration.incremental.memory",
+		"migration.incremental.memory.",
+		"nvidia.",
+		"oci.",
+		"raw.lxc",
+		"raw.seccomp",
+		"security.bpffs.",
+		"security.guestapi.images",
+		"security.idmap.",
+		"security.nesting",
+		"security.privileged",
+		"security.protection.shift",
+		"security.syscalls.",
+	}
+	vmOnlyKeys = []string{
+		"agent.",
+		"limits.memory.hotplug",
+		"limits.memory.hugepages",
+		"raw.qemu",
+		"raw.qemu.",
+		"security.agent.",
+		"security.csm",
+		"security.iommu",
+		"security.secureboot",
+		"security.sev",
+		"security.sev.",
+		"smbios11.",
+	}
+	// containerOnlyDevices are the device types VMs do not support.
+	containerOnlyDevices = []string{"unix-block", "unix-char", "unix-hotplug"}
+)
+
+// ValidateInstanceOptions checks that the config keys and devices passed
+// through to Incus fit the instance type of the pool, and do not touch the
+// keys Incus or the pool manage.
+func (c IncusConfig) ValidateInstanceOptions() error {
+	instanceType, wrong := "container", vmOnlyKeys
+	if c.VM {
+		instanceType, wrong = "virtual machine", containerOnlyKeys
+	}
+
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(c.Config)) {
+		switch {
+		case strings.HasPrefix(key, "volatile."), strings.HasPrefix(key, "image."):
+			errs = append(errs, fmt.Errorf("config key %q is managed by Incus", key))
+		case strings.HasPrefix(key, "user.iap."):
+			errs = append(errs, fmt.Errorf("config key %q is managed by the pool", key))
+		case matchesKey(key, wrong):
+			errs = append(errs, fmt.Errorf("config key %q does not apply to a %s", key, instanceType))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Devices)) {
+		deviceType := c.Devices[name]["type"]
+		switch {
+		case deviceType == "":
+			errs = append(errs, fmt.Errorf("device %q has no type", name))
+		case c.VM && slices.Contains(containerOnlyDevices, deviceType):
+			errs = append(errs, fmt.Errorf("device %q of type %s does not apply to a %s", name, deviceType, instanceType))
+		case c.VM && deviceType == "disk" && c.Devices[name]["source"] == "tmpfs:":
+			errs = append(errs, fmt.Errorf("device %q is a tmpfs disk, which does not apply to a %s", name, instanceType))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func matchesKey(key string, keys []string) bool {
+	for _, k := range keys {
+		if key == k || (strings.HasSuffix(k, ".") && strings.HasPrefix(key, k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyInstanceOptions merges the configured profiles, config and devices over
+// the defaults of an instance request.
+func applyInstanceOptions(conf IncusConfig, config map[string]string, devices map[string]map[string]string) []string {
+	maps.Copy(config, conf.Config)
+	for name, device := range conf.Devices {
+		devices[name] = maps.Clone(device)
+	}
+	return slices.Clone(conf.Profiles)
+}
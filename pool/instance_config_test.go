@@ -0,0 +1,109 @@
+package pool
+
+import (
+	"testing"
+
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncusConfig_ValidateInstanceOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    IncusConfig
+		wantErr string
+	}{
+		{
+			name: "container keys on a container",
+			conf: IncusConfig{
+				Config:  map[string]string{"security.syscalls.intercept.mknod": "true", "linux.sysctl.net.core.somaxconn": "4096"},
+				Devices: map[string]map[string]string{"kvm": {"type": "unix-char", "source": "/dev/kvm"}},
+			},
+		},
+		{
+			name: "vm keys on a vm",
+			conf: IncusConfig{
+				VM:      true,
+				Config:  map[string]string{"security.secureboot": "false", "limits.memory": "8GiB"},
+				Devices: map[string]map[string]string{"eth1": {"type": "nic", "network": "ci"}},
+			},
+		},
+		{
+			name:    "container key on a vm",
+			conf:    IncusConfig{VM: true, Config: map[string]string{"security.syscalls.intercept.mount": "true"}},
+			wantErr: `config key "security.syscalls.intercept.mount" does not apply to a virtual machine`,
+		},
+		{
+			name:    "vm key on a container",
+			conf:    IncusConfig{Config: map[string]string{"raw.qemu": "-no-reboot"}},
+			wantErr: `config key "raw.qemu" does not apply to a container`,
+		},
+		{
+			name:    "volatile key",
+			conf:    IncusConfig{Config: map[string]string{"volatile.eth0.hwaddr": "00:16:3e:00:00:01"}},
+			wantErr: `config key "volatile.eth0.hwaddr" is managed by Incus`,
+		},
+		{
+			name:    "pool key",
+			conf:    IncusConfig{Config: map[string]string{"user.iap.image": "other"}},
+			wantErr: `config key "user.iap.image" is managed by the pool`,
+		},
+		{
+			name:    "device without type",
+			conf:    IncusConfig{Devices: map[string]map[string]string{"cache": {"path": "/cache"}}},
+			wantErr: `device "cache" has no type`,
+		},
+		{
+			name:    "unix device on a vm",
+			conf:    IncusConfig{VM: true, Devices: map[string]map[string]string{"fuse": {"type": "unix-char", "source": "/dev/fuse"}}},
+			wantErr: `device "fuse" of type unix-char does not apply to a virtual machine`,
+		},
+		{
+			name:    "tmpfs on a vm",
+			conf:    IncusConfig{VM: true, Devices: map[string]map[string]string{"scratch": {"type": "disk", "source": "tmpfs:", "path": "/scratch"}}},
+			wantErr: `device "scratch" is a tmpfs disk`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conf.ValidateInstanceOptions()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestPool_InstanceRequest_MergesOptions(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Incus.MaxRamInGb = 4
+	conf.Incus.TmpfsSizeInGb = 12
+	conf.Incus.Profiles = []string{"default", "ci-cache"}
+	conf.Incus.Config = map[string]string{
+		"limits.memory":                     "6GiB",
+		"security.syscalls.intercept.mknod": "true",
+	}
+	conf.Incus.Devices = map[string]map[string]string{
+		"tmpfs": {"type": "none"},
+		"cache": {"type": "disk", "source": "/srv/cache", "path": "/cache"},
+	}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	req := p.instanceRequest(p.AgentName(0))
+	assert.Equal(t, []string{"default", "ci-cache"}, req.Profiles)
+	assert.Equal(t, "6GiB", req.Config["limits.memory"])
+	assert.Equal(t, "true", req.Config["security.syscalls.intercept.mknod"])
+	assert.Equal(t, "true", req.Config["security.nesting"], "defaults stay unless overridden")
+	assert.Equal(t, "azp-agent", req.Config["user.iap.pool"])
+	assert.Equal(t, map[string]string{"type": "none"}, req.Devices["tmpfs"])
+	assert.Equal(t, "/srv/cache", req.Devices["cache"]["source"])
+
+	// The request gets copies, so changing it leaves the config alone.
+	req.Devices["cache"]["path"] = "/other"
+	assert.Equal(t, "/cache", p.config().Incus.Devices["cache"]["path"])
+}
@@ -5,10 +5,32 @@ import (
 	"encoding/json"
 	"fmt"
 
+	incus "github.com/lxc/incus/v6/client"
 	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/history"
 )
 
+// ListenForDeletes queues the index of every pool agent deleted on any of the
+// pool's remotes until ctx is done or a listener fails.
 func (p *Pool) ListenForDeletes(ctx context.Context, agentsToCreate chan<- int) error {
+	if len(p.remotes) == 1 {
+		return p.listenForDeletes(ctx, p.c, agentsToCreate)
+	}
+
+	// Stop the other listeners when one fails, so the caller can retry them
+	// all together.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(p.remotes))
+	for r, remote := range p.remotes {
+		go func() {
+			errs <- p.remoteError(r, p.listenForDeletes(ctx, remote.Server, agentsToCreate))
+		}()
+	}
+	return <-errs
+}
+
+func (p *Pool) listenForDeletes(ctx context.Context, server incus.InstanceServer, agentsToCreate chan<- int) error {
 
 	handlerFunc := func(e api.Event) {
 		meta := map[string]any{}
@@ -37,11 +59,15 @@ func (p *Pool) ListenForDeletes(ctx context.Context, agentsToCreate chan<- int)
 				return
 			}
 			p.logger.Info("container deleted", "name", instance)
+			p.endLifetime(idx, history.ExitPoweroff, "")
+			if idx >= p.DesiredAgents() || p.AgentDraining(idx) {
+				return
+			}
 			agentsToCreate <- idx
 		}
 	}
 
-	l, err := p.c.GetEvents()
+	l, err := server.GetEvents()
 	if err != nil {
 		return fmt.Errorf("error setting up incus event listener: %w", err)
 	}
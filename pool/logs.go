@@ -0,0 +1,225 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/archive"
+)
+
+const agentLogPath = "/home/agent/" + archive.LogFile
+
+// logTimeLayout is the timestamp the agent prefixes its lines with.
+const logTimeLayout = "2006-01-02 15:04:05Z"
+
+// followPollInterval is how often a followed agent is checked for a new
+// instance once its instance went away.
+var followPollInterval = 2 * time.Second
+
+// LogOptions select which part of an agent log is output.
+type LogOptions struct {
+	// Follow keeps streaming the log as it grows, and the log of every later
+	// instance at the same index, until the context is canceled.
+	Follow bool
+	// Tail limits the output to the last Tail lines of the log. 0 outputs the
+	// whole log.
+	Tail int
+	// Since drops lines logged before it. Lines without a timestamp count as
+	// logged with the line before them, or when the instance was created.
+	Since time.Time
+}
+
+// AgentLogs writes the log of the agent at idx to w.
+func (p *Pool) AgentLogs(ctx context.Context, idx int, w io.Writer, opts LogOptions) error {
+	conf := p.config()
+
+	if idx >= conf.Capacity() {
+		return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, p.Name(), conf.Capacity())
+	}
+
+	name := p.AgentName(idx)
+	if opts.Follow {
+		return p.followLog(ctx, name, w, opts)
+	}
+
+	var createdAt time.Time
+	if !opts.Since.IsZero() {
+		i, err := p.getInstance(name)
+		if err != nil {
+			return err
+		}
+		createdAt = i.CreatedAt
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultOperationTimeout)
+	defer cancel()
+	return p.execLog(ctx, name, w, logCommand(opts.Tail, false), opts.Since, createdAt)
+}
+
+// followLog streams the log of the instance called name until ctx is canceled.
+// When the instance goes away, it waits for the next one and streams its log.
+func (p *Pool) followLog(ctx context.Context, name string, w io.Writer, opts LogOptions) error {
+	var previous time.Time
+	tail := opts.Tail
+	for {
+		i, err := p.waitForInstance(ctx, name, previous)
+		if err != nil {
+			return nil
+		}
+		if !previous.IsZero() {
+			if _, err := fmt.Fprintf(w, "==> %s was recreated <==\n", name); err != nil {
+				return err
+			}
+			// The log of a new instance is output from its first line.
+			tail = 0
+		}
+		previous = i.CreatedAt
+
+		err = p.execLog(ctx, name, w, logCommand(tail, true), opts.Since, i.CreatedAt)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			p.logger.Warn("agent log stream ended", "name", name, "err", err)
+		}
+	}
+}
+
+// waitForInstance returns the instance called name once it is running and was
+// not created at previous. It only returns an error when ctx is canceled.
+func (p *Pool) waitForInstance(ctx context.Context, name string, previous time.Time) (*api.Instance, error) {
+	for {
+		i, err := p.getInstance(name)
+		if err == nil && i.StatusCode == api.Running && !i.CreatedAt.Equal(previous) {
+			return i, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(followPollInterval):
+		}
+	}
+}
+
+// execLog runs command in the instance called name and copies its output to w,
+// dropping lines logged before since. The command is terminated when ctx is
+// canceled.
+func (p *Pool) execLog(ctx context.Context, name string, w io.Writer, command []string, since, createdAt time.Time) error {
+	out := w
+	var filter *sinceWriter
+	if !since.IsZero() {
+		filter = &sinceWriter{w: w, since: since, t: createdAt}
+		out = filter
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dataDone := make(chan bool)
+	op, err := p.server(name).ExecInstance(
+		name,
+		api.InstanceExecPost{
+			Command:     command,
+			WaitForWS:   true,
+			Interactive: false,
+		}, &incus.InstanceExecArgs{
+			Stdout:   out,
+			Control:  signalOnCancel(ctx),
+			DataDone: dataDone,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if err := op.WaitContext(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-dataDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if filter != nil {
+		return filter.Flush()
+	}
+	return nil
+}
+
+// signalOnCancel returns an exec control handler that terminates the command
+// once ctx is canceled, so commands like tail -F do not outlive the caller.
+func signalOnCancel(ctx context.Context) func(*websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		<-ctx.Done()
+		_ = conn.WriteJSON(api.InstanceExecControl{Command: "signal", Signal: int(syscall.SIGTERM)})
+	}
+}
+
+func logCommand(tail int, follow bool) []string {
+	if tail == 0 && !follow {
+		return []string{"cat", agentLogPath}
+	}
+
+	command := []string{"tail"}
+	if follow {
+		command = append(command, "-F")
+	}
+	lines := "+1"
+	if tail > 0 {
+		lines = strconv.Itoa(tail)
+	}
+	return append(command, "-n", lines, agentLogPath)
+}
+
+// sinceWriter drops the lines written to it that were logged before since.
+type sinceWriter struct {
+	w     io.Writer
+	since time.Time
+	// t is when the current line was logged.
+	t   time.Time
+	buf []byte
+}
+
+func (s *sinceWriter) Write(b []byte) (int, error) {
+	s.buf = append(s.buf, b...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := s.writeLine(s.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[i+1:]
+	}
+}
+
+// Flush writes a last line that has no newline.
+func (s *sinceWriter) Flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	err := s.writeLine(s.buf)
+	s.buf = nil
+	return err
+}
+
+func (s *sinceWriter) writeLine(line []byte) error {
+	if len(line) >= len(logTimeLayout) {
+		if t, err := time.Parse(logTimeLayout, string(line[:len(logTimeLayout)])); err == nil {
+			s.t = t
+		}
+	}
+	if s.t.Before(s.since) {
+		return nil
+	}
+	_, err := s.w.Write(line)
+	return err
+}
@@ -0,0 +1,102 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// expectLogExec makes an exec of command in name write output.
+func expectLogExec(t *testing.T, m *mocks.MockInstanceServer, name string, command []string, output string, run func()) {
+	t.Helper()
+	m.On("ExecInstance", name, mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return slices.Equal(req.Command, command)
+	}), mock.Anything).
+		Run(func(args mock.Arguments) {
+			execArgs := args.Get(2).(*incus.InstanceExecArgs)
+			_, _ = io.WriteString(execArgs.Stdout, output)
+			close(execArgs.DataDone)
+			if run != nil {
+				run()
+			}
+		}).
+		Return(okOp(t), nil).Once()
+}
+
+func TestLogCommand(t *testing.T) {
+	assert.Equal(t, []string{"cat", agentLogPath}, logCommand(0, false))
+	assert.Equal(t, []string{"tail", "-n", "20", agentLogPath}, logCommand(20, false))
+	assert.Equal(t, []string{"tail", "-F", "-n", "+1", agentLogPath}, logCommand(0, true))
+	assert.Equal(t, []string{"tail", "-F", "-n", "5", agentLogPath}, logCommand(5, true))
+}
+
+func TestSinceWriter(t *testing.T) {
+	created := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	since := created.Add(time.Minute)
+
+	var buf bytes.Buffer
+	w := &sinceWriter{w: &buf, since: since, t: created}
+	for _, chunk := range []string{
+		"uid=1000\n",
+		"2025-01-02 03:00:30Z: Listening for Jobs\n2025-01-02 03:01:00Z: Running job: build\ncontinued",
+		" line\n2025-01-02 03:00:59Z: out of order\n",
+		"2025-01-02 03:02:00Z: Job build completed",
+	} {
+		_, err := io.WriteString(w, chunk)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Flush())
+
+	assert.Equal(t, "2025-01-02 03:01:00Z: Running job: build\ncontinued line\n2025-01-02 03:02:00Z: Job build completed", buf.String())
+}
+
+func TestPool_AgentLogs_TailSince(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	created := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	m.On("GetInstance", "azp-agent-0").Return(&api.Instance{Name: "azp-agent-0", CreatedAt: created}, "", nil)
+	expectLogExec(t, m, "azp-agent-0", []string{"tail", "-n", "2", agentLogPath},
+		"config.sh output\n2025-01-02 03:05:00Z: Listening for Jobs\n", nil)
+
+	var buf bytes.Buffer
+	require.NoError(t, p.AgentLogs(context.Background(), 0, &buf, LogOptions{Tail: 2, Since: created.Add(time.Minute)}))
+	assert.Equal(t, "2025-01-02 03:05:00Z: Listening for Jobs\n", buf.String())
+}
+
+func TestPool_AgentLogs_FollowsRecreatedInstance(t *testing.T) {
+	followPollInterval = time.Millisecond
+	t.Cleanup(func() { followPollInterval = 2 * time.Second })
+
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	created := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	first := &api.Instance{Name: "azp-agent-0", StatusCode: api.Running, CreatedAt: created}
+	second := &api.Instance{Name: "azp-agent-0", StatusCode: api.Running, CreatedAt: created.Add(time.Hour)}
+	m.On("GetInstance", "azp-agent-0").Return(first, "", nil).Once()
+	m.On("GetInstance", "azp-agent-0").Return(nil, "", api.StatusErrorf(404, "not found")).Once()
+	m.On("GetInstance", "azp-agent-0").Return(first, "", nil).Once()
+	m.On("GetInstance", "azp-agent-0").Return(second, "", nil).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expectLogExec(t, m, "azp-agent-0", []string{"tail", "-F", "-n", "10", agentLogPath}, "first job\n", nil)
+	expectLogExec(t, m, "azp-agent-0", []string{"tail", "-F", "-n", "+1", agentLogPath}, "second job\n", cancel)
+
+	var buf bytes.Buffer
+	require.NoError(t, p.AgentLogs(ctx, 0, &buf, LogOptions{Follow: true, Tail: 10}))
+	assert.Equal(t, "first job\n==> azp-agent-0 was recreated <==\nsecond job\n", buf.String())
+}
@@ -20,7 +20,7 @@ func newAgentUptimeCollector(p *Pool) *agentUptimeCollector {
 		desc: prometheus.NewDesc(
 			"iap_agent_uptime",
 			"Time (in seconds) an agent is up and running",
-			[]string{"idx"},
+			[]string{"idx", "image"},
 			map[string]string{
 				"pool": p.Name(),
 			},
@@ -53,6 +53,7 @@ func (c *agentUptimeCollector) Collect(ch chan<- prometheus.Metric) {
 			prometheus.GaugeValue,
 			val,
 			strconv.Itoa(idx),
+			instanceFingerprint(i.Config),
 		)
 
 		if err != nil {
@@ -96,3 +97,91 @@ var agentsReapedErrorMetric = promauto.NewCounterVec(
 	},
 	[]string{"pool"},
 )
+
+var agentsTimedOutMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_agents_timed_out",
+		Help: "Count of agents stopped for exceeding maxLifetime or maxJobDuration, by limit",
+	},
+	[]string{"pool", "limit"},
+)
+
+var desiredAgentsMetric = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "iap_agents_desired",
+		Help: "Number of agents the orchestrator is currently trying to keep running",
+	},
+	[]string{"pool"},
+)
+
+var agentsStartedFromStandbyMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_agents_started_from_standby",
+		Help: "Count of agents started from a warm standby instance instead of the image",
+	},
+	[]string{"pool"},
+)
+
+var canaryOutcomesMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_canary_outcomes",
+		Help: "Count of canary agent outcomes by result (success or failure)",
+	},
+	[]string{"pool", "result"},
+)
+
+var canaryRollbacksMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_canary_rollbacks",
+		Help: "Count of canary image rollouts rolled back because of their failure rate",
+	},
+	[]string{"pool"},
+)
+
+var imageInfoMetric = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "iap_pool_image_info",
+		Help: "Image fingerprint new agents of the pool are created from; the value is always 1",
+	},
+	[]string{"pool", "image", "fingerprint"},
+)
+
+var azureAgentsRemovedMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_azure_agents_removed",
+		Help: "Count of orphaned Azure agent registrations removed",
+	},
+	[]string{"pool"},
+)
+
+var admissionRefusedMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_agents_admission_refused",
+		Help: "Count of agent creations refused because the image is missing or the host has no room",
+	},
+	[]string{"pool"},
+)
+
+var poolDegradedMetric = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "iap_pool_degraded",
+		Help: "Whether the pool refuses to create agents (1) or not (0)",
+	},
+	[]string{"pool"},
+)
+
+var createBreakerOpenMetric = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "iap_create_breaker_open",
+		Help: "Whether the circuit breaker pauses agent creation for the pool (1) or not (0)",
+	},
+	[]string{"pool"},
+)
+
+var createBreakerTripsMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "iap_create_breaker_trips",
+		Help: "Count of times repeated failed agent creations opened the circuit breaker",
+	},
+	[]string{"pool"},
+)
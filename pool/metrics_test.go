@@ -121,3 +121,29 @@ func TestAgentUptimeCollector_Collect_ListError(t *testing.T) {
 	}
 	assert.Empty(t, metrics)
 }
+
+func TestAgentUptimeCollector_Collect_ImageLabel(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{
+			Name:        "azp-agent-0",
+			CreatedAt:   time.Now(),
+			InstancePut: api.InstancePut{Config: map[string]string{"user.iap.image-fingerprint": "fp-1"}},
+		},
+	}, nil)
+
+	pool, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	ch := make(chan prometheus.Metric, 10)
+	newAgentUptimeCollector(pool).Collect(ch)
+	close(ch)
+
+	var dtoMetric dto.Metric
+	require.NoError(t, (<-ch).Write(&dtoMetric))
+	labels := map[string]string{}
+	for _, label := range dtoMetric.Label {
+		labels[label.GetName()] = label.GetValue()
+	}
+	assert.Equal(t, "fp-1", labels["image"])
+}
@@ -0,0 +1,62 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// RemoveOrphanedAgents deletes the Azure registrations of this host's agents
+// that are offline and have no local instance left, for example because the
+// instance died before run_agent.sh could remove its registration. It returns
+// the number of registrations deleted.
+func (p *Pool) RemoveOrphanedAgents(ctx context.Context) (int, error) {
+	// Registrations are listed before instances, so an instance created in
+	// between is seen and keeps its registration.
+	agents, err := p.azure.ListAgents(ctx, p.Name())
+	if err != nil {
+		return 0, fmt.Errorf("list Azure agents: %w", err)
+	}
+	instances, err := p.ListAgents()
+	if err != nil {
+		return 0, err
+	}
+
+	local := make(map[int]bool, len(instances))
+	for _, i := range instances {
+		idx, err := p.agentIndex(i.Name)
+		if err != nil {
+			continue
+		}
+		local[idx] = true
+	}
+
+	var removed int
+	var errs []error
+	for name, status := range agents {
+		matches := p.azureAgentRe.FindStringSubmatch(name)
+		if len(matches) < 2 {
+			continue
+		}
+		idx, err := strconv.Atoi(matches[1])
+		if err != nil {
+			continue
+		}
+		if status.Online || status.Assigned || status.ID == 0 || local[idx] {
+			continue
+		}
+		if _, busy := p.inFlight.Load(idx); busy {
+			continue
+		}
+
+		if err := p.azure.DeleteAgent(ctx, p.Name(), status.ID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p.logger.Info("removed orphaned Azure agent", "idx", idx, "agent", name, "id", status.ID)
+		azureAgentsRemovedMetric.WithLabelValues(p.Name()).Inc()
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOrphanTestPool(t *testing.T, m *mocks.MockInstanceServer, azure AzureAgentClient) *Pool {
+	t.Helper()
+	conf := testConfig()
+	conf.AgentPrefix = "runner"
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	p.azure = azure
+	return p
+}
+
+func TestPool_RemoveOrphanedAgents(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	azure := &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+		"runner-0":       {ID: 10},                 // local instance still exists
+		"runner-1":       {ID: 11},                 // orphaned
+		"runner-2":       {ID: 12, Online: true},   // online elsewhere
+		"runner-3":       {ID: 13, Assigned: true}, // still holds a job
+		"runner-4":       {ID: 14},                 // being created
+		"runner-7":       {ID: 17},                 // orphaned beyond the pool size
+		"other-host-1":   {ID: 21},                 // another host's agent
+		"runner-extra-1": {ID: 22},
+	}}
+	p := newOrphanTestPool(t, m, azure)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0"}}, nil)
+	p.inFlight.Store(4, struct{}{})
+
+	removed, err := p.RemoveOrphanedAgents(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.ElementsMatch(t, []int{11, 17}, azure.deleted)
+}
+
+func TestPool_RemoveOrphanedAgents_FailsClosed(t *testing.T) {
+	t.Run("azure", func(t *testing.T) {
+		m := mocks.NewMockInstanceServer(t)
+		azure := &fakeAzureAgentClient{err: errors.New("unavailable")}
+		p := newOrphanTestPool(t, m, azure)
+
+		_, err := p.RemoveOrphanedAgents(context.Background())
+		require.Error(t, err)
+		assert.Empty(t, azure.deleted)
+	})
+
+	t.Run("incus", func(t *testing.T) {
+		m := mocks.NewMockInstanceServer(t)
+		azure := &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{"runner-1": {ID: 11}}}
+		p := newOrphanTestPool(t, m, azure)
+		m.On("GetInstances", api.InstanceTypeContainer).Return(nil, errors.New("incus down"))
+
+		_, err := p.RemoveOrphanedAgents(context.Background())
+		require.Error(t, err)
+		assert.Empty(t, azure.deleted)
+	})
+}
@@ -4,19 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	incus "github.com/lxc/incus/v6/client"
 	"github.com/lxc/incus/v6/shared/api"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sklarsa/incus-azure-pipelines/archive"
+	"github.com/sklarsa/incus-azure-pipelines/history"
 	"github.com/sklarsa/incus-azure-pipelines/provision"
 )
 
@@ -34,28 +39,101 @@ func waitOp(ctx context.Context, op incus.Operation, timeout time.Duration) erro
 }
 
 type Pool struct {
+	// c is the first remote. Images are resolved on it, so every remote must
+	// have the same images.
 	c            incus.InstanceServer
+	remotes      []Remote
+	placements   []placement
+	confMu       sync.RWMutex
 	conf         Config
+	collector    prometheus.Collector
 	agentRe      *regexp.Regexp
 	agentPrefix  string
+	azureAgentRe *regexp.Regexp
+	standbyRe    *regexp.Regexp
 	inFlight     *sync.Map
+	// standbyInFlight holds the names of standby instances being created or claimed.
+	standbyInFlight *sync.Map
+	// overdue tracks the stops of agents that exceeded a limit, which run in
+	// the background so waiting for their workers does not hold up the reaper.
+	overdue sync.WaitGroup
+	// jobLookups tracks the history records waiting for the job of their
+	// instance to be looked up.
+	jobLookups sync.WaitGroup
+	// draining is set while the whole pool drains; drainingAgents holds the
+	// indices drained individually.
+	draining       atomic.Bool
+	drainingAgents *sync.Map
+	// imageMu guards fingerprint, the image new agents are pinned to, and the
+	// canary rollout.
+	imageMu      sync.Mutex
+	fingerprint  string
+	canary       canaryRollout
+	offlineMu    sync.Mutex
 	offlineSince map[int]time.Time
-	azure        AzureAgentClient
-	now          func() time.Time
-	logger       *slog.Logger
+	// patMu guards the last resolved Azure PAT. entra is set instead when the
+	// pool authenticates as a service principal.
+	patMu         sync.Mutex
+	pat           string
+	patResolvedAt time.Time
+	entra         *entraTokenSource
+	// historyMu guards the history log and the lifetimes of the agents that
+	// still exist, keyed by index.
+	historyMu sync.Mutex
+	history   *history.Log
+	lifetimes map[int]*lifetime
+	archiveMu sync.Mutex
+	archive   *archive.Archive
+	// admitMu guards what admission control knows about the image and the
+	// capacity of the host.
+	admitMu   sync.Mutex
+	admission admission
+	// createMu guards the failed creation counts and the circuit breaker.
+	createMu sync.Mutex
+	creates  createTracker
+	// placeMu guards where each instance lives and the free memory of each
+	// placement.
+	placeMu   sync.Mutex
+	locations map[string]int
+	free      map[placement]int64
+	desired   atomic.Int64
+	azure     AzureAgentClient
+	now       func() time.Time
+	logger    *slog.Logger
 }
 
+// NewPool returns a pool that runs its agents on a single Incus server.
 func NewPool(c incus.InstanceServer, conf Config) (*Pool, error) {
+	return NewPoolOnRemotes([]Remote{{Name: LocalRemote, Server: c}}, conf)
+}
+
+// NewPoolOnRemotes returns a pool that spreads its agents over several Incus
+// servers, in the order of conf.Remotes.
+func NewPoolOnRemotes(remotes []Remote, conf Config) (*Pool, error) {
+	if len(remotes) == 0 {
+		return nil, fmt.Errorf("pool %q has no remotes", conf.Name)
+	}
+	remotes = slices.Clone(remotes)
 	if conf.Incus.ProjectName != "" {
-		c = c.UseProject(conf.Incus.ProjectName)
+		for i := range remotes {
+			remotes[i].Server = remotes[i].Server.UseProject(conf.Incus.ProjectName)
+		}
 	}
 
 	p := &Pool{
-		c:            c,
-		conf:         conf,
-		inFlight:     &sync.Map{},
-		offlineSince: make(map[int]time.Time),
-		now:          time.Now,
+		c:               remotes[0].Server,
+		remotes:         remotes,
+		placements:      placements(remotes, conf.Targets),
+		conf:            conf,
+		inFlight:        &sync.Map{},
+		standbyInFlight: &sync.Map{},
+		drainingAgents:  &sync.Map{},
+		offlineSince:    make(map[int]time.Time),
+		locations:       make(map[string]int),
+		free:            make(map[placement]int64),
+		lifetimes:       make(map[int]*lifetime),
+		creates:         createTracker{failures: map[int]int{}, retryAt: map[int]time.Time{}},
+		now:             time.Now,
 	}
 	// Log the effective project ("default" when unset) so it's clear where
 	// instances are created.
@@ -71,16 +149,19 @@ func NewPool(c incus.InstanceServer, conf Config) (*Pool, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct agent regexp from Name %q: %w", conf.Name, err)
 	}
-
-	if p.conf.Incus.StartupGracePeriod == 0 {
-		if p.conf.Incus.VM {
-			p.conf.Incus.StartupGracePeriod = 5 * time.Minute
-		} else {
-			p.conf.Incus.StartupGracePeriod = time.Minute
-		}
+	p.standbyRe, err = regexp.Compile("^" + conf.Name + `-standby-(\d+)$`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct standby regexp from Name %q: %w", conf.Name, err)
 	}
-	if p.conf.OfflineGracePeriod == 0 {
-		p.conf.OfflineGracePeriod = 5 * time.Minute
+
+	applyDefaults(&p.conf)
+
+	// Autoscaled pools start at their floor; the autoscaler grows them once it
+	// has seen the Azure job queue.
+	if p.conf.Autoscaling() {
+		p.setDesiredAgents(p.conf.MinAgents)
+	} else {
+		p.setDesiredAgents(p.conf.AgentCount)
 	}
 
 	p.agentPrefix = p.conf.AgentPrefix
@@ -90,12 +171,36 @@ func NewPool(c incus.InstanceServer, conf Config) (*Pool, error) {
 			return nil, fmt.Errorf("determine Azure agent name prefix: %w", err)
 		}
 	}
-	p.azure, err = newHTTPAzureAgentClient(p.conf.Azure.Url, p.conf.Azure.PAT, nil)
+	p.azureAgentRe, err = regexp.Compile("^" + regexp.QuoteMeta(p.agentPrefix) + `-(\d+)$`)
 	if err != nil {
+		return nil, fmt.Errorf("unable to construct Azure agent regexp from prefix %q: %w", p.agentPrefix, err)
+	}
+	var cred credential
+	if p.conf.Azure.Auth == AuthServicePrincipal {
+		if p.conf.Azure.ServicePrincipal == nil {
+			return nil, fmt.Errorf("azure auth %q requires servicePrincipal settings", AuthServicePrincipal)
+		}
+		p.entra, err = newEntraTokenSource(*p.conf.Azure.ServicePrincipal, nil, func() time.Time { return p.now() })
+		if err != nil {
+			return nil, err
+		}
+		cred = p.entra
+	} else {
+		if _, err := p.resolvePAT(context.Background()); err != nil {
+			return nil, err
+		}
+		cred = patCredential(p.azureToken)
+	}
+	p.azure, err = newHTTPAzureAgentClient(p.conf.Azure.Url, cred, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.startCanary(p.conf); err != nil {
 		return nil, err
 	}
 
-	err = prometheus.DefaultRegisterer.Register(newAgentUptimeCollector(p))
+	p.collector = newAgentUptimeCollector(p)
+	err = prometheus.DefaultRegisterer.Register(p.collector)
 	var are prometheus.AlreadyRegisteredError
 	if errors.As(err, &are) {
 		err = nil
@@ -103,12 +208,98 @@ func NewPool(c incus.InstanceServer, conf Config) (*Pool, error) {
 	return p, err
 }
 
-func (p *Pool) CreateAgent(ctx context.Context, idx int) error {
-	if idx >= p.conf.AgentCount {
-		return fmt.Errorf("cannot create agent at index %d, capacity is %d", idx, p.conf.AgentCount)
+// applyDefaults fills in settings whose defaults depend on other settings.
+func applyDefaults(conf *Config) {
+	if conf.Incus.StartupGracePeriod == 0 {
+		if conf.Incus.VM {
+			conf.Incus.StartupGracePeriod = 5 * time.Minute
+		} else {
+			conf.Incus.StartupGracePeriod = time.Minute
+		}
 	}
+	if conf.OfflineGracePeriod == 0 {
+		conf.OfflineGracePeriod = 5 * time.Minute
+	}
+}
 
-	// todo: check for base image existence
+// config returns a snapshot of the pool configuration, which Reconfigure may
+// replace while the daemon is running.
+func (p *Pool) config() Config {
+	p.confMu.RLock()
+	defer p.confMu.RUnlock()
+	return p.conf
+}
+
+// ErrRestartRequired is returned by Reconfigure when a setting changed that a
+// running pool cannot pick up. The caller should replace the pool instead.
+var ErrRestartRequired = errors.New("pool must be restarted to apply configuration")
+
+// Reconfigure applies a changed configuration to a running pool. Agents that
+// are already running keep the settings they were created with; new agents
+// use the new ones. When the agent count shrinks, the indices above it are
+// drained rather than stopped.
+func (p *Pool) Reconfigure(conf Config) error {
+	current := p.config()
+	if conf.Name != current.Name ||
+		conf.AgentPrefix != current.AgentPrefix ||
+		!reflect.DeepEqual(conf.Azure, current.Azure) ||
+		conf.Incus.ProjectName != current.Incus.ProjectName ||
+		conf.Incus.VM != current.Incus.VM ||
+		!slices.Equal(conf.Remotes, current.Remotes) ||
+		!slices.Equal(conf.Targets, current.Targets) {
+		return ErrRestartRequired
+	}
+
+	applyDefaults(&conf)
+	if err := p.startCanary(conf); err != nil {
+		return err
+	}
+	p.confMu.Lock()
+	p.conf = conf
+	p.confMu.Unlock()
+
+	switch {
+	case conf.Autoscaling() && !current.Autoscaling():
+		p.setDesiredAgents(conf.MinAgents)
+	case conf.Autoscaling():
+		p.setDesiredAgents(min(max(p.DesiredAgents(), conf.MinAgents), conf.MaxAgents))
+	default:
+		p.setDesiredAgents(conf.AgentCount)
+	}
+
+	p.logger.Info("applied new configuration", "desired", p.DesiredAgents(), "image", conf.Incus.Image)
+	return nil
+}
+
+// Close waits for the pool's background stops and history records, and
+// releases the resources the pool registered globally. The pool must not be
+// used afterwards.
+func (p *Pool) Close() {
+	p.overdue.Wait()
+	p.jobLookups.Wait()
+	prometheus.DefaultRegisterer.Unregister(p.collector)
+}
+
+func (p *Pool) CreateAgent(ctx context.Context, idx int) error {
+	conf := p.config()
+	if idx >= conf.Capacity() {
+		return fmt.Errorf("cannot create agent at index %d, capacity is %d", idx, conf.Capacity())
+	}
+	if desired := p.DesiredAgents(); idx >= desired {
+		p.logger.Info("skipping agent creation",
+			"reason", "index exceeds desired agent count",
+			"idx", idx,
+			"desired", desired,
+		)
+		return nil
+	}
+	if p.AgentDraining(idx) {
+		p.logger.Info("skipping agent creation",
+			"reason", "draining",
+			"idx", idx,
+		)
+		return nil
+	}
 
 	if _, exists := p.inFlight.LoadOrStore(idx, true); exists {
 		p.logger.Warn("skipping agent creation",
@@ -119,122 +310,194 @@ func (p *Pool) CreateAgent(ctx context.Context, idx int) error {
 	}
 	defer p.inFlight.Delete(idx)
 
+	probe, err := p.allowCreate(idx)
+	if err != nil {
+		return err
+	}
+	source, canary := p.imageSource(idx)
+	if err := p.admit(idx, source); err != nil {
+		if probe {
+			p.cancelProbe()
+		}
+		return err
+	}
 	createErr := func() error {
+		name := p.AgentName(idx)
 
-		req := api.InstancesPost{
-			Name: p.AgentName(idx),
-			Type: p.instanceType(),
-			Source: api.InstanceSource{
-				Alias: p.conf.Incus.Image,
-				Type:  "image",
-			},
-			Start: true,
-			InstancePut: api.InstancePut{
-				Config: map[string]string{
-					"boot.host_shutdown_action": "force-stop",
-				},
-				Ephemeral: true,
-				Devices:   map[string]map[string]string{},
-			},
+		// Resolved for every agent so a rotated token is used right away.
+		token, err := p.agentToken(ctx)
+		if err != nil {
+			return err
 		}
 
-		if p.conf.Incus.VM {
-			// VMs have their own kernel; container-only keys are invalid/unneeded.
-			if p.conf.Incus.MaxCores > 0 {
-				req.Config["limits.cpu"] = fmt.Sprintf("%d", p.conf.Incus.MaxCores)
-			}
-			if p.conf.Incus.DiskSizeInGb > 0 {
-				req.Devices["root"] = map[string]string{
-					"type": "disk",
-					"path": "/",
-					"pool": p.conf.Incus.StoragePool,
-					"size": fmt.Sprintf("%dGiB", p.conf.Incus.DiskSizeInGb),
-				}
+		// Standbys are built from the stable image and mount caches like any
+		// agent, so canaries and cache writers skip them.
+		claimed := false
+		if !canary && !p.isAnyCacheWriter(idx) {
+			claimed, err = p.claimStandby(ctx, name)
+			if err != nil {
+				p.logger.Warn("unable to start standby instance, creating from image", "idx", idx, "err", err)
 			}
-		} else {
-			req.Config["raw.lxc"] = "lxc.cgroup2.memory.oom.group = 1"
-			req.Config["security.nesting"] = "true"
-			if p.conf.Incus.MaxCores > 0 {
-				req.Config["limits.cpu.allowance"] = fmt.Sprintf("%d%%", p.conf.Incus.MaxCores*100)
+		}
+		if !claimed {
+			req := p.instanceRequest(name)
+			req.Source = source
+			p.stampImage(&req, canary)
+			op, err := p.createInstance(ctx, req)
+			if err != nil {
+				return err
 			}
-			if p.conf.Incus.TmpfsSizeInGb > 0 {
-				req.Devices["tmpfs"] = map[string]string{
-					"type":   "disk",
-					"source": "tmpfs:",
-					"path":   "/tmp",
-					"size":   fmt.Sprintf("%dGiB", p.conf.Incus.TmpfsSizeInGb),
-				}
+
+			if err = waitOp(ctx, op, 2*time.Minute); err != nil {
+				return err
 			}
 		}
 
-		if p.conf.Incus.MaxRamInGb > 0 {
-			req.Config["limits.memory"] = fmt.Sprintf("%dGiB", p.conf.Incus.MaxRamInGb)
-		}
+		return p.startAgent(ctx, idx, token)
+	}()
 
-		op, err := p.c.CreateInstance(req)
-		if err != nil {
-			return err
+	// A create canceled by the daemon shutting down says nothing about the
+	// image or the host.
+	switch {
+	case ctx.Err() == nil:
+		p.createFinished(idx, probe, createErr)
+	case probe:
+		p.cancelProbe()
+	}
+	if createErr == nil {
+		agentsCreatedMetric.WithLabelValues(conf.Name).Inc()
+		p.logger.Info("agent started", "idx", idx, "image", sourceLabel(source), "canary", canary)
+		p.startLifetime(idx, sourceLabel(source))
+		p.noteCanaryAgent(idx, canary, p.now())
+	} else {
+		agentsCreatedErrorMetric.WithLabelValues(conf.Name).Inc()
+		p.failedLifetime(idx, sourceLabel(source), createErr)
+		if canary {
+			p.recordCanaryOutcome(false, createErr.Error())
 		}
+	}
 
-		if err = waitOp(ctx, op, 2*time.Minute); err != nil {
-			return err
-		}
+	return createErr
 
-		if p.conf.Incus.VM {
-			if err = p.waitForAgent(ctx, req.Name, 3*time.Minute, 2*time.Second); err != nil {
-				return err
+}
+
+// instanceRequest builds the request for a running, ephemeral agent instance.
+func (p *Pool) instanceRequest(name string) api.InstancesPost {
+	conf := p.config()
+	source, _ := p.imageSource(-1)
+	req := api.InstancesPost{
+		Name:   name,
+		Type:   p.instanceType(),
+		Source: source,
+		Start:  true,
+		InstancePut: api.InstancePut{
+			Config: map[string]string{
+				"boot.host_shutdown_action": "force-stop",
+			},
+			Ephemeral: true,
+			Devices:   map[string]map[string]string{},
+		},
+	}
+
+	if conf.Incus.VM {
+		// VMs have their own kernel; container-only keys are invalid/unneeded.
+		if conf.Incus.MaxCores > 0 {
+			req.Config["limits.cpu"] = fmt.Sprintf("%d", conf.Incus.MaxCores)
+		}
+		if conf.Incus.DiskSizeInGb > 0 {
+			req.Devices["root"] = map[string]string{
+				"type": "disk",
+				"path": "/",
+				"pool": conf.Incus.StoragePool,
+				"size": fmt.Sprintf("%dGiB", conf.Incus.DiskSizeInGb),
 			}
 		}
-
-		if err = p.c.CreateInstanceFile(req.Name, "/home/agent/.token", incus.InstanceFileArgs{
-			Content:   strings.NewReader(p.conf.Azure.PAT),
-			WriteMode: "overwrite",
-			Mode:      400,
-			UID:       int64(provision.AgentUid),
-			GID:       int64(provision.AgentGid),
-		}); err != nil {
-			return err
+	} else {
+		req.Config["raw.lxc"] = "lxc.cgroup2.memory.oom.group = 1"
+		req.Config["security.nesting"] = "true"
+		if conf.Incus.MaxCores > 0 {
+			req.Config["limits.cpu.allowance"] = fmt.Sprintf("%d%%", conf.Incus.MaxCores*100)
+		}
+		if conf.Incus.TmpfsSizeInGb > 0 {
+			req.Devices["tmpfs"] = map[string]string{
+				"type":   "disk",
+				"source": "tmpfs:",
+				"path":   "/tmp",
+				"size":   fmt.Sprintf("%dGiB", conf.Incus.TmpfsSizeInGb),
+			}
 		}
+	}
 
-		execPost := api.InstanceExecPost{
-			Command: []string{
-				"setsid",
-				"--fork",
-				"/home/agent/run_agent.sh",
-				"--agent", p.AzureAgentName(idx),
-				"--pool", p.conf.Name,
-				"--url", p.conf.Azure.Url,
-			},
-			Interactive: false,
-			WaitForWS:   true,
-		}
+	if conf.Incus.MaxRamInGb > 0 {
+		req.Config["limits.memory"] = fmt.Sprintf("%dGiB", conf.Incus.MaxRamInGb)
+	}
 
-		if len(p.conf.Env) > 0 {
-			execPost.Environment = p.conf.Env
-		}
+	p.addCacheDevices(name, conf, req.Devices)
+	req.Profiles = applyInstanceOptions(conf.Incus, req.Config, req.Devices)
+	p.stampImage(&req, false)
+	return req
+}
 
-		op, err = p.c.ExecInstance(
-			req.Name,
-			execPost,
-			&incus.InstanceExecArgs{},
-		)
+// startAgent pushes the registration token into the running instance at idx and
+// launches run_agent.sh.
+func (p *Pool) startAgent(ctx context.Context, idx int, token string) error {
+	conf := p.config()
+	name := p.AgentName(idx)
 
-		if err != nil {
+	if conf.Incus.VM {
+		if err := p.waitForAgent(ctx, name, 3*time.Minute, 2*time.Second); err != nil {
 			return err
 		}
+	}
 
-		return waitOp(ctx, op, defaultOperationTimeout)
+	if err := p.configureDocker(ctx, name); err != nil {
+		return err
+	}
 
-	}()
+	if err := p.server(name).CreateInstanceFile(name, "/home/agent/.token", incus.InstanceFileArgs{
+		Content:   strings.NewReader(token),
+		WriteMode: "overwrite",
+		Mode:      400,
+		UID:       int64(provision.AgentUid),
+		GID:       int64(provision.AgentGid),
+	}); err != nil {
+		return err
+	}
 
-	if createErr == nil {
-		agentsCreatedMetric.WithLabelValues(p.conf.Name).Inc()
-	} else {
-		agentsCreatedErrorMetric.WithLabelValues(p.conf.Name).Inc()
+	execPost := api.InstanceExecPost{
+		Command: []string{
+			"setsid",
+			"--fork",
+			"/home/agent/run_agent.sh",
+			"--agent", p.AzureAgentName(idx),
+			"--pool", conf.Name,
+			"--url", conf.Azure.Url,
+		},
+		Interactive: false,
+		WaitForWS:   true,
 	}
 
-	return createErr
+	if len(conf.Env) > 0 {
+		execPost.Environment = maps.Clone(conf.Env)
+	}
+	if p.logArchive() != nil {
+		if execPost.Environment == nil {
+			execPost.Environment = map[string]string{}
+		}
+		execPost.Environment["IAP_ARCHIVE_WAIT"] = strconv.Itoa(int(archiveWait.Seconds()))
+	}
 
+	op, err := p.server(name).ExecInstance(
+		name,
+		execPost,
+		&incus.InstanceExecArgs{},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return waitOp(ctx, op, defaultOperationTimeout)
 }
 
 func (p *Pool) isAgent(i api.Instance) bool {
@@ -244,7 +507,7 @@ func (p *Pool) isAgent(i api.Instance) bool {
 
 func (p *Pool) ListAgents() ([]api.Instance, error) {
 	agents := []api.Instance{}
-	allInstances, err := p.c.GetInstances(p.instanceType())
+	allInstances, err := p.listInstances()
 	if err != nil {
 		return nil, err
 	}
@@ -260,7 +523,7 @@ func (p *Pool) ListAgents() ([]api.Instance, error) {
 
 func (p *Pool) ListAgentsFull() ([]api.InstanceFull, error) {
 	agents := []api.InstanceFull{}
-	allInstances, err := p.c.GetInstancesFull(p.instanceType())
+	allInstances, err := p.listInstancesFull()
 	if err != nil {
 		return nil, err
 	}
@@ -275,7 +538,7 @@ func (p *Pool) ListAgentsFull() ([]api.InstanceFull, error) {
 }
 
 func (p *Pool) Reconcile(agentsToCreate chan<- int) error {
-	instancesFound := make(map[int]struct{}, p.conf.AgentCount)
+	instancesFound := make(map[int]struct{}, p.config().Capacity())
 
 	instances, err := p.ListAgents()
 	if err != nil {
@@ -294,7 +557,10 @@ func (p *Pool) Reconcile(agentsToCreate chan<- int) error {
 		instancesFound[idx] = struct{}{}
 	}
 
-	for idx := range p.conf.AgentCount {
+	for idx := range p.DesiredAgents() {
+		if p.AgentDraining(idx) || p.backingOff(idx) {
+			continue
+		}
 		if _, exists := instancesFound[idx]; !exists {
 			agentsToCreate <- idx
 		}
@@ -303,160 +569,173 @@ func (p *Pool) Reconcile(agentsToCreate chan<- int) error {
 	return nil
 }
 
+// Reap stops the instances that are stale according to decideReap.
 func (p *Pool) Reap(ctx context.Context) error {
-	now := p.now()
-
-	instances, err := p.ListAgentsFull()
+	decisions, instances, err := p.reapDecisions(ctx)
 	if err != nil {
 		return err
 	}
 
-	var (
-		azureAgents map[string]AzureAgentStatus
-		azureErr    error
-		azureLoaded bool
-	)
-	loadAzureAgents := func() (map[string]AzureAgentStatus, error) {
-		if !azureLoaded {
-			azureLoaded = true
-			azureAgents, azureErr = p.azure.ListAgents(ctx, p.conf.Name)
-		}
-		return azureAgents, azureErr
-	}
-
-	for _, instance := range instances {
-		idx, err := p.agentIndex(instance.Name)
-		if err != nil {
-			continue
-		}
-
-		// Any state where this exact instance cannot yet be judged resets prior
-		// observations for the reused pool index.
-		if instance.State == nil {
-			delete(p.offlineSince, idx)
-			p.logger.Debug("reaper: skipping instance",
-				"reason", "instance state unknown",
-				"idx", idx,
+	for i, d := range decisions {
+		switch {
+		case d.err != nil:
+			p.logger.Warn("reaper: check failed; failing closed", "idx", d.Index, "reason", d.Reason, "err", d.err)
+		case d.Verdict == ReapVerdictReap:
+		case d.firstOffline:
+			p.logger.Info("reaper: observed offline unassigned agent",
+				"idx", d.Index,
+				"grace", p.config().OfflineGracePeriod,
 			)
-			continue
-		}
-
-		status := instance.State.Status
-		if status != "Running" {
-			delete(p.offlineSince, idx)
+		default:
 			p.logger.Debug("reaper: skipping instance",
-				"reason", fmt.Sprintf("container status: %s", status),
-				"idx", idx,
+				"reason", d.Reason,
+				"age", d.Age,
+				"idx", d.Index,
 			)
-			continue
 		}
 
-		age := now.Sub(instance.CreatedAt)
-		if age < p.conf.Incus.StartupGracePeriod {
-			delete(p.offlineSince, idx)
-			p.logger.Debug("reaper: skipping instance",
-				"reason", "age < grace period",
-				"age", age,
-				"idx", idx,
-			)
-			continue
+		// Any state where this exact instance cannot yet be judged resets prior
+		// observations for the reused pool index.
+		if !d.unhealthy {
+			p.forgetOffline(d.Index)
 		}
-
-		wrapperRunning, err := p.isAgentProcessRunning(ctx, idx)
-		if err != nil {
-			delete(p.offlineSince, idx)
-			p.logger.Warn("reaper: health check failed", "idx", idx, "err", err)
+		if d.firstOffline {
+			p.observeOffline(d.Index, d.now)
+		}
+		if d.Verdict != ReapVerdictReap {
 			continue
 		}
 
-		workerRunning, err := p.isAgentWorkerRunning(ctx, idx)
-		if err != nil {
-			delete(p.offlineSince, idx)
-			p.logger.Warn("reaper: worker health check failed", "idx", idx, "err", err)
+		if d.leftover {
+			p.deleteLeftover(ctx, d)
 			continue
 		}
-		if workerRunning {
-			delete(p.offlineSince, idx)
-			p.logger.Debug("reaper: skipping instance",
-				"reason", "Agent.Worker is running",
-				"age", age,
-				"idx", idx,
-			)
+		if d.limit != "" {
+			p.stopOverdue(ctx, d)
 			continue
 		}
-
-		controlProcessRunning := wrapperRunning
-		if !controlProcessRunning {
-			controlProcessRunning, err = p.isAgentListenerRunning(ctx, idx)
+		if d.drain {
+			idle, err := p.disableDrained(ctx, d)
 			if err != nil {
-				delete(p.offlineSince, idx)
-				p.logger.Warn("reaper: listener health check failed", "idx", idx, "err", err)
+				p.logger.Warn("reaper: unable to disable Azure agent; failing closed", "idx", d.Index, "err", err)
 				continue
 			}
-		}
-
-		reason := "agent control processes are not running"
-		if controlProcessRunning {
-			agents, err := loadAzureAgents()
-			if err != nil {
-				delete(p.offlineSince, idx)
-				p.logger.Warn("reaper: Azure health check failed; failing closed", "idx", idx, "err", err)
+			if !idle {
+				p.logger.Info("reaper: skipping instance", "reason", d.Reason+", but the Azure agent was assigned a job", "idx", d.Index)
 				continue
 			}
+		}
+		if d.unhealthy && p.isCanaryInstance(instances[i]) {
+			p.recordCanaryOutcome(false, d.Reason)
+		}
+		p.reapStale(ctx, d.Index, d.Age, d.Reason)
+	}
 
-			azureStatus, found := agents[p.AzureAgentName(idx)]
-			if found && (azureStatus.Online || azureStatus.Assigned) {
-				delete(p.offlineSince, idx)
-				p.logger.Debug("reaper: skipping instance",
-					"reason", "Azure agent is online or assigned",
-					"age", age,
-					"idx", idx,
-				)
-				continue
-			}
+	return nil
+}
 
-			offlineAt, observed := p.offlineSince[idx]
-			if !observed {
-				p.offlineSince[idx] = now
-				p.logger.Info("reaper: observed offline unassigned agent",
-					"idx", idx,
-					"grace", p.conf.OfflineGracePeriod,
-				)
-				continue
-			}
-			offlineFor := now.Sub(offlineAt)
-			if offlineFor < p.conf.OfflineGracePeriod {
-				p.logger.Debug("reaper: skipping instance",
-					"reason", "offline duration < grace period",
-					"offline_for", offlineFor,
-					"idx", idx,
-				)
-				continue
-			}
-			reason = "Azure agent remained offline and unassigned without Agent.Worker"
-		}
+// deleteLeftover deletes the stopped instance of d unless another operation
+// holds it, such as a standby claim that has not made it ephemeral yet.
+func (p *Pool) deleteLeftover(ctx context.Context, d ReapDecision) {
+	if _, exists := p.inFlight.LoadOrStore(d.Index, true); exists {
+		p.logger.Debug("reaper: skipping instance",
+			"reason", "in-flight",
+			"idx", d.Index,
+		)
+		return
+	}
+	defer p.inFlight.Delete(d.Index)
+	p.logger.Info("reaper: deleting leftover instance", "idx", d.Index, "reason", d.Reason)
+	p.deleteInstance(ctx, d.Name)
+}
 
-		if _, exists := p.inFlight.LoadOrStore(idx, true); exists {
-			p.logger.Debug("reaper: skipping instance",
-				"reason", "in-flight",
-				"idx", idx,
-			)
-			continue
-		}
+// reapStale stops the instance at idx unless another operation holds it.
+func (p *Pool) reapStale(ctx context.Context, idx int, age time.Duration, reason string) {
+	if _, exists := p.inFlight.LoadOrStore(idx, true); exists {
+		p.logger.Debug("reaper: skipping instance",
+			"reason", "in-flight",
+			"idx", idx,
+		)
+		return
+	}
+	defer p.inFlight.Delete(idx)
+	p.reapClaimed(ctx, idx, age, reason)
+}
 
-		p.logger.Info("reaper: reaping stale instance", "idx", idx, "age", age, "reason", reason)
-		err = p.reapInstance(ctx, idx)
-		p.inFlight.Delete(idx)
+// reapClaimed stops the instance at idx, whose slot the caller holds.
+func (p *Pool) reapClaimed(ctx context.Context, idx int, age time.Duration, reason string) {
+	conf := p.config()
+	p.logger.Info("reaper: reaping stale instance", "idx", idx, "age", age, "reason", reason)
+	if err := p.reapAndRecord(ctx, idx, reason); err != nil {
+		p.logger.Error("reaper: failed to reap", "idx", idx, "err", err)
+		agentsReapedErrorMetric.WithLabelValues(conf.Name).Inc()
+	} else {
+		p.forgetOffline(idx)
+		agentsReapedMetric.WithLabelValues(conf.Name).Inc()
+	}
+}
 
-		if err != nil {
-			p.logger.Error("reaper: failed to reap", "idx", idx, "err", err)
-			agentsReapedErrorMetric.WithLabelValues(p.conf.Name).Inc()
-		} else {
-			delete(p.offlineSince, idx)
-			agentsReapedMetric.WithLabelValues(p.conf.Name).Inc()
+// forgetOffline drops any offline observation for idx.
+func (p *Pool) forgetOffline(idx int) {
+	p.offlineMu.Lock()
+	defer p.offlineMu.Unlock()
+	delete(p.offlineSince, idx)
+}
+
+// observeOffline returns when idx was first seen offline. If it had not been
+// seen offline before, it records now and returns false.
+func (p *Pool) observeOffline(idx int, now time.Time) (time.Time, bool) {
+	p.offlineMu.Lock()
+	defer p.offlineMu.Unlock()
+	offlineAt, observed := p.offlineSince[idx]
+	if !observed {
+		p.offlineSince[idx] = now
+	}
+	return offlineAt, observed
+}
+
+// DesiredAgents returns the number of agent indices the pool currently keeps
+// populated. It equals AgentCount unless the pool is autoscaled.
+func (p *Pool) DesiredAgents() int {
+	return int(p.desired.Load())
+}
+
+func (p *Pool) setDesiredAgents(n int) {
+	p.desired.Store(int64(n))
+	desiredAgentsMetric.WithLabelValues(p.config().Name).Set(float64(n))
+}
+
+// Autoscaling reports whether the pool is sized from the Azure job queue.
+func (p *Pool) Autoscaling() bool {
+	return p.config().Autoscaling()
+}
+
+// Autoscale sizes an autoscaled pool from the Azure job queue. Demand is every
+// queued job plus every job running on one of this host's agents, bounded by
+// MinAgents and MaxAgents.
+func (p *Pool) Autoscale(ctx context.Context) error {
+	conf := p.config()
+	if !conf.Autoscaling() {
+		return nil
+	}
+
+	requests, err := p.azure.ListJobRequests(ctx, conf.Name)
+	if err != nil {
+		return err
+	}
+
+	demand := 0
+	for _, r := range requests {
+		if r.AgentName == "" || p.azureAgentRe.MatchString(r.AgentName) {
+			demand++
 		}
 	}
 
+	desired := min(max(demand, conf.MinAgents), conf.MaxAgents)
+	if previous := p.DesiredAgents(); previous != desired {
+		p.logger.Info("autoscaler: resizing pool", "from", previous, "to", desired, "demand", demand)
+	}
+	p.setDesiredAgents(desired)
 	return nil
 }
 
@@ -473,54 +752,48 @@ func (p *Pool) isAgentListenerRunning(ctx context.Context, idx int) (bool, error
 }
 
 func (p *Pool) isProcessRunning(ctx context.Context, idx int, pattern string) (bool, error) {
-	op, err := p.c.ExecInstance(
-		p.AgentName(idx),
-		api.InstanceExecPost{
-			Command: []string{
-				"pgrep",
-				"-u",
-				provision.AgentUser,
-				"-f",
-				pattern,
-			},
-			WaitForWS:   true,
-			Interactive: false,
-		},
-		&incus.InstanceExecArgs{},
-	)
-	if err != nil {
-		return false, fmt.Errorf("exec failed: %w", err)
-	}
-
-	if err := waitOp(ctx, op, defaultOperationTimeout); err != nil {
-		return false, fmt.Errorf("wait failed: %w", err)
-	}
-
-	meta := op.Get().Metadata
-	if meta == nil {
-		return false, fmt.Errorf("metadata is nil")
-	}
-
-	returnCode, ok := meta["return"].(float64)
-	if !ok {
-		return false, fmt.Errorf("return code not found")
-	}
-
-	return int(returnCode) == 0, nil
+	return p.execSucceeds(ctx, p.AgentName(idx), []string{
+		"pgrep",
+		"-u",
+		provision.AgentUser,
+		"-f",
+		pattern,
+	})
 }
 
 // ReapAgent force-stops one pool instance. Incus removes the instance because
 // pool agents are ephemeral, and the reconciler then creates a replacement.
 func (p *Pool) ReapAgent(ctx context.Context, idx int) error {
-	if idx < 0 || idx >= p.conf.AgentCount {
-		return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, p.Name(), p.conf.AgentCount)
+	if err := p.validateIndex(idx); err != nil {
+		return err
 	}
 	if _, exists := p.inFlight.LoadOrStore(idx, true); exists {
 		return fmt.Errorf("agent index %d in pool %q already has an operation in flight", idx, p.Name())
 	}
 	defer p.inFlight.Delete(idx)
 
-	return p.reapInstance(ctx, idx)
+	return p.reapAndRecord(ctx, idx, "reaped manually")
+}
+
+// reapAndRecord archives the logs of the instance at idx, stops it and records
+// why in the history.
+func (p *Pool) reapAndRecord(ctx context.Context, idx int, reason string) error {
+	p.markReaping(idx, reason)
+	p.archiveLogs(ctx, idx)
+	if err := p.reapInstance(ctx, idx); err != nil {
+		p.markReaping(idx, "")
+		return err
+	}
+	p.endLifetime(idx, history.ExitReaped, reason)
+	return nil
+}
+
+func (p *Pool) validateIndex(idx int) error {
+	conf := p.config()
+	if idx < 0 || idx >= conf.Capacity() {
+		return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, conf.Name, conf.Capacity())
+	}
+	return nil
 }
 
 func (p *Pool) reapInstance(ctx context.Context, idx int) error {
@@ -529,12 +802,12 @@ func (p *Pool) reapInstance(ctx context.Context, idx int) error {
 	// waitTimeout must exceed stopTimeout so the client-side context doesn't cancel before Incus reports completion.
 	stopTimeout := 30
 	waitTimeout := 45 * time.Second
-	if p.conf.Incus.VM {
+	if p.config().Incus.VM {
 		stopTimeout = 60
 		waitTimeout = 90 * time.Second
 	}
 
-	op, err := p.c.UpdateInstanceState(name, api.InstanceStatePut{
+	op, err := p.server(name).UpdateInstanceState(name, api.InstanceStatePut{
 		Action:  "stop",
 		Force:   true,
 		Timeout: stopTimeout,
@@ -576,7 +849,7 @@ func (p *Pool) agentIndex(name string) (int, error) {
 }
 
 func (p *Pool) AgentName(idx int) string {
-	return fmt.Sprintf("%s-%d", p.conf.Name, idx)
+	return fmt.Sprintf("%s-%d", p.config().Name, idx)
 }
 
 func (p *Pool) AzureAgentName(idx int) string {
@@ -591,7 +864,7 @@ func (p *Pool) waitForAgent(ctx context.Context, name string, timeout, interval
 	deadline := time.Now().Add(timeout)
 	var lastErr error
 	for {
-		op, err := p.c.ExecInstance(name, api.InstanceExecPost{
+		op, err := p.server(name).ExecInstance(name, api.InstanceExecPost{
 			Command:     []string{"true"},
 			WaitForWS:   true,
 			Interactive: false,
@@ -620,43 +893,22 @@ func (p *Pool) waitForAgent(ctx context.Context, name string, timeout, interval
 
 // instanceType returns the Incus instance type for this pool's agents.
 func (p *Pool) instanceType() api.InstanceType {
-	if p.conf.Incus.VM {
+	if p.config().Incus.VM {
 		return api.InstanceTypeVM
 	}
 	return api.InstanceTypeContainer
 }
 
-func (p *Pool) AgentLogs(ctx context.Context, idx int, w io.Writer) error {
-
-	if idx >= p.conf.AgentCount {
-		return fmt.Errorf("invalid agent index %d, pool %q has %d agents", idx, p.Name(), p.conf.AgentCount)
-	}
-
-	op, err := p.c.ExecInstance(
-		p.AgentName(idx),
-		api.InstanceExecPost{
-			Command:     []string{"cat", "/home/agent/azp-agent.log"},
-			WaitForWS:   true,
-			Interactive: false,
-		}, &incus.InstanceExecArgs{
-			Stdout: w,
-		},
-	)
-	if err != nil {
-		return err
-	}
-	return waitOp(ctx, op, defaultOperationTimeout)
-}
-
 func (p *Pool) Name() string {
-	return p.conf.Name
+	return p.config().Name
 }
 
 // Project returns the effective Incus project for this pool ("default" when
 // unset), matching where instances are actually created.
 func (p *Pool) Project() string {
-	if p.conf.Incus.ProjectName == "" {
+	conf := p.config()
+	if conf.Incus.ProjectName == "" {
 		return "default"
 	}
-	return p.conf.Incus.ProjectName
+	return conf.Incus.ProjectName
 }
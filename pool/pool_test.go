@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"slices"
 	"testing"
 	"time"
 
+	incus "github.com/lxc/incus/v6/client"
 	"github.com/lxc/incus/v6/shared/api"
 	"github.com/sklarsa/incus-azure-pipelines/mocks"
 	"github.com/stretchr/testify/assert"
@@ -408,7 +411,7 @@ func TestPool_Reap_SkipsNonRunning(t *testing.T) {
 	m := mocks.NewMockInstanceServer(t)
 	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{
 		{
-			Instance: api.Instance{Name: "azp-agent-0"},
+			Instance: api.Instance{Name: "azp-agent-0", InstancePut: api.InstancePut{Ephemeral: true}},
 			State:    &api.InstanceState{Status: "Stopped"},
 		},
 	}, nil)
@@ -595,7 +598,7 @@ func TestPool_AgentLogs_InvalidIndex(t *testing.T) {
 	require.NoError(t, err)
 
 	var buf bytes.Buffer
-	err = pool.AgentLogs(context.Background(), 10, &buf) // Pool has 3 agents (0, 1, 2)
+	err = pool.AgentLogs(context.Background(), 10, &buf, LogOptions{}) // Pool has 3 agents (0, 1, 2)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid agent index 10")
 }
@@ -608,7 +611,7 @@ func TestPool_AgentLogs_ExecError(t *testing.T) {
 	require.NoError(t, err)
 
 	var buf bytes.Buffer
-	err = pool.AgentLogs(context.Background(), 0, &buf)
+	err = pool.AgentLogs(context.Background(), 0, &buf, LogOptions{})
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "instance not found")
 }
@@ -618,14 +621,23 @@ func TestPool_AgentLogs_Success(t *testing.T) {
 
 	execOp := mocks.NewMockOperation(t)
 	execOp.On("WaitContext", mock.Anything).Return(nil)
-	m.On("ExecInstance", "azp-agent-1", mock.Anything, mock.Anything).Return(execOp, nil)
+	m.On("ExecInstance", "azp-agent-1", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return slices.Equal(req.Command, []string{"cat", "/home/agent/azp-agent.log"})
+	}), mock.Anything).
+		Run(func(args mock.Arguments) {
+			execArgs := args.Get(2).(*incus.InstanceExecArgs)
+			_, _ = io.WriteString(execArgs.Stdout, "Listening for Jobs\n")
+			close(execArgs.DataDone)
+		}).
+		Return(execOp, nil)
 
 	pool, err := NewPool(m, testConfig())
 	require.NoError(t, err)
 
 	var buf bytes.Buffer
-	err = pool.AgentLogs(context.Background(), 1, &buf)
+	err = pool.AgentLogs(context.Background(), 1, &buf, LogOptions{})
 	require.NoError(t, err)
+	assert.Equal(t, "Listening for Jobs\n", buf.String())
 }
 
 func TestPool_AgentLogs_WaitError(t *testing.T) {
@@ -639,7 +651,7 @@ func TestPool_AgentLogs_WaitError(t *testing.T) {
 	require.NoError(t, err)
 
 	var buf bytes.Buffer
-	err = pool.AgentLogs(context.Background(), 0, &buf)
+	err = pool.AgentLogs(context.Background(), 0, &buf, LogOptions{})
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "wait failed")
 }
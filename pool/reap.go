@@ -0,0 +1,361 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/provision"
+)
+
+// Limits after which the reaper stops an agent whatever it is doing.
+const (
+	limitMaxLifetime    = "maxLifetime"
+	limitMaxJobDuration = "maxJobDuration"
+)
+
+// workerStopTimeout is how long the job worker of an agent that exceeded a
+// limit gets to exit after SIGTERM, before its instance is force-stopped.
+var (
+	workerStopTimeout      = time.Minute
+	workerStopPollInterval = 5 * time.Second
+)
+
+// ReapVerdict is what the reaper does with an instance.
+type ReapVerdict string
+
+const (
+	// ReapVerdictKeep leaves a healthy or busy instance alone.
+	ReapVerdictKeep ReapVerdict = "keep"
+	// ReapVerdictWait leaves an instance alone while a grace period runs.
+	ReapVerdictWait ReapVerdict = "wait"
+	// ReapVerdictReap stops the instance.
+	ReapVerdictReap ReapVerdict = "reap"
+	// ReapVerdictUnknown leaves an instance alone because a check failed.
+	ReapVerdictUnknown ReapVerdict = "unknown"
+)
+
+// ReapDecision is what the reaper decides about one instance, and why.
+type ReapDecision struct {
+	Index   int         `json:"index"`
+	Name    string      `json:"name"`
+	Verdict ReapVerdict `json:"verdict"`
+	Reason  string      `json:"reason"`
+	// Age is how long ago the instance was created.
+	Age time.Duration `json:"age"`
+	// OfflineFor is how long the Azure agent has been seen offline and
+	// unassigned, if it has been.
+	OfflineFor time.Duration `json:"offlineFor,omitempty"`
+	// JobID is the Azure job request of an agent stopped for exceeding a limit.
+	JobID int64 `json:"jobId,omitempty"`
+
+	now time.Time
+	err error
+	// limit is the exceeded limit, maxLifetime or maxJobDuration, of an agent
+	// that is stopped whatever it is doing.
+	limit string
+	// unhealthy decisions keep the offline observation of the index. A reaped
+	// unhealthy canary counts against the canary image.
+	unhealthy bool
+	// firstOffline is set when the agent is seen offline for the first time,
+	// which starts its offline grace period.
+	firstOffline bool
+	// drain is set for an idle agent that is stopped because it is drained.
+	// Its Azure registration is disabled first, since Azure can still assign
+	// it a job.
+	drain bool
+	azure AzureAgentStatus
+	// leftover is set for a stopped agent instance that is not ephemeral, so
+	// nothing else would ever remove it. It is deleted instead of stopped.
+	leftover bool
+}
+
+// ExplainReap returns what the reaper would decide about every instance of the
+// pool, without stopping any or recording offline observations.
+func (p *Pool) ExplainReap(ctx context.Context) ([]ReapDecision, error) {
+	decisions, _, err := p.reapDecisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range decisions {
+		if d.Verdict != ReapVerdictReap {
+			continue
+		}
+		if _, held := p.inFlight.Load(d.Index); held {
+			decisions[i].Verdict = ReapVerdictKeep
+			decisions[i].Reason = d.Reason + ", but an operation is in flight"
+		}
+	}
+	return decisions, nil
+}
+
+// reapDecisions decides about every agent instance of the pool. The instances
+// are returned in the same order as the decisions.
+func (p *Pool) reapDecisions(ctx context.Context) ([]ReapDecision, []api.InstanceFull, error) {
+	now := p.now()
+
+	all, err := p.ListAgentsFull()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		azureAgents map[string]AzureAgentStatus
+		azureErr    error
+		azureLoaded bool
+	)
+	loadAzureAgents := func() (map[string]AzureAgentStatus, error) {
+		if !azureLoaded {
+			azureLoaded = true
+			azureAgents, azureErr = p.azure.ListAgents(ctx, p.Name())
+		}
+		return azureAgents, azureErr
+	}
+
+	var (
+		decisions []ReapDecision
+		instances []api.InstanceFull
+	)
+	for _, instance := range all {
+		idx, err := p.agentIndex(instance.Name)
+		if err != nil {
+			continue
+		}
+		d := ReapDecision{Index: idx, Name: instance.Name, Age: now.Sub(instance.CreatedAt), now: now}
+		p.decideReap(ctx, instance, &d, loadAzureAgents)
+		decisions = append(decisions, d)
+		instances = append(instances, instance)
+	}
+	return decisions, instances, nil
+}
+
+// decideReap fills in the verdict about one instance and the reason for it.
+func (p *Pool) decideReap(ctx context.Context, instance api.InstanceFull, d *ReapDecision, loadAzureAgents func() (map[string]AzureAgentStatus, error)) {
+	conf := p.config()
+	idx := d.Index
+
+	decide := func(verdict ReapVerdict, reason string) {
+		d.Verdict, d.Reason = verdict, reason
+	}
+	failed := func(check string, err error) {
+		d.Verdict, d.Reason, d.err = ReapVerdictUnknown, check+" failed: "+err.Error(), err
+	}
+
+	if instance.State == nil {
+		decide(ReapVerdictKeep, "instance state unknown")
+		return
+	}
+	if status := instance.State.Status; status != "Running" {
+		// Agents are ephemeral. A stopped one that is not was left by a standby
+		// claim whose start and cleanup both failed, and holds its index.
+		if status == "Stopped" && !instance.Ephemeral {
+			d.leftover = true
+			decide(ReapVerdictReap, "stopped instance is not ephemeral")
+			return
+		}
+		decide(ReapVerdictKeep, fmt.Sprintf("container status: %s", status))
+		return
+	}
+
+	// Agents that exceeded a limit are stopped even while they run a job.
+	if conf.MaxLifetime > 0 && d.Age > conf.MaxLifetime {
+		d.limit = limitMaxLifetime
+		decide(ReapVerdictReap, fmt.Sprintf("age %s exceeds maxLifetime %s", d.Age.Round(time.Second), conf.MaxLifetime))
+		// The job ID is only logged, so an Azure outage must not keep the
+		// instance alive.
+		if agents, err := loadAzureAgents(); err == nil {
+			d.JobID = agents[p.AzureAgentName(idx)].RequestID
+		}
+		return
+	}
+	if conf.MaxJobDuration > 0 {
+		// Azure errors are reported by the checks below when they matter.
+		agents, err := loadAzureAgents()
+		status := agents[p.AzureAgentName(idx)]
+		if err == nil && status.Assigned && !status.AssignedAt.IsZero() {
+			if running := d.now.Sub(status.AssignedAt); running > conf.MaxJobDuration {
+				d.limit = limitMaxJobDuration
+				d.JobID = status.RequestID
+				decide(ReapVerdictReap, fmt.Sprintf("job %d running for %s exceeds maxJobDuration %s", status.RequestID, running.Round(time.Second), conf.MaxJobDuration))
+				return
+			}
+		}
+	}
+
+	// Indices above the desired count, draining agents, and agents on a
+	// rolled back canary image are drained: busy agents finish their job and
+	// power off on their own, idle ones are stopped now.
+	desired := p.DesiredAgents()
+	if idx >= desired || p.AgentDraining(idx) || p.isRolledBackCanary(instance) {
+		reason := "index exceeds desired agent count"
+		switch {
+		case idx >= desired:
+		case p.AgentDraining(idx):
+			reason = "draining"
+		default:
+			reason = "canary image rolled back"
+		}
+
+		workerRunning, err := p.isAgentWorkerRunning(ctx, idx)
+		if err != nil {
+			failed("busy check", err)
+			return
+		}
+		if workerRunning {
+			decide(ReapVerdictKeep, reason+", but Agent.Worker is running")
+			return
+		}
+		agents, err := loadAzureAgents()
+		if err != nil {
+			failed("busy check", err)
+			return
+		}
+		status := agents[p.AzureAgentName(idx)]
+		if status.Assigned {
+			decide(ReapVerdictKeep, reason+", but the Azure agent is assigned a job")
+			return
+		}
+		d.drain, d.azure = true, status
+		decide(ReapVerdictReap, reason)
+		return
+	}
+
+	if d.Age < conf.Incus.StartupGracePeriod {
+		decide(ReapVerdictWait, fmt.Sprintf("age %s < startup grace period %s", d.Age.Round(time.Second), conf.Incus.StartupGracePeriod))
+		return
+	}
+
+	wrapperRunning, err := p.isAgentProcessRunning(ctx, idx)
+	if err != nil {
+		failed("health check", err)
+		return
+	}
+
+	workerRunning, err := p.isAgentWorkerRunning(ctx, idx)
+	if err != nil {
+		failed("worker health check", err)
+		return
+	}
+	if workerRunning {
+		decide(ReapVerdictKeep, "Agent.Worker is running")
+		return
+	}
+
+	controlProcessRunning := wrapperRunning
+	if !controlProcessRunning {
+		controlProcessRunning, err = p.isAgentListenerRunning(ctx, idx)
+		if err != nil {
+			failed("listener health check", err)
+			return
+		}
+	}
+	if !controlProcessRunning {
+		d.unhealthy = true
+		decide(ReapVerdictReap, "agent control processes are not running")
+		return
+	}
+
+	agents, err := loadAzureAgents()
+	if err != nil {
+		failed("Azure health check", err)
+		return
+	}
+	azureStatus, found := agents[p.AzureAgentName(idx)]
+	if found && (azureStatus.Online || azureStatus.Assigned) {
+		decide(ReapVerdictKeep, "Azure agent is online or assigned")
+		return
+	}
+
+	d.unhealthy = true
+	p.offlineMu.Lock()
+	offlineAt, observed := p.offlineSince[idx]
+	p.offlineMu.Unlock()
+	if !observed {
+		d.firstOffline = true
+		decide(ReapVerdictWait, fmt.Sprintf("Azure agent is offline and unassigned, offline grace period %s starts now", conf.OfflineGracePeriod))
+		return
+	}
+	d.OfflineFor = d.now.Sub(offlineAt)
+	if d.OfflineFor < conf.OfflineGracePeriod {
+		decide(ReapVerdictWait, fmt.Sprintf("offline for %s < offline grace period %s", d.OfflineFor.Round(time.Second), conf.OfflineGracePeriod))
+		return
+	}
+	decide(ReapVerdictReap, "Azure agent remained offline and unassigned without Agent.Worker")
+}
+
+// disableDrained disables the Azure registration of a drained idle agent, so
+// no job is dispatched to it while its instance is stopped. It reports whether
+// the agent is still unassigned afterwards: a job assigned before the agent
+// was disabled shows up when the agents are listed again. Offline agents get
+// no jobs and are left as they are.
+func (p *Pool) disableDrained(ctx context.Context, d ReapDecision) (bool, error) {
+	if !d.azure.Online {
+		return true, nil
+	}
+	if err := p.azure.DisableAgent(ctx, p.Name(), d.azure.ID); err != nil {
+		return false, err
+	}
+	p.logger.Info("reaper: disabled Azure agent", "idx", d.Index, "agent_id", d.azure.ID, "reason", d.Reason)
+	agents, err := p.azure.ListAgents(ctx, p.Name())
+	if err != nil {
+		return false, err
+	}
+	return !agents[p.AzureAgentName(d.Index)].Assigned, nil
+}
+
+// stopOverdue stops an agent that exceeded a limit: its job worker is asked to
+// exit first, so the job is canceled rather than lost, then the instance is
+// force-stopped. The slot is held for the whole stop, which runs in the
+// background so each agent waiting for its worker does not stall the reaper.
+func (p *Pool) stopOverdue(ctx context.Context, d ReapDecision) {
+	if _, held := p.inFlight.LoadOrStore(d.Index, true); held {
+		p.logger.Debug("reaper: skipping instance", "reason", "in-flight", "idx", d.Index)
+		return
+	}
+
+	p.logger.Warn("reaper: agent exceeded its limit",
+		"idx", d.Index,
+		"limit", d.limit,
+		"job_id", d.JobID,
+		"age", d.Age,
+		"reason", d.Reason,
+	)
+	agentsTimedOutMetric.WithLabelValues(p.Name(), d.limit).Inc()
+
+	p.overdue.Go(func() {
+		defer p.inFlight.Delete(d.Index)
+		if err := p.stopWorker(ctx, d.Index); err != nil {
+			p.logger.Warn("reaper: graceful worker stop failed; force-stopping", "idx", d.Index, "err", err)
+		}
+		p.reapClaimed(ctx, d.Index, d.Age, d.Reason)
+	})
+}
+
+// stopWorker sends SIGTERM to the job worker of the agent at idx and waits up
+// to workerStopTimeout for it to exit.
+func (p *Pool) stopWorker(ctx context.Context, idx int) error {
+	if _, err := p.execSucceeds(ctx, p.AgentName(idx), []string{
+		"pkill", "-TERM", "-u", provision.AgentUser, "-f", "Agent.Worker",
+	}); err != nil {
+		return err
+	}
+
+	deadline := time.After(workerStopTimeout)
+	for {
+		running, err := p.isAgentWorkerRunning(ctx, idx)
+		if err != nil {
+			return err
+		}
+		if !running {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("worker process Agent.Worker still running after %s", workerStopTimeout)
+		case <-time.After(workerStopPollInterval):
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_ExplainReap_DoesNotAct(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := mocks.NewMockInstanceServer(t)
+	young := oldRunningAgent("azp-agent-1", now)
+	young.CreatedAt = now.Add(-30 * time.Second)
+	stopped := api.InstanceFull{
+		Instance: api.Instance{Name: "azp-agent-2", CreatedAt: now.Add(-time.Hour), InstancePut: api.InstancePut{Ephemeral: true}},
+		State:    &api.InstanceState{Status: "Stopped"},
+	}
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{
+		oldRunningAgent("azp-agent-0", now), young, stopped,
+	}, nil).Twice()
+	expectProcessChecks(m, "azp-agent-0", processResult(t, true), processResult(t, false))
+	expectProcessChecks(m, "azp-agent-0", processResult(t, true), processResult(t, false))
+	p := newOfflineTestPool(t, m, &now, &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{"runner-0": {}}})
+
+	for range 2 {
+		decisions, err := p.ExplainReap(context.Background())
+		require.NoError(t, err)
+		require.Len(t, decisions, 3)
+
+		assert.Equal(t, ReapVerdictWait, decisions[0].Verdict)
+		assert.Contains(t, decisions[0].Reason, "offline grace period 5m0s starts now")
+		assert.Equal(t, ReapVerdictWait, decisions[1].Verdict)
+		assert.Equal(t, "age 30s < startup grace period 1m0s", decisions[1].Reason)
+		assert.Equal(t, ReapVerdictKeep, decisions[2].Verdict)
+		assert.Equal(t, "container status: Stopped", decisions[2].Reason)
+	}
+	assert.Empty(t, p.offlineSince, "explaining records no offline observation")
+}
+
+func TestPool_ExplainReap_OfflineFor(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{oldRunningAgent("azp-agent-0", now)}, nil)
+	expectProcessChecks(m, "azp-agent-0", processResult(t, true), processResult(t, false))
+	expectProcessChecks(m, "azp-agent-0", processResult(t, true), processResult(t, false))
+	expectProcessChecks(m, "azp-agent-0", processResult(t, true), processResult(t, false))
+	p := newOfflineTestPool(t, m, &now, &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{"runner-0": {}}})
+
+	require.NoError(t, p.Reap(context.Background()))
+	now = now.Add(2 * time.Minute)
+	decisions, err := p.ExplainReap(context.Background())
+	require.NoError(t, err)
+	require.Len(t, decisions, 1)
+	assert.Equal(t, ReapVerdictWait, decisions[0].Verdict)
+	assert.Equal(t, 2*time.Minute, decisions[0].OfflineFor)
+	assert.Equal(t, "offline for 2m0s < offline grace period 5m0s", decisions[0].Reason)
+
+	// An agent held by another operation would be skipped by the reaper.
+	now = now.Add(5 * time.Minute)
+	release, err := p.HoldAgent(0)
+	require.NoError(t, err)
+	defer release()
+	decisions, err = p.ExplainReap(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ReapVerdictKeep, decisions[0].Verdict)
+	assert.Equal(t, "Azure agent remained offline and unassigned without Agent.Worker, but an operation is in flight", decisions[0].Reason)
+	m.AssertNotCalled(t, "UpdateInstanceState", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPool_ExplainReap_ExcessBusyAgent(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{oldRunningAgent("azp-agent-5", now)}, nil)
+	m.On("ExecInstance", "azp-agent-5", mock.Anything, mock.Anything).Return(processResult(t, false), nil).Once()
+	p := newOfflineTestPool(t, m, &now, &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{"runner-5": {Assigned: true}}})
+
+	decisions, err := p.ExplainReap(context.Background())
+	require.NoError(t, err)
+	require.Len(t, decisions, 1)
+	assert.Equal(t, ReapVerdictKeep, decisions[0].Verdict)
+	assert.Equal(t, "index exceeds desired agent count, but the Azure agent is assigned a job", decisions[0].Reason)
+}
@@ -0,0 +1,140 @@
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func timedOutCount(t *testing.T, pool, limit string) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, agentsTimedOutMetric.WithLabelValues(pool, limit).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func expectWorkerStop(m *mocks.MockInstanceServer, t *testing.T, name string, stillRunning ...bool) {
+	t.Helper()
+	m.On("ExecInstance", name, mock.MatchedBy(isCommand("pkill")), mock.Anything).Return(processResult(t, true), nil).Once()
+	for _, running := range stillRunning {
+		m.On("ExecInstance", name, mock.MatchedBy(func(req api.InstanceExecPost) bool {
+			return req.Command[len(req.Command)-1] == "Agent.Worker" && req.Command[0] == "pgrep"
+		}), mock.Anything).Return(processResult(t, running), nil).Once()
+	}
+}
+
+func newLimitsTestPool(t *testing.T, m *mocks.MockInstanceServer, now *time.Time, azure AzureAgentClient, configure func(*Config)) *Pool {
+	t.Helper()
+	conf := testConfig()
+	conf.AgentPrefix = "runner"
+	configure(&conf)
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	p.now = func() time.Time { return *now }
+	p.azure = azure
+	return p
+}
+
+func TestPool_Reap_MaxLifetimeStopsBusyAgent(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{oldRunningAgent("azp-agent-0", now)}, nil)
+	azure := &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+		"runner-0": {Online: true, Assigned: true, RequestID: 42},
+	}}
+	p := newLimitsTestPool(t, m, &now, azure, func(c *Config) { c.MaxLifetime = 5 * time.Minute })
+
+	expectWorkerStop(m, t, "azp-agent-0", false)
+	expectStop(m, t, "azp-agent-0")
+	before := timedOutCount(t, p.Name(), limitMaxLifetime)
+	require.NoError(t, p.Reap(context.Background()))
+	p.overdue.Wait()
+	assert.Equal(t, before+1, timedOutCount(t, p.Name(), limitMaxLifetime))
+}
+
+func TestPool_Reap_StopsOverdueAgentsInBackground(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{
+		oldRunningAgent("azp-agent-0", now),
+		oldRunningAgent("azp-agent-1", now),
+	}, nil)
+	p := newLimitsTestPool(t, m, &now, &fakeAzureAgentClient{}, func(c *Config) { c.MaxLifetime = 5 * time.Minute })
+
+	// The workers take until after Reap returns to exit.
+	release := make(chan time.Time)
+	for _, name := range []string{"azp-agent-0", "azp-agent-1"} {
+		m.On("ExecInstance", name, mock.MatchedBy(isCommand("pkill")), mock.Anything).Return(processResult(t, true), nil).Once()
+		m.On("ExecInstance", name, mock.MatchedBy(isCommand("pgrep")), mock.Anything).
+			WaitUntil(release).Return(processResult(t, false), nil).Once()
+		expectStop(m, t, name)
+	}
+
+	require.NoError(t, p.Reap(context.Background()))
+	for idx := range 2 {
+		_, held := p.inFlight.Load(idx)
+		assert.True(t, held, "the slot of agent %d is held while its worker stops", idx)
+	}
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+	decisions, err := p.ExplainReap(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ReapVerdictKeep, decisions[0].Verdict)
+
+	close(release)
+	p.overdue.Wait()
+	m.AssertNumberOfCalls(t, "UpdateInstanceState", 2)
+	_, held := p.inFlight.Load(0)
+	assert.False(t, held)
+}
+
+func TestPool_Reap_MaxJobDurationForceStopsHungWorker(t *testing.T) {
+	workerStopTimeout, workerStopPollInterval = 20*time.Millisecond, time.Millisecond
+	t.Cleanup(func() { workerStopTimeout, workerStopPollInterval = time.Minute, 5*time.Second })
+
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{oldRunningAgent("azp-agent-0", now)}, nil)
+	azure := &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+		"runner-0": {Online: true, Assigned: true, RequestID: 42, AssignedAt: now.Add(-2 * time.Hour)},
+	}}
+	p := newLimitsTestPool(t, m, &now, azure, func(c *Config) { c.MaxJobDuration = time.Hour })
+
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(isCommand("pkill")), mock.Anything).Return(processResult(t, true), nil).Once()
+	m.On("ExecInstance", "azp-agent-0", mock.MatchedBy(isCommand("pgrep")), mock.Anything).Return(processResult(t, true), nil)
+	expectStop(m, t, "azp-agent-0")
+	before := timedOutCount(t, p.Name(), limitMaxJobDuration)
+	require.NoError(t, p.Reap(context.Background()))
+	p.overdue.Wait()
+	assert.Equal(t, before+1, timedOutCount(t, p.Name(), limitMaxJobDuration))
+
+	decisions, err := p.ExplainReap(context.Background())
+	require.NoError(t, err)
+	require.Len(t, decisions, 1)
+	assert.Equal(t, ReapVerdictReap, decisions[0].Verdict)
+	assert.Equal(t, int64(42), decisions[0].JobID)
+	assert.Equal(t, "job 42 running for 2h0m0s exceeds maxJobDuration 1h0m0s", decisions[0].Reason)
+}
+
+func TestPool_Reap_WithinLimitsKeepsBusyAgent(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{oldRunningAgent("azp-agent-0", now)}, nil)
+	azure := &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+		"runner-0": {Online: true, Assigned: true, RequestID: 42, AssignedAt: now.Add(-30 * time.Minute)},
+	}}
+	p := newLimitsTestPool(t, m, &now, azure, func(c *Config) {
+		c.MaxLifetime = time.Hour
+		c.MaxJobDuration = time.Hour
+	})
+	expectProcessChecks(m, "azp-agent-0", processResult(t, true), processResult(t, true))
+
+	require.NoError(t, p.Reap(context.Background()))
+	m.AssertNotCalled(t, "UpdateInstanceState", mock.Anything, mock.Anything, mock.Anything)
+}
@@ -14,9 +14,16 @@ import (
 )
 
 type fakeAzureAgentClient struct {
-	agents map[string]AzureAgentStatus
-	err    error
-	calls  int
+	agents   map[string]AzureAgentStatus
+	requests []AzureJobRequest
+	finished []AzureJobRequest
+	err      error
+	calls    int
+	deleted  []int
+	disabled []int
+	// onDisable runs when an agent is disabled, to assign it a job in the
+	// meantime.
+	onDisable func()
 }
 
 func (f *fakeAzureAgentClient) ListAgents(context.Context, string) (map[string]AzureAgentStatus, error) {
@@ -24,6 +31,37 @@ func (f *fakeAzureAgentClient) ListAgents(context.Context, string) (map[string]A
 	return f.agents, f.err
 }
 
+func (f *fakeAzureAgentClient) ListJobRequests(context.Context, string) ([]AzureJobRequest, error) {
+	f.calls++
+	return f.requests, f.err
+}
+
+func (f *fakeAzureAgentClient) ListFinishedJobRequests(context.Context, string) ([]AzureJobRequest, error) {
+	f.calls++
+	return f.finished, f.err
+}
+
+func (f *fakeAzureAgentClient) DeleteAgent(_ context.Context, _ string, agentID int) error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	f.deleted = append(f.deleted, agentID)
+	return nil
+}
+
+func (f *fakeAzureAgentClient) DisableAgent(_ context.Context, _ string, agentID int) error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	f.disabled = append(f.disabled, agentID)
+	if f.onDisable != nil {
+		f.onDisable()
+	}
+	return nil
+}
+
 func processResult(t *testing.T, running bool) *mocks.MockOperation {
 	t.Helper()
 	op := mocks.NewMockOperation(t)
@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Reconfigure_AppliesSettings(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	conf := testConfig()
+	conf.AgentCount = 1
+	conf.Env = map[string]string{"FOO": "bar"}
+	conf.Incus.Image = "new-image"
+	require.NoError(t, p.Reconfigure(conf))
+
+	assert.Equal(t, 1, p.DesiredAgents())
+	req := p.instanceRequest(p.AgentName(0))
+	assert.Equal(t, "new-image", req.Source.Alias)
+	// Defaults that depend on other settings are filled in again.
+	assert.Equal(t, time.Minute, p.config().Incus.StartupGracePeriod)
+	assert.Equal(t, 5*time.Minute, p.config().OfflineGracePeriod)
+}
+
+func TestPool_Reconfigure_Autoscaling(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p := newAutoscaleTestPool(t, m, &fakeAzureAgentClient{})
+	p.setDesiredAgents(4)
+
+	conf := p.config()
+	conf.MaxAgents = 2
+	require.NoError(t, p.Reconfigure(conf))
+	assert.Equal(t, 2, p.DesiredAgents(), "desired count is clamped to the new maximum")
+
+	conf.MinAgents = 0
+	conf.MaxAgents = 8
+	require.NoError(t, p.Reconfigure(conf))
+	assert.Equal(t, 2, p.DesiredAgents(), "desired count is kept while within bounds")
+
+	conf.MaxAgents = 0
+	conf.AgentCount = 5
+	require.NoError(t, p.Reconfigure(conf))
+	assert.False(t, p.Autoscaling())
+	assert.Equal(t, 5, p.DesiredAgents())
+}
+
+func TestPool_Reconfigure_RestartRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+	}{
+		{name: "name", change: func(c *Config) { c.Name = "other" }},
+		{name: "agent prefix", change: func(c *Config) { c.AgentPrefix = "runner" }},
+		{name: "azure", change: func(c *Config) { c.Azure.PAT = "rotated" }},
+		{name: "project", change: func(c *Config) { c.Incus.ProjectName = "ci" }},
+		{name: "vm", change: func(c *Config) { c.Incus.VM = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := mocks.NewMockInstanceServer(t)
+			p, err := NewPool(m, testConfig())
+			require.NoError(t, err)
+
+			conf := testConfig()
+			conf.AgentCount = 1
+			tt.change(&conf)
+			require.ErrorIs(t, p.Reconfigure(conf), ErrRestartRequired)
+			assert.Equal(t, 3, p.DesiredAgents(), "configuration is left unchanged")
+		})
+	}
+}
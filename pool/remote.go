@@ -0,0 +1,290 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// LocalRemote is the name of the Incus daemon reached over the local unix
+// socket. Pools that do not list any remotes place their agents on it.
+const LocalRemote = "local"
+
+// defaultAgentMemory is the memory an agent without MaxRamInGb is assumed to
+// use when placing several agents between two capacity refreshes.
+const defaultAgentMemory = 1 << 30
+
+// Remote is an Incus server a pool places agents on.
+type Remote struct {
+	// Name identifies the remote in logs and agent listings.
+	Name   string
+	Server incus.InstanceServer
+}
+
+// placement is somewhere the pool can create an instance: a remote, and for a
+// clustered remote the member to create it on.
+type placement struct {
+	remote int
+	target string
+}
+
+// placements returns every remote and cluster member combination the pool
+// spreads its agents over.
+func placements(remotes []Remote, targets []string) []placement {
+	var all []placement
+	for r := range remotes {
+		if len(targets) == 0 {
+			all = append(all, placement{remote: r})
+			continue
+		}
+		for _, target := range targets {
+			all = append(all, placement{remote: r, target: target})
+		}
+	}
+	return all
+}
+
+// label names a placement in logs and errors.
+func (p *Pool) label(pl placement) string {
+	name := p.remotes[pl.remote].Name
+	if pl.target != "" {
+		name += "/" + pl.target
+	}
+	return name
+}
+
+// RefreshCapacity records the free memory of every remote and cluster member
+// the pool places agents on. New agents go wherever the most memory is free.
+// Places that cannot be queried are left out until the next refresh. Pools
+// with a single place to put agents skip the queries.
+func (p *Pool) RefreshCapacity() error {
+	if len(p.placements) < 2 {
+		return nil
+	}
+
+	free := map[placement]int64{}
+	var errs []error
+	for _, pl := range p.placements {
+		bytes, err := p.freeMemory(pl)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("query free memory on %s: %w", p.label(pl), err))
+			continue
+		}
+		free[pl] = bytes
+	}
+
+	p.placeMu.Lock()
+	p.free = free
+	p.placeMu.Unlock()
+	return errors.Join(errs...)
+}
+
+func (p *Pool) freeMemory(pl placement) (int64, error) {
+	server := p.remotes[pl.remote].Server
+	if pl.target != "" {
+		state, _, err := server.GetClusterMemberState(pl.target)
+		if err != nil {
+			return 0, err
+		}
+		return int64(state.SysInfo.FreeRAM), nil
+	}
+
+	resources, err := server.GetServerResources()
+	if err != nil {
+		return 0, err
+	}
+	return int64(resources.Memory.Total) - int64(resources.Memory.Used), nil
+}
+
+// place picks where to create the instance called name and remembers it.
+// Agents go where admission control placed them. The memory the agent may use
+// is subtracted right away, so agents created before the next refresh spread
+// out instead of all landing on the same place.
+func (p *Pool) place(name string) placement {
+	admitted, pinned := p.admittedPlacement(name)
+
+	p.placeMu.Lock()
+	defer p.placeMu.Unlock()
+
+	best := p.placements[0]
+	bestFree, known := p.free[best]
+	for _, pl := range p.placements[1:] {
+		if free, ok := p.free[pl]; ok && (!known || free > bestFree) {
+			best, bestFree, known = pl, free, true
+		}
+	}
+	if pinned {
+		best = admitted
+		bestFree, known = p.free[best]
+	}
+	if known {
+		reserve := int64(p.config().Incus.MaxRamInGb) << 30
+		if reserve == 0 {
+			reserve = defaultAgentMemory
+		}
+		p.free[best] = bestFree - reserve
+	}
+	p.locations[name] = best.remote
+	return best
+}
+
+// createInstance creates an instance on the place with the most free memory,
+// after preparing the caches it mounts there.
+func (p *Pool) createInstance(ctx context.Context, req api.InstancesPost) (incus.Operation, error) {
+	pl := p.place(req.Name)
+	server := p.remotes[pl.remote].Server
+	if pl.target != "" {
+		server = server.UseTarget(pl.target)
+	}
+	if len(p.placements) > 1 {
+		p.logger.Info("placing instance", "name", req.Name, "remote", p.label(pl))
+	}
+	if err := p.prepareCaches(ctx, server, req); err != nil {
+		return nil, err
+	}
+	return server.CreateInstance(req)
+}
+
+// server returns the remote the instance called name lives on.
+func (p *Pool) server(name string) incus.InstanceServer {
+	return p.remotes[p.remoteOf(name)].Server
+}
+
+// remoteOf returns the index of the remote the instance called name lives on.
+// Instances the pool has not seen yet, for example in a one-off CLI command,
+// are looked up on every remote first. Unknown instances map to the first
+// remote, which then reports them as not found.
+func (p *Pool) remoteOf(name string) int {
+	if len(p.remotes) == 1 {
+		return 0
+	}
+
+	p.placeMu.Lock()
+	r, ok := p.locations[name]
+	p.placeMu.Unlock()
+	if ok {
+		return r
+	}
+
+	if _, err := p.listInstances(); err != nil {
+		p.logger.Warn("unable to locate instance", "name", name, "err", err)
+	}
+	p.placeMu.Lock()
+	defer p.placeMu.Unlock()
+	return p.locations[name]
+}
+
+// getInstance returns the instance called name. An instance that is not found
+// on the remote it was last seen on may have been recreated elsewhere since, so
+// the remotes are listed again and it is looked up where it lives now.
+func (p *Pool) getInstance(name string) (*api.Instance, error) {
+	r := p.remoteOf(name)
+	instance, _, err := p.remotes[r].Server.GetInstance(name)
+	if len(p.remotes) == 1 || !api.StatusErrorCheck(err, http.StatusNotFound) {
+		return instance, err
+	}
+
+	if _, err := p.listInstances(); err != nil {
+		p.logger.Warn("unable to locate instance", "name", name, "err", err)
+	}
+	if moved := p.remoteOf(name); moved != r {
+		instance, _, err = p.remotes[moved].Server.GetInstance(name)
+	}
+	return instance, err
+}
+
+// RemoteName returns the name of the remote the instance called name lives on.
+func (p *Pool) RemoteName(name string) string {
+	return p.remotes[p.remoteOf(name)].Name
+}
+
+// setLocation records that the instance called to lives where from does, after
+// a rename.
+func (p *Pool) setLocation(from, to string) {
+	p.placeMu.Lock()
+	defer p.placeMu.Unlock()
+	if r, ok := p.locations[from]; ok {
+		p.locations[to] = r
+		delete(p.locations, from)
+	}
+}
+
+// listInstances returns the pool's instances on every remote and records
+// where each of them lives. A remote that cannot be listed fails the whole
+// listing: treating its agents as missing would create them all again.
+func (p *Pool) listInstances() ([]api.Instance, error) {
+	var all []api.Instance
+	locations := map[string]int{}
+	for r, remote := range p.remotes {
+		instances, err := remote.Server.GetInstances(p.instanceType())
+		if err != nil {
+			return nil, p.remoteError(r, err)
+		}
+		for _, i := range instances {
+			if p.ownsInstance(i.Name) {
+				locations[i.Name] = r
+				all = append(all, i)
+			}
+		}
+	}
+	p.setLocations(locations)
+	return all, nil
+}
+
+// listInstancesFull is listInstances with each instance's state.
+func (p *Pool) listInstancesFull() ([]api.InstanceFull, error) {
+	var all []api.InstanceFull
+	locations := map[string]int{}
+	for r, remote := range p.remotes {
+		instances, err := remote.Server.GetInstancesFull(p.instanceType())
+		if err != nil {
+			return nil, p.remoteError(r, err)
+		}
+		for _, i := range instances {
+			if p.ownsInstance(i.Name) {
+				locations[i.Name] = r
+				all = append(all, i)
+			}
+		}
+	}
+	p.setLocations(locations)
+	return all, nil
+}
+
+func (p *Pool) ownsInstance(name string) bool {
+	if p.agentRe.MatchString(name) {
+		return true
+	}
+	_, err := p.standbyIndex(name)
+	return err == nil
+}
+
+// setLocations merges a listing into the known locations. Instances missing
+// from it are forgotten, except those being created: place has already
+// recorded where they go, and the listing may have been taken before they
+// existed.
+func (p *Pool) setLocations(locations map[string]int) {
+	if len(p.remotes) == 1 {
+		return
+	}
+	p.placeMu.Lock()
+	defer p.placeMu.Unlock()
+	for name := range p.locations {
+		if _, listed := locations[name]; !listed && !p.creatingInstance(name) {
+			delete(p.locations, name)
+		}
+	}
+	maps.Copy(p.locations, locations)
+}
+
+func (p *Pool) remoteError(r int, err error) error {
+	if len(p.remotes) == 1 {
+		return err
+	}
+	return fmt.Errorf("remote %q: %w", p.remotes[r].Name, err)
+}
@@ -0,0 +1,184 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func expectFreeMemory(m *mocks.MockInstanceServer, gb uint64) {
+	m.On("GetServerResources").Return(&api.Resources{
+		Memory: api.ResourcesMemory{Total: 64 << 30, Used: 64<<30 - gb<<30},
+	}, nil)
+}
+
+func newRemoteTestPool(t *testing.T, a, b *mocks.MockInstanceServer) *Pool {
+	t.Helper()
+	conf := testConfig()
+	conf.Remotes = []string{"a", "b"}
+	conf.Incus.MaxRamInGb = 4
+	p, err := NewPoolOnRemotes([]Remote{{Name: "a", Server: a}, {Name: "b", Server: b}}, conf)
+	require.NoError(t, err)
+	return p
+}
+
+func TestPool_CreateAgent_PlacesByFreeMemory(t *testing.T) {
+	a := mocks.NewMockInstanceServer(t)
+	b := mocks.NewMockInstanceServer(t)
+	p := newRemoteTestPool(t, a, b)
+	expectFreeMemory(a, 10)
+	expectFreeMemory(b, 12)
+	require.NoError(t, p.RefreshCapacity())
+
+	b.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Name == "azp-agent-0"
+	})).Return(okOp(t), nil).Once()
+	expectAgentStart(t, b, "azp-agent-0")
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+
+	// b has 8GiB left after reserving MaxRamInGb for agent 0, so a is next.
+	a.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Name == "azp-agent-1"
+	})).Return(okOp(t), nil).Once()
+	expectAgentStart(t, a, "azp-agent-1")
+	require.NoError(t, p.CreateAgent(context.Background(), 1))
+
+	assert.Equal(t, "b", p.RemoteName("azp-agent-0"))
+	assert.Equal(t, "a", p.RemoteName("azp-agent-1"))
+}
+
+func TestPool_RefreshCapacity_SkipsUnreachableRemote(t *testing.T) {
+	a := mocks.NewMockInstanceServer(t)
+	b := mocks.NewMockInstanceServer(t)
+	p := newRemoteTestPool(t, a, b)
+	a.On("GetServerResources").Return(nil, errors.New("connection refused"))
+	expectFreeMemory(b, 2)
+
+	assert.ErrorContains(t, p.RefreshCapacity(), "query free memory on a")
+	assert.Equal(t, 1, p.place("azp-agent-0").remote)
+}
+
+func TestPool_RefreshCapacity_SingleRemote(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.RefreshCapacity())
+	m.AssertNotCalled(t, "GetServerResources")
+}
+
+func TestPool_ListAgents_AcrossRemotes(t *testing.T) {
+	a := mocks.NewMockInstanceServer(t)
+	b := mocks.NewMockInstanceServer(t)
+	p := newRemoteTestPool(t, a, b)
+	a.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0"}, {Name: "other"}}, nil)
+	b.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-2"}}, nil)
+
+	agents, err := p.ListAgents()
+	require.NoError(t, err)
+	assert.Len(t, agents, 2)
+
+	// Operations on an agent go to the remote it lives on.
+	expectStop(b, t, "azp-agent-2")
+	require.NoError(t, p.ReapAgent(context.Background(), 2))
+	a.AssertNotCalled(t, "UpdateInstanceState", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPool_ListAgents_KeepsLocationsOfInstancesBeingCreated(t *testing.T) {
+	a := mocks.NewMockInstanceServer(t)
+	b := mocks.NewMockInstanceServer(t)
+	p := newRemoteTestPool(t, a, b)
+	expectFreeMemory(a, 4)
+	expectFreeMemory(b, 12)
+	require.NoError(t, p.RefreshCapacity())
+
+	// Agent 1 is placed on b, and the listing is taken before it exists.
+	p.inFlight.Store(1, true)
+	p.place("azp-agent-1")
+	a.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0"}}, nil)
+	b.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	_, err := p.ListAgents()
+	require.NoError(t, err)
+	assert.Equal(t, "b", p.RemoteName("azp-agent-1"))
+	assert.Equal(t, "a", p.RemoteName("azp-agent-0"))
+}
+
+func TestPool_GetInstance_RelocatesMovedInstance(t *testing.T) {
+	a := mocks.NewMockInstanceServer(t)
+	b := mocks.NewMockInstanceServer(t)
+	p := newRemoteTestPool(t, a, b)
+	a.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0"}}, nil).Once()
+	b.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil).Once()
+	_, err := p.ListAgents()
+	require.NoError(t, err)
+
+	// The agent was recreated on b since the last listing.
+	a.On("GetInstance", "azp-agent-0").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "not found")).Once()
+	a.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil).Once()
+	b.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0"}}, nil).Once()
+	b.On("GetInstance", "azp-agent-0").Return(&api.Instance{Name: "azp-agent-0"}, "", nil).Once()
+
+	i, err := p.getInstance("azp-agent-0")
+	require.NoError(t, err)
+	assert.Equal(t, "azp-agent-0", i.Name)
+	assert.Equal(t, "b", p.RemoteName("azp-agent-0"))
+}
+
+func TestPool_ListAgents_FailsWhenRemoteFails(t *testing.T) {
+	a := mocks.NewMockInstanceServer(t)
+	b := mocks.NewMockInstanceServer(t)
+	p := newRemoteTestPool(t, a, b)
+	a.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{{Name: "azp-agent-0"}}, nil)
+	b.On("GetInstances", api.InstanceTypeContainer).Return(nil, errors.New("connection refused"))
+
+	_, err := p.ListAgents()
+	assert.ErrorContains(t, err, `remote "b"`)
+
+	// Agents on the unreachable remote must not be recreated elsewhere.
+	ch := make(chan int, 64)
+	require.Error(t, p.Reconcile(ch))
+	assert.Empty(t, ch)
+}
+
+func TestPool_CreateAgent_ClusterTarget(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	member := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Targets = []string{"node-1", "node-2"}
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	m.On("GetClusterMemberState", "node-1").Return(&api.ClusterMemberState{
+		SysInfo: api.ClusterMemberSysInfo{FreeRAM: 2 << 30},
+	}, "", nil)
+	m.On("GetClusterMemberState", "node-2").Return(&api.ClusterMemberState{
+		SysInfo: api.ClusterMemberSysInfo{FreeRAM: 8 << 30},
+	}, "", nil)
+	require.NoError(t, p.RefreshCapacity())
+
+	m.On("UseTarget", "node-2").Return(member).Once()
+	member.On("CreateInstance", mock.Anything).Return(okOp(t), nil).Once()
+	expectAgentStart(t, m, "azp-agent-0")
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+}
+
+func TestPool_Reconfigure_RemotesRequireRestart(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	conf := testConfig()
+	conf.Remotes = []string{"other"}
+	assert.ErrorIs(t, p.Reconfigure(conf), ErrRestartRequired)
+
+	conf = testConfig()
+	conf.Targets = []string{"node-1"}
+	assert.ErrorIs(t, p.Reconfigure(conf), ErrRestartRequired)
+}
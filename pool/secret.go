@@ -0,0 +1,103 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// secretRefreshInterval is how long the Azure API client reuses a resolved PAT
+// before resolving it again. Agent creation always resolves it afresh.
+const secretRefreshInterval = time.Minute
+
+// execSecretTimeout bounds how long an exec: secret command may run.
+const execSecretTimeout = 30 * time.Second
+
+// resolveSecret returns the secret a reference points to. A reference is one of
+// env:NAME, file:PATH or exec:COMMAND [ARGS...]; any other value is the secret
+// itself. Surrounding whitespace, such as a trailing newline, is trimmed.
+func resolveSecret(ctx context.Context, ref string) (string, error) {
+	kind, value, _ := strings.Cut(ref, ":")
+	var secret string
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(value)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", value)
+		}
+		secret = v
+	case "file":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return "", err
+		}
+		secret = string(data)
+	case "exec":
+		args := strings.Fields(value)
+		if len(args) == 0 {
+			return "", fmt.Errorf("exec secret has no command")
+		}
+		ctx, cancel := context.WithTimeout(ctx, execSecretTimeout)
+		defer cancel()
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("run %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		secret = stdout.String()
+	default:
+		return ref, nil
+	}
+
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return "", fmt.Errorf("%s secret is empty", kind)
+	}
+	return secret, nil
+}
+
+// resolvePAT resolves the configured Azure PAT and keeps it for the Azure API
+// client, so a rotated token is picked up without a restart.
+func (p *Pool) resolvePAT(ctx context.Context) (string, error) {
+	pat, err := resolveSecret(ctx, p.config().Azure.PAT)
+	if err != nil {
+		return "", fmt.Errorf("resolve Azure PAT: %w", err)
+	}
+
+	p.patMu.Lock()
+	defer p.patMu.Unlock()
+	p.pat = pat
+	p.patResolvedAt = p.now()
+	return pat, nil
+}
+
+// azureToken returns the PAT for Azure API requests, resolving it again once
+// it is older than secretRefreshInterval.
+func (p *Pool) azureToken(ctx context.Context) (string, error) {
+	p.patMu.Lock()
+	pat, resolvedAt := p.pat, p.patResolvedAt
+	p.patMu.Unlock()
+	if pat != "" && p.now().Sub(resolvedAt) < secretRefreshInterval {
+		return pat, nil
+	}
+	return p.resolvePAT(ctx)
+}
+
+// agentToken returns the token a new agent registers with: the PAT, or an
+// access token of the service principal, which expires within the hour.
+func (p *Pool) agentToken(ctx context.Context) (string, error) {
+	if p.entra == nil {
+		return p.resolvePAT(ctx)
+	}
+	token, err := p.entra.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get Entra token: %w", err)
+	}
+	return token, nil
+}
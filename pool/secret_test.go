@@ -0,0 +1,124 @@
+package pool
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("IAP_TEST_PAT", "from-env")
+	file := filepath.Join(t.TempDir(), "pat")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{ref: "plain-token", want: "plain-token"},
+		{ref: "env:IAP_TEST_PAT", want: "from-env"},
+		{ref: "file:" + file, want: "from-file"},
+		{ref: "exec:echo from-exec", want: "from-exec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := resolveSecret(context.Background(), tt.ref)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResolveSecret_Errors(t *testing.T) {
+	tests := []struct {
+		ref     string
+		wantErr string
+	}{
+		{ref: "env:IAP_TEST_PAT_UNSET", wantErr: `environment variable "IAP_TEST_PAT_UNSET" is not set`},
+		{ref: "file:" + filepath.Join(t.TempDir(), "missing"), wantErr: "no such file"},
+		{ref: "exec:", wantErr: "no command"},
+		{ref: "exec:false", wantErr: "run false"},
+		{ref: "exec:true", wantErr: "exec secret is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			_, err := resolveSecret(context.Background(), tt.ref)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestPool_CreateAgent_ResolvesRotatedPAT(t *testing.T) {
+	t.Setenv("IAP_TEST_PAT", "first")
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Azure.PAT = "env:IAP_TEST_PAT"
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	t.Setenv("IAP_TEST_PAT", "rotated")
+	m.On("CreateInstance", mock.Anything).Return(okOp(t), nil).Once()
+	m.On("CreateInstanceFile", "azp-agent-0", "/home/agent/.token", mock.MatchedBy(func(args incus.InstanceFileArgs) bool {
+		content, err := io.ReadAll(args.Content)
+		return err == nil && string(content) == "rotated"
+	})).Return(nil).Once()
+	m.On("ExecInstance", "azp-agent-0", mock.Anything, mock.Anything).Return(okOp(t), nil)
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+
+	token, err := p.azureToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", token)
+}
+
+func TestPool_CreateAgent_PATUnavailable(t *testing.T) {
+	t.Setenv("IAP_TEST_PAT", "first")
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Azure.PAT = "env:IAP_TEST_PAT"
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Unsetenv("IAP_TEST_PAT"))
+	assert.ErrorContains(t, p.CreateAgent(context.Background(), 0), "resolve Azure PAT")
+	m.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestPool_AzureToken_RefreshesAfterInterval(t *testing.T) {
+	t.Setenv("IAP_TEST_PAT", "first")
+	now := time.Now()
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Azure.PAT = "env:IAP_TEST_PAT"
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	p.now = func() time.Time { return now }
+	_, err = p.resolvePAT(context.Background())
+	require.NoError(t, err)
+
+	t.Setenv("IAP_TEST_PAT", "rotated")
+	token, err := p.azureToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "first", token)
+
+	now = now.Add(secretRefreshInterval)
+	token, err = p.azureToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", token)
+}
+
+func TestNewPool_PATUnavailable(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.Azure.PAT = "env:IAP_TEST_PAT_UNSET"
+	_, err := NewPool(m, conf)
+	assert.ErrorContains(t, err, "resolve Azure PAT")
+}
@@ -0,0 +1,96 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// ShellOptions configure an interactive shell in an agent instance.
+type ShellOptions struct {
+	// Root opens the shell as root instead of the agent user.
+	Root bool
+	// Term is the TERM of the shell. Width and Height are its initial size.
+	Term          string
+	Width, Height int
+	Stdin         io.Reader
+	Stdout        io.Writer
+	// Control is called with the exec control connection, to forward window
+	// resizes and signals.
+	Control func(*websocket.Conn)
+}
+
+// Shell opens an interactive login shell in the agent instance at idx and
+// returns its exit status once it exits.
+func (p *Pool) Shell(ctx context.Context, idx int, opts ShellOptions) (int, error) {
+	if err := p.validateIndex(idx); err != nil {
+		return 0, err
+	}
+
+	command := []string{"su", "-l", "agent"}
+	if opts.Root {
+		command = []string{"su", "-l"}
+	}
+	var env map[string]string
+	if opts.Term != "" {
+		env = map[string]string{"TERM": opts.Term}
+	}
+
+	name := p.AgentName(idx)
+	dataDone := make(chan bool)
+	op, err := p.server(name).ExecInstance(
+		name,
+		api.InstanceExecPost{
+			Command:     command,
+			Environment: env,
+			WaitForWS:   true,
+			Interactive: true,
+			Width:       opts.Width,
+			Height:      opts.Height,
+		}, &incus.InstanceExecArgs{
+			Stdin:    opts.Stdin,
+			Stdout:   opts.Stdout,
+			Control:  opts.Control,
+			DataDone: dataDone,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	if err := op.WaitContext(ctx); err != nil {
+		return 0, err
+	}
+	select {
+	case <-dataDone:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	code, ok := op.Get().Metadata["return"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("return code not found")
+	}
+	return int(code), nil
+}
+
+// HoldAgent marks the agent at idx as having an operation in flight until
+// release is called, so the reaper leaves its instance alone and the
+// reconciler does not replace it.
+func (p *Pool) HoldAgent(idx int) (release func(), err error) {
+	if err := p.validateIndex(idx); err != nil {
+		return nil, err
+	}
+	if _, exists := p.inFlight.LoadOrStore(idx, true); exists {
+		return nil, fmt.Errorf("agent index %d in pool %q already has an operation in flight", idx, p.Name())
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { p.inFlight.Delete(idx) })
+	}, nil
+}
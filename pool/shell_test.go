@@ -0,0 +1,78 @@
+package pool
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	incus "github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Shell(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		root    bool
+		command []string
+	}{
+		{name: "agent", command: []string{"su", "-l", "agent"}},
+		{name: "root", root: true, command: []string{"su", "-l"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := mocks.NewMockInstanceServer(t)
+			p, err := NewPool(m, testConfig())
+			require.NoError(t, err)
+
+			op := mocks.NewMockOperation(t)
+			op.On("WaitContext", mock.Anything).Return(nil)
+			op.On("Get").Return(api.Operation{Metadata: map[string]any{"return": float64(3)}})
+			m.On("ExecInstance", "azp-agent-2", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+				return slices.Equal(req.Command, tt.command) &&
+					req.Interactive &&
+					req.Environment["TERM"] == "xterm-256color" &&
+					req.Width == 120 && req.Height == 40
+			}), mock.Anything).
+				Run(func(args mock.Arguments) {
+					close(args.Get(2).(*incus.InstanceExecArgs).DataDone)
+				}).
+				Return(op, nil).Once()
+
+			code, err := p.Shell(context.Background(), 2, ShellOptions{
+				Root:   tt.root,
+				Term:   "xterm-256color",
+				Width:  120,
+				Height: 40,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, 3, code)
+		})
+	}
+}
+
+func TestPool_HoldAgent(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	_, err = p.HoldAgent(5)
+	assert.ErrorContains(t, err, "invalid agent index 5")
+
+	release, err := p.HoldAgent(1)
+	require.NoError(t, err)
+	_, err = p.HoldAgent(1)
+	assert.ErrorContains(t, err, "already has an operation in flight")
+
+	// A held agent is skipped by the reaper.
+	p.reapStale(context.Background(), 1, 0, "test")
+	m.AssertNotCalled(t, "UpdateInstanceState", mock.Anything, mock.Anything, mock.Anything)
+
+	release()
+	release()
+	release, err = p.HoldAgent(1)
+	require.NoError(t, err)
+	release()
+}
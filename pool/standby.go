@@ -0,0 +1,216 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// Warm standby instances are created ahead of time in the stopped state, so
+// replacing an agent only pays for a boot instead of an image unpack. Incus can
+// only rename stopped instances, and stopping an ephemeral instance deletes it,
+// so standbys are persistent until they are claimed for an agent slot.
+
+// WarmStandby returns the number of standby instances the pool keeps ready.
+func (p *Pool) WarmStandby() int {
+	return p.config().Incus.WarmStandby
+}
+
+// StandbyName returns the instance name of the standby at position n.
+func (p *Pool) StandbyName(n int) string {
+	return fmt.Sprintf("%s-standby-%d", p.config().Name, n)
+}
+
+// standbyIndex returns the position of a standby instance based on its name.
+func (p *Pool) standbyIndex(name string) (int, error) {
+	matches := p.standbyRe.FindStringSubmatch(name)
+	if len(matches) == 0 {
+		return 0, errNotPoolAgent
+	}
+	return strconv.Atoi(matches[1])
+}
+
+// listStandby returns the pool's standby instances keyed by position.
+func (p *Pool) listStandby() (map[int]api.Instance, error) {
+	allInstances, err := p.listInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	standby := map[int]api.Instance{}
+	for _, i := range allInstances {
+		n, err := p.standbyIndex(i.Name)
+		if err != nil {
+			continue
+		}
+		standby[n] = i
+	}
+	return standby, nil
+}
+
+// ReconcileStandby creates the stopped standby instances that are missing, or
+// deletes them all while the pool is draining.
+func (p *Pool) ReconcileStandby(ctx context.Context) error {
+	conf := p.config()
+	if conf.Incus.WarmStandby == 0 {
+		return nil
+	}
+
+	standby, err := p.listStandby()
+	if err != nil {
+		return err
+	}
+
+	// A draining pool must leave the host empty, so its standbys are removed
+	// instead of being kept ready.
+	if p.Draining() {
+		for _, i := range standby {
+			name := i.Name
+			if _, claiming := p.standbyInFlight.LoadOrStore(name, true); claiming {
+				continue
+			}
+			p.logger.Info("deleting standby instance", "name", name, "reason", "draining")
+			p.deleteInstance(ctx, name)
+			p.standbyInFlight.Delete(name)
+		}
+		return nil
+	}
+
+	var errs []error
+	for n := range conf.Incus.WarmStandby {
+		if instance, exists := standby[n]; exists {
+			if instance.Status != "Stopped" || p.isCurrentStandby(instance) {
+				continue
+			}
+			if _, claiming := p.standbyInFlight.LoadOrStore(instance.Name, true); claiming {
+				continue
+			}
+			// Deleted now and recreated from the current image next cycle.
+			p.logger.Info("deleting standby instance", "name", instance.Name, "reason", "image changed")
+			p.deleteInstance(ctx, instance.Name)
+			p.standbyInFlight.Delete(instance.Name)
+			continue
+		}
+		name := p.StandbyName(n)
+		if _, claiming := p.standbyInFlight.LoadOrStore(name, true); claiming {
+			continue
+		}
+
+		p.logger.Info("creating standby instance", "name", name)
+		err := p.createStandby(ctx, name)
+		p.standbyInFlight.Delete(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("create standby %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pool) createStandby(ctx context.Context, name string) error {
+	req := p.instanceRequest(name)
+	req.Start = false
+	req.Ephemeral = false
+
+	op, err := p.createInstance(ctx, req)
+	if err != nil {
+		return err
+	}
+	return waitOp(ctx, op, 2*time.Minute)
+}
+
+// claimStandby turns a stopped standby instance into the agent instance called
+// name and starts it. It returns false when no standby was available, in which
+// case the caller should create the instance from the image.
+func (p *Pool) claimStandby(ctx context.Context, name string) (bool, error) {
+	conf := p.config()
+	if conf.Incus.WarmStandby == 0 {
+		return false, nil
+	}
+
+	standby, err := p.listStandby()
+	if err != nil {
+		return false, err
+	}
+
+	for n := range conf.Incus.WarmStandby {
+		instance, exists := standby[n]
+		if !exists || instance.Status != "Stopped" || !p.isCurrentStandby(instance) {
+			continue
+		}
+		if _, claiming := p.standbyInFlight.LoadOrStore(instance.Name, true); claiming {
+			continue
+		}
+
+		err := p.renameStandby(ctx, instance.Name, name)
+		p.standbyInFlight.Delete(instance.Name)
+		if err != nil {
+			return false, err
+		}
+
+		if err := p.startStandby(ctx, name); err != nil {
+			// The instance no longer counts as a standby and is not ephemeral, so
+			// it has to be removed here or it would hold the agent slot forever.
+			p.deleteInstance(ctx, name)
+			return false, err
+		}
+
+		p.logger.Info("started standby instance", "standby", instance.Name, "name", name)
+		agentsStartedFromStandbyMetric.WithLabelValues(conf.Name).Inc()
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (p *Pool) renameStandby(ctx context.Context, from, to string) error {
+	op, err := p.server(from).RenameInstance(from, api.InstancePost{Name: to})
+	if err != nil {
+		return err
+	}
+	if err := waitOp(ctx, op, defaultOperationTimeout); err != nil {
+		return err
+	}
+	p.setLocation(from, to)
+	return nil
+}
+
+// startStandby marks a claimed standby ephemeral, so Incus removes it when the
+// agent powers off, and starts it.
+func (p *Pool) startStandby(ctx context.Context, name string) error {
+	instance, etag, err := p.server(name).GetInstance(name)
+	if err != nil {
+		return err
+	}
+
+	put := instance.Writable()
+	put.Ephemeral = true
+	op, err := p.server(name).UpdateInstance(name, put, etag)
+	if err != nil {
+		return err
+	}
+	if err := waitOp(ctx, op, defaultOperationTimeout); err != nil {
+		return err
+	}
+
+	op, err = p.server(name).UpdateInstanceState(name, api.InstanceStatePut{Action: "start"}, "")
+	if err != nil {
+		return err
+	}
+	return waitOp(ctx, op, 2*time.Minute)
+}
+
+// deleteInstance removes an instance on a best-effort basis.
+func (p *Pool) deleteInstance(ctx context.Context, name string) {
+	op, err := p.server(name).DeleteInstance(name)
+	if err == nil {
+		err = waitOp(ctx, op, defaultOperationTimeout)
+	}
+	if err != nil && !api.StatusErrorCheck(err, http.StatusNotFound) {
+		p.logger.Error("error deleting instance", "name", name, "err", err)
+	}
+}
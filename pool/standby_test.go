@@ -0,0 +1,153 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func standbyTestConfig() Config {
+	conf := testConfig()
+	conf.Incus.WarmStandby = 2
+	return conf
+}
+
+func okOp(t *testing.T) *mocks.MockOperation {
+	t.Helper()
+	op := mocks.NewMockOperation(t)
+	op.On("WaitContext", mock.Anything).Return(nil)
+	return op
+}
+
+func expectAgentStart(t *testing.T, m *mocks.MockInstanceServer, name string) {
+	t.Helper()
+	m.On("CreateInstanceFile", name, "/home/agent/.token", mock.Anything).Return(nil)
+	m.On("ExecInstance", name, mock.Anything, mock.Anything).Return(okOp(t), nil)
+}
+
+func TestPool_ReconcileStandby_CreatesMissingStopped(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-standby-0", Status: "Stopped"},
+		{Name: "azp-agent-0", Status: "Running"},
+	}, nil)
+	m.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Name == "azp-agent-standby-1" &&
+			!req.Start &&
+			!req.Ephemeral &&
+			req.Source.Alias == "test-image"
+	})).Return(okOp(t), nil).Once()
+
+	p, err := NewPool(m, standbyTestConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.ReconcileStandby(context.Background()))
+}
+
+func TestPool_ReconcileStandby_Disabled(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.ReconcileStandby(context.Background()))
+	m.AssertNotCalled(t, "GetInstances", mock.Anything)
+}
+
+func TestPool_CreateAgent_ClaimsStoppedStandby(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-standby-0", Status: "Running"},
+		{Name: "azp-agent-standby-1", Status: "Stopped"},
+	}, nil)
+	m.On("RenameInstance", "azp-agent-standby-1", api.InstancePost{Name: "azp-agent-2"}).Return(okOp(t), nil)
+	m.On("GetInstance", "azp-agent-2").Return(&api.Instance{Name: "azp-agent-2"}, "etag", nil)
+	m.On("UpdateInstance", "azp-agent-2", mock.MatchedBy(func(put api.InstancePut) bool {
+		return put.Ephemeral
+	}), "etag").Return(okOp(t), nil)
+	m.On("UpdateInstanceState", "azp-agent-2", api.InstanceStatePut{Action: "start"}, "").Return(okOp(t), nil)
+	expectAgentStart(t, m, "azp-agent-2")
+
+	p, err := NewPool(m, standbyTestConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.CreateAgent(context.Background(), 2))
+	m.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestPool_CreateAgent_NoStandbyCreatesFromImage(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+	m.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Name == "azp-agent-0" && req.Start && req.Ephemeral
+	})).Return(okOp(t), nil)
+	expectAgentStart(t, m, "azp-agent-0")
+
+	p, err := NewPool(m, standbyTestConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+	m.AssertNotCalled(t, "RenameInstance", mock.Anything, mock.Anything)
+}
+
+func TestPool_CreateAgent_FailedStandbyStartFallsBackToImage(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-standby-0", Status: "Stopped"},
+	}, nil)
+	m.On("RenameInstance", "azp-agent-standby-0", api.InstancePost{Name: "azp-agent-0"}).Return(okOp(t), nil)
+	m.On("GetInstance", "azp-agent-0").Return(nil, "", fmt.Errorf("boom"))
+	m.On("DeleteInstance", "azp-agent-0").Return(okOp(t), nil).Once()
+	m.On("CreateInstance", mock.MatchedBy(func(req api.InstancesPost) bool {
+		return req.Name == "azp-agent-0"
+	})).Return(okOp(t), nil)
+	expectAgentStart(t, m, "azp-agent-0")
+
+	p, err := NewPool(m, standbyTestConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, p.CreateAgent(context.Background(), 0))
+}
+
+func TestPool_Reap_DeletesLeftoverClaimedStandby(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	// A claimed standby whose start and cleanup failed: renamed, stopped and
+	// not ephemeral.
+	m.On("GetInstancesFull", api.InstanceTypeContainer).Return([]api.InstanceFull{
+		{Instance: api.Instance{Name: "azp-agent-0"}, State: &api.InstanceState{Status: "Stopped"}},
+		{Instance: api.Instance{Name: "azp-agent-1"}, State: &api.InstanceState{Status: "Stopped"}},
+	}, nil)
+	m.On("DeleteInstance", "azp-agent-0").Return(okOp(t), nil).Once()
+
+	p, err := NewPool(m, standbyTestConfig())
+	require.NoError(t, err)
+
+	// Agent 1 is being claimed and not ephemeral yet.
+	p.inFlight.Store(1, true)
+	require.NoError(t, p.Reap(context.Background()))
+	m.AssertNotCalled(t, "DeleteInstance", "azp-agent-1")
+	m.AssertNotCalled(t, "UpdateInstanceState", mock.Anything, mock.Anything, mock.Anything)
+	_, held := p.inFlight.Load(0)
+	assert.False(t, held)
+}
+
+func TestPool_StandbyIndex(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, standbyTestConfig())
+	require.NoError(t, err)
+
+	n, err := p.standbyIndex("azp-agent-standby-3")
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "azp-agent-standby-3", p.StandbyName(3))
+
+	_, err = p.standbyIndex("azp-agent-3")
+	assert.ErrorIs(t, err, errNotPoolAgent)
+	_, err = p.agentIndex("azp-agent-standby-3")
+	assert.ErrorIs(t, err, errNotPoolAgent)
+}
@@ -0,0 +1,194 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// PoolInfo summarizes a pool managed by the daemon.
+type PoolInfo struct {
+	Name    string `json:"name"`
+	Project string `json:"project"`
+	// Image is the configured image and Fingerprint the one new agents use.
+	Image       string `json:"image"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Desired     int    `json:"desired"`
+	Capacity    int    `json:"capacity"`
+	Autoscaling bool   `json:"autoscaling"`
+	Draining    bool   `json:"draining"`
+	// Degraded is why the pool refuses to create agents, if it does.
+	Degraded string `json:"degraded,omitempty"`
+	// CreationPausedUntil is set while the circuit breaker pauses agent
+	// creation after repeated failures.
+	CreationPausedUntil time.Time `json:"creationPausedUntil,omitzero"`
+	// Canary is the state of the candidate image rollout, if one is configured.
+	Canary *CanaryInfo `json:"canary,omitempty"`
+}
+
+// AgentInfo is the daemon's live view of one agent slot.
+type AgentInfo struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	// Status is the Incus instance status, or empty when no instance exists.
+	Status    string    `json:"status,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+	// Image is the fingerprint of the image the instance was created from.
+	Image string `json:"image,omitempty"`
+	// Remote is where the instance runs, as remote or remote/member, for pools
+	// that spread agents over more than one place.
+	Remote string `json:"remote,omitempty"`
+	// InFlight is true while a create or reap operation holds the slot.
+	InFlight bool `json:"inFlight"`
+	// Draining is true when the agent will not be replaced once it goes away.
+	Draining bool `json:"draining"`
+	// OfflineSince is when the reaper first saw the Azure agent offline and unassigned.
+	OfflineSince *time.Time `json:"offlineSince,omitempty"`
+}
+
+// Info returns a summary of the pool.
+func (p *Pool) Info() PoolInfo {
+	conf := p.config()
+	return PoolInfo{
+		Name:                p.Name(),
+		Project:             p.Project(),
+		Image:               conf.Incus.Image,
+		Fingerprint:         p.Fingerprint(),
+		Desired:             p.DesiredAgents(),
+		Capacity:            conf.Capacity(),
+		Autoscaling:         conf.Autoscaling(),
+		Draining:            p.Draining(),
+		Degraded:            p.Degraded(),
+		CreationPausedUntil: p.CreationPausedUntil(),
+		Canary:              p.CanaryInfo(),
+	}
+}
+
+// Agents returns every desired agent slot plus any other pool instance that
+// still exists, ordered by index.
+func (p *Pool) Agents() ([]AgentInfo, error) {
+	instances, err := p.ListAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	slots := map[int]*AgentInfo{}
+	for idx := range p.DesiredAgents() {
+		slots[idx] = &AgentInfo{Index: idx, Name: p.AgentName(idx)}
+	}
+	for _, i := range instances {
+		idx, err := p.agentIndex(i.Name)
+		if err != nil {
+			continue
+		}
+		slots[idx] = &AgentInfo{
+			Index:     idx,
+			Name:      i.Name,
+			Status:    i.Status,
+			CreatedAt: i.CreatedAt,
+			Image:     instanceFingerprint(i.Config),
+			Remote:    p.instanceRemote(i),
+		}
+	}
+
+	p.offlineMu.Lock()
+	defer p.offlineMu.Unlock()
+
+	agents := make([]AgentInfo, 0, len(slots))
+	for idx, info := range slots {
+		_, info.InFlight = p.inFlight.Load(idx)
+		info.Draining = p.AgentDraining(idx)
+		if offlineAt, observed := p.offlineSince[idx]; observed {
+			info.OfflineSince = &offlineAt
+		}
+		agents = append(agents, *info)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Index < agents[j].Index
+	})
+	return agents, nil
+}
+
+// AgentStatus is an agent slot joined with what Azure and the instance itself
+// report about the agent.
+type AgentStatus struct {
+	AgentInfo
+	// Registered is true when Azure knows the agent. Online and Assigned are
+	// as Azure reports them.
+	Registered bool `json:"registered"`
+	Online     bool `json:"online"`
+	Assigned   bool `json:"assigned"`
+	// JobID is the Azure job request assigned to the agent, if any.
+	JobID int64 `json:"jobId,omitempty"`
+	// WorkerRunning is whether Agent.Worker runs in the instance. It is only
+	// checked in running instances, and unset when the check failed.
+	WorkerRunning *bool `json:"workerRunning,omitempty"`
+}
+
+// Status returns the agent slots of the pool with their Azure status, and for
+// running instances whether a job worker is running, as the reaper sees them.
+func (p *Pool) Status(ctx context.Context) ([]AgentStatus, error) {
+	agents, err := p.Agents()
+	if err != nil {
+		return nil, err
+	}
+	azure, err := p.azure.ListAgents(ctx, p.Name())
+	if err != nil {
+		return nil, fmt.Errorf("list Azure agents: %w", err)
+	}
+
+	statuses := make([]AgentStatus, len(agents))
+	var wg sync.WaitGroup
+	for i, a := range agents {
+		s := &statuses[i]
+		s.AgentInfo = a
+		if azureStatus, found := azure[p.AzureAgentName(a.Index)]; found {
+			s.Registered = true
+			s.Online = azureStatus.Online
+			s.Assigned = azureStatus.Assigned
+			s.JobID = azureStatus.RequestID
+		}
+		if a.Status != "Running" {
+			continue
+		}
+		wg.Go(func() {
+			running, err := p.isAgentWorkerRunning(ctx, a.Index)
+			if err != nil {
+				p.logger.Debug("status: worker check failed", "idx", a.Index, "err", err)
+				return
+			}
+			s.WorkerRunning = &running
+		})
+	}
+	wg.Wait()
+	return statuses, nil
+}
+
+// AgentImage returns the fingerprint of the image the agent at idx runs.
+func (p *Pool) AgentImage(idx int) (string, error) {
+	if err := p.validateIndex(idx); err != nil {
+		return "", err
+	}
+	instance, err := p.getInstance(p.AgentName(idx))
+	if err != nil {
+		return "", err
+	}
+	return instanceFingerprint(instance.Config), nil
+}
+
+// instanceRemote returns where an instance runs, or an empty string when the
+// pool only has one place to put agents.
+func (p *Pool) instanceRemote(i api.Instance) string {
+	if len(p.placements) < 2 {
+		return ""
+	}
+	name := p.RemoteName(i.Name)
+	if i.Location != "" && i.Location != "none" {
+		name += "/" + i.Location
+	}
+	return name
+}
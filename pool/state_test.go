@@ -0,0 +1,64 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/sklarsa/incus-azure-pipelines/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Status(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	conf := testConfig()
+	conf.AgentPrefix = "runner"
+	p, err := NewPool(m, conf)
+	require.NoError(t, err)
+	p.azure = &fakeAzureAgentClient{agents: map[string]AzureAgentStatus{
+		"runner-0": {Online: true, Assigned: true, RequestID: 7},
+		"runner-1": {Online: false},
+	}}
+
+	created := time.Now().Add(-time.Hour)
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{
+		{Name: "azp-agent-0", Status: "Running", CreatedAt: created},
+		{Name: "azp-agent-1", Status: "Running", CreatedAt: created},
+		{Name: "azp-agent-2", Status: "Stopped", CreatedAt: created},
+	}, nil)
+	m.On("ExecInstance", "azp-agent-0", mock.Anything, mock.Anything).Return(processResult(t, true), nil).Once()
+	m.On("ExecInstance", "azp-agent-1", mock.Anything, mock.Anything).Return(nil, errors.New("exec failed")).Once()
+
+	statuses, err := p.Status(context.Background())
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+
+	assert.Equal(t, "Running", statuses[0].Status)
+	assert.True(t, statuses[0].Registered)
+	assert.True(t, statuses[0].Assigned)
+	assert.Equal(t, int64(7), statuses[0].JobID)
+	require.NotNil(t, statuses[0].WorkerRunning)
+	assert.True(t, *statuses[0].WorkerRunning)
+
+	assert.True(t, statuses[1].Registered)
+	assert.False(t, statuses[1].Online)
+	assert.Nil(t, statuses[1].WorkerRunning, "a failed check is unknown")
+
+	assert.False(t, statuses[2].Registered)
+	assert.Nil(t, statuses[2].WorkerRunning, "only running instances are checked")
+}
+
+func TestPool_Status_AzureError(t *testing.T) {
+	m := mocks.NewMockInstanceServer(t)
+	p, err := NewPool(m, testConfig())
+	require.NoError(t, err)
+	p.azure = &fakeAzureAgentClient{err: errors.New("unauthorized")}
+	m.On("GetInstances", api.InstanceTypeContainer).Return([]api.Instance{}, nil)
+
+	_, err = p.Status(context.Background())
+	assert.ErrorContains(t, err, "list Azure agents: unauthorized")
+}
@@ -0,0 +1,234 @@
+package provision
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Agent image properties record which agent an image was built with.
+const (
+	AgentVersionProperty = "azp.agent.version"
+	AgentSHA256Property  = "azp.agent.sha256"
+)
+
+// agentTarballPath is where the agent tarball is pushed in the builder.
+const agentTarballPath = "/tmp/agent.tar.gz"
+
+// Where agent releases are looked up and downloaded from. Variables so tests
+// can serve them.
+var (
+	agentLatestReleaseURL = "https://api.github.com/repos/microsoft/azure-pipelines-agent/releases/latest"
+	agentDownloadBaseURL  = "https://download.agent.dev.azure.com/agent"
+)
+
+// agentTarballRe matches the file names of agent releases.
+var agentTarballRe = regexp.MustCompile(`^vsts-agent-linux-[a-z0-9]+-(\d+\.\d+\.\d+)\.tar\.gz$`)
+
+// agentPackage is the agent tarball an image is built with.
+type agentPackage struct {
+	version string
+	path    string
+	sha256  string
+}
+
+// resolveAgent returns the agent tarball to build with: conf.AgentTarball, or
+// the release conf.AgentVersion from the host cache, downloading it there
+// first if needed. Without a version the latest release is used, which needs
+// GitHub. The tarball must match conf.AgentSHA256 when set.
+func resolveAgent(ctx context.Context, conf Config) (agentPackage, error) {
+	version := strings.TrimPrefix(conf.AgentVersion, "v")
+	if conf.AgentTarball != "" {
+		return localAgent(conf.AgentTarball, version, conf.AgentSHA256)
+	}
+
+	arch, err := agentArch()
+	if err != nil {
+		return agentPackage{}, err
+	}
+	if version == "" {
+		if version, err = latestAgentVersion(ctx); err != nil {
+			return agentPackage{}, err
+		}
+		slog.Info("using latest agent release", "version", version)
+	}
+
+	dir, err := agentCacheDir(conf.AgentCacheDir)
+	if err != nil {
+		return agentPackage{}, err
+	}
+	name := fmt.Sprintf("vsts-agent-linux-%s-%s.tar.gz", arch, version)
+	path := filepath.Join(dir, name)
+
+	if sum, err := fileSHA256(path); err == nil {
+		if conf.AgentSHA256 == "" || strings.EqualFold(sum, conf.AgentSHA256) {
+			slog.Info("using cached agent", "path", path, "sha256", sum)
+			return agentPackage{version: version, path: path, sha256: sum}, nil
+		}
+		slog.Warn("cached agent does not match the checksum, downloading it again", "path", path, "sha256", sum)
+	} else if !os.IsNotExist(err) {
+		return agentPackage{}, err
+	}
+
+	sum, err := downloadAgent(ctx, fmt.Sprintf("%s/%s/%s", agentDownloadBaseURL, version, name), path, conf.AgentSHA256)
+	if err != nil {
+		return agentPackage{}, err
+	}
+	return agentPackage{version: version, path: path, sha256: sum}, nil
+}
+
+// localAgent checks an agent tarball on the host. Its version comes from its
+// file name unless set.
+func localAgent(path, version, checksum string) (agentPackage, error) {
+	if m := agentTarballRe.FindStringSubmatch(filepath.Base(path)); m != nil {
+		if version != "" && version != m[1] {
+			return agentPackage{}, fmt.Errorf("agent tarball %s is version %s, not %s", path, m[1], version)
+		}
+		version = m[1]
+	}
+	if version == "" {
+		return agentPackage{}, fmt.Errorf("cannot tell the version of agent tarball %s from its name, set the agent version", path)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return agentPackage{}, fmt.Errorf("error reading agent tarball: %w", err)
+	}
+	if checksum != "" && !strings.EqualFold(sum, checksum) {
+		return agentPackage{}, fmt.Errorf("agent tarball %s has sha256 %s, expected %s", path, sum, checksum)
+	}
+	return agentPackage{version: version, path: path, sha256: sum}, nil
+}
+
+// downloadAgent downloads url to path through a temporary file, so an
+// interrupted or mismatching download never lands in the cache, and returns
+// its checksum.
+func downloadAgent(ctx context.Context, url, path, checksum string) (string, error) {
+	slog.Info("downloading agent", "url", url)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download agent: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("error closing response body", "err", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download agent: unexpected status code: %d", resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to download agent: %w", err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if checksum != "" && !strings.EqualFold(sum, checksum) {
+		return "", fmt.Errorf("downloaded agent has sha256 %s, expected %s", sum, checksum)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	slog.Info("cached agent", "path", path, "sha256", sum)
+	return sum, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// agentCacheDir returns dir, or the cache directory of the user by default.
+func agentCacheDir(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine the agent cache directory, set it: %w", err)
+	}
+	return filepath.Join(cache, "incus-azure-pipelines", "agent"), nil
+}
+
+// agentArch returns the agent release architecture of the host.
+func agentArch() (string, error) {
+	switch arch := runtime.GOARCH; arch {
+	case "amd64":
+		return "x64", nil
+	case "arm64":
+		return "arm64", nil
+	case "arm":
+		return "arm", nil
+	default:
+		return "", fmt.Errorf("unsupported architecture: %s", arch)
+	}
+}
+
+// latestAgentVersion fetches the latest Azure Pipelines agent release from
+// GitHub.
+func latestAgentVersion(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, agentLatestReleaseURL, nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch latest release: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("error closing response body", "err", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", fmt.Errorf("failed to decode release JSON: %w", err)
+	}
+
+	// Strip 'v' prefix if present
+	return strings.TrimPrefix(release.TagName, "v"), nil
+}
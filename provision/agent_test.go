@@ -0,0 +1,136 @@
+package provision
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAgent = "agent release"
+
+func sha256Of(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// fakeAgentServer serves the latest-release API and agent downloads, and
+// counts the requests for each path.
+func fakeAgentServer(t *testing.T, body string) map[string]int {
+	t.Helper()
+	arch, err := agentArch()
+	if err != nil {
+		t.Skip(err)
+	}
+	var mu sync.Mutex
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/latest":
+			_, _ = io.WriteString(w, `{"tag_name": "v4.260.0"}`)
+		case fmt.Sprintf("/agent/4.260.0/vsts-agent-linux-%s-4.260.0.tar.gz", arch),
+			fmt.Sprintf("/agent/4.255.0/vsts-agent-linux-%s-4.255.0.tar.gz", arch):
+			_, _ = io.WriteString(w, body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	latest, base := agentLatestReleaseURL, agentDownloadBaseURL
+	agentLatestReleaseURL, agentDownloadBaseURL = srv.URL+"/latest", srv.URL+"/agent"
+	t.Cleanup(func() { agentLatestReleaseURL, agentDownloadBaseURL = latest, base })
+	return requests
+}
+
+func TestResolveAgent_DownloadsOnce(t *testing.T) {
+	requests := fakeAgentServer(t, testAgent)
+	conf := Config{AgentCacheDir: t.TempDir(), AgentVersion: "v4.255.0", AgentSHA256: sha256Of(testAgent)}
+
+	for range 2 {
+		agent, err := resolveAgent(context.Background(), conf)
+		require.NoError(t, err)
+		assert.Equal(t, "4.255.0", agent.version)
+		assert.Equal(t, sha256Of(testAgent), agent.sha256)
+		data, err := os.ReadFile(agent.path)
+		require.NoError(t, err)
+		assert.Equal(t, testAgent, string(data))
+		assert.Equal(t, conf.AgentCacheDir, filepath.Dir(agent.path))
+	}
+	assert.Equal(t, 1, len(requests))
+	for _, n := range requests {
+		assert.Equal(t, 1, n)
+	}
+}
+
+func TestResolveAgent_Latest(t *testing.T) {
+	requests := fakeAgentServer(t, testAgent)
+
+	agent, err := resolveAgent(context.Background(), Config{AgentCacheDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, "4.260.0", agent.version)
+	assert.Equal(t, 1, requests["/latest"])
+}
+
+func TestResolveAgent_ChecksumMismatch(t *testing.T) {
+	fakeAgentServer(t, "tampered")
+	dir := t.TempDir()
+
+	_, err := resolveAgent(context.Background(), Config{AgentCacheDir: dir, AgentVersion: "4.255.0", AgentSHA256: sha256Of(testAgent)})
+	assert.ErrorContains(t, err, "expected "+sha256Of(testAgent))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "a mismatching download is not cached")
+}
+
+func TestResolveAgent_ReplacesBadCache(t *testing.T) {
+	requests := fakeAgentServer(t, testAgent)
+	dir := t.TempDir()
+	arch, _ := agentArch()
+	cached := filepath.Join(dir, fmt.Sprintf("vsts-agent-linux-%s-4.255.0.tar.gz", arch))
+	require.NoError(t, os.WriteFile(cached, []byte("truncated"), 0o644))
+
+	agent, err := resolveAgent(context.Background(), Config{AgentCacheDir: dir, AgentVersion: "4.255.0", AgentSHA256: sha256Of(testAgent)})
+	require.NoError(t, err)
+	assert.Equal(t, cached, agent.path)
+	data, err := os.ReadFile(cached)
+	require.NoError(t, err)
+	assert.Equal(t, testAgent, string(data))
+	assert.Equal(t, 1, len(requests))
+}
+
+func TestResolveAgent_Tarball(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vsts-agent-linux-x64-4.255.0.tar.gz")
+	require.NoError(t, os.WriteFile(path, []byte(testAgent), 0o644))
+
+	agent, err := resolveAgent(context.Background(), Config{AgentTarball: path})
+	require.NoError(t, err)
+	assert.Equal(t, agentPackage{version: "4.255.0", path: path, sha256: sha256Of(testAgent)}, agent)
+
+	_, err = resolveAgent(context.Background(), Config{AgentTarball: path, AgentVersion: "4.256.0"})
+	assert.ErrorContains(t, err, "is version 4.255.0, not 4.256.0")
+	_, err = resolveAgent(context.Background(), Config{AgentTarball: path, AgentSHA256: sha256Of("other")})
+	assert.ErrorContains(t, err, "expected "+sha256Of("other"))
+
+	renamed := filepath.Join(dir, "agent.tar.gz")
+	require.NoError(t, os.Rename(path, renamed))
+	_, err = resolveAgent(context.Background(), Config{AgentTarball: renamed})
+	assert.ErrorContains(t, err, "set the agent version")
+	agent, err = resolveAgent(context.Background(), Config{AgentTarball: renamed, AgentVersion: "v4.255.0"})
+	require.NoError(t, err)
+	assert.Equal(t, "4.255.0", agent.version)
+}
@@ -0,0 +1,36 @@
+#!/bin/bash
+# Base provisioning of every agent image: the agent user, Docker, and the Azure
+# Pipelines agent. BaseImage pushes the agent release to AGENT_TARBALL and sets
+# AGENT_USER, AGENT_UID and AGENT_GID.
+set -euo pipefail
+AGENT_HOME="/home/${AGENT_USER}"
+
+apt-get update
+apt-get install -y curl wget tar sudo
+
+groupadd --gid "${AGENT_GID}" "${AGENT_USER}"
+useradd -m -s /bin/bash --uid "${AGENT_UID}" --gid "${AGENT_GID}" "${AGENT_USER}"
+echo "${AGENT_USER} ALL=(ALL) NOPASSWD:ALL" > "/etc/sudoers.d/${AGENT_USER}"
+chmod 440 "/etc/sudoers.d/${AGENT_USER}"
+
+# Add Docker repo
+install -m 0755 -d /etc/apt/keyrings
+curl -fsSL https://download.docker.com/linux/ubuntu/gpg -o /etc/apt/keyrings/docker.asc
+chmod a+r /etc/apt/keyrings/docker.asc
+
+echo "deb [arch=$(dpkg --print-architecture) signed-by=/etc/apt/keyrings/docker.asc] https://download.docker.com/linux/ubuntu $(. /etc/os-release && echo "$VERSION_CODENAME") stable" > /etc/apt/sources.list.d/docker.list
+
+# Install
+apt-get update
+apt-get install -y docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin
+
+# Add agent to docker group
+usermod -aG docker "${AGENT_USER}"
+
+su - "${AGENT_USER}" -c "tar -xzf ${AGENT_TARBALL} -C ${AGENT_HOME}"
+rm "${AGENT_TARBALL}"
+
+# Install the agent's runtime dependencies (libicu, etc.). Without these the
+# agent's config.sh aborts on first run with a missing-assembly error
+# (e.g. Microsoft.Win32.Primitives). The tarball ships this helper.
+"${AGENT_HOME}/bin/installdependencies.sh"
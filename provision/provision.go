@@ -2,15 +2,17 @@ package provision
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/rand"
 	_ "embed"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
-	"runtime"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,15 +30,68 @@ const (
 	builderCleanupOpTimeout        = 2 * time.Minute
 )
 
+// DefaultBaseServer is the image server base images are pulled from.
+const DefaultBaseServer = "https://images.linuxcontainers.org"
+
+// LocalServer names the images of the Incus server itself as the base server.
+const LocalServer = "local"
+
 type Config struct {
-	BaseAlias   string `validate:"required,nefield=TargetAlias"`
-	TargetAlias string `validate:"required"`
-	ProjectName string
+	BaseAlias string `validate:"required,nefield=TargetAlias"`
+	// BaseServer is the image server BaseAlias is pulled from, or LocalServer.
+	// Default: DefaultBaseServer
+	BaseServer string
+	// BaseProtocol is the protocol of BaseServer: simplestreams or incus.
+	// Default: simplestreams
+	BaseProtocol string `validate:"omitempty,oneof=simplestreams incus"`
+	TargetAlias  string `validate:"required"`
+	ProjectName  string
 	// Scripts is a list of local file paths containing scripts that are run after the initial
 	// base image provisioning. This allows users to customize their agent environments.
 	Scripts []string
 	// VM builds a virtual-machine image instead of a container image.
 	VM bool
+	// RegistryMirrors are written to registry-mirrors in the image's
+	// /etc/docker/daemon.json.
+	RegistryMirrors []string `validate:"dive,url"`
+	// AgentVersion is the Azure Pipelines agent release to install, for
+	// example 4.255.0. Default: the latest release, or the version in the
+	// file name of AgentTarball
+	AgentVersion string
+	// AgentTarball is a local agent release tarball to install instead of
+	// downloading one.
+	AgentTarball string
+	// AgentSHA256 is the expected hex SHA-256 checksum of the agent tarball.
+	AgentSHA256 string `validate:"omitempty,hexadecimal,len=64"`
+	// AgentCacheDir is where downloaded agent tarballs are kept, so each
+	// release is only downloaded once. Default: incus-azure-pipelines/agent in
+	// the user cache directory
+	AgentCacheDir string
+	// Env is the environment of the package install and of Scripts and Steps.
+	Env map[string]string
+	// Packages are apt packages installed after Files are pushed.
+	Packages []string
+	// Files are local files pushed into the image after the base provisioning.
+	Files []File `validate:"dive"`
+	// Steps are run in order after Scripts.
+	Steps []Step `validate:"dive"`
+}
+
+// File is a local file pushed into the image.
+type File struct {
+	Source string `validate:"required"`
+	Path   string `validate:"required,startswith=/"`
+	Mode   os.FileMode
+	UID    int64
+	GID    int64
+}
+
+// Step is a script run in the image.
+type Step struct {
+	Name   string `validate:"required"`
+	Script string `validate:"required"`
+	// User runs the script as the agent user instead of root.
+	User string `validate:"omitempty,oneof=root agent"`
 }
 
 // instanceTypeStr returns the Incus instance type string for the API.
@@ -50,6 +105,9 @@ func instanceTypeStr(vm bool) string {
 //go:embed run_agent.sh
 var runAgentScript string
 
+//go:embed base.sh
+var baseScript string
+
 // isAlreadyStopped reports whether err is the Incus "instance is already
 // stopped" response. Incus returns this as a 400 Bad Request with that
 // message; there is no exported sentinel in the client package, so we match
@@ -123,15 +181,37 @@ func BaseImage(ctx context.Context, c incus.InstanceServer, conf Config) error {
 		slog.Info("using default project")
 	}
 
-	// First check that all provisioning scripts exist
-	provisioningScripts := [][]byte{}
+	// First check that all provisioning scripts and files exist
+	steps := []Step{}
 	for _, f := range conf.Scripts {
 		data, err := os.ReadFile(f)
 		if err != nil {
 			return fmt.Errorf("error reading script %s: %w", f, err)
 		}
-		provisioningScripts = append(provisioningScripts, data)
+		steps = append(steps, Step{Name: "script " + f, Script: string(data)})
+	}
+	steps = append(steps, conf.Steps...)
+	files := make([][]byte, len(conf.Files))
+	for i, f := range conf.Files {
+		data, err := os.ReadFile(f.Source)
+		if err != nil {
+			return fmt.Errorf("error reading file %s: %w", f.Source, err)
+		}
+		files[i] = data
+	}
+
+	// Resolve the agent before creating the builder, so a bad version or
+	// checksum fails fast and a cached agent builds offline.
+	agent, err := resolveAgent(ctx, conf)
+	if err != nil {
+		return err
 	}
+	slog.Info("using agent", "version", agent.version, "sha256", agent.sha256)
+	tarball, err := os.Open(agent.path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tarball.Close() }()
 
 	suffix, err := randomString(8)
 	if err != nil {
@@ -139,16 +219,10 @@ func BaseImage(ctx context.Context, c incus.InstanceServer, conf Config) error {
 	}
 
 	req := api.InstancesPost{
-		Name: fmt.Sprintf("%s-builder-%s", conf.TargetAlias, suffix),
-		Source: api.InstanceSource{
-			Type:     "image",
-			Mode:     "pull",
-			Alias:    conf.BaseAlias,
-			Server:   "https://images.linuxcontainers.org",
-			Protocol: "simplestreams",
-		},
-		Type:  api.InstanceType(instanceTypeStr(conf.VM)),
-		Start: true,
+		Name:   fmt.Sprintf("%s-builder-%s", conf.TargetAlias, suffix),
+		Source: baseSource(conf),
+		Type:   api.InstanceType(instanceTypeStr(conf.VM)),
+		Start:  true,
 	}
 
 	slog.Info("creating", "instance", req.Name)
@@ -189,71 +263,31 @@ func BaseImage(ctx context.Context, c incus.InstanceServer, conf Config) error {
 		return err
 	}
 
-	execReq := api.InstanceExecPost{
-		Command:     []string{"bash"},
-		WaitForWS:   true,
-		Interactive: false,
+	if err := c.CreateInstanceFile(req.Name, agentTarballPath, incus.InstanceFileArgs{
+		Content:   tarball,
+		Mode:      0644,
+		WriteMode: "overwrite",
+	}); err != nil {
+		return fmt.Errorf("error pushing agent tarball: %w", err)
 	}
 
-	agentURL, err := getAgentDownloadURL()
-	if err != nil {
+	if err := runStep(ctx, c, req.Name, 0, Step{Name: "base provisioning", Script: baseScript}, map[string]string{
+		"AGENT_TARBALL": agentTarballPath,
+		"AGENT_USER":    AgentUser,
+		"AGENT_UID":     strconv.Itoa(int(AgentUid)),
+		"AGENT_GID":     strconv.Itoa(int(AgentGid)),
+	}); err != nil {
 		return err
 	}
 
-	script := `
-set -euo pipefail
-AGENT_URL="` + agentURL + `"
-AGENT_USER="` + AgentUser + `"
-AGENT_UID="` + strconv.Itoa(int(AgentUid)) + `"
-AGENT_GID="` + strconv.Itoa(int(AgentGid)) + `"
-AGENT_HOME="/home/${AGENT_USER}"
-
-apt-get update
-apt-get install -y curl wget tar sudo
-
-groupadd --gid ${AGENT_GID} "${AGENT_USER}"
-useradd -m -s /bin/bash --uid ${AGENT_UID} --gid ${AGENT_GID} "${AGENT_USER}"
-echo "${AGENT_USER} ALL=(ALL) NOPASSWD:ALL" > /etc/sudoers.d/${AGENT_USER}
-chmod 440 /etc/sudoers.d/${AGENT_USER}
-
-# Add Docker repo
-install -m 0755 -d /etc/apt/keyrings
-curl -fsSL https://download.docker.com/linux/ubuntu/gpg -o /etc/apt/keyrings/docker.asc
-chmod a+r /etc/apt/keyrings/docker.asc
-
-echo "deb [arch=$(dpkg --print-architecture) signed-by=/etc/apt/keyrings/docker.asc] https://download.docker.com/linux/ubuntu $(. /etc/os-release && echo "$VERSION_CODENAME") stable" > /etc/apt/sources.list.d/docker.list
-
-# Install
-apt-get update
-apt-get install -y docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin
-
-# Add agent to docker group
-usermod -aG docker agent
-
-su - "${AGENT_USER}" -c "
-  cd ${AGENT_HOME}
-  curl -fsSL -o agent.tar.gz ${AGENT_URL}
-  tar -xzf agent.tar.gz
-  rm agent.tar.gz
-"
-
-# Install the agent's runtime dependencies (libicu, etc.). Without these the
-# agent's config.sh aborts on first run with a missing-assembly error
-# (e.g. Microsoft.Win32.Primitives). The tarball ships this helper.
-"${AGENT_HOME}/bin/installdependencies.sh"
-`
-	args := &incus.InstanceExecArgs{
-		Stdin:  strings.NewReader(script),
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-	}
-
-	op, err = c.ExecInstance(req.Name, execReq, args)
-	if err != nil {
-		return err
-	}
-	if err := checkExecExit(ctx, op, "base provisioning"); err != nil {
-		return err
+	if data := dockerDaemonConfig(conf.RegistryMirrors); data != nil {
+		if err := c.CreateInstanceFile(req.Name, "/etc/docker/daemon.json", incus.InstanceFileArgs{
+			Content:   bytes.NewReader(data),
+			Mode:      0644,
+			WriteMode: "overwrite",
+		}); err != nil {
+			return fmt.Errorf("error writing docker daemon config: %w", err)
+		}
 	}
 
 	if err := c.CreateInstanceFile(
@@ -270,53 +304,24 @@ su - "${AGENT_USER}" -c "
 		return err
 	}
 
-	// Now execute custom provisioning scripts. Copy each script into the
-	// instance, exec it by path, then remove it. Piping the script via stdin
-	// can hang on large scripts, so we push the file first and run it directly.
-	for idx, s := range provisioningScripts {
-		// Wrap each script in a closure so the deferred cleanup runs after that
-		// script executes, rather than piling up until BaseImage returns (which
-		// happens only after the image is published).
-		runScript := func() error {
-			remotePath := fmt.Sprintf("/tmp/provision-%d.sh", idx)
-
-			if err := c.CreateInstanceFile(
-				req.Name,
-				remotePath,
-				incus.InstanceFileArgs{
-					Content:   bytes.NewReader(s),
-					Mode:      0755,
-					WriteMode: "overwrite",
-				},
-			); err != nil {
-				return fmt.Errorf("error copying script %s: %w", conf.Scripts[idx], err)
-			}
-
-			// Remove the script once it has run.
-			defer func() {
-				if err := c.DeleteInstanceFile(req.Name, remotePath); err != nil {
-					slog.Warn("error removing provisioning script", "instance", req.Name, "path", remotePath, "err", err)
-				}
-			}()
-
-			runReq := api.InstanceExecPost{
-				Command:     []string{"bash", remotePath},
-				WaitForWS:   true,
-				Interactive: false,
-			}
-			args := &incus.InstanceExecArgs{
-				Stdout: os.Stdout,
-				Stderr: os.Stderr,
-			}
+	if err := pushFiles(ctx, c, req.Name, conf.Files, files); err != nil {
+		return err
+	}
 
-			op, err := c.ExecInstance(req.Name, runReq, args)
-			if err != nil {
-				return fmt.Errorf("error executing script %s: %w", conf.Scripts[idx], err)
-			}
-			return checkExecExit(ctx, op, fmt.Sprintf("script %s", conf.Scripts[idx]))
+	if len(conf.Packages) > 0 {
+		env := maps.Clone(conf.Env)
+		if env == nil {
+			env = map[string]string{}
 		}
+		env["DEBIAN_FRONTEND"] = "noninteractive"
+		if err := runStep(ctx, c, req.Name, 0, Step{Name: "package install", Script: packageScript(conf.Packages)}, env); err != nil {
+			return err
+		}
+	}
 
-		if err := runScript(); err != nil {
+	// Now execute custom provisioning steps in order.
+	for idx, step := range steps {
+		if err := runStep(ctx, c, req.Name, idx, step, conf.Env); err != nil {
 			return err
 		}
 	}
@@ -368,7 +373,9 @@ su - "${AGENT_USER}" -c "
 			},
 			ImagePut: api.ImagePut{
 				Properties: map[string]string{
-					"description": fmt.Sprintf("azure pipeline runner built on %s", conf.BaseAlias),
+					"description":        fmt.Sprintf("azure pipeline runner built on %s", conf.BaseAlias),
+					AgentVersionProperty: agent.version,
+					AgentSHA256Property:  agent.sha256,
 				},
 			},
 		},
@@ -415,6 +422,127 @@ su - "${AGENT_USER}" -c "
 
 }
 
+// baseSource returns where the builder instance gets its image from.
+func baseSource(conf Config) api.InstanceSource {
+	source := api.InstanceSource{Type: "image", Alias: conf.BaseAlias}
+	if conf.BaseServer == LocalServer {
+		return source
+	}
+	source.Mode = "pull"
+	source.Server = cmp.Or(conf.BaseServer, DefaultBaseServer)
+	source.Protocol = cmp.Or(conf.BaseProtocol, "simplestreams")
+	return source
+}
+
+// dockerDaemonConfig returns the Docker daemon config of the image, or nil when
+// there is nothing to configure.
+func dockerDaemonConfig(mirrors []string) []byte {
+	if len(mirrors) == 0 {
+		return nil
+	}
+	data, _ := json.MarshalIndent(map[string][]string{"registry-mirrors": mirrors}, "", "  ")
+	return data
+}
+
+// packageScript installs packages with apt.
+func packageScript(packages []string) string {
+	quoted := make([]string, len(packages))
+	for i, p := range packages {
+		quoted[i] = "'" + strings.ReplaceAll(p, "'", `'\''`) + "'"
+	}
+	return "set -euo pipefail\napt-get update\napt-get install -y " + strings.Join(quoted, " ") + "\n"
+}
+
+// runStep copies the script of step into the instance, runs it by path, then
+// removes it. Piping the script via stdin can hang on large scripts, so we push
+// the file first and run it directly.
+func runStep(ctx context.Context, c incus.InstanceServer, instance string, idx int, step Step, env map[string]string) error {
+	remotePath := fmt.Sprintf("/tmp/provision-%d.sh", idx)
+
+	if err := c.CreateInstanceFile(
+		instance,
+		remotePath,
+		incus.InstanceFileArgs{
+			Content:   strings.NewReader(step.Script),
+			Mode:      0755,
+			WriteMode: "overwrite",
+		},
+	); err != nil {
+		return fmt.Errorf("error copying %s: %w", step.Name, err)
+	}
+
+	// Remove the script once it has run.
+	defer func() {
+		if err := c.DeleteInstanceFile(instance, remotePath); err != nil {
+			slog.Warn("error removing provisioning script", "instance", instance, "path", remotePath, "err", err)
+		}
+	}()
+
+	runReq := api.InstanceExecPost{
+		Command:     []string{"bash", remotePath},
+		WaitForWS:   true,
+		Interactive: false,
+		Environment: maps.Clone(env),
+	}
+	if step.User == AgentUser {
+		runReq.User = AgentUid
+		runReq.Group = AgentGid
+		runReq.Cwd = "/home/" + AgentUser
+		if runReq.Environment == nil {
+			runReq.Environment = map[string]string{}
+		}
+		runReq.Environment["HOME"] = "/home/" + AgentUser
+		runReq.Environment["USER"] = AgentUser
+	}
+	args := &incus.InstanceExecArgs{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	slog.Info("running", "step", step.Name)
+	op, err := c.ExecInstance(instance, runReq, args)
+	if err != nil {
+		return fmt.Errorf("error executing %s: %w", step.Name, err)
+	}
+	return checkExecExit(ctx, op, step.Name)
+}
+
+// pushFiles creates the parent directories of files in the instance, then
+// pushes the contents read from their sources.
+func pushFiles(ctx context.Context, c incus.InstanceServer, instance string, files []File, contents [][]byte) error {
+	if len(files) == 0 {
+		return nil
+	}
+	mkdir := []string{"mkdir", "-p"}
+	for _, f := range files {
+		mkdir = append(mkdir, path.Dir(f.Path))
+	}
+	op, err := c.ExecInstance(instance, api.InstanceExecPost{Command: mkdir, WaitForWS: true}, &incus.InstanceExecArgs{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating file directories: %w", err)
+	}
+	if err := checkExecExit(ctx, op, "mkdir"); err != nil {
+		return err
+	}
+
+	for i, f := range files {
+		slog.Info("pushing file", "source", f.Source, "path", f.Path)
+		if err := c.CreateInstanceFile(instance, f.Path, incus.InstanceFileArgs{
+			Content:   bytes.NewReader(contents[i]),
+			Mode:      int(f.Mode.Perm()),
+			UID:       f.UID,
+			GID:       f.GID,
+			WriteMode: "overwrite",
+		}); err != nil {
+			return fmt.Errorf("error pushing %s to %s: %w", f.Source, f.Path, err)
+		}
+	}
+	return nil
+}
+
 // startFinalizeSpinner renders the image-publish progress bar and, once the
 // data-transfer phase completes, a "finalizing image" spinner for the
 // server-side finalization that would otherwise look like a hang at 100%.
@@ -540,54 +668,6 @@ func startFinalizeSpinner(ctx context.Context, op incus.Operation) func() {
 	}
 }
 
-// getAgentDownloadURL fetches the latest Azure Pipelines agent release and returns
-// the download URL for the current Linux architecture.
-func getAgentDownloadURL() (string, error) {
-	arch := runtime.GOARCH
-	var archSuffix string
-	switch arch {
-	case "amd64":
-		archSuffix = "x64"
-	case "arm64":
-		archSuffix = "arm64"
-	case "arm":
-		archSuffix = "arm"
-	default:
-		return "", fmt.Errorf("unsupported architecture: %s", arch)
-	}
-
-	// Get latest version from GitHub
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get("https://api.github.com/repos/microsoft/azure-pipelines-agent/releases/latest")
-	if err != nil {
-		return "", fmt.Errorf("failed to fetch latest release: %w", err)
-	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			slog.Error("error closing response body", "err", err)
-		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-
-	var release struct {
-		TagName string `json:"tag_name"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		return "", fmt.Errorf("failed to decode release JSON: %w", err)
-	}
-
-	// Strip 'v' prefix if present
-	version := strings.TrimPrefix(release.TagName, "v")
-
-	// Build URL to Azure CDN
-	url := fmt.Sprintf("https://download.agent.dev.azure.com/agent/%s/vsts-agent-linux-%s-%s.tar.gz", version, archSuffix, version)
-
-	return url, nil
-}
-
 func randomString(n int) (string, error) {
 	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
 	b := make([]byte, n)
@@ -233,3 +233,40 @@ func TestStopBuilderForCleanup(t *testing.T) {
 		require.NoError(t, stopBuilderForCleanup(context.Background(), c, "builder"))
 	})
 }
+
+func TestDockerDaemonConfig(t *testing.T) {
+	assert.Nil(t, dockerDaemonConfig(nil))
+	assert.JSONEq(t, `{"registry-mirrors": ["http://10.0.0.1:5000"]}`, string(dockerDaemonConfig([]string{"http://10.0.0.1:5000"})))
+}
+
+func TestBaseSource(t *testing.T) {
+	assert.Equal(t, api.InstanceSource{
+		Type: "image", Mode: "pull", Alias: "ubuntu/24.04", Server: DefaultBaseServer, Protocol: "simplestreams",
+	}, baseSource(Config{BaseAlias: "ubuntu/24.04"}))
+	assert.Equal(t, api.InstanceSource{
+		Type: "image", Mode: "pull", Alias: "ubuntu/24.04", Server: "https://mirror.example.com", Protocol: "incus",
+	}, baseSource(Config{BaseAlias: "ubuntu/24.04", BaseServer: "https://mirror.example.com", BaseProtocol: "incus"}))
+	assert.Equal(t, api.InstanceSource{Type: "image", Alias: "my-base"}, baseSource(Config{BaseAlias: "my-base", BaseServer: LocalServer}))
+}
+
+func TestPackageScript(t *testing.T) {
+	assert.Equal(t, "set -euo pipefail\napt-get update\napt-get install -y 'jq' 'git=1:2.43.0'\n", packageScript([]string{"jq", "git=1:2.43.0"}))
+	assert.Contains(t, packageScript([]string{"a'b"}), `'a'\''b'`)
+}
+
+func TestRunStep_AsAgent(t *testing.T) {
+	c := mocks.NewMockInstanceServer(t)
+	c.On("CreateInstanceFile", "builder", "/tmp/provision-2.sh", mock.Anything).Return(nil)
+	c.On("DeleteInstanceFile", "builder", "/tmp/provision-2.sh").Return(nil)
+	op := mocks.NewMockOperation(t)
+	op.On("WaitContext", mock.Anything).Return(nil)
+	op.On("Get").Return(api.Operation{Metadata: map[string]any{"return": float64(0)}})
+	c.On("ExecInstance", "builder", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.User == AgentUid && req.Group == AgentGid && req.Cwd == "/home/agent" &&
+			req.Environment["HOME"] == "/home/agent" && req.Environment["GOFLAGS"] == "-mod=mod"
+	}), mock.Anything).Return(op, nil)
+
+	env := map[string]string{"GOFLAGS": "-mod=mod"}
+	require.NoError(t, runStep(context.Background(), c, "builder", 2, Step{Name: "warm go cache", Script: "go version", User: AgentUser}, env))
+	assert.NotContains(t, env, "HOME", "the shared environment is left alone")
+}
@@ -21,6 +21,8 @@ if [[ ! -f "$TOKEN_FILE" ]]; then
     exit 1
 fi
 
+# The token is either a PAT or a short-lived access token of the pool's
+# service principal, which the agent only needs to register.
 TOKEN=$(cat "$TOKEN_FILE")
 rm -f "$TOKEN_FILE"
 
@@ -34,6 +36,16 @@ rm -f "$TOKEN_FILE"
 
 ./run.sh --once
 
+# Best effort: a service principal's access token may have expired by now.
 ./config.sh remove --unattended --auth "PAT" --token "${TOKEN}" 
 
+# When the daemon archives logs, give it time to collect them before the
+# ephemeral instance and its logs are gone. It removes the marker when done.
+FINISHED_MARKER="/home/agent/.finished"
+touch "$FINISHED_MARKER"
+for _ in $(seq "${IAP_ARCHIVE_WAIT:-0}"); do
+    [[ -f "$FINISHED_MARKER" ]] || break
+    sleep 1
+done
+
 sudo poweroff -f
\ No newline at end of file
@@ -0,0 +1,176 @@
+package provision
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/creasty/defaults"
+	"github.com/go-playground/validator/v10"
+	"github.com/goccy/go-yaml"
+)
+
+// Spec is an image definition, read from a YAML file by provision -f so image
+// definitions can live in version control next to the daemon config. Relative
+// paths in it are relative to the file.
+type Spec struct {
+	// Base is the image the build starts from.
+	Base BaseSpec `json:"base"`
+	// Target is the alias the built image is published as.
+	Target string `json:"target" validate:"required"`
+	// Project is the Incus project to build the image in. Default: the default project
+	Project string `json:"project,omitempty"`
+	// VM builds a virtual-machine image instead of a container image.
+	VM bool `json:"vm,omitempty"`
+	// Agent contains settings for the Azure Pipelines agent in the image.
+	Agent AgentSpec `json:"agent,omitempty"`
+	// Env is the environment of the package install and of every step.
+	Env map[string]string `json:"env,omitempty"`
+	// Packages are apt packages to install, optionally pinned as name=version.
+	Packages []string `json:"packages,omitempty" validate:"dive,required"`
+	// Files are local files pushed into the image before packages are
+	// installed, so they can add apt sources.
+	Files []FileSpec `json:"files,omitempty" validate:"dive"`
+	// Steps are scripts run in order after packages are installed.
+	Steps []StepSpec `json:"steps,omitempty" validate:"dive"`
+	// RegistryMirrors are written to registry-mirrors in the image's
+	// /etc/docker/daemon.json.
+	RegistryMirrors []string `json:"registryMirrors,omitempty" validate:"unique,dive,url"`
+}
+
+// BaseSpec describes the image a build starts from.
+type BaseSpec struct {
+	// Alias of the base image. For example: ubuntu/24.04
+	Alias string `json:"alias" validate:"required"`
+	// Server is the image server to pull Alias from, or "local" for an image
+	// of the Incus server. Default: https://images.linuxcontainers.org
+	Server string `json:"server,omitempty" default:"https://images.linuxcontainers.org" validate:"required,url|eq=local"`
+	// Protocol of Server: simplestreams or incus. Default: simplestreams
+	Protocol string `json:"protocol,omitempty" default:"simplestreams" validate:"oneof=simplestreams incus"`
+}
+
+// AgentSpec contains settings for the Azure Pipelines agent in the image.
+type AgentSpec struct {
+	// Version is the agent release to install. For example: 4.255.0
+	// Default: the latest release, or the version in the file name of Tarball
+	Version string `json:"version,omitempty" validate:"omitempty,semver"`
+	// Tarball is a local agent release tarball to install instead of
+	// downloading one.
+	Tarball string `json:"tarball,omitempty"`
+	// SHA256 is the expected hex SHA-256 checksum of the agent tarball.
+	SHA256 string `json:"sha256,omitempty" validate:"omitempty,hexadecimal,len=64"`
+}
+
+// FileSpec is a local file to push into the image.
+type FileSpec struct {
+	// Source is the local file.
+	Source string `json:"source" validate:"required"`
+	// Path is where the file goes in the image. Missing directories are created.
+	Path string `json:"path" validate:"required,startswith=/"`
+	// Mode is the octal permission bits of the file. Default: 0644
+	Mode string `json:"mode,omitempty" default:"0644"`
+	// Owner is root or agent. Default: root
+	Owner string `json:"owner,omitempty" default:"root" validate:"oneof=root agent"`
+}
+
+// StepSpec is a script to run in the image.
+type StepSpec struct {
+	// Name identifies the step in logs and errors.
+	Name string `json:"name" validate:"required"`
+	// Run is the script to run with bash. Mutually exclusive with Script.
+	Run string `json:"run,omitempty" validate:"required_without=Script,excluded_with=Script"`
+	// Script is a local file with the script to run with bash.
+	Script string `json:"script,omitempty"`
+	// User is root or agent. Default: root
+	User string `json:"user,omitempty" default:"root" validate:"oneof=root agent"`
+}
+
+// LoadSpec reads and validates the image spec at path, and returns the build
+// config it describes. Step scripts are read; files are read by BaseImage.
+func LoadSpec(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	spec := Spec{}
+	if err := defaults.Set(&spec); err != nil {
+		return Config{}, fmt.Errorf("error setting defaults: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return Config{}, err
+	}
+	// Files and steps are allocated by YAML unmarshalling, after the defaults
+	// pass.
+	for i := range spec.Files {
+		if err := defaults.Set(&spec.Files[i]); err != nil {
+			return Config{}, err
+		}
+	}
+	for i := range spec.Steps {
+		if err := defaults.Set(&spec.Steps[i]); err != nil {
+			return Config{}, err
+		}
+	}
+
+	v := validator.New(validator.WithRequiredStructEnabled())
+	if err := v.Struct(spec); err != nil {
+		return Config{}, err
+	}
+	conf, err := spec.config(filepath.Dir(path))
+	if err != nil {
+		return Config{}, err
+	}
+	return conf, v.Struct(conf)
+}
+
+// config converts the spec to a build config, resolving paths against dir.
+func (s Spec) config(dir string) (Config, error) {
+	conf := Config{
+		BaseAlias:       s.Base.Alias,
+		BaseServer:      s.Base.Server,
+		BaseProtocol:    s.Base.Protocol,
+		TargetAlias:     s.Target,
+		ProjectName:     s.Project,
+		VM:              s.VM,
+		RegistryMirrors: s.RegistryMirrors,
+		AgentVersion:    s.Agent.Version,
+		AgentSHA256:     s.Agent.SHA256,
+		Env:             s.Env,
+		Packages:        s.Packages,
+	}
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	if s.Agent.Tarball != "" {
+		conf.AgentTarball = resolve(s.Agent.Tarball)
+	}
+
+	for _, f := range s.Files {
+		mode, err := strconv.ParseUint(f.Mode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return Config{}, fmt.Errorf("file %s: invalid mode %q", f.Path, f.Mode)
+		}
+		file := File{Source: resolve(f.Source), Path: f.Path, Mode: os.FileMode(mode)}
+		if f.Owner == AgentUser {
+			file.UID, file.GID = int64(AgentUid), int64(AgentGid)
+		}
+		conf.Files = append(conf.Files, file)
+	}
+
+	for _, st := range s.Steps {
+		step := Step{Name: st.Name, Script: st.Run, User: st.User}
+		if st.Script != "" {
+			data, err := os.ReadFile(resolve(st.Script))
+			if err != nil {
+				return Config{}, fmt.Errorf("step %s: %w", st.Name, err)
+			}
+			step.Script = string(data)
+		}
+		conf.Steps = append(conf.Steps, step)
+	}
+	return conf, nil
+}
@@ -0,0 +1,142 @@
+package provision
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSpec(t *testing.T, spec string, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	path := filepath.Join(dir, "image.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(spec), 0o644))
+	return path
+}
+
+func TestLoadSpec(t *testing.T) {
+	path := writeSpec(t, `
+base:
+  alias: ubuntu/24.04
+target: my-runner-image
+vm: true
+agent:
+  version: 4.255.0
+  tarball: vsts-agent-linux-x64-4.255.0.tar.gz
+  sha256: 1d4f5ab4bf8ecb9bb40d2a6d3f8a4c61d8e3b0c47ee2b0b4f34da1ef7cd5b1f2
+env:
+  NODE_MAJOR: "20"
+packages: [jq, git]
+files:
+  - source: files/npmrc
+    path: /home/agent/.npmrc
+    mode: "0600"
+    owner: agent
+  - source: /etc/hosts
+    path: /etc/hosts.build
+steps:
+  - name: node
+    run: echo node
+  - name: tools
+    script: scripts/tools.sh
+    user: agent
+`, map[string]string{
+		"files/npmrc":      "registry=https://npm.example.com",
+		"scripts/tools.sh": "echo tools",
+	})
+
+	conf, err := LoadSpec(path)
+	require.NoError(t, err)
+	dir := filepath.Dir(path)
+	assert.Equal(t, Config{
+		BaseAlias:    "ubuntu/24.04",
+		BaseServer:   DefaultBaseServer,
+		BaseProtocol: "simplestreams",
+		TargetAlias:  "my-runner-image",
+		VM:           true,
+		AgentVersion: "4.255.0",
+		AgentTarball: filepath.Join(dir, "vsts-agent-linux-x64-4.255.0.tar.gz"),
+		AgentSHA256:  "1d4f5ab4bf8ecb9bb40d2a6d3f8a4c61d8e3b0c47ee2b0b4f34da1ef7cd5b1f2",
+		Env:          map[string]string{"NODE_MAJOR": "20"},
+		Packages:     []string{"jq", "git"},
+		Files: []File{
+			{Source: filepath.Join(dir, "files/npmrc"), Path: "/home/agent/.npmrc", Mode: 0o600, UID: int64(AgentUid), GID: int64(AgentGid)},
+			{Source: "/etc/hosts", Path: "/etc/hosts.build", Mode: 0o644},
+		},
+		Steps: []Step{
+			{Name: "node", Script: "echo node", User: "root"},
+			{Name: "tools", Script: "echo tools", User: "agent"},
+		},
+	}, conf)
+}
+
+func TestLoadSpec_Local(t *testing.T) {
+	conf, err := LoadSpec(writeSpec(t, `
+base:
+  alias: my-base
+  server: local
+target: my-runner-image
+`, nil))
+	require.NoError(t, err)
+	assert.Equal(t, LocalServer, conf.BaseServer)
+}
+
+func TestLoadSpec_Invalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		spec string
+		err  string
+	}{
+		"missing target": {
+			spec: "base: {alias: ubuntu/24.04}",
+			err:  "Spec.Target",
+		},
+		"same alias": {
+			spec: "base: {alias: img}\ntarget: img",
+			err:  "Config.BaseAlias",
+		},
+		"bad server": {
+			spec: "base: {alias: ubuntu/24.04, server: images}\ntarget: img",
+			err:  "Spec.Base.Server",
+		},
+		"run and script": {
+			spec: "base: {alias: ubuntu/24.04}\ntarget: img\nsteps: [{name: s, run: x, script: s.sh}]",
+			err:  "Spec.Steps[0].Run",
+		},
+		"no run": {
+			spec: "base: {alias: ubuntu/24.04}\ntarget: img\nsteps: [{name: s}]",
+			err:  "Spec.Steps[0].Run",
+		},
+		"bad mode": {
+			spec: "base: {alias: ubuntu/24.04}\ntarget: img\nfiles: [{source: a, path: /a, mode: '0999'}]",
+			err:  `file /a: invalid mode "0999"`,
+		},
+		"relative path": {
+			spec: "base: {alias: ubuntu/24.04}\ntarget: img\nfiles: [{source: a, path: a}]",
+			err:  "Spec.Files[0].Path",
+		},
+		"missing script": {
+			spec: "base: {alias: ubuntu/24.04}\ntarget: img\nsteps: [{name: s, script: missing.sh}]",
+			err:  "step s: open",
+		},
+		"bad agent checksum": {
+			spec: "base: {alias: ubuntu/24.04}\ntarget: img\nagent: {sha256: abc}",
+			err:  "Spec.Agent.SHA256",
+		},
+		"bad agent version": {
+			spec: "base: {alias: ubuntu/24.04}\ntarget: img\nagent: {version: latest}",
+			err:  "Spec.Agent.Version",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadSpec(writeSpec(t, tc.spec, nil))
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -1,9 +1,11 @@
 // Generates JSON Schema from config structs using godoc comments.
 // Run with: go run ./tools/schema > schema.json
+// or, for image spec files: go run ./tools/schema -image > image-schema.json
 package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"path"
@@ -11,11 +13,15 @@ import (
 
 	"github.com/invopop/jsonschema"
 	"github.com/sklarsa/incus-azure-pipelines/cmd"
+	"github.com/sklarsa/incus-azure-pipelines/provision"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 )
 
 func main() {
+	image := flag.Bool("image", false, "generate the schema of image spec files")
+	flag.Parse()
+
 	title := cases.Title(language.English)
 	r := &jsonschema.Reflector{
 		Namer: func(t reflect.Type) string {
@@ -31,10 +37,18 @@ func main() {
 		fmt.Fprintf(os.Stderr, "warning: could not load comments: %v\n", err)
 	}
 
-	schema := r.Reflect(&cmd.CLIConfig{})
-	schema.ID = "https://github.com/sklarsa/incus-azure-pipelines/config-schema.json"
-	schema.Title = "incus-azure-pipelines configuration"
-	schema.Description = "Configuration file schema for incus-azure-pipelines daemon"
+	var schema *jsonschema.Schema
+	if *image {
+		schema = r.Reflect(&provision.Spec{})
+		schema.ID = "https://github.com/sklarsa/incus-azure-pipelines/image-schema.json"
+		schema.Title = "incus-azure-pipelines image spec"
+		schema.Description = "Image spec file schema for incus-azure-pipelines provision -f"
+	} else {
+		schema = r.Reflect(&cmd.CLIConfig{})
+		schema.ID = "https://github.com/sklarsa/incus-azure-pipelines/config-schema.json"
+		schema.Title = "incus-azure-pipelines configuration"
+		schema.Description = "Configuration file schema for incus-azure-pipelines daemon"
+	}
 
 	data, err := json.MarshalIndent(schema, "", "  ")
 	if err != nil {